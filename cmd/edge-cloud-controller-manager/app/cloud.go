@@ -0,0 +1,68 @@
+/*
+Copyright 2019 Midokura
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"net/http"
+
+	"k8s.io/apiserver/pkg/server/healthz"
+	"k8s.io/apiserver/pkg/server/mux"
+	cloudprovider "k8s.io/cloud-provider"
+)
+
+// HealthCheckerCloud is implemented by the cloud providers with health checks
+// to serve with the ones of the cloud controller manager
+type HealthCheckerCloud interface {
+	HealthCheckers() []healthz.HealthChecker
+}
+
+// DebugHandlerCloud is implemented by the cloud providers with debugging
+// endpoints to serve on the secure port, by path
+type DebugHandlerCloud interface {
+	DebugHandlers() map[string]http.Handler
+}
+
+// NodeAgentCloud is implemented by the cloud providers with a node agent,
+// run by every cloud controller manager before the leader election
+type NodeAgentCloud interface {
+	RunNodeAgent(clientBuilder cloudprovider.ControllerClientBuilder, stop <-chan struct{})
+}
+
+// cloudHealthCheckers returns the health checks of the cloud provider, if any
+func cloudHealthCheckers(cloud cloudprovider.Interface) []healthz.HealthChecker {
+	if healthCheckerCloud, ok := cloud.(HealthCheckerCloud); ok {
+		return healthCheckerCloud.HealthCheckers()
+	}
+	return nil
+}
+
+// installCloudDebugHandlers adds the debugging endpoints of the cloud
+// provider, if any, to the mux of the secure port
+func installCloudDebugHandlers(pathRecorderMux *mux.PathRecorderMux, cloud cloudprovider.Interface) {
+	if debugHandlerCloud, ok := cloud.(DebugHandlerCloud); ok {
+		for path, debugHandler := range debugHandlerCloud.DebugHandlers() {
+			pathRecorderMux.Handle(path, debugHandler)
+		}
+	}
+}
+
+// runCloudNodeAgent starts the node agent of the cloud provider, if any
+func runCloudNodeAgent(cloud cloudprovider.Interface, clientBuilder cloudprovider.ControllerClientBuilder, stop <-chan struct{}) {
+	if nodeAgentCloud, ok := cloud.(NodeAgentCloud); ok {
+		nodeAgentCloud.RunNodeAgent(clientBuilder, stop)
+	}
+}
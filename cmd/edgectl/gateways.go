@@ -0,0 +1,129 @@
+/*
+Copyright 2019 Midokura
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/huin/goupnp"
+	"github.com/spf13/cobra"
+)
+
+func newDiscoverCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "discover",
+		Short: "Discover the WAN connections of the gateways on each network interface",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			gateways, err := getGateways()
+			if err != nil {
+				return err
+			}
+			w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 8, 2, ' ', 0)
+			fmt.Fprintln(w, "GATEWAY\tINTERFACE\tLOCAL-ADDRESS\tEXTERNAL-IP\tSERVICE\tLOCATION")
+			for i, gw := range gateways {
+				ctx, cancel := newContext()
+				externalIP, err := gw.ExternalIP(ctx)
+				cancel()
+				if err != nil {
+					externalIP = fmt.Sprintf("<%v>", err)
+				}
+				fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\n", i, gw.Interface, gw.LocalAddress, externalIP, gw.ServiceType, gw.Location)
+			}
+			return w.Flush()
+		},
+	}
+}
+
+func newDescribeCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "describe",
+		Short: "Print the description of the gateway and the status of its WAN connection",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			gw, err := getGateway()
+			if err != nil {
+				return err
+			}
+			out := cmd.OutOrStdout()
+			fmt.Fprintf(out, "Location:     %s\n", gw.Location)
+			fmt.Fprintf(out, "Interface:    %s\n", gw.Interface)
+			fmt.Fprintf(out, "Local address: %s\n", gw.LocalAddress)
+			fmt.Fprintf(out, "Service:      %s\n", gw.ServiceType)
+			fmt.Fprintf(out, "Control URL:  %s\n", gw.ControlURL())
+			ctx, cancel := newContext()
+			defer cancel()
+			status, lastConnectionError, uptime, err := gw.StatusInfo(ctx)
+			if err != nil {
+				fmt.Fprintf(out, "Status:       <%v>\n", err)
+			} else {
+				fmt.Fprintf(out, "Status:       %s, uptime %s, last connection error %s\n", status, uptime, lastConnectionError)
+			}
+			if externalIP, err := gw.ExternalIP(ctx); err != nil {
+				fmt.Fprintf(out, "External IP:  <%v>\n", err)
+			} else {
+				fmt.Fprintf(out, "External IP:  %s\n", externalIP)
+			}
+			fmt.Fprintln(out)
+			printDevice(out, gw.Device, 0)
+			return nil
+		},
+	}
+}
+
+// printDevice prints the device, its services and embedded devices
+func printDevice(w io.Writer, device *goupnp.Device, depth int) {
+	indent := strings.Repeat("  ", depth)
+	fmt.Fprintf(w, "%sDevice: %s\n", indent, device.DeviceType)
+	fmt.Fprintf(w, "%s  Name: %s\n", indent, device.FriendlyName)
+	fmt.Fprintf(w, "%s  Model: %s %s %s\n", indent, device.Manufacturer, device.ModelName, device.ModelNumber)
+	if device.SerialNumber != "" {
+		fmt.Fprintf(w, "%s  Serial number: %s\n", indent, device.SerialNumber)
+	}
+	fmt.Fprintf(w, "%s  UDN: %s\n", indent, device.UDN)
+	for _, service := range device.Services {
+		fmt.Fprintf(w, "%s  Service: %s (%s)\n", indent, service.ServiceType, service.ControlURL.URL.String())
+	}
+	for i := range device.Devices {
+		printDevice(w, &device.Devices[i], depth+1)
+	}
+}
+
+func newExternalIPCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "external-ip",
+		Short: "Print the external IP of the WAN connection",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			gw, err := getGateway()
+			if err != nil {
+				return err
+			}
+			ctx, cancel := newContext()
+			defer cancel()
+			externalIP, err := gw.ExternalIP(ctx)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintln(cmd.OutOrStdout(), externalIP)
+			return nil
+		},
+	}
+}
@@ -0,0 +1,129 @@
+/*
+Copyright 2019 Midokura
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// edgectl inspects the Internet gateway devices and manages their port
+// mappings by hand, with the UPnP client of the edge cloud provider.
+
+package main
+
+import (
+	"context"
+	goflag "flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/midokura/cloud-provider-edge/pkg/cloudprovider/providers/edge"
+	"github.com/spf13/cobra"
+	"k8s.io/klog"
+)
+
+// Version is set by the linker flags in the Makefile.
+var version string
+
+// globalOptions select the gateway used by the commands
+type globalOptions struct {
+	interfaceName  string
+	location       string
+	index          int
+	maxWaitSeconds int
+	timeout        time.Duration
+}
+
+var options globalOptions
+
+func main() {
+	klog.InitFlags(nil)
+	goflag.Set("logtostderr", "true")
+
+	command := newRootCommand()
+	command.PersistentFlags().AddGoFlag(goflag.CommandLine.Lookup("v"))
+	defer klog.Flush()
+	if err := command.Execute(); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// newRootCommand returns the edgectl command, with its global options set to
+// their defaults
+func newRootCommand() *cobra.Command {
+	command := &cobra.Command{
+		Use:     "edgectl",
+		Short:   "Inspect Internet gateway devices and manage their port mappings",
+		Version: version,
+		Long: `edgectl inspects the UPnP Internet gateway devices and manages their port
+mappings by hand, with the same UPnP client as the edge cloud controller manager.
+
+Gateways are discovered with SSDP on each network interface, unless the
+location of the description of the device is given.`,
+		SilenceUsage:  true,
+		SilenceErrors: true,
+	}
+	flags := command.PersistentFlags()
+	flags.StringVarP(&options.interfaceName, "interface", "i", "", "discover the gateways only on this network interface")
+	flags.StringVarP(&options.location, "location", "l", "", "URL of the description of the gateway, to skip the discovery")
+	flags.IntVarP(&options.index, "gateway", "g", 0, "index of the WAN connection to use, as listed by discover")
+	flags.IntVar(&options.maxWaitSeconds, "wait", 2, "seconds to wait for the gateways to answer the discovery")
+	flags.DurationVar(&options.timeout, "timeout", 10*time.Second, "timeout of the requests to the gateway")
+
+	command.AddCommand(
+		newDiscoverCommand(),
+		newDescribeCommand(),
+		newExternalIPCommand(),
+		newListCommand(),
+		newAddCommand(),
+		newDeleteCommand(),
+		newValidateCommand(),
+	)
+	return command
+}
+
+// getGateways returns the WAN connections of the gateway at the location given,
+// or of the gateways discovered
+func getGateways() ([]*edge.Gateway, error) {
+	var gateways []*edge.Gateway
+	var err error
+	if options.location != "" {
+		gateways, err = edge.GatewaysByLocation(options.location)
+	} else {
+		gateways, err = edge.DiscoverGateways(options.interfaceName, options.maxWaitSeconds)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(gateways) == 0 {
+		return nil, fmt.Errorf("no gateway found")
+	}
+	return gateways, nil
+}
+
+// getGateway returns the WAN connection selected
+func getGateway() (*edge.Gateway, error) {
+	gateways, err := getGateways()
+	if err != nil {
+		return nil, err
+	}
+	if options.index < 0 || options.index >= len(gateways) {
+		return nil, fmt.Errorf("gateway %d not found: %d found", options.index, len(gateways))
+	}
+	return gateways[options.index], nil
+}
+
+// newContext returns the context of a request to the gateway
+func newContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), options.timeout)
+}
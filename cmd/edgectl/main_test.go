@@ -0,0 +1,105 @@
+/*
+Copyright 2019 Midokura
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/midokura/cloud-provider-edge/pkg/cloudprovider/providers/edge/igdtest"
+)
+
+// runEdgectl runs edgectl with the arguments and the standard input given,
+// returning its standard output
+func runEdgectl(t *testing.T, stdin string, args ...string) (string, error) {
+	command := newRootCommand()
+	var out bytes.Buffer
+	command.SetIn(strings.NewReader(stdin))
+	command.SetOut(&out)
+	command.SetArgs(args)
+	err := command.Execute()
+	return out.String(), err
+}
+
+// newTestServer starts a simulated gateway, closed at the end of the test
+func newTestServer(t *testing.T) *igdtest.Server {
+	server, err := igdtest.NewServer(igdtest.Config{})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	return server
+}
+
+func TestGlobalFlags(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Close()
+
+	out, err := runEdgectl(t, "", "external-ip", "-l", server.Location, "-g", "0", "-i", "lo", "--wait", "1", "--timeout", "3s")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if out != "198.51.100.1\n" {
+		t.Errorf("got %q\nwant the external IP of the gateway", out)
+	}
+	expected := globalOptions{interfaceName: "lo", location: server.Location, maxWaitSeconds: 1, timeout: 3 * time.Second}
+	if options != expected {
+		t.Errorf("got %+v\nwant %+v", options, expected)
+	}
+
+	// the defaults are set again
+	if _, err := runEdgectl(t, "", "external-ip", "-l", server.Location); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	expected = globalOptions{location: server.Location, maxWaitSeconds: 2, timeout: 10 * time.Second}
+	if options != expected {
+		t.Errorf("got %+v\nwant %+v", options, expected)
+	}
+}
+
+func TestFlagErrors(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Close()
+
+	testCases := []struct {
+		args []string
+		err  string
+	}{
+		{args: []string{"list", "extra"}, err: `unknown command "extra" for "edgectl list"`},
+		{args: []string{"list", "--lease", "0"}, err: "unknown flag: --lease"},
+		{args: []string{"list", "--timeout", "soon"}, err: `invalid argument "soon" for "--timeout"`},
+		{args: []string{"list", "-l", server.Location, "--gateway", "1"}, err: "gateway 1 not found: 1 found"},
+		{args: []string{"add", "TCP", "8080"}, err: "accepts 3 arg(s), received 2"},
+		{args: []string{"add", "SCTP", "8080", "192.0.2.1:30080"}, err: "unsupported protocol SCTP: must be TCP or UDP"},
+		{args: []string{"add", "TCP", "0", "192.0.2.1:30080"}, err: "invalid port 0"},
+		{args: []string{"add", "TCP", "8080", "192.0.2.1"}, err: "invalid internal address 192.0.2.1"},
+		{args: []string{"add", "TCP", "8080", "gateway:30080"}, err: "invalid internal IP gateway"},
+		{args: []string{"add", "TCP", "8080", "192.0.2.1:30080", "--lease", "forever"}, err: `invalid argument "forever" for "--lease"`},
+		{args: []string{"delete", "TCP", "65536"}, err: "invalid port 65536"},
+		{args: []string{"validate"}, err: `required flag(s) "filename" not set`},
+	}
+	for _, tc := range testCases {
+		_, err := runEdgectl(t, "", tc.args...)
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%v: got error %v\nwant %s", tc.args, err, tc.err)
+		}
+	}
+	if len(server.Mappings()) != 0 {
+		t.Errorf("got %+v\nwant no port mapping added", server.Mappings())
+	}
+}
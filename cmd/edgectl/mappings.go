@@ -0,0 +1,148 @@
+/*
+Copyright 2019 Midokura
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/midokura/cloud-provider-edge/pkg/cloudprovider/providers/edge"
+	"github.com/spf13/cobra"
+)
+
+func newListCommand() *cobra.Command {
+	owned := false
+	command := &cobra.Command{
+		Use:   "list",
+		Short: "List the port mappings of the WAN connection, with the load balancers owning them",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			gw, err := getGateway()
+			if err != nil {
+				return err
+			}
+			ctx, cancel := newContext()
+			defer cancel()
+			entries, err := gw.PortMappings(ctx)
+			if err != nil {
+				return err
+			}
+			w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 8, 2, ' ', 0)
+			fmt.Fprintln(w, "PROTOCOL\tEXTERNAL-PORT\tINTERNAL\tENABLED\tLEASE\tCLUSTER\tNAMESPACE\tSERVICE\tPORT\tDESCRIPTION")
+			for _, entry := range entries {
+				owner, ok := edge.ParsePortMappingOwner(entry.Description)
+				if !ok {
+					if owned {
+						continue
+					}
+					owner = &edge.PortMappingOwner{ClusterName: "-", Namespace: "-", Service: "-", Port: "-"}
+				}
+				lease := "permanent"
+				if entry.LeaseDuration > 0 {
+					lease = fmt.Sprintf("%ds", entry.LeaseDuration)
+				}
+				fmt.Fprintf(w, "%s\t%d\t%s:%d\t%t\t%s\t%s\t%s\t%s\t%s\t%s\n", entry.Protocol, entry.ExternalPort, entry.InternalIP, entry.InternalPort,
+					entry.Enabled, lease, owner.ClusterName, owner.Namespace, owner.Service, owner.Port, entry.Description)
+			}
+			return w.Flush()
+		},
+	}
+	command.Flags().BoolVar(&owned, "owned", false, "list only the port mappings of the edge load balancers")
+	return command
+}
+
+func newAddCommand() *cobra.Command {
+	entry := edge.PortMappingEntry{Enabled: true}
+	command := &cobra.Command{
+		Use:   "add PROTOCOL EXTERNAL-PORT INTERNAL-IP:INTERNAL-PORT",
+		Short: "Add or replace a port mapping of the WAN connection",
+		Example: `  # map the TCP port 8080 of the external IP to the port 30080 of 192.168.1.10
+  edgectl add TCP 8080 192.168.1.10:30080 --description test`,
+		Args: cobra.ExactArgs(3),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var err error
+			entry.Protocol, entry.ExternalPort, err = parseProtocolAndPort(args[0], args[1])
+			if err != nil {
+				return err
+			}
+			host, port, err := net.SplitHostPort(args[2])
+			if err != nil {
+				return fmt.Errorf("invalid internal address %s: %v", args[2], err)
+			}
+			if net.ParseIP(host) == nil {
+				return fmt.Errorf("invalid internal IP %s", host)
+			}
+			entry.InternalIP = host
+			if entry.InternalPort, err = parsePort(port); err != nil {
+				return err
+			}
+			gw, err := getGateway()
+			if err != nil {
+				return err
+			}
+			ctx, cancel := newContext()
+			defer cancel()
+			return gw.AddPortMapping(ctx, entry)
+		},
+	}
+	flags := command.Flags()
+	flags.StringVar(&entry.Description, "description", "edgectl", "description of the port mapping")
+	flags.Uint32Var(&entry.LeaseDuration, "lease", 0, "lease duration in seconds, 0 for a permanent port mapping")
+	flags.StringVar(&entry.RemoteHost, "remote-host", "", "only map the connections from this host")
+	return command
+}
+
+func newDeleteCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "delete PROTOCOL EXTERNAL-PORT",
+		Short: "Delete a port mapping of the WAN connection",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			protocol, externalPort, err := parseProtocolAndPort(args[0], args[1])
+			if err != nil {
+				return err
+			}
+			gw, err := getGateway()
+			if err != nil {
+				return err
+			}
+			ctx, cancel := newContext()
+			defer cancel()
+			return gw.DeletePortMapping(ctx, protocol, externalPort)
+		},
+	}
+}
+
+func parseProtocolAndPort(protocol, port string) (string, uint16, error) {
+	protocol = strings.ToUpper(protocol)
+	if protocol != "TCP" && protocol != "UDP" {
+		return "", 0, fmt.Errorf("unsupported protocol %s: must be TCP or UDP", protocol)
+	}
+	externalPort, err := parsePort(port)
+	return protocol, externalPort, err
+}
+
+func parsePort(port string) (uint16, error) {
+	value, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || value == 0 {
+		return 0, fmt.Errorf("invalid port %s", port)
+	}
+	return uint16(value), nil
+}
@@ -0,0 +1,74 @@
+/*
+Copyright 2019 Midokura
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/midokura/cloud-provider-edge/pkg/cloudprovider/providers/edge/igdtest"
+)
+
+func TestList(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Close()
+	server.AddMapping(igdtest.Mapping{ExternalPort: 8080, Protocol: "TCP", InternalPort: 30080, InternalClient: "192.0.2.1", Enabled: true, Description: "kubernetes/default/svc/http"})
+	server.AddMapping(igdtest.Mapping{ExternalPort: 2222, Protocol: "TCP", InternalPort: 22, InternalClient: "192.0.2.9", Description: "ssh"})
+
+	out, err := runEdgectl(t, "", "list", "-l", server.Location)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	expected := `PROTOCOL  EXTERNAL-PORT  INTERNAL         ENABLED  LEASE      CLUSTER     NAMESPACE  SERVICE  PORT  DESCRIPTION
+TCP       8080           192.0.2.1:30080  true     permanent  kubernetes  default    svc      http  kubernetes/default/svc/http
+TCP       2222           192.0.2.9:22     false    permanent  -           -          -        -     ssh
+`
+	if out != expected {
+		t.Errorf("got\n%s\nwant\n%s", out, expected)
+	}
+
+	out, err = runEdgectl(t, "", "list", "-l", server.Location, "--owned")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	expected = `PROTOCOL  EXTERNAL-PORT  INTERNAL         ENABLED  LEASE      CLUSTER     NAMESPACE  SERVICE  PORT  DESCRIPTION
+TCP       8080           192.0.2.1:30080  true     permanent  kubernetes  default    svc      http  kubernetes/default/svc/http
+`
+	if out != expected {
+		t.Errorf("got\n%s\nwant\n%s", out, expected)
+	}
+}
+
+func TestAddAndDelete(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Close()
+
+	if _, err := runEdgectl(t, "", "add", "udp", "5353", "192.0.2.1:30053", "-l", server.Location, "--description", "dns"); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	expected := []igdtest.Mapping{{ExternalPort: 5353, Protocol: "UDP", InternalPort: 30053, InternalClient: "192.0.2.1", Enabled: true, Description: "dns"}}
+	if mappings := server.Mappings(); !reflect.DeepEqual(mappings, expected) {
+		t.Errorf("got %+v\nwant %+v", mappings, expected)
+	}
+
+	if _, err := runEdgectl(t, "", "delete", "UDP", "5353", "-l", server.Location); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if mappings := server.Mappings(); len(mappings) != 0 {
+		t.Errorf("got %+v\nwant the port mapping deleted", mappings)
+	}
+}
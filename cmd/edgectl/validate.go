@@ -0,0 +1,128 @@
+/*
+Copyright 2019 Midokura
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/midokura/cloud-provider-edge/pkg/cloudprovider/providers/edge"
+	"github.com/spf13/cobra"
+	k8s "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/client-go/kubernetes/scheme"
+	corev1 "k8s.io/kubernetes/pkg/apis/core/v1"
+)
+
+func newValidateCommand() *cobra.Command {
+	filename := ""
+	clusterName := "kubernetes"
+	loadBalancerType := edge.UniversalPlugAndPlayInternetGatewayDeviceLoadBalancerType
+	command := &cobra.Command{
+		Use:   "validate -f FILENAME",
+		Short: "Check offline the load balancer services of a manifest, as the edge cloud controller manager",
+		Long: `Check offline the load balancer services of a manifest, as the edge cloud
+controller manager. The services get the defaults of the API server, and the
+node ports it would allocate are assumed.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			services, err := readServices(filename, cmd.InOrStdin())
+			if err != nil {
+				return err
+			}
+			if len(services) == 0 {
+				return fmt.Errorf("%s: no service found", filename)
+			}
+			failed := 0
+			for _, service := range services {
+				setServiceDefaults(service)
+				if err := edge.ValidateService(clusterName, loadBalancerType, service); err != nil {
+					fmt.Fprintf(cmd.OutOrStdout(), "%s/%s: invalid: %v\n", service.Namespace, service.Name, err)
+					failed++
+					continue
+				}
+				fmt.Fprintf(cmd.OutOrStdout(), "%s/%s: valid\n", service.Namespace, service.Name)
+			}
+			if failed > 0 {
+				return fmt.Errorf("%d of %d services are invalid", failed, len(services))
+			}
+			return nil
+		},
+	}
+	flags := command.Flags()
+	flags.StringVarP(&filename, "filename", "f", "", "YAML or JSON manifest of the services, - for the standard input")
+	flags.StringVar(&clusterName, "cluster-name", clusterName, "name of the cluster, as given to the cloud provider")
+	flags.StringVar(&loadBalancerType, "load-balancer-type", loadBalancerType, "load-balancer-type of the configuration of the cloud provider")
+	command.MarkFlagRequired("filename")
+	return command
+}
+
+// setServiceDefaults sets the defaults of the API server, and node ports where
+// it would allocate them
+func setServiceDefaults(service *k8s.Service) {
+	corev1.SetObjectDefaults_Service(service)
+	if service.Namespace == "" {
+		service.Namespace = "default"
+	}
+	if service.Spec.Type != k8s.ServiceTypeLoadBalancer && service.Spec.Type != k8s.ServiceTypeNodePort {
+		return
+	}
+	for i := range service.Spec.Ports {
+		if service.Spec.Ports[i].NodePort == 0 {
+			service.Spec.Ports[i].NodePort = int32(30000 + i)
+		}
+	}
+}
+
+// readServices returns the services of the manifest, or of the standard input
+// given for -, ignoring the other objects
+func readServices(filename string, stdin io.Reader) ([]*k8s.Service, error) {
+	input := stdin
+	if filename != "-" {
+		file, err := os.Open(filename)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		input = file
+	}
+	reader := yaml.NewYAMLReader(bufio.NewReader(input))
+	decoder := scheme.Codecs.UniversalDeserializer()
+	services := make([]*k8s.Service, 0)
+	for {
+		document, err := reader.Read()
+		if err == io.EOF {
+			return services, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", filename, err)
+		}
+		if len(bytes.TrimSpace(document)) == 0 {
+			continue
+		}
+		object, _, err := decoder.Decode(document, nil, nil)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", filename, err)
+		}
+		if service, ok := object.(*k8s.Service); ok {
+			services = append(services, service)
+		}
+	}
+}
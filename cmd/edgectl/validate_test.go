@@ -0,0 +1,92 @@
+/*
+Copyright 2019 Midokura
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+const testManifest = `apiVersion: v1
+kind: Service
+metadata:
+  name: web
+  annotations:
+    midokura.com/load-balancer-type: upnp-igd
+spec:
+  type: LoadBalancer
+  ports:
+  - name: http
+    port: 80
+    targetPort: 8080
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: ignored
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: sctp
+  namespace: telco
+  annotations:
+    midokura.com/load-balancer-type: upnp-igd
+spec:
+  type: LoadBalancer
+  ports:
+  - name: signaling
+    protocol: SCTP
+    port: 3868
+`
+
+func TestValidate(t *testing.T) {
+	file, err := ioutil.TempFile("", "edgectl-validate")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.WriteString(testManifest); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	file.Close()
+
+	out, err := runEdgectl(t, "", "validate", "-f", file.Name())
+	if err == nil || err.Error() != "1 of 2 services are invalid" {
+		t.Errorf("got error %v\nwant 1 of 2 services are invalid", err)
+	}
+	lines := strings.Split(strings.TrimSuffix(out, "\n"), "\n")
+	if len(lines) != 2 || lines[0] != "default/web: valid" ||
+		!strings.HasPrefix(lines[1], "telco/sctp: invalid: ") || !strings.HasSuffix(lines[1], "unsupported protocol SCTP") {
+		t.Errorf("got\n%s\nwant default/web valid, and telco/sctp invalid for its protocol", out)
+	}
+
+	// the standard input, for another load balancer type
+	out, err = runEdgectl(t, testManifest, "validate", "-f", "-", "--load-balancer-type", "linux-nat")
+	if err == nil || err.Error() != "2 of 2 services are invalid" {
+		t.Errorf("got error %v\nwant 2 of 2 services are invalid", err)
+	}
+	if strings.Count(out, ": invalid: ") != 2 || !strings.Contains(out, "load balancer type (annotation") {
+		t.Errorf("got\n%s\nwant both services invalid for their type", out)
+	}
+
+	if _, err := runEdgectl(t, "kind: ConfigMap\napiVersion: v1\n", "validate", "-f", "-"); err == nil || err.Error() != "-: no service found" {
+		t.Errorf("got error %v\nwant -: no service found", err)
+	}
+}
@@ -1,5 +1,7 @@
 module github.com/midokura/cloud-provider-edge
 
+go 1.13
+
 replace k8s.io/api => k8s.io/api v0.0.0-20190918155943-95b840bb6a1f
 
 replace k8s.io/apiextensions-apiserver => k8s.io/apiextensions-apiserver v0.0.0-20190918161926-8f644eb6e783
@@ -54,14 +56,23 @@ require (
 	github.com/huin/goupnp v1.0.0
 	github.com/keegancsmith/rpc v1.1.0 // indirect
 	github.com/mdempsky/gocode v0.0.0-20190203001940-7fb65232883f // indirect
+	github.com/spf13/cobra v0.0.5
+	github.com/spf13/pflag v1.0.3
 	github.com/stamblerre/gocode v0.0.0-20190327203809-810592086997 // indirect
 	github.com/uudashr/gopkgs v2.0.1+incompatible // indirect
+	github.com/vishvananda/netlink v0.0.0-20171020171820-b2de5d10e38e
+	github.com/vishvananda/netns v0.0.0-20171111001504-be1fbeda1936
 	golang.org/x/lint v0.0.0-20190930215403-16217165b5de // indirect
+	golang.org/x/net v0.0.0-20190812203447-cdfb69ac37fc
 	golang.org/x/tools v0.0.0-20191004055002-72853e10c5a3 // indirect
 	gopkg.in/gcfg.v1 v1.2.0
 	k8s.io/api v0.0.0
 	k8s.io/apimachinery v0.0.0
+	k8s.io/apiserver v0.0.0
+	k8s.io/client-go v0.0.0
 	k8s.io/cloud-provider v0.0.0
+	k8s.io/component-base v0.0.0
 	k8s.io/klog v0.4.0
-	k8s.io/kubernetes v1.16.0 // indirect
+	k8s.io/kubernetes v1.16.0
+	k8s.io/utils v0.0.0-20190801114015-581e00157fb1
 )
@@ -52,6 +52,9 @@ will create the TCP port mapping:
   <external_ip>:<external_port> -> <internal_ip>:<internal_port>
 
 The internal port is the service node port and the internal IP is the IP of
-the first node available (usually non-master node).
+one of the nodes available. All the port mappings of a service target the
+same node, which is kept while it is available: this way services with
+"sessionAffinity: ClientIP" keep each client pinned to a node, and kube-proxy
+applies the affinity to the service endpoints from there.
 */
 package edge
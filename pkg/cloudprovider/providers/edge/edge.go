@@ -17,9 +17,19 @@ limitations under the License.
 package edge
 
 import (
+	"crypto/tls"
 	"fmt"
 	"io"
-
+	"net/http"
+	"sync"
+
+	k8s "k8s.io/api/core/v1"
+	"k8s.io/apiserver/pkg/server/healthz"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
 	cloudprovider "k8s.io/cloud-provider"
 	"k8s.io/klog"
 )
@@ -27,11 +37,21 @@ import (
 const (
 	// ProviderName is the name of the edge provider
 	ProviderName = "edge"
+	// clientName is the name of the Kubernetes client, and source of the events
+	clientName = "edge-cloud-provider"
 )
 
 // Edge is an implementation of cloud provider Interface for edge deployments.
 type Edge struct {
 	LoadBalancerInstance *LoadBalancer
+	kubeClient           kubernetes.Interface
+	dynamicClient        dynamic.Interface
+	eventRecorder        record.EventRecorder
+	stop                 <-chan struct{}
+	config               Config
+	routes               *routes
+	// mutex protects LoadBalancerInstance, used by the health checks
+	mutex sync.Mutex
 }
 
 // init register the Edge Cloud Manager
@@ -52,7 +72,10 @@ func init() {
 // NewEdge creates a new new instance of the Edge struct from a config struct
 func NewEdge(cfg Config) (*Edge, error) {
 	klog.Infof("New Edge Cloud Manager")
-	cloud := Edge{}
+	cloud := Edge{config: cfg}
+	if cfg.Global.DryRun {
+		klog.Warningf("Dry run: the port mappings of the gateway won't be changed")
+	}
 	return &cloud, nil
 }
 
@@ -60,15 +83,64 @@ func NewEdge(cfg Config) (*Edge, error) {
 // to perform housekeeping or run custom controllers specific to the cloud provider.
 // Any tasks started here should be cleaned up when the stop channel closes.
 func (cloud *Edge) Initialize(clientBuilder cloudprovider.ControllerClientBuilder, stop <-chan struct{}) {
+	cloud.initialize(clientBuilder.ClientOrDie(clientName), dynamic.NewForConfigOrDie(clientBuilder.ConfigOrDie(clientName)), stop)
+}
+
+// initialize sets the clients of the cloud provider, and records its events
+// until stop is closed
+func (cloud *Edge) initialize(kubeClient kubernetes.Interface, dynamicClient dynamic.Interface, stop <-chan struct{}) {
+	cloud.stop = stop
+	cloud.kubeClient = kubeClient
+	cloud.dynamicClient = dynamicClient
+	eventBroadcaster := record.NewBroadcaster()
+	logging := eventBroadcaster.StartLogging(klog.Infof)
+	recording := eventBroadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: cloud.kubeClient.CoreV1().Events("")})
+	cloud.eventRecorder = eventBroadcaster.NewRecorder(scheme.Scheme, k8s.EventSource{Component: clientName})
+	go func() {
+		<-stop
+		recording.Stop()
+		logging.Stop()
+	}()
 }
 
 // LoadBalancer returns a balancer interface, and true since the interface is supported.
 func (cloud *Edge) LoadBalancer() (cloudprovider.LoadBalancer, bool) {
+	cloud.mutex.Lock()
+	defer cloud.mutex.Unlock()
 	if cloud.LoadBalancerInstance == nil {
-		loadBalancer, err := NewLoadBalancer()
-		if err != nil {
-			klog.Errorf("Error getting LoadBalancer interface: %v", err)
-			return nil, false
+		loadBalancer := NewLoadBalancer()
+		loadBalancer.kubeClient = cloud.kubeClient
+		loadBalancer.eventRecorder = cloud.eventRecorder
+		loadBalancer.dynamicClient = cloud.dynamicClient
+		loadBalancer.dryRun = cloud.config.Global.DryRun
+		loadBalancer.loadBalancerType = cloud.config.Global.LoadBalancerType
+		loadBalancer.leaseDuration = portMappingLeaseDuration(cloud.config.Global.LeaseDuration)
+		switch loadBalancer.loadBalancerType {
+		case LinuxNATLoadBalancerType:
+			linuxNAT := cloud.config.LinuxNAT
+			// validated by ReadConfig
+			mark, _ := parseLinuxNATMark(linuxNAT.Mark)
+			loadBalancer.discover = discoverLinuxNAT(linuxNAT.NodeName, linuxNAT.WANInterface, linuxNAT.Backend, linuxNAT.InternalIP, mark)
+		case RouterOSLoadBalancerType:
+			routerOS := cloud.config.RouterOS
+			var tlsConfig *tls.Config
+			if routerOS.TLS {
+				tlsConfig = &tls.Config{InsecureSkipVerify: routerOS.InsecureSkipVerify}
+			}
+			loadBalancer.discover = discoverRouterOS(cloud.kubeClient, routerOS.Address, tlsConfig, routerOS.CredentialsSecret, routerOS.WANInterface)
+		case OpenWrtLoadBalancerType:
+			openWrt := cloud.config.OpenWrt
+			tlsConfig := &tls.Config{InsecureSkipVerify: openWrt.InsecureSkipVerify}
+			loadBalancer.discover = discoverOpenWrt(cloud.kubeClient, openWrt.Address, tlsConfig, openWrt.CredentialsSecret, openWrt.WANInterface, openWrt.WANZone, openWrt.LANInterface)
+		case OPNsenseLoadBalancerType:
+			opnsense := cloud.config.OPNsense
+			tlsConfig := &tls.Config{InsecureSkipVerify: opnsense.InsecureSkipVerify}
+			loadBalancer.discover = discoverOPNsense(cloud.kubeClient, opnsense.Address, tlsConfig, opnsense.CredentialsSecret, opnsense.WANInterface)
+		}
+		go loadBalancer.runGatewayManager(cloud.stop)
+		go loadBalancer.runIngressPropagator(cloud.stop)
+		if cloud.config.DNS.Listen != "" {
+			go cloud.runDNSResponder(loadBalancer)
 		}
 		cloud.LoadBalancerInstance = loadBalancer
 	}
@@ -76,14 +148,57 @@ func (cloud *Edge) LoadBalancer() (cloudprovider.LoadBalancer, bool) {
 	return cloud.LoadBalancerInstance, true
 }
 
-// Instances returns nil and false, since instances interface is not supported.
+// runDNSResponder answers the hostnames of the load balancers until the cloud
+// is stopped
+func (cloud *Edge) runDNSResponder(loadBalancer *LoadBalancer) {
+	responder, err := newDNSResponder(loadBalancer, cloud.config.DNS.LANCIDR)
+	if err == nil {
+		err = responder.listen(cloud.config.DNS.Listen, cloud.stop)
+	}
+	if err != nil {
+		klog.Errorf("runDNSResponder: %v", err)
+	}
+}
+
+// HealthCheckers returns the health checks of the edge cloud provider, to be
+// registered in the healthz endpoint of the cloud controller manager. They
+// pass until the load balancer is in use, e.g. while waiting to be the leader.
+func (cloud *Edge) HealthCheckers() []healthz.HealthChecker {
+	return []healthz.HealthChecker{
+		healthz.NamedCheck("edge-gateway", func(req *http.Request) error {
+			loadBalancer := cloud.loadBalancer()
+			if loadBalancer == nil {
+				return nil
+			}
+			return loadBalancer.checkGatewayHealth(req.Context())
+		}),
+		healthz.NamedCheck("edge-gateway-circuit", func(_ *http.Request) error {
+			loadBalancer := cloud.loadBalancer()
+			if loadBalancer == nil || loadBalancer.breaker == nil {
+				return nil
+			}
+			return loadBalancer.breaker.check()
+		}),
+	}
+}
+
+// loadBalancer returns the load balancer, or nil if it is not in use yet
+func (cloud *Edge) loadBalancer() *LoadBalancer {
+	cloud.mutex.Lock()
+	defer cloud.mutex.Unlock()
+	return cloud.LoadBalancerInstance
+}
+
+// Instances returns an instances interface, and true since the interface is
+// supported.
 func (cloud *Edge) Instances() (cloudprovider.Instances, bool) {
-	return nil, false
+	return newInstances(cloud), true
 }
 
-// Zones returns nil and false, since zones interface is not supported.
+// Zones returns a zones interface, and true since the interface is
+// supported.
 func (cloud *Edge) Zones() (cloudprovider.Zones, bool) {
-	return nil, false
+	return newZones(cloud), true
 }
 
 // Clusters returns nil and false, since clusters interface is not supported.
@@ -91,9 +206,18 @@ func (cloud *Edge) Clusters() (cloudprovider.Clusters, bool) {
 	return nil, false
 }
 
-// Routes returns nil and false, since routes interface is not supported.
+// Routes returns a routes interface, and true if the routes to the pod CIDRs
+// of the nodes are programmed (node-routes).
 func (cloud *Edge) Routes() (cloudprovider.Routes, bool) {
-	return nil, false
+	if !cloud.config.Routes.NodeRoutes {
+		return nil, false
+	}
+	cloud.mutex.Lock()
+	defer cloud.mutex.Unlock()
+	if cloud.routes == nil {
+		cloud.routes = newRoutes(cloud)
+	}
+	return cloud.routes, true
 }
 
 // ProviderName returns the cloud provider ID.
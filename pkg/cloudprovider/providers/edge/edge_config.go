@@ -17,15 +17,151 @@ limitations under the License.
 package edge
 
 import (
-	"bufio"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
 
+	gcfg "gopkg.in/gcfg.v1"
 	"k8s.io/klog"
-	//gcfg "gopkg.in/gcfg.v1"
+)
+
+// Environment variables of the configuration
+const (
+	dryRunEnv = "EDGE_DRY_RUN"
+)
+
+// Defaults of the configuration
+const (
+	// defaultClusterName is the default --cluster-name of the cloud
+	// controller manager
+	defaultClusterName  = "kubernetes"
+	defaultInstanceType = "edge"
 )
 
 // Config is used to read and store information from the cloud configuration file
 type Config struct {
+	Global struct {
+		// DryRun runs the reconciliation of the load balancers without
+		// changing the port mappings of the gateway: they are only logged
+		// and reported in the events of the services. The node agents only
+		// log the routes.
+		DryRun bool `gcfg:"dry-run"`
+		// ClusterName is the name of the cluster in the provider IDs of the
+		// nodes, as given to the cloud controller manager with --cluster-name
+		ClusterName string `gcfg:"cluster-name"`
+		// InstanceType is the instance type of the nodes not configured in an
+		// Instance section
+		InstanceType string `gcfg:"instance-type"`
+		// Region and Zone are the topology of the nodes not configured in
+		// an Instance section nor labeled
+		Region string `gcfg:"region"`
+		Zone   string `gcfg:"zone"`
+		// ZoneFromGateway derives the zone of the nodes from the discovered
+		// gateway, when not configured: "udn" or "external-ip"
+		ZoneFromGateway string `gcfg:"zone-from-gateway"`
+		// LoadBalancerType is the type of the gateway, and of the load
+		// balancers of the services: upnp-igd, linux-nat, routeros, openwrt or
+		// opnsense
+		LoadBalancerType string `gcfg:"load-balancer-type"`
+		// LeaseDuration is the lease, in seconds, of the port mappings of
+		// the upnp-igd gateways, renewed before it expires: 0 for permanent
+		// port mappings
+		LeaseDuration uint32 `gcfg:"lease-duration"`
+		// InternalCIDR are the networks of the internal IPs of the nodes:
+		// the node running the cloud controller manager reports the
+		// addresses of its network interfaces in them, instead of the ones
+		// its kubelet reported
+		InternalCIDR []string `gcfg:"internal-cidr"`
+	}
+	LinuxNAT struct {
+		// NodeName is the node which is the gateway, where the leader has
+		// to run
+		NodeName string `gcfg:"node-name"`
+		// WANInterface is the network interface of the node on the WAN,
+		// where the port mappings are programmed
+		WANInterface string `gcfg:"wan-interface"`
+		// Backend is nftables or iptables, by default nftables if the nft
+		// command is available
+		Backend string `gcfg:"backend"`
+		// InternalIP is the address of the node towards the other nodes, by
+		// default its first IPv4 address not on the WAN interface
+		InternalIP string `gcfg:"internal-ip"`
+		// Mark is the conntrack mark set on the forwarded connections, for
+		// the forward chains of the other nftables tables to accept them
+		Mark string `gcfg:"mark"`
+	}
+	RouterOS struct {
+		// Address is the host, and port, of the RouterOS API of the router
+		Address string `gcfg:"address"`
+		// TLS uses the API over TLS (api-ssl), and InsecureSkipVerify
+		// accepts the self-signed certificate of the router
+		TLS                bool `gcfg:"tls"`
+		InsecureSkipVerify bool `gcfg:"insecure-skip-verify"`
+		// CredentialsSecret is the Secret, namespace/name, with the username
+		// and password of the API
+		CredentialsSecret string `gcfg:"credentials-secret"`
+		// WANInterface is the interface of the dstnat entries, and of the
+		// external IP: ether1 by default
+		WANInterface string `gcfg:"wan-interface"`
+	}
+	OpenWrt struct {
+		// Address is the URL of the ubus JSON-RPC endpoint of rpcd, or the
+		// host of the router for http://<host>/ubus
+		Address string `gcfg:"address"`
+		// InsecureSkipVerify accepts the self-signed certificate of the
+		// router over HTTPS
+		InsecureSkipVerify bool `gcfg:"insecure-skip-verify"`
+		// CredentialsSecret is the Secret, namespace/name, with the username
+		// and password of the rpcd login
+		CredentialsSecret string `gcfg:"credentials-secret"`
+		// WANInterface is the logical network interface of the external IP,
+		// and WANZone the firewall zone of the redirects: wan by default
+		WANInterface string `gcfg:"wan-interface"`
+		WANZone      string `gcfg:"wan-zone"`
+		// LANInterface is the logical network interface of the routes to the
+		// pod CIDRs of the nodes: lan by default
+		LANInterface string `gcfg:"lan-interface"`
+	}
+	OPNsense struct {
+		// Address is the URL of the REST API of the firewall, or its host
+		// for https://<host>/api
+		Address string `gcfg:"address"`
+		// InsecureSkipVerify accepts the self-signed certificate of the
+		// firewall
+		InsecureSkipVerify bool `gcfg:"insecure-skip-verify"`
+		// CredentialsSecret is the Secret, namespace/name, with the key of
+		// the API as username and its secret as password
+		CredentialsSecret string `gcfg:"credentials-secret"`
+		// WANInterface is the interface of the port forward rules, and of
+		// the external IP: wan by default
+		WANInterface string `gcfg:"wan-interface"`
+	}
+	Routes struct {
+		// NodeRoutes programs the routing table of every node with the
+		// routes to the pod CIDRs of the other nodes, and supports the route
+		// controller
+		NodeRoutes bool `gcfg:"node-routes"`
+	}
+	DNS struct {
+		// Listen is the UDP address of the split-horizon DNS responder
+		// answering the hostnames of the load balancers, disabled if empty
+		Listen string `gcfg:"listen"`
+		// LANCIDR are the networks of the clients answered with the internal
+		// IPs of the nodes, by default the private networks
+		LANCIDR []string `gcfg:"lan-cidr"`
+	}
+	// Instance are the nodes with a specific configuration, by name
+	Instance map[string]*struct {
+		// Type is the instance type of the node
+		Type string `gcfg:"type"`
+		// Region and Zone are the topology of the node
+		Region string `gcfg:"region"`
+		Zone   string `gcfg:"zone"`
+	}
 }
 
 // ReadConfig reads values from environment variables and the cloud.conf, prioritizing cloud-config
@@ -36,24 +172,135 @@ func ReadConfig(config io.Reader) (Config, error) {
 	klog.V(5).Infof("Config loaded from the environment variables:")
 	logCfg(cfg)
 
-	//err := gcfg.FatalOnly(gcfg.ReadInto(&cfg, config))
+	if config == nil {
+		return cfg, nil
+	}
+	data, err := ioutil.ReadAll(config)
+	if err != nil {
+		return cfg, err
+	}
 	klog.V(5).Infof("Config file contents:")
-	scanner := bufio.NewScanner(config)
-	for scanner.Scan() {
-		klog.V(5).Infof("  %s", scanner.Text())
+	for _, line := range strings.Split(string(data), "\n") {
+		klog.V(5).Infof("  %s", line)
+	}
+	err = gcfg.FatalOnly(gcfg.ReadStringInto(&cfg, string(data)))
+	if err != nil {
+		return cfg, err
 	}
 
 	klog.V(5).Infof("Config after adding the config file:")
 	logCfg(cfg)
 
-	return cfg, nil //err
+	switch cfg.Global.ZoneFromGateway {
+	case "", zoneFromGatewayUDN, zoneFromGatewayExternalIP:
+	default:
+		return cfg, fmt.Errorf("invalid zone-from-gateway '%s': expected %s or %s", cfg.Global.ZoneFromGateway, zoneFromGatewayUDN, zoneFromGatewayExternalIP)
+	}
+	switch cfg.Global.LoadBalancerType {
+	case UniversalPlugAndPlayInternetGatewayDeviceLoadBalancerType:
+	case LinuxNATLoadBalancerType:
+		if cfg.LinuxNAT.NodeName == "" || cfg.LinuxNAT.WANInterface == "" {
+			return cfg, fmt.Errorf("load-balancer-type %s: missing node-name or wan-interface", LinuxNATLoadBalancerType)
+		}
+		switch cfg.LinuxNAT.Backend {
+		case "", linuxNATNFTables, linuxNATIPTables:
+		default:
+			return cfg, fmt.Errorf("invalid backend '%s': expected %s or %s", cfg.LinuxNAT.Backend, linuxNATNFTables, linuxNATIPTables)
+		}
+		if _, err := parseLinuxNATMark(cfg.LinuxNAT.Mark); err != nil {
+			return cfg, err
+		}
+		if cfg.LinuxNAT.Mark != "" && cfg.LinuxNAT.Backend == linuxNATIPTables {
+			return cfg, fmt.Errorf("load-balancer-type %s: mark is only supported by %s", LinuxNATLoadBalancerType, linuxNATNFTables)
+		}
+	case RouterOSLoadBalancerType:
+		if cfg.RouterOS.Address == "" || cfg.RouterOS.CredentialsSecret == "" {
+			return cfg, fmt.Errorf("load-balancer-type %s: missing address or credentials-secret", RouterOSLoadBalancerType)
+		}
+	case OpenWrtLoadBalancerType:
+		if cfg.OpenWrt.Address == "" || cfg.OpenWrt.CredentialsSecret == "" {
+			return cfg, fmt.Errorf("load-balancer-type %s: missing address or credentials-secret", OpenWrtLoadBalancerType)
+		}
+	case OPNsenseLoadBalancerType:
+		if cfg.OPNsense.Address == "" || cfg.OPNsense.CredentialsSecret == "" {
+			return cfg, fmt.Errorf("load-balancer-type %s: missing address or credentials-secret", OPNsenseLoadBalancerType)
+		}
+	default:
+		return cfg, fmt.Errorf("invalid load-balancer-type '%s': expected %s, %s, %s, %s or %s", cfg.Global.LoadBalancerType,
+			UniversalPlugAndPlayInternetGatewayDeviceLoadBalancerType, LinuxNATLoadBalancerType, RouterOSLoadBalancerType, OpenWrtLoadBalancerType,
+			OPNsenseLoadBalancerType)
+	}
+	if cfg.Global.LeaseDuration != uint32(infinitePortMappingLeaseDuration) {
+		if cfg.Global.LoadBalancerType != UniversalPlugAndPlayInternetGatewayDeviceLoadBalancerType {
+			return cfg, fmt.Errorf("lease-duration: the port mappings of load-balancer-type %s are permanent", cfg.Global.LoadBalancerType)
+		}
+		if cfg.Global.LeaseDuration < minPortMappingLeaseDuration || cfg.Global.LeaseDuration > maxPortMappingLeaseDuration {
+			return cfg, fmt.Errorf("invalid lease-duration %d: expected 0, or between %d and %d seconds", cfg.Global.LeaseDuration, minPortMappingLeaseDuration, maxPortMappingLeaseDuration)
+		}
+	}
+	for _, cidr := range cfg.Global.InternalCIDR {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return cfg, fmt.Errorf("invalid internal-cidr: %v", err)
+		}
+	}
+	if _, err := parseCIDRs(cfg.DNS.LANCIDR); err != nil {
+		return cfg, fmt.Errorf("invalid lan-cidr: %v", err)
+	}
+	return cfg, nil
 }
 
 func configFromEnv() Config {
 	var cfg Config
+	cfg.Global.ClusterName = defaultClusterName
+	cfg.Global.InstanceType = defaultInstanceType
+	cfg.Global.LoadBalancerType = UniversalPlugAndPlayInternetGatewayDeviceLoadBalancerType
 
+	if value, ok := os.LookupEnv(dryRunEnv); ok {
+		dryRun, err := strconv.ParseBool(value)
+		if err != nil {
+			klog.Warningf("configFromEnv: ignoring invalid %s: %v", dryRunEnv, err)
+		}
+		cfg.Global.DryRun = dryRun
+	}
 	return cfg
 }
 
 func logCfg(cfg Config) {
+	klog.V(5).Infof("  [Global] dry-run: %t", cfg.Global.DryRun)
+	klog.V(5).Infof("  [Global] cluster-name: %s", cfg.Global.ClusterName)
+	klog.V(5).Infof("  [Global] instance-type: %s", cfg.Global.InstanceType)
+	klog.V(5).Infof("  [Global] region: %s", cfg.Global.Region)
+	klog.V(5).Infof("  [Global] zone: %s", cfg.Global.Zone)
+	klog.V(5).Infof("  [Global] zone-from-gateway: %s", cfg.Global.ZoneFromGateway)
+	klog.V(5).Infof("  [Global] load-balancer-type: %s", cfg.Global.LoadBalancerType)
+	klog.V(5).Infof("  [Global] lease-duration: %d", cfg.Global.LeaseDuration)
+	klog.V(5).Infof("  [Global] internal-cidr: %v", cfg.Global.InternalCIDR)
+	klog.V(5).Infof("  [LinuxNAT] node-name: %s", cfg.LinuxNAT.NodeName)
+	klog.V(5).Infof("  [LinuxNAT] wan-interface: %s", cfg.LinuxNAT.WANInterface)
+	klog.V(5).Infof("  [LinuxNAT] backend: %s", cfg.LinuxNAT.Backend)
+	klog.V(5).Infof("  [LinuxNAT] internal-ip: %s", cfg.LinuxNAT.InternalIP)
+	klog.V(5).Infof("  [LinuxNAT] mark: %s", cfg.LinuxNAT.Mark)
+	klog.V(5).Infof("  [RouterOS] address: %s", cfg.RouterOS.Address)
+	klog.V(5).Infof("  [RouterOS] tls: %t", cfg.RouterOS.TLS)
+	klog.V(5).Infof("  [RouterOS] insecure-skip-verify: %t", cfg.RouterOS.InsecureSkipVerify)
+	klog.V(5).Infof("  [RouterOS] credentials-secret: %s", cfg.RouterOS.CredentialsSecret)
+	klog.V(5).Infof("  [RouterOS] wan-interface: %s", cfg.RouterOS.WANInterface)
+	klog.V(5).Infof("  [OpenWrt] address: %s", cfg.OpenWrt.Address)
+	klog.V(5).Infof("  [OpenWrt] insecure-skip-verify: %t", cfg.OpenWrt.InsecureSkipVerify)
+	klog.V(5).Infof("  [OpenWrt] credentials-secret: %s", cfg.OpenWrt.CredentialsSecret)
+	klog.V(5).Infof("  [OpenWrt] wan-interface: %s", cfg.OpenWrt.WANInterface)
+	klog.V(5).Infof("  [OpenWrt] wan-zone: %s", cfg.OpenWrt.WANZone)
+	klog.V(5).Infof("  [OpenWrt] lan-interface: %s", cfg.OpenWrt.LANInterface)
+	klog.V(5).Infof("  [OPNsense] address: %s", cfg.OPNsense.Address)
+	klog.V(5).Infof("  [OPNsense] insecure-skip-verify: %t", cfg.OPNsense.InsecureSkipVerify)
+	klog.V(5).Infof("  [OPNsense] credentials-secret: %s", cfg.OPNsense.CredentialsSecret)
+	klog.V(5).Infof("  [OPNsense] wan-interface: %s", cfg.OPNsense.WANInterface)
+	klog.V(5).Infof("  [Routes] node-routes: %t", cfg.Routes.NodeRoutes)
+	klog.V(5).Infof("  [DNS] listen: %s", cfg.DNS.Listen)
+	klog.V(5).Infof("  [DNS] lan-cidr: %v", cfg.DNS.LANCIDR)
+	for name, instance := range cfg.Instance {
+		klog.V(5).Infof("  [Instance %q] type: %s", name, instance.Type)
+		klog.V(5).Infof("  [Instance %q] region: %s", name, instance.Region)
+		klog.V(5).Infof("  [Instance %q] zone: %s", name, instance.Zone)
+	}
 }
@@ -0,0 +1,122 @@
+/*
+Copyright 2019 Midokura
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package edge
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestReadConfig(t *testing.T) {
+	cfg, err := ReadConfig(strings.NewReader("[Global]\ndry-run = true\n"))
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if !cfg.Global.DryRun {
+		t.Errorf("got dry run %t\nwant true", cfg.Global.DryRun)
+	}
+	if cfg.Global.ClusterName != defaultClusterName || cfg.Global.InstanceType != defaultInstanceType {
+		t.Errorf("got cluster %s and instance type %s\nwant the defaults", cfg.Global.ClusterName, cfg.Global.InstanceType)
+	}
+	cfg, err = ReadConfig(strings.NewReader("[Global]\ncluster-name = site\n[Instance \"pi\"]\ntype = raspberry-pi\n"))
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if cfg.Global.ClusterName != "site" || cfg.Instance["pi"] == nil || cfg.Instance["pi"].Type != "raspberry-pi" {
+		t.Errorf("got cluster %s and instances %+v\nwant site and the type of pi", cfg.Global.ClusterName, cfg.Instance)
+	}
+	if _, err := ReadConfig(strings.NewReader("[Global]\ndry-run = maybe\n")); err == nil {
+		t.Errorf("expected error")
+	}
+	if _, err := ReadConfig(strings.NewReader("[Global]\nzone-from-gateway = mac\n")); err == nil {
+		t.Errorf("expected error")
+	}
+	cfg, err = ReadConfig(strings.NewReader("[DNS]\nlisten = :53\nlan-cidr = 192.168.1.0/24\nlan-cidr = 10.42.0.0/16\n"))
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if cfg.DNS.Listen != ":53" || len(cfg.DNS.LANCIDR) != 2 {
+		t.Errorf("got %+v\nwant the DNS responder on :53 with 2 LAN CIDRs", cfg.DNS)
+	}
+	if _, err := ReadConfig(strings.NewReader("[DNS]\nlan-cidr = 192.168.1.0\n")); err == nil {
+		t.Errorf("expected error")
+	}
+	cfg, err = ReadConfig(strings.NewReader("[Global]\ninternal-cidr = 192.168.1.0/24\n"))
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if len(cfg.Global.InternalCIDR) != 1 {
+		t.Errorf("got %v\nwant 1 internal CIDR", cfg.Global.InternalCIDR)
+	}
+	if _, err := ReadConfig(strings.NewReader("[Global]\ninternal-cidr = 192.168.1.1\n")); err == nil {
+		t.Errorf("expected error")
+	}
+	cfg, err = ReadConfig(strings.NewReader("[Global]\nload-balancer-type = linux-nat\n[LinuxNAT]\nnode-name = gateway\nwan-interface = eth1\n"))
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if cfg.Global.LoadBalancerType != LinuxNATLoadBalancerType || cfg.LinuxNAT.WANInterface != "eth1" {
+		t.Errorf("got %s on %s\nwant linux-nat on eth1", cfg.Global.LoadBalancerType, cfg.LinuxNAT.WANInterface)
+	}
+	cfg, err = ReadConfig(strings.NewReader("[Global]\nload-balancer-type = routeros\n[RouterOS]\naddress = 192.168.88.1\ncredentials-secret = kube-system/routeros-credentials\n"))
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if cfg.Global.LoadBalancerType != RouterOSLoadBalancerType || cfg.RouterOS.Address != "192.168.88.1" {
+		t.Errorf("got %s on %s\nwant routeros on 192.168.88.1", cfg.Global.LoadBalancerType, cfg.RouterOS.Address)
+	}
+	cfg, err = ReadConfig(strings.NewReader("[Global]\nload-balancer-type = openwrt\n[OpenWrt]\naddress = https://192.168.1.1/ubus\ncredentials-secret = kube-system/openwrt-credentials\nwan-zone = wan6\n"))
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if cfg.Global.LoadBalancerType != OpenWrtLoadBalancerType || cfg.OpenWrt.WANZone != "wan6" {
+		t.Errorf("got %s in %s\nwant openwrt in wan6", cfg.Global.LoadBalancerType, cfg.OpenWrt.WANZone)
+	}
+	cfg, err = ReadConfig(strings.NewReader("[Global]\nload-balancer-type = opnsense\n[OPNsense]\naddress = 192.168.1.1\ncredentials-secret = kube-system/opnsense-credentials\n"))
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if cfg.Global.LoadBalancerType != OPNsenseLoadBalancerType || cfg.OPNsense.Address != "192.168.1.1" {
+		t.Errorf("got %s on %s\nwant opnsense on 192.168.1.1", cfg.Global.LoadBalancerType, cfg.OPNsense.Address)
+	}
+	cfg, err = ReadConfig(strings.NewReader("[Global]\nlease-duration = 3600\n"))
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if cfg.Global.LeaseDuration != 3600 {
+		t.Errorf("got lease duration %d\nwant 3600", cfg.Global.LeaseDuration)
+	}
+	for _, config := range []string{
+		"[Global]\nload-balancer-type = pcp\n",
+		"[Global]\nlease-duration = 60\n",
+		"[Global]\nlease-duration = 1209600\n",
+		"[Global]\nlease-duration = -1\n",
+		"[Global]\nload-balancer-type = linux-nat\nlease-duration = 3600\n[LinuxNAT]\nnode-name = gateway\nwan-interface = eth1\n",
+		"[Global]\nload-balancer-type = linux-nat\n",
+		"[Global]\nload-balancer-type = linux-nat\n[LinuxNAT]\nwan-interface = eth1\n",
+		"[Global]\nload-balancer-type = linux-nat\n[LinuxNAT]\nnode-name = gateway\nwan-interface = eth1\nbackend = pf\n",
+		"[Global]\nload-balancer-type = linux-nat\n[LinuxNAT]\nnode-name = gateway\nwan-interface = eth1\nmark = red\n",
+		"[Global]\nload-balancer-type = linux-nat\n[LinuxNAT]\nnode-name = gateway\nwan-interface = eth1\nbackend = iptables\nmark = 0x4544\n",
+		"[Global]\nload-balancer-type = routeros\n[RouterOS]\naddress = 192.168.88.1\n",
+		"[Global]\nload-balancer-type = openwrt\n[OpenWrt]\ncredentials-secret = kube-system/openwrt-credentials\n",
+		"[Global]\nload-balancer-type = opnsense\n[OPNsense]\naddress = 192.168.1.1\n",
+	} {
+		if _, err := ReadConfig(strings.NewReader(config)); err == nil {
+			t.Errorf("%q: expected error", config)
+		}
+	}
+}
@@ -0,0 +1,322 @@
+/*
+Copyright 2019 Midokura
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package edge
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/midokura/cloud-provider-edge/pkg/cloudprovider/providers/edge/igdtest"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/informers"
+	coreinformers "k8s.io/client-go/informers/core/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	core "k8s.io/client-go/testing"
+	servicecontroller "k8s.io/kubernetes/pkg/controller/service"
+)
+
+// These tests run the edge cloud provider under the service controller of the
+// cloud controller manager, with a fake clientset and a simulated gateway.
+
+// controllerTestTimeout bounds the waits for the service controller. Failed
+// syncs are retried after 5 seconds.
+const controllerTestTimeout = 15 * time.Second
+
+// controllerHarness runs the service controller on the edge cloud provider
+type controllerHarness struct {
+	t          *testing.T
+	cloud      *Edge
+	igd        *igdtest.Server
+	kubeClient *fake.Clientset
+	nodeLister corelisters.NodeLister
+	stop       chan struct{}
+	closeIGD   func()
+
+	// the fake clientset rejects the events of the recorders, created without
+	// namespace: they are kept here
+	eventsMutex sync.Mutex
+	events      []v1.Event
+}
+
+// nodeInformer signals the first listing of the nodes by the service
+// controller, done by its first sync of the nodes
+type nodeInformer struct {
+	coreinformers.NodeInformer
+	listed chan struct{}
+	once   sync.Once
+}
+
+func (informer *nodeInformer) Lister() corelisters.NodeLister {
+	return &nodeLister{NodeLister: informer.NodeInformer.Lister(), informer: informer}
+}
+
+type nodeLister struct {
+	corelisters.NodeLister
+	informer *nodeInformer
+}
+
+func (lister *nodeLister) ListWithPredicate(predicate corelisters.NodeConditionPredicate) ([]*v1.Node, error) {
+	nodes, err := lister.NodeLister.ListWithPredicate(predicate)
+	lister.informer.once.Do(func() {
+		close(lister.informer.listed)
+	})
+	return nodes, err
+}
+
+// newControllerHarness starts the service controller once the simulated
+// gateway is discovered, and waits for its first sync of the nodes. The nodes
+// are to be added afterwards: in Kubernetes 1.16, this sync races with the
+// syncs of the services when the nodes changed.
+func newControllerHarness(t *testing.T, config igdtest.Config) *controllerHarness {
+	igd, closeIGD := newTestIGD(t, config)
+	h := &controllerHarness{
+		t:          t,
+		cloud:      &Edge{},
+		igd:        igd,
+		kubeClient: fake.NewSimpleClientset(),
+		stop:       make(chan struct{}),
+		closeIGD:   closeIGD,
+	}
+	h.kubeClient.PrependReactor("create", "events", func(action core.Action) (bool, runtime.Object, error) {
+		event := action.(core.CreateAction).GetObject().(*v1.Event)
+		h.eventsMutex.Lock()
+		defer h.eventsMutex.Unlock()
+		h.events = append(h.events, *event)
+		return true, event, nil
+	})
+	h.cloud.initialize(h.kubeClient, dynamicfake.NewSimpleDynamicClient(runtime.NewScheme()), h.stop)
+	h.cloud.LoadBalancer()
+	h.waitFor("the discovery of the gateway", func() bool {
+		return h.cloud.loadBalancer().hasGateway()
+	})
+
+	informerFactory := informers.NewSharedInformerFactory(h.kubeClient, 0)
+	nodes := &nodeInformer{NodeInformer: informerFactory.Core().V1().Nodes(), listed: make(chan struct{})}
+	controller, err := servicecontroller.New(h.cloud, h.kubeClient, informerFactory.Core().V1().Services(), nodes, "kubernetes")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	h.nodeLister = nodes.NodeInformer.Lister()
+	informerFactory.Start(h.stop)
+	go controller.Run(h.stop, 1)
+	select {
+	case <-nodes.listed:
+	case <-time.After(controllerTestTimeout):
+		t.Fatalf("timeout waiting for the first sync of the nodes")
+	}
+	return h
+}
+
+func (h *controllerHarness) close() {
+	close(h.stop)
+	h.closeIGD()
+}
+
+// waitFor waits until the condition is true, or fails the test
+func (h *controllerHarness) waitFor(what string, condition func() bool) {
+	err := wait.PollImmediate(10*time.Millisecond, controllerTestTimeout, func() (bool, error) {
+		return condition(), nil
+	})
+	if err != nil {
+		h.t.Fatalf("timeout waiting for %s", what)
+	}
+}
+
+// waitForMappings waits until the gateway has the port mappings given
+func (h *controllerHarness) waitForMappings(expected ...igdtest.Mapping) {
+	h.waitFor("the port mappings of the gateway", func() bool {
+		mappings := h.igd.Mappings()
+		return reflect.DeepEqual(mappings, expected) || (len(mappings) == 0 && len(expected) == 0)
+	})
+}
+
+// waitForIngress waits until the status of the service has the ingress IP
+// given, or none if empty
+func (h *controllerHarness) waitForIngress(name, ip string) {
+	h.waitFor("the status of the service", func() bool {
+		service, err := h.kubeClient.CoreV1().Services("default").Get(name, metav1.GetOptions{})
+		if err != nil {
+			return false
+		}
+		ingress := service.Status.LoadBalancer.Ingress
+		if ip == "" {
+			return len(ingress) == 0
+		}
+		return len(ingress) == 1 && ingress[0].IP == ip
+	})
+}
+
+// waitForEvent waits until an event of the reason given is recorded for the
+// service
+func (h *controllerHarness) waitForEvent(name, reason string) {
+	h.waitFor("the event "+reason, func() bool {
+		h.eventsMutex.Lock()
+		defer h.eventsMutex.Unlock()
+		for _, event := range h.events {
+			if event.InvolvedObject.Name == name && event.Reason == reason {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// addNode adds a ready node, and waits for the service controller to see it
+func (h *controllerHarness) addNode(name, internalIP string) {
+	node := newTestNode(name, internalIP)
+	node.Status.Conditions = []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue}}
+	if _, err := h.kubeClient.CoreV1().Nodes().Create(node); err != nil {
+		h.t.Fatalf("unexpected error %v", err)
+	}
+	h.waitFor("the node "+name, func() bool {
+		_, err := h.nodeLister.Get(name)
+		return err == nil
+	})
+}
+
+func (h *controllerHarness) createService(service *v1.Service) {
+	if _, err := h.kubeClient.CoreV1().Services(service.Namespace).Create(service); err != nil {
+		h.t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func (h *controllerHarness) updateService(name string, update func(service *v1.Service)) {
+	service, err := h.kubeClient.CoreV1().Services("default").Get(name, metav1.GetOptions{})
+	if err != nil {
+		h.t.Fatalf("unexpected error %v", err)
+	}
+	update(service)
+	if _, err := h.kubeClient.CoreV1().Services("default").Update(service); err != nil {
+		h.t.Fatalf("unexpected error %v", err)
+	}
+}
+
+// deleteService deletes the service like the API server: it is only marked
+// for deletion until the service controller removes its finalizer
+func (h *controllerHarness) deleteService(name string) {
+	h.updateService(name, func(service *v1.Service) {
+		now := metav1.Now()
+		service.DeletionTimestamp = &now
+	})
+	h.waitFor("the removal of the finalizer", func() bool {
+		service, err := h.kubeClient.CoreV1().Services("default").Get(name, metav1.GetOptions{})
+		return err == nil && len(service.Finalizers) == 0
+	})
+	if err := h.kubeClient.CoreV1().Services("default").Delete(name, nil); err != nil {
+		h.t.Fatalf("unexpected error %v", err)
+	}
+}
+
+// newTestMapping returns the port mapping of the port of the service of
+// newTestService
+func newTestMapping(externalPort, internalPort uint16) igdtest.Mapping {
+	return igdtest.Mapping{
+		ExternalPort:   externalPort,
+		Protocol:       "TCP",
+		InternalPort:   internalPort,
+		InternalClient: "127.0.0.1",
+		Enabled:        true,
+		Description:    "kubernetes/default/svc/http",
+	}
+}
+
+func TestControllerServiceLifecycle(t *testing.T) {
+	h := newControllerHarness(t, igdtest.Config{})
+	defer h.close()
+	h.addNode("node", "127.0.0.1")
+
+	h.createService(newTestService(""))
+	h.waitForMappings(newTestMapping(8080, 30080))
+	h.waitForIngress("svc", testIGDExternalIP)
+	h.waitForEvent("svc", "EnsuredLoadBalancer")
+
+	h.updateService("svc", func(service *v1.Service) {
+		service.Spec.Ports[0].Port = 9090
+		service.Spec.Ports[0].NodePort = 30090
+	})
+	h.waitForMappings(newTestMapping(9090, 30090))
+	h.waitForIngress("svc", testIGDExternalIP)
+
+	h.deleteService("svc")
+	h.waitForMappings()
+	if _, exists, err := h.cloud.loadBalancer().GetLoadBalancer(context.TODO(), "kubernetes", newTestService("")); err != nil || exists {
+		t.Errorf("got %v, %v\nwant the load balancer deleted", exists, err)
+	}
+}
+
+func TestControllerServiceTypeChange(t *testing.T) {
+	h := newControllerHarness(t, igdtest.Config{})
+	defer h.close()
+	h.addNode("node", "127.0.0.1")
+
+	h.createService(newTestService(""))
+	h.waitForMappings(newTestMapping(8080, 30080))
+
+	// the load balancer is deleted when the service does not want it anymore
+	h.updateService("svc", func(service *v1.Service) {
+		service.Spec.Type = v1.ServiceTypeNodePort
+	})
+	h.waitForMappings()
+	h.waitForIngress("svc", "")
+	h.waitForEvent("svc", "DeletedLoadBalancer")
+}
+
+func TestControllerUpdateBeforeEnsure(t *testing.T) {
+	h := newControllerHarness(t, igdtest.Config{})
+	defer h.close()
+	h.addNode("node", "127.0.0.1")
+	// another host has the port: the ensure fails until it is released
+	h.igd.AddMapping(igdtest.Mapping{
+		ExternalPort:   8080,
+		Protocol:       "TCP",
+		InternalPort:   8080,
+		InternalClient: "192.0.2.9",
+		Enabled:        true,
+		Description:    "other host",
+	})
+
+	h.createService(newTestService(""))
+	h.waitForEvent("svc", "SyncLoadBalancerFailed")
+
+	// the service controller updates the hosts of the services of its cache,
+	// even if their load balancer was never ensured: the update must fail
+	// with "not found", and the load balancer must not exist, for the
+	// controller to ignore the error
+	lb := h.cloud.loadBalancer()
+	nodes := []*v1.Node{newTestNode("node", "127.0.0.1")}
+	err := lb.UpdateLoadBalancer(context.TODO(), "kubernetes", newTestService(""), nodes)
+	if err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("got %v\nwant a not found error", err)
+	}
+	if _, exists, err := lb.GetLoadBalancer(context.TODO(), "kubernetes", newTestService("")); err != nil || exists {
+		t.Errorf("got %v, %v\nwant no load balancer", exists, err)
+	}
+
+	// the service controller retries the ensure
+	h.igd.DeleteMapping("TCP", 8080)
+	h.waitForMappings(newTestMapping(8080, 30080))
+	h.waitForIngress("svc", testIGDExternalIP)
+}
@@ -0,0 +1,296 @@
+/*
+Copyright 2019 Midokura
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package edge
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/huin/goupnp"
+	k8s "k8s.io/api/core/v1"
+	"k8s.io/klog"
+)
+
+// Paths of the debugging endpoints
+const (
+	debugMappingsPath = "/debug/edge/mappings"
+	debugGatewayPath  = "/debug/edge/gateway"
+	// debugQueryTimeout is the time given to the gateway to report each port
+	// mapping to /debug/edge/mappings
+	debugQueryTimeout = 2 * time.Second
+)
+
+// debugLoadBalancer is a load balancer, as served by /debug/edge/mappings
+type debugLoadBalancer struct {
+	Name         string             `json:"name"`
+	ExternalIP   string             `json:"externalIP"`
+	NodeIP       string             `json:"nodeIP"`
+	LastError    string             `json:"lastError,omitempty"`
+	PortMappings []debugPortMapping `json:"portMappings"`
+}
+
+// debugPortMapping is a desired port mapping, with what the gateway reports
+type debugPortMapping struct {
+	Name         string       `json:"name,omitempty"`
+	Protocol     k8s.Protocol `json:"protocol"`
+	Port         int32        `json:"port"`
+	ExternalPort int32        `json:"externalPort"`
+	NodePort     int32        `json:"nodePort"`
+	// LeaseRemaining is the time left before the lease expires, unset if it
+	// is permanent
+	LeaseRemaining string `json:"leaseRemaining,omitempty"`
+	// Gateway is the port mapping reported by the gateway, unset if missing
+	Gateway *debugGatewayEntry `json:"gateway,omitempty"`
+	// GatewayError is the error of the gateway when asked for the port mapping
+	GatewayError string `json:"gatewayError,omitempty"`
+	// InSync is whether the gateway has the desired port mapping
+	InSync bool `json:"inSync"`
+}
+
+// debugGatewayEntry is a port mapping as reported by the gateway
+type debugGatewayEntry struct {
+	InternalIP    string `json:"internalIP"`
+	InternalPort  uint16 `json:"internalPort"`
+	Enabled       bool   `json:"enabled"`
+	Description   string `json:"description"`
+	LeaseDuration uint32 `json:"leaseDuration"`
+}
+
+// debugGateway is the gateway, as served by /debug/edge/gateway
+type debugGateway struct {
+	Available     bool                 `json:"available"`
+	DryRun        bool                 `json:"dryRun,omitempty"`
+	LastDiscovery *time.Time           `json:"lastDiscovery,omitempty"`
+	CircuitError  string               `json:"circuitError,omitempty"`
+	Connections   []debugWANConnection `json:"connections"`
+}
+
+// debugWANConnection is a WAN connection of the gateway
+type debugWANConnection struct {
+	Default      bool         `json:"default"`
+	ExternalIP   string       `json:"externalIP"`
+	LocalAddress string       `json:"localAddress"`
+	ServiceType  string       `json:"serviceType,omitempty"`
+	ControlURL   string       `json:"controlURL,omitempty"`
+	Location     string       `json:"location,omitempty"`
+	Device       *debugDevice `json:"device,omitempty"`
+	// DryRunOperations are the last changes of port mappings not done, in
+	// dry run
+	DryRunOperations []string `json:"dryRunOperations,omitempty"`
+}
+
+// debugDevice is an UPnP device, with its services and embedded devices
+type debugDevice struct {
+	UDN          string         `json:"udn"`
+	DeviceType   string         `json:"deviceType"`
+	FriendlyName string         `json:"friendlyName,omitempty"`
+	Manufacturer string         `json:"manufacturer,omitempty"`
+	ModelName    string         `json:"modelName,omitempty"`
+	ModelNumber  string         `json:"modelNumber,omitempty"`
+	SerialNumber string         `json:"serialNumber,omitempty"`
+	Services     []debugService `json:"services,omitempty"`
+	Devices      []debugDevice  `json:"devices,omitempty"`
+}
+
+// debugService is an UPnP service
+type debugService struct {
+	ServiceType string `json:"serviceType"`
+	ServiceID   string `json:"serviceId"`
+	ControlURL  string `json:"controlURL"`
+}
+
+// debugQuery is a port mapping to ask the gateway for
+type debugQuery struct {
+	portMapping *debugPortMapping
+	client      clientInterface
+	nodeIP      string
+}
+
+// debugMappings returns the known load balancers, sorted by name, with the
+// port mappings reported by the gateway
+func (lb *LoadBalancer) debugMappings(ctx context.Context, now time.Time) []debugLoadBalancer {
+	// the gateway is asked without holding the mutex
+	lb.mutex.Lock()
+	loadBalancers := make([]debugLoadBalancer, 0, len(lb.loadBalancers))
+	queries := make([]debugQuery, 0)
+	for name, loadBalancer := range lb.loadBalancers {
+		debugLB := debugLoadBalancer{
+			Name:         name,
+			NodeIP:       loadBalancer.nodeIP,
+			LastError:    loadBalancer.lastError,
+			PortMappings: make([]debugPortMapping, len(loadBalancer.portMappings)),
+		}
+		if loadBalancer.status != nil && len(loadBalancer.status.Ingress) > 0 {
+			debugLB.ExternalIP = loadBalancer.status.Ingress[0].IP
+		}
+		for i, pm := range loadBalancer.portMappings {
+			debugLB.PortMappings[i] = debugPortMapping{
+				Name:         pm.servicePort.Name,
+				Protocol:     pm.servicePort.Protocol,
+				Port:         pm.servicePort.Port,
+				ExternalPort: pm.externalPort(),
+				NodePort:     pm.servicePort.NodePort,
+			}
+			if !pm.leaseExpiry.IsZero() {
+				debugLB.PortMappings[i].LeaseRemaining = pm.leaseExpiry.Sub(now).Round(time.Second).String()
+			}
+			if lb.client == nil {
+				debugLB.PortMappings[i].GatewayError = errGatewayNotAvailable.Error()
+				continue
+			}
+			wan, err := lb.getWANConnection(pm.externalIP)
+			if err != nil {
+				debugLB.PortMappings[i].GatewayError = err.Error()
+				continue
+			}
+			// the gateway is asked without retries, and the failures of a
+			// debugging request don't open the circuit
+			queries = append(queries, debugQuery{&debugLB.PortMappings[i], unwrapClient(wan.client), pm.nodeIP})
+		}
+		loadBalancers = append(loadBalancers, debugLB)
+	}
+	lb.mutex.Unlock()
+
+	for _, query := range queries {
+		pm := query.portMapping
+		queryCtx, cancel := context.WithTimeout(ctx, debugQueryTimeout)
+		entry, err := query.client.GetSpecificPortMappingEntry(queryCtx, "", uint16(pm.ExternalPort), string(pm.Protocol))
+		cancel()
+		if err != nil {
+			if !isUPnPError(err, upnpNoSuchEntryInArray) {
+				pm.GatewayError = err.Error()
+			}
+			continue
+		}
+		pm.Gateway = &debugGatewayEntry{
+			InternalIP:    entry.internalIP,
+			InternalPort:  entry.internalPort,
+			Enabled:       entry.enabled,
+			Description:   entry.desc,
+			LeaseDuration: entry.leaseDuration,
+		}
+		pm.InSync = entry.enabled && entry.internalIP == query.nodeIP && int32(entry.internalPort) == pm.NodePort
+	}
+	sort.Slice(loadBalancers, func(i, j int) bool {
+		return loadBalancers[i].Name < loadBalancers[j].Name
+	})
+	return loadBalancers
+}
+
+// debugGateway returns the discovered gateway
+func (lb *LoadBalancer) debugGateway() debugGateway {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+	gw := debugGateway{
+		Available:   lb.client != nil,
+		DryRun:      lb.dryRun,
+		Connections: make([]debugWANConnection, 0, len(lb.wanConnections)),
+	}
+	if !lb.lastDiscovery.IsZero() {
+		lastDiscovery := lb.lastDiscovery
+		gw.LastDiscovery = &lastDiscovery
+	}
+	if lb.breaker != nil {
+		if err := lb.breaker.check(); err != nil {
+			gw.CircuitError = err.Error()
+		}
+	}
+	for i, connection := range lb.wanConnections {
+		debugConnection := debugWANConnection{
+			Default:      i == 0,
+			ExternalIP:   connection.externalIP.String(),
+			LocalAddress: connection.localAddress.String(),
+		}
+		if connection.location != nil {
+			debugConnection.Location = connection.location.String()
+		}
+		if connection.service != nil {
+			debugConnection.ServiceType = connection.service.ServiceType
+			debugConnection.ControlURL = connection.service.ControlURL.URL.String()
+		}
+		if connection.device != nil {
+			device := newDebugDevice(connection.device)
+			debugConnection.Device = &device
+		}
+		if client, ok := connection.client.(*dryRunClient); ok {
+			debugConnection.DryRunOperations = client.getOperations()
+		}
+		gw.Connections = append(gw.Connections, debugConnection)
+	}
+	return gw
+}
+
+func newDebugDevice(device *goupnp.Device) debugDevice {
+	debugDevice := debugDevice{
+		UDN:          device.UDN,
+		DeviceType:   device.DeviceType,
+		FriendlyName: device.FriendlyName,
+		Manufacturer: device.Manufacturer,
+		ModelName:    device.ModelName,
+		ModelNumber:  device.ModelNumber,
+		SerialNumber: device.SerialNumber,
+	}
+	for _, service := range device.Services {
+		debugDevice.Services = append(debugDevice.Services, debugService{
+			ServiceType: service.ServiceType,
+			ServiceID:   service.ServiceId,
+			ControlURL:  service.ControlURL.URL.String(),
+		})
+	}
+	for i := range device.Devices {
+		debugDevice.Devices = append(debugDevice.Devices, newDebugDevice(&device.Devices[i]))
+	}
+	return debugDevice
+}
+
+// DebugHandlers returns the debugging endpoints of the edge cloud provider, to
+// be served by the cloud controller manager
+func (cloud *Edge) DebugHandlers() map[string]http.Handler {
+	return map[string]http.Handler{
+		debugMappingsPath: cloud.debugHandler(func(lb *LoadBalancer, req *http.Request) interface{} {
+			return lb.debugMappings(req.Context(), time.Now())
+		}),
+		debugGatewayPath: cloud.debugHandler(func(lb *LoadBalancer, _ *http.Request) interface{} {
+			return lb.debugGateway()
+		}),
+	}
+}
+
+// debugHandler serves as JSON what the function given returns for the load
+// balancer, or an error if it is not in use yet
+func (cloud *Edge) debugHandler(f func(lb *LoadBalancer, req *http.Request) interface{}) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		loadBalancer := cloud.loadBalancer()
+		if loadBalancer == nil {
+			http.Error(w, "load balancer not in use", http.StatusServiceUnavailable)
+			return
+		}
+		data, err := json.MarshalIndent(f(loadBalancer, req), "", "  ")
+		if err != nil {
+			http.Error(w, fmt.Sprintf("error encoding response: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if _, err := w.Write(data); err != nil {
+			klog.V(3).Infof("debugHandler: %s: %v", req.URL.Path, err)
+		}
+	})
+}
@@ -0,0 +1,160 @@
+/*
+Copyright 2019 Midokura
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package edge
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/huin/goupnp"
+)
+
+func getDebugEndpoint(t *testing.T, cloud *Edge, path string, response interface{}) int {
+	recorder := httptest.NewRecorder()
+	cloud.DebugHandlers()[path].ServeHTTP(recorder, httptest.NewRequest("GET", path, nil))
+	if recorder.Code == http.StatusOK {
+		if err := json.Unmarshal(recorder.Body.Bytes(), response); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+	}
+	return recorder.Code
+}
+
+func TestDebugMappings(t *testing.T) {
+	cloud := &Edge{}
+	if code := getDebugEndpoint(t, cloud, debugMappingsPath, nil); code != http.StatusServiceUnavailable {
+		t.Errorf("got HTTP %d\nwant %d", code, http.StatusServiceUnavailable)
+	}
+
+	client := newMockClient(t)
+	cloud.LoadBalancerInstance = newTestGatewayLoadBalancer(t, newTestGateway(client, "uuid:gw", "192.0.2.1", "198.51.100.1"))
+	expected := []debugLoadBalancer{{
+		Name:       "kubernetes/default/svc",
+		ExternalIP: "198.51.100.1",
+		NodeIP:     "192.0.2.1",
+		PortMappings: []debugPortMapping{{
+			Name:         "http",
+			Protocol:     "TCP",
+			Port:         8080,
+			ExternalPort: 8080,
+			NodePort:     30080,
+			Gateway:      &debugGatewayEntry{InternalIP: "192.0.2.1", InternalPort: 30080, Enabled: true},
+			InSync:       true,
+		}},
+	}}
+	var mappings []debugLoadBalancer
+	if code := getDebugEndpoint(t, cloud, debugMappingsPath, &mappings); code != http.StatusOK {
+		t.Fatalf("got HTTP %d\nwant %d", code, http.StatusOK)
+	}
+	if !reflect.DeepEqual(mappings, expected) {
+		t.Errorf("got %+v\nwant %+v", mappings, expected)
+	}
+
+	// the gateway lost the port mapping
+	client.added = nil
+	expected[0].PortMappings[0].Gateway = nil
+	expected[0].PortMappings[0].InSync = false
+	mappings = nil
+	getDebugEndpoint(t, cloud, debugMappingsPath, &mappings)
+	if !reflect.DeepEqual(mappings, expected) {
+		t.Errorf("got %+v\nwant %+v", mappings, expected)
+	}
+}
+
+// unreachableGatewayClient is a mockClient whose gateway no longer answers the
+// port mapping queries
+type unreachableGatewayClient struct {
+	*mockClient
+	getCalls int
+}
+
+func (client *unreachableGatewayClient) GetSpecificPortMappingEntry(ctx context.Context, host string, externalPort uint16, proto string) (*portMappingEntry, error) {
+	client.getCalls++
+	return nil, fmt.Errorf("connection refused")
+}
+
+func TestDebugMappingsUnreachableGateway(t *testing.T) {
+	client := &unreachableGatewayClient{mockClient: newMockClient(t)}
+	lb := newTestGatewayLoadBalancer(t, newTestGateway(client, "uuid:gw", "192.0.2.1", "198.51.100.1"))
+	cloud := &Edge{LoadBalancerInstance: lb}
+
+	// the debugging requests are not retried, and don't open the circuit
+	for i := 0; i < circuitBreakerFailureThreshold; i++ {
+		var mappings []debugLoadBalancer
+		getDebugEndpoint(t, cloud, debugMappingsPath, &mappings)
+		if len(mappings) != 1 || mappings[0].PortMappings[0].GatewayError != "connection refused" {
+			t.Fatalf("got %+v\nwant the error of the gateway", mappings)
+		}
+	}
+	if client.getCalls != circuitBreakerFailureThreshold {
+		t.Errorf("got %d calls\nwant %d", client.getCalls, circuitBreakerFailureThreshold)
+	}
+	if err := lb.breaker.check(); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestDebugGateway(t *testing.T) {
+	gw := newTestGateway(newMockClient(t), "uuid:gw", "192.0.2.1", "198.51.100.1")
+	gw.connections[0].device = &goupnp.Device{
+		UDN:          "uuid:gw",
+		DeviceType:   "urn:schemas-upnp-org:device:InternetGatewayDevice:1",
+		FriendlyName: "router",
+		Devices: []goupnp.Device{{
+			UDN:        "uuid:wan",
+			DeviceType: "urn:schemas-upnp-org:device:WANDevice:1",
+			Services: []goupnp.Service{{
+				ServiceType: "urn:schemas-upnp-org:service:WANCommonInterfaceConfig:1",
+				ServiceId:   "urn:upnp-org:serviceId:WANCommonIFC1",
+			}},
+		}},
+	}
+	cloud := &Edge{LoadBalancerInstance: newTestGatewayLoadBalancer(t, gw)}
+
+	var debugGW debugGateway
+	if code := getDebugEndpoint(t, cloud, debugGatewayPath, &debugGW); code != http.StatusOK {
+		t.Fatalf("got HTTP %d\nwant %d", code, http.StatusOK)
+	}
+	if !debugGW.Available || debugGW.LastDiscovery == nil || len(debugGW.Connections) != 1 {
+		t.Fatalf("got %+v\nwant an available gateway with 1 connection", debugGW)
+	}
+	connection := debugGW.Connections[0]
+	if !connection.Default || connection.ExternalIP != "198.51.100.1" || connection.LocalAddress != "192.0.2.1" {
+		t.Errorf("got %+v\nwant the default connection of 198.51.100.1 from 192.0.2.1", connection)
+	}
+	expected := &debugDevice{
+		UDN:          "uuid:gw",
+		DeviceType:   "urn:schemas-upnp-org:device:InternetGatewayDevice:1",
+		FriendlyName: "router",
+		Devices: []debugDevice{{
+			UDN:        "uuid:wan",
+			DeviceType: "urn:schemas-upnp-org:device:WANDevice:1",
+			Services: []debugService{{
+				ServiceType: "urn:schemas-upnp-org:service:WANCommonInterfaceConfig:1",
+				ServiceID:   "urn:upnp-org:serviceId:WANCommonIFC1",
+			}},
+		}},
+	}
+	if !reflect.DeepEqual(connection.Device, expected) {
+		t.Errorf("got %+v\nwant %+v", connection.Device, expected)
+	}
+}
@@ -0,0 +1,256 @@
+/*
+Copyright 2019 Midokura
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package edge
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	k8s "k8s.io/api/core/v1"
+	"k8s.io/klog"
+)
+
+const (
+	// HostnameAnnotation is the public DNS name of the load balancer of a
+	// service, answered by the split-horizon DNS responder
+	HostnameAnnotation string = "midokura.com/hostname"
+	// dnsTTL is the TTL of the answers of the DNS responder, short for the
+	// clients to follow the changes of node or external IP
+	dnsTTL = 30
+	// dnsMaxMessageSize is the maximum size of a DNS message over UDP
+	dnsMaxMessageSize = 512
+)
+
+// nodeServiceDialTimeout is the time given to a node to accept a connection to
+// a service port
+var nodeServiceDialTimeout = time.Second
+
+// dialNodeService connects to a service port of a node
+var dialNodeService = func(ctx context.Context, address string) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: nodeServiceDialTimeout}
+	return dialer.DialContext(ctx, "tcp", address)
+}
+
+// defaultLANCIDRs are the networks of the clients answered with the internal
+// IPs, when none are configured: private, loopback and link-local
+var defaultLANCIDRs = []string{
+	"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "127.0.0.0/8", "169.254.0.0/16",
+	"fc00::/7", "::1/128", "fe80::/10",
+}
+
+// dnsRecord are the addresses of a hostname, by view
+type dnsRecord struct {
+	internal net.IP
+	external net.IP
+}
+
+// dnsResponder answers the hostnames of the load balancers with the internal
+// IP of their node to the LAN clients, which can't reach the external IP when
+// the gateway doesn't support NAT loopback, and with the external IP otherwise
+type dnsResponder struct {
+	lb      *LoadBalancer
+	lanNets []*net.IPNet
+}
+
+// serviceHostname returns the public DNS name of the load balancer of the
+// service, if any
+func serviceHostname(service *k8s.Service) string {
+	hostname, ok := service.Annotations[HostnameAnnotation]
+	if !ok {
+		hostname = service.Annotations[IngressHostnameAnnotation]
+	}
+	return strings.ToLower(strings.TrimSuffix(hostname, "."))
+}
+
+// parseCIDRs parses the networks, or returns the default LAN networks when
+// none are given
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	if len(cidrs) == 0 {
+		cidrs = defaultLANCIDRs
+	}
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+func newDNSResponder(lb *LoadBalancer, lanCIDRs []string) (*dnsResponder, error) {
+	lanNets, err := parseCIDRs(lanCIDRs)
+	if err != nil {
+		return nil, fmt.Errorf("newDNSResponder: %v", err)
+	}
+	return &dnsResponder{lb: lb, lanNets: lanNets}, nil
+}
+
+// nodeServesPorts returns whether the node accepts the connections to the
+// service ports of the port mappings itself, e.g. with hostPort or the
+// servicelb of k3s, and not only to the node ports the gateway forwards to.
+// The UDP ports can't be checked, so they are considered not served.
+func nodeServesPorts(ctx context.Context, nodeIP string, portMappings []portMapping) bool {
+	for _, pm := range portMappings {
+		if pm.servicePort.Protocol != k8s.ProtocolTCP {
+			return false
+		}
+		address := net.JoinHostPort(nodeIP, strconv.Itoa(int(pm.servicePort.Port)))
+		conn, err := dialNodeService(ctx, address)
+		if err != nil {
+			klog.V(3).Infof("nodeServesPorts: %s: %v", address, err)
+			return false
+		}
+		conn.Close()
+	}
+	return len(portMappings) > 0
+}
+
+// publishDNSRecords publishes the addresses of the hostnames of the load
+// balancers for the DNS responder, which reads them without the mutex. The
+// caller holds the mutex.
+func (lb *LoadBalancer) publishDNSRecords() {
+	records := make(map[string]dnsRecord)
+	for name, loadBalancer := range lb.loadBalancers {
+		if loadBalancer.hostname == "" || loadBalancer.status == nil || len(loadBalancer.status.Ingress) == 0 {
+			continue
+		}
+		if current, ok := records[loadBalancer.hostname]; ok {
+			klog.Warningf("publishDNSRecords: %s: hostname %s already answered with %v", name, loadBalancer.hostname, current.external)
+			continue
+		}
+		record := dnsRecord{external: net.ParseIP(loadBalancer.status.Ingress[0].IP)}
+		// the LAN clients can only use the internal IP when the node serves
+		// the service ports: the gateway forwards to the node ports
+		if loadBalancer.nodeServesPorts {
+			record.internal = net.ParseIP(loadBalancer.nodeIP)
+		}
+		records[loadBalancer.hostname] = record
+	}
+	lb.dnsRecords.Store(records)
+}
+
+// getDNSRecords returns the addresses of the hostnames of the load balancers
+// last published
+func (lb *LoadBalancer) getDNSRecords() map[string]dnsRecord {
+	records, _ := lb.dnsRecords.Load().(map[string]dnsRecord)
+	return records
+}
+
+// isLAN returns whether the client is in the LAN, behind the gateway
+func (responder *dnsResponder) isLAN(client net.IP) bool {
+	for _, lanNet := range responder.lanNets {
+		if lanNet.Contains(client) {
+			return true
+		}
+	}
+	return false
+}
+
+// listen answers the queries received on the UDP address until stop is closed
+func (responder *dnsResponder) listen(address string, stop <-chan struct{}) error {
+	conn, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return fmt.Errorf("listen: %v", err)
+	}
+	klog.Infof("listen: answering the hostnames of the load balancers on %s", conn.LocalAddr())
+	go func() {
+		<-stop
+		conn.Close()
+	}()
+	responder.serve(conn)
+	return nil
+}
+
+// serve answers the queries received on the connection until it is closed
+func (responder *dnsResponder) serve(conn net.PacketConn) {
+	buffer := make([]byte, dnsMaxMessageSize)
+	for {
+		n, addr, err := conn.ReadFrom(buffer)
+		if err != nil {
+			if !strings.Contains(err.Error(), "use of closed network connection") {
+				klog.Errorf("serve: %v", err)
+			}
+			return
+		}
+		udpAddr, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		response, err := responder.answer(buffer[:n], udpAddr.IP)
+		if err != nil {
+			klog.V(4).Infof("serve: %s: %v", addr, err)
+			continue
+		}
+		if _, err := conn.WriteTo(response, addr); err != nil {
+			klog.V(4).Infof("serve: %s: %v", addr, err)
+		}
+	}
+}
+
+// answer returns the response to the query of the client
+func (responder *dnsResponder) answer(query []byte, client net.IP) ([]byte, error) {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(query)
+	if err != nil {
+		return nil, err
+	}
+	question, err := parser.Question()
+	if err != nil {
+		return nil, err
+	}
+	response := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:               header.ID,
+			Response:         true,
+			OpCode:           header.OpCode,
+			RecursionDesired: header.RecursionDesired,
+		},
+		Questions: []dnsmessage.Question{question},
+	}
+	hostname := strings.ToLower(strings.TrimSuffix(question.Name.String(), "."))
+	record, ok := responder.lb.getDNSRecords()[hostname]
+	switch {
+	case header.OpCode != 0 || question.Class != dnsmessage.ClassINET || !ok:
+		// only the hostnames of the load balancers are answered
+		response.Header.RCode = dnsmessage.RCodeRefused
+	default:
+		response.Header.Authoritative = true
+		ip := record.external
+		if responder.isLAN(client) && record.internal != nil {
+			ip = record.internal
+		}
+		resource := dnsmessage.ResourceHeader{Name: question.Name, Class: dnsmessage.ClassINET, TTL: dnsTTL}
+		if ipv4 := ip.To4(); ipv4 != nil && question.Type == dnsmessage.TypeA {
+			var a dnsmessage.AResource
+			copy(a.A[:], ipv4)
+			response.Answers = append(response.Answers, dnsmessage.Resource{Header: resource, Body: &a})
+		} else if ipv4 == nil && ip != nil && question.Type == dnsmessage.TypeAAAA {
+			var aaaa dnsmessage.AAAAResource
+			copy(aaaa.AAAA[:], ip.To16())
+			response.Answers = append(response.Answers, dnsmessage.Resource{Header: resource, Body: &aaaa})
+		}
+		// other types: no data
+	}
+	return response.Pack()
+}
@@ -0,0 +1,192 @@
+/*
+Copyright 2019 Midokura
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package edge
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"k8s.io/api/core/v1"
+)
+
+func newTestDNSResponder(t *testing.T) *dnsResponder {
+	lb := NewLoadBalancer()
+	service := newTestService("")
+	service.Annotations[HostnameAnnotation] = "App.Example.com."
+	loadBalancer := newLoadBalancerWithPortMappings(service, "192.168.1.10", "198.51.100.1")
+	loadBalancer.nodeServesPorts = true
+	lb.loadBalancers["kubernetes/default/svc"] = loadBalancer
+	lb.loadBalancers["kubernetes/default/no-hostname"] = newLoadBalancerWithPortMappings(newTestService(""), "192.168.1.11", "198.51.100.1")
+	lb.publishDNSRecords()
+	responder, err := newDNSResponder(lb, nil)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	return responder
+}
+
+func newTestDNSQuery(name string, qtype dnsmessage.Type) []byte {
+	query := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: 42, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName(name), Type: qtype, Class: dnsmessage.ClassINET}},
+	}
+	packed, _ := query.Pack()
+	return packed
+}
+
+// dnsAnswers returns the response code and the answered addresses
+func dnsAnswers(t *testing.T, response []byte) (dnsmessage.RCode, []string) {
+	var message dnsmessage.Message
+	if err := message.Unpack(response); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if message.Header.ID != 42 || !message.Header.Response {
+		t.Errorf("got header %+v\nwant the response to the query 42", message.Header)
+	}
+	addresses := make([]string, 0)
+	for _, answer := range message.Answers {
+		switch body := answer.Body.(type) {
+		case *dnsmessage.AResource:
+			addresses = append(addresses, net.IP(body.A[:]).String())
+		case *dnsmessage.AAAAResource:
+			addresses = append(addresses, net.IP(body.AAAA[:]).String())
+		}
+	}
+	return message.Header.RCode, addresses
+}
+
+func TestDNSAnswer(t *testing.T) {
+	responder := newTestDNSResponder(t)
+	testCases := []struct {
+		name      string
+		qtype     dnsmessage.Type
+		client    string
+		rcode     dnsmessage.RCode
+		addresses []string
+	}{
+		{name: "app.example.com.", qtype: dnsmessage.TypeA, client: "192.168.1.20", addresses: []string{"192.168.1.10"}},
+		{name: "app.example.com.", qtype: dnsmessage.TypeA, client: "10.42.1.5", addresses: []string{"192.168.1.10"}},
+		{name: "APP.example.com.", qtype: dnsmessage.TypeA, client: "203.0.113.1", addresses: []string{"198.51.100.1"}},
+		{name: "app.example.com.", qtype: dnsmessage.TypeAAAA, client: "192.168.1.20", addresses: []string{}},
+		{name: "other.example.com.", qtype: dnsmessage.TypeA, client: "192.168.1.20", rcode: dnsmessage.RCodeRefused, addresses: []string{}},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("%s %v from %s", tc.name, tc.qtype, tc.client), func(t *testing.T) {
+			response, err := responder.answer(newTestDNSQuery(tc.name, tc.qtype), net.ParseIP(tc.client))
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			rcode, addresses := dnsAnswers(t, response)
+			if rcode != tc.rcode || fmt.Sprint(addresses) != fmt.Sprint(tc.addresses) {
+				t.Errorf("got %v %v\nwant %v %v", rcode, addresses, tc.rcode, tc.addresses)
+			}
+		})
+	}
+	if _, err := responder.answer([]byte{0, 42}, net.ParseIP("192.168.1.20")); err == nil {
+		t.Errorf("expected error")
+	}
+}
+
+func TestDNSServe(t *testing.T) {
+	responder := newTestDNSResponder(t)
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	defer conn.Close()
+	go responder.serve(conn)
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := client.Write(newTestDNSQuery("app.example.com.", dnsmessage.TypeA)); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	response := make([]byte, dnsMaxMessageSize)
+	n, err := client.Read(response)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	// the loopback is in the LAN
+	if rcode, addresses := dnsAnswers(t, response[:n]); rcode != dnsmessage.RCodeSuccess || fmt.Sprint(addresses) != "[192.168.1.10]" {
+		t.Errorf("got %v %v\nwant the internal IP", rcode, addresses)
+	}
+}
+
+func TestDNSAnswerNodeServesPorts(t *testing.T) {
+	// the node serves the service port, e.g. with hostPort
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	defer listener.Close()
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	lb := &LoadBalancer{
+		breaker:       newCircuitBreaker(),
+		loadBalancers: make(map[string]loadBalancer),
+	}
+	lb.setGateway(newTestGateway(newMockClient(t), "uuid:gateway", "127.0.0.1", "198.51.100.1"))
+	responder, err := newDNSResponder(lb, nil)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	service := newTestService("")
+	service.Annotations[HostnameAnnotation] = "app.example.com"
+	service.Spec.Ports[0].Port = int32(port)
+	nodes := []*v1.Node{newTestNode("node", "127.0.0.1")}
+	if _, err := lb.EnsureLoadBalancer(context.TODO(), "kubernetes", service, nodes); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	lookup := func() string {
+		response, err := responder.answer(newTestDNSQuery("app.example.com.", dnsmessage.TypeA), net.ParseIP("192.168.1.20"))
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		_, addresses := dnsAnswers(t, response)
+		if len(addresses) != 1 {
+			t.Fatalf("got %v\nwant a single address", addresses)
+		}
+		return addresses[0]
+	}
+	address := lookup()
+	if address != "127.0.0.1" {
+		t.Errorf("got %s\nwant the internal IP 127.0.0.1", address)
+	}
+	conn, err := net.Dial("tcp", net.JoinHostPort(address, fmt.Sprint(port)))
+	if err != nil {
+		t.Fatalf("got %v connecting to the address answered\nwant the service port served", err)
+	}
+	conn.Close()
+
+	// only the node port is served now
+	listener.Close()
+	if err := lb.UpdateLoadBalancer(context.TODO(), "kubernetes", service, nodes); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if address := lookup(); address != "198.51.100.1" {
+		t.Errorf("got %s\nwant the external IP 198.51.100.1", address)
+	}
+}
@@ -0,0 +1,119 @@
+/*
+Copyright 2019 Midokura
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package edge
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"k8s.io/klog"
+)
+
+// maxDryRunOperations is the number of operations kept by the dry run clients
+const maxDryRunOperations = 100
+
+// dryRunClient records the port mapping changes instead of doing them on the
+// gateway, which is still queried. The operations are logged, and the last
+// ones are kept for /debug/edge/gateway.
+type dryRunClient struct {
+	client clientInterface
+	dryRunRecorder
+}
+
+func newDryRunClient(client clientInterface) *dryRunClient {
+	return &dryRunClient{client: client, dryRunRecorder: dryRunRecorder{name: "dryRunClient"}}
+}
+
+// AddPortMapping implements clientInterface
+func (client *dryRunClient) AddPortMapping(ctx context.Context, host string, externalPort uint16, proto string, internalPort uint16, internalIP string, enabled bool, desc string, lease uint32) error {
+	client.record(fmt.Sprintf("add %s %d -> %s:%d (%s, lease %ds)", proto, externalPort, internalIP, internalPort, desc, lease))
+	return nil
+}
+
+// DeletePortMapping implements clientInterface
+func (client *dryRunClient) DeletePortMapping(ctx context.Context, host string, externalPort uint16, proto string) error {
+	client.record(fmt.Sprintf("delete %s %d", proto, externalPort))
+	return nil
+}
+
+// GetExternalIPAddress implements clientInterface
+func (client *dryRunClient) GetExternalIPAddress(ctx context.Context) (string, error) {
+	return client.client.GetExternalIPAddress(ctx)
+}
+
+// GetStatusInfo implements clientInterface
+func (client *dryRunClient) GetStatusInfo(ctx context.Context) (string, string, uint32, error) {
+	return client.client.GetStatusInfo(ctx)
+}
+
+// GetSpecificPortMappingEntry implements clientInterface
+func (client *dryRunClient) GetSpecificPortMappingEntry(ctx context.Context, host string, externalPort uint16, proto string) (*portMappingEntry, error) {
+	return client.client.GetSpecificPortMappingEntry(ctx, host, externalPort, proto)
+}
+
+// dryRunRouteBackend logs the route changes instead of doing them on the
+// routing table, which is still listed
+type dryRunRouteBackend struct {
+	backend routeBackend
+	dryRunRecorder
+}
+
+func newDryRunRouteBackend(backend routeBackend) *dryRunRouteBackend {
+	return &dryRunRouteBackend{backend: backend, dryRunRecorder: dryRunRecorder{name: "dryRunRouteBackend"}}
+}
+
+// ListRoutes implements routeBackend
+func (backend *dryRunRouteBackend) ListRoutes(ctx context.Context) ([]backendRoute, error) {
+	return backend.backend.ListRoutes(ctx)
+}
+
+// ReplaceRoute implements routeBackend
+func (backend *dryRunRouteBackend) ReplaceRoute(ctx context.Context, route backendRoute) error {
+	backend.record(fmt.Sprintf("replace the route %s (%s)", route, route.Description))
+	return nil
+}
+
+// DeleteRoute implements routeBackend
+func (backend *dryRunRouteBackend) DeleteRoute(ctx context.Context, route backendRoute) error {
+	backend.record(fmt.Sprintf("delete the route to %s", route.Destination))
+	return nil
+}
+
+// dryRunRecorder logs the operations of a dry run, keeping the last ones
+type dryRunRecorder struct {
+	name       string
+	mutex      sync.Mutex
+	operations []string
+}
+
+func (recorder *dryRunRecorder) record(operation string) {
+	klog.Infof("%s: would %s", recorder.name, operation)
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+	recorder.operations = append(recorder.operations, operation)
+	if len(recorder.operations) > maxDryRunOperations {
+		recorder.operations = recorder.operations[len(recorder.operations)-maxDryRunOperations:]
+	}
+}
+
+// getOperations returns the last operations recorded, oldest first
+func (recorder *dryRunRecorder) getOperations() []string {
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+	return append([]string(nil), recorder.operations...)
+}
@@ -0,0 +1,98 @@
+/*
+Copyright 2019 Midokura
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package edge
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"k8s.io/api/core/v1"
+)
+
+func TestDryRun(t *testing.T) {
+	registerMetrics()
+	added := map[string]string{"operation": "add", "result": "success", "upnp_error_code": ""}
+	recorded := map[string]string{"operation": "add", "result": "dry_run", "upnp_error_code": ""}
+	addedBefore := getMetricValue(t, "cloudprovider_edge_port_mapping_operations_total", added)
+	recordedBefore := getMetricValue(t, "cloudprovider_edge_port_mapping_operations_total", recorded)
+	client := newMockClient(t)
+	lb := &LoadBalancer{
+		breaker:       newCircuitBreaker(),
+		dryRun:        true,
+		loadBalancers: make(map[string]loadBalancer),
+	}
+	lb.setGateway(newTestGateway(client, "uuid:gw", "192.0.2.1", "198.51.100.1"))
+	nodes := []*v1.Node{newTestNode("node", "192.0.2.1")}
+	service := newTestService("")
+
+	status, err := lb.EnsureLoadBalancer(context.TODO(), "kubernetes", service, nodes)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if status.Ingress[0].IP != "198.51.100.1" {
+		t.Errorf("got ingress IP %s\nwant 198.51.100.1", status.Ingress[0].IP)
+	}
+	err = lb.EnsureLoadBalancerDeleted(context.TODO(), "kubernetes", service)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	if client.addCalls != 0 || client.deleteCalls != 0 {
+		t.Errorf("got %d additions and %d deletions on the gateway\nwant none", client.addCalls, client.deleteCalls)
+	}
+	expected := []string{
+		"add TCP 8080 -> 192.0.2.1:30080 (kubernetes/default/svc/http, lease 0s)",
+		"delete TCP 8080",
+	}
+	operations := lb.client.(*dryRunClient).getOperations()
+	if !reflect.DeepEqual(operations, expected) {
+		t.Errorf("got %v\nwant %v", operations, expected)
+	}
+	if value := getMetricValue(t, "cloudprovider_edge_port_mapping_operations_total", added); value != addedBefore {
+		t.Errorf("got %v added port mappings\nwant %v", value, addedBefore)
+	}
+	if value := getMetricValue(t, "cloudprovider_edge_port_mapping_operations_total", recorded); value != recordedBefore+1 {
+		t.Errorf("got %v port mappings added in dry run\nwant %v", value, recordedBefore+1)
+	}
+}
+
+func TestDryRunRouteBackend(t *testing.T) {
+	routes := newRecordingRouteBackend(
+		newTestRoute("10.42.1.0/24", "192.0.2.1", "node1"),
+		newTestRoute("10.42.3.0/24", "192.0.2.3", "gone"),
+	)
+	backend := newDryRunRouteBackend(routes)
+	desired := []backendRoute{
+		newTestRoute("10.42.1.0/24", "192.0.2.1", "node1"),
+		newTestRoute("10.42.2.0/24", "192.0.2.2", "node2"),
+	}
+	if err := syncRoutes(context.TODO(), backend, desired); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if len(routes.changes) != 0 {
+		t.Errorf("got %v on the routing table\nwant no changes", routes.changes)
+	}
+	expected := []string{
+		"delete the route to 10.42.3.0/24",
+		"replace the route 10.42.2.0/24 via 192.0.2.2 (node2)",
+	}
+	operations := backend.getOperations()
+	if !reflect.DeepEqual(operations, expected) {
+		t.Errorf("got %v\nwant %v", operations, expected)
+	}
+}
@@ -0,0 +1,84 @@
+/*
+Copyright 2019 Midokura
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package edge
+
+// errorClass is how the reconciler handles an error of a port mapping operation
+type errorClass int
+
+const (
+	// errorRetry errors are transient (network errors, overloaded gateways):
+	// the same operation is retried by the resilientClient, with backoff
+	errorRetry errorClass = iota
+	// errorAdaptSamePort errors require the external and internal ports to be
+	// the same: the operation is retried using the node port as external port
+	errorAdaptSamePort
+	// errorAdaptPermanentLease errors require permanent leases: the operation is
+	// retried with an infinite lease duration
+	errorAdaptPermanentLease
+	// errorIgnore errors mean the gateway is already in the desired state: the
+	// operation is considered successful
+	errorIgnore
+	// errorFail errors are permanent: retrying can't succeed until the service
+	// or the gateway configuration changes
+	errorFail
+)
+
+func (class errorClass) String() string {
+	switch class {
+	case errorRetry:
+		return "retry"
+	case errorAdaptSamePort:
+		return "adapt (same port)"
+	case errorAdaptPermanentLease:
+		return "adapt (permanent lease)"
+	case errorIgnore:
+		return "ignore"
+	default:
+		return "fail"
+	}
+}
+
+// maxMappingAttempts is the maximum number of attempts of a port mapping
+// operation, including the retries after adaptations
+const maxMappingAttempts = 3
+
+// classifyMappingError returns how to handle an error of a port mapping
+// operation. Errors not coming from the gateway (timeouts, connection errors)
+// are considered transient.
+func classifyMappingError(operation mappingOperation, err error) errorClass {
+	upnpErr, ok := err.(*upnpError)
+	if !ok {
+		return errorRetry
+	}
+	switch upnpErr.Code {
+	case upnpActionFailed:
+		return errorRetry
+	case upnpSamePortValuesRequired:
+		if operation == mappingAdd {
+			return errorAdaptSamePort
+		}
+	case upnpOnlyPermanentLeasesSupported:
+		if operation == mappingAdd {
+			return errorAdaptPermanentLease
+		}
+	case upnpNoSuchEntryInArray:
+		if operation == mappingDelete {
+			return errorIgnore
+		}
+	}
+	return errorFail
+}
@@ -0,0 +1,65 @@
+/*
+Copyright 2019 Midokura
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package edge
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestClassifyMappingError(t *testing.T) {
+	tests := []struct {
+		operation mappingOperation
+		err       error
+		expected  errorClass
+	}{
+		{mappingAdd, fmt.Errorf("AddPortMapping: i/o timeout"), errorRetry},
+		{mappingDelete, fmt.Errorf("DeletePortMapping: connection refused"), errorRetry},
+		{mappingAdd, newUPnPError(upnpActionFailed), errorRetry},
+		{mappingAdd, newUPnPError(upnpConflictInMappingEntry), errorFail},
+		{mappingAdd, newUPnPError(upnpSamePortValuesRequired), errorAdaptSamePort},
+		{mappingAdd, newUPnPError(upnpOnlyPermanentLeasesSupported), errorAdaptPermanentLease},
+		{mappingAdd, newUPnPError(upnpActionNotAuthorized), errorFail},
+		{mappingAdd, newUPnPError(upnpNoPortMapsAvailable), errorFail},
+		{mappingDelete, newUPnPError(upnpNoSuchEntryInArray), errorIgnore},
+		{mappingAdd, newUPnPError(upnpNoSuchEntryInArray), errorFail},
+		{mappingDelete, newUPnPError(upnpActionNotAuthorized), errorFail},
+		{mappingDelete, &upnpError{Code: 899, Description: "Vendor specific"}, errorFail},
+	}
+	for _, test := range tests {
+		actual := classifyMappingError(test.operation, test.err)
+		if actual != test.expected {
+			t.Errorf("%s: %v: got %s\nwant %s", test.operation, test.err, actual, test.expected)
+		}
+	}
+}
+
+func TestUPnPErrorString(t *testing.T) {
+	tests := []struct {
+		err      *upnpError
+		expected string
+	}{
+		{newUPnPError(upnpConflictInMappingEntry), "UPnP error 718: ConflictInMappingEntry"},
+		{&upnpError{Code: 718, Description: "Conflict"}, "UPnP error 718 (ConflictInMappingEntry): Conflict"},
+		{&upnpError{Code: 899, Description: "Vendor specific"}, "UPnP error 899: Vendor specific"},
+	}
+	for _, test := range tests {
+		if actual := test.err.Error(); actual != test.expected {
+			t.Errorf("got %s\nwant %s", actual, test.expected)
+		}
+	}
+}
@@ -0,0 +1,377 @@
+/*
+Copyright 2019 Midokura
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package edge
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+)
+
+const (
+	// gatewayCheckPeriod is the period of the checks of the gateway
+	gatewayCheckPeriod = 1 * time.Minute
+	// gatewayDiscoveryRetryPeriod is the period of the discoveries while no
+	// gateway is available
+	gatewayDiscoveryRetryPeriod = 10 * time.Second
+	// leaseRenewalMargin is the time before the expiration of the lease of a
+	// port mapping when it is due to be renewed
+	leaseRenewalMargin = 2 * gatewayCheckPeriod
+	// gatewayRediscoveryPeriod is the maximum time between discoveries of the
+	// gateway, to detect a replaced router even if the calls don't fail
+	gatewayRediscoveryPeriod = 10 * time.Minute
+	// credentialsUsernameKey and credentialsPasswordKey are the keys of the
+	// credentials of the gateway in their Secret, as in a
+	// kubernetes.io/basic-auth Secret
+	credentialsUsernameKey = "username"
+	credentialsPasswordKey = "password"
+	// gatewayHealthCheckTimeout is the time given to the gateway to answer
+	// the health checks
+	gatewayHealthCheckTimeout = 5 * time.Second
+	// upnpConnected is the status of a connected WAN connection
+	upnpConnected = "Connected"
+)
+
+// errGatewayNotAvailable is returned by the API calls until a gateway is
+// discovered. The service controller retries them with backoff.
+var errGatewayNotAvailable = fmt.Errorf("gateway not available yet: discovery in progress")
+
+// gateway store the data of a discovered UPnP IGD
+type gateway struct {
+	// WAN connections of the gateway, the first one is the default
+	connections []wanConnection
+	// External IP of the public side of the default WAN connection
+	externalIP net.IP
+}
+
+// discoverGateway discovers the gateway via SSDP, and the external IP
+func discoverGateway() (*gateway, error) {
+	connections, err := discoverWANConnections()
+	if err != nil {
+		return nil, fmt.Errorf("client error: %v", err)
+	}
+	if len(connections) > 1 {
+		klog.Infof("discoverGateway: %d WAN connections available: using #0 by default", len(connections))
+	}
+	externalIP, err := getExternalIP()
+	if err != nil {
+		return nil, fmt.Errorf("error: external IP: %v", err)
+	}
+	return &gateway{connections: connections, externalIP: externalIP}, nil
+}
+
+// setGateway makes the load balancer use the WAN connections of the gateway
+// given, through clients sharing the circuit breaker of the load balancer.
+// The caller must hold the mutex, unless the load balancer is not in use yet.
+func (lb *LoadBalancer) setGateway(gw *gateway) {
+	connections := make([]wanConnection, len(gw.connections))
+	for i, connection := range gw.connections {
+		connection.client = newResilientClient(connection.client, lb.breaker)
+		if lb.dryRun {
+			connection.client = newDryRunClient(connection.client)
+		}
+		connections[i] = connection
+	}
+	lb.wanConnections = connections
+	lb.client = connections[0].client
+	lb.localAddress = connections[0].localAddress
+	lb.externalIP = gw.externalIP
+	lb.lastDiscovery = time.Now()
+	lb.breaker.reset()
+}
+
+// runGatewayManager discovers the gateway, then checks it periodically until
+// stop is closed, discovering it again when it disappears or changes. The
+// state is loaded in the background, see runStateLoader.
+func (lb *LoadBalancer) runGatewayManager(stop <-chan struct{}) {
+	go lb.runStateLoader(stop)
+	for {
+		lb.checkGateway()
+		period := gatewayCheckPeriod
+		if lb.hasGateway() {
+			lb.renewLeases(time.Now())
+			lb.cleanStalePortMappings(context.Background())
+		} else {
+			period = gatewayDiscoveryRetryPeriod
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(wait.Jitter(period, 0.1)):
+		}
+	}
+}
+
+// hasGateway returns whether a gateway was discovered
+func (lb *LoadBalancer) hasGateway() bool {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+	return lb.client != nil
+}
+
+// checkGatewayHealth verifies that the WAN connection of the gateway answers
+// GetStatusInfo and GetExternalIPAddress within the timeout, and is connected
+func (lb *LoadBalancer) checkGatewayHealth(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, gatewayHealthCheckTimeout)
+	defer cancel()
+	// the mutex may be held during a long update of a load balancer: don't
+	// wait for it beyond the timeout
+	clients := make(chan clientInterface, 1)
+	go func() {
+		lb.mutex.Lock()
+		defer lb.mutex.Unlock()
+		clients <- lb.client
+	}()
+	var client clientInterface
+	select {
+	case client = <-clients:
+	case <-ctx.Done():
+		return fmt.Errorf("timeout waiting for a load balancer update")
+	}
+	if client == nil {
+		return errGatewayNotAvailable
+	}
+
+	status, lastConnectionError, _, err := client.GetStatusInfo(ctx)
+	if err != nil {
+		return fmt.Errorf("gateway status: %v", err)
+	}
+	if status != upnpConnected {
+		return fmt.Errorf("gateway WAN connection %s: %s", status, lastConnectionError)
+	}
+	if _, err := client.GetExternalIPAddress(ctx); err != nil {
+		return fmt.Errorf("gateway external IP: %v", err)
+	}
+	return nil
+}
+
+// checkGateway discovers the gateway again if there is a reason to think it
+// changed, and if it did, swaps the clients and replays all the known port
+// mappings onto the new gateway
+func (lb *LoadBalancer) checkGateway() {
+	reason := lb.rediscoveryReason()
+	if reason == "" {
+		return
+	}
+	klog.Infof("checkGateway: discovering the gateway: %s", reason)
+	gw, err := lb.discover()
+	if err != nil {
+		klog.Errorf("checkGateway: %v", err)
+		return
+	}
+
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+	if !lb.gatewayChanged(gw) {
+		klog.V(3).Infof("checkGateway: the gateway did not change")
+		lb.lastDiscovery = time.Now()
+		return
+	}
+	oldLocalAddress, oldExternalIP, oldDefaultIP := lb.localAddress, lb.externalIP, lb.defaultWANConnection().externalIP
+	lb.setGateway(gw)
+	klog.Infof("checkGateway: new gateway: addresses: {local: %s, external: %s}", lb.localAddress, lb.externalIP)
+	if oldExternalIP != nil && !oldExternalIP.Equal(lb.externalIP) {
+		externalIPChanges.Inc()
+	}
+	lb.replayPortMappings(context.Background(), oldLocalAddress, oldDefaultIP)
+}
+
+// rediscoveryReason returns why the gateway may have changed, or "" if there
+// is no reason
+func (lb *LoadBalancer) rediscoveryReason() string {
+	if err := lb.breaker.check(); err != nil {
+		return fmt.Sprintf("repeated failures: %v", err)
+	}
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+	if lb.client == nil {
+		return "no gateway available yet"
+	}
+	if lb.wanConnections[0].location != nil {
+		localAddress := getLocalAddressToHost(lb.wanConnections[0].location.Hostname())
+		if !localAddress.Equal(lb.localAddress) {
+			return fmt.Sprintf("local address changed from %s to %s", lb.localAddress, localAddress)
+		}
+	}
+	if time.Since(lb.lastDiscovery) >= gatewayRediscoveryPeriod {
+		return "periodic discovery"
+	}
+	return ""
+}
+
+// gatewayChanged returns whether the gateway given is not the one in use
+func (lb *LoadBalancer) gatewayChanged(gw *gateway) bool {
+	if !gw.externalIP.Equal(lb.externalIP) || len(gw.connections) != len(lb.wanConnections) {
+		return true
+	}
+	for i, connection := range gw.connections {
+		current := lb.wanConnections[i]
+		if connection.deviceID != current.deviceID ||
+			!sameLocation(connection.location, current.location) ||
+			!connection.localAddress.Equal(current.localAddress) ||
+			!connection.externalIP.Equal(current.externalIP) {
+			return true
+		}
+	}
+	return false
+}
+
+func sameLocation(a, b *url.URL) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.String() == b.String()
+}
+
+// replayPortMappings adds all the known port mappings to the gateway in use.
+// Mappings to the old local address, or on the old external IP of the default
+// WAN connection, are moved to the new ones.
+func (lb *LoadBalancer) replayPortMappings(ctx context.Context, oldLocalAddress, oldExternalIP net.IP) {
+	externalIP := lb.defaultWANConnection().externalIP
+	for name, loadBalancer := range lb.loadBalancers {
+		if loadBalancer.nodeIP != "" && loadBalancer.nodeIP == oldLocalAddress.String() {
+			loadBalancer.nodeIP = lb.localAddress.String()
+			loadBalancer.nodeServesPorts = false
+		}
+		for i := range loadBalancer.portMappings {
+			pm := &loadBalancer.portMappings[i]
+			if pm.nodeIP != "" && pm.nodeIP == oldLocalAddress.String() {
+				pm.nodeIP = lb.localAddress.String()
+			}
+			if pm.externalIP == oldExternalIP.String() {
+				pm.externalIP = externalIP.String()
+			}
+			if err := lb.addPortMapping(ctx, name, pm); err != nil {
+				klog.Errorf("replayPortMappings: %s: %s: %v", name, pm, err)
+				continue
+			}
+			driftRepairs.WithLabelValues(driftGatewayChanged).Inc()
+			klog.V(3).Infof("replayPortMappings: %s: %s", name, pm)
+		}
+		loadBalancer.status = loadBalancer.status.DeepCopy()
+		for i := range loadBalancer.status.Ingress {
+			if loadBalancer.status.Ingress[i].IP == oldExternalIP.String() {
+				loadBalancer.status.Ingress[i].IP = externalIP.String()
+			}
+		}
+		lb.loadBalancers[name] = loadBalancer
+	}
+	lb.publishDNSRecords()
+}
+
+// renewLeases adds again the port mappings whose lease expires soon. The
+// mappings whose lease already expired were lost by the gateway.
+func (lb *LoadBalancer) renewLeases(now time.Time) {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+	for name, loadBalancer := range lb.loadBalancers {
+		for i := range loadBalancer.portMappings {
+			pm := &loadBalancer.portMappings[i]
+			if pm.leaseExpiry.IsZero() {
+				continue
+			}
+			due := pm.leaseExpiry.Add(-leaseRenewalMargin)
+			if now.Before(due) {
+				continue
+			}
+			leaseRenewalLag.Observe(now.Sub(due).Seconds())
+			expired := !now.Before(pm.leaseExpiry)
+			if err := lb.addPortMapping(context.Background(), name, pm); err != nil {
+				klog.Errorf("renewLeases: %s: %s: %v", name, pm, err)
+				continue
+			}
+			if expired {
+				driftRepairs.WithLabelValues(driftLeaseExpired).Inc()
+			}
+			klog.V(3).Infof("renewLeases: %s: %s: lease renewed until %s", name, pm, pm.leaseExpiry)
+		}
+	}
+}
+
+// cleanStalePortMappings deletes the port mappings of the cluster owned by the
+// gateway that no load balancer has, e.g. of the services deleted while the
+// cloud controller manager was down. The cluster is the one of the API calls,
+// so nothing is cleaned before the first one, and the port mappings of the
+// other clusters sharing the gateway are kept. Only the gateways listing the
+// port mappings they own, see portMappingLister, are cleaned.
+func (lb *LoadBalancer) cleanStalePortMappings(ctx context.Context) {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+	if lb.client == nil || !lb.stateLoaded || lb.clusterName == "" {
+		return
+	}
+	lister, ok := unwrapClient(lb.client).(portMappingLister)
+	if !ok {
+		return
+	}
+	listed, err := lister.ListPortMappings(ctx, lb.clusterName)
+	if err != nil {
+		klog.Errorf("cleanStalePortMappings: %v", err)
+		return
+	}
+	known := make(map[string]bool)
+	externalIP := lb.defaultWANConnection().externalIP.String()
+	for name, loadBalancer := range lb.loadBalancers {
+		for _, pm := range loadBalancer.portMappings {
+			if pm.externalIP == "" || pm.externalIP == externalIP {
+				desc := portMappingDescription(name, pm.servicePort.Name)
+				known[fmt.Sprintf("%s %s/%d", desc, pm.servicePort.Protocol, pm.externalPort())] = true
+			}
+		}
+	}
+	for _, mapping := range listed {
+		if known[fmt.Sprintf("%s %s/%d", mapping.desc, mapping.proto, mapping.externalPort)] {
+			continue
+		}
+		klog.Infof("cleanStalePortMappings: deleting %s %d to %s:%d (%s)", mapping.proto, mapping.externalPort, mapping.internalIP, mapping.internalPort, mapping.desc)
+		err := lb.client.DeletePortMapping(ctx, "", mapping.externalPort, mapping.proto)
+		if err != nil && classifyMappingError(mappingDelete, err) != errorIgnore {
+			klog.Errorf("cleanStalePortMappings: %s %d: %v", mapping.proto, mapping.externalPort, err)
+			continue
+		}
+		driftRepairs.WithLabelValues(driftStaleMapping).Inc()
+	}
+}
+
+// secretCredentials returns the username and password in the Secret,
+// namespace/name
+func secretCredentials(kubeClient kubernetes.Interface, secretName string) (string, string, error) {
+	parts := strings.SplitN(secretName, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("invalid credentials-secret '%s': expected namespace/name", secretName)
+	}
+	if kubeClient == nil {
+		return "", "", fmt.Errorf("no Kubernetes client to get the Secret %s", secretName)
+	}
+	secret, err := kubeClient.CoreV1().Secrets(parts[0]).Get(parts[1], metav1.GetOptions{})
+	if err != nil {
+		return "", "", err
+	}
+	username, ok := secret.Data[credentialsUsernameKey]
+	if !ok {
+		return "", "", fmt.Errorf("Secret %s: no %s", secretName, credentialsUsernameKey)
+	}
+	return string(username), string(secret.Data[credentialsPasswordKey]), nil
+}
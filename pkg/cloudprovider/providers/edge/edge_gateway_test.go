@@ -0,0 +1,210 @@
+/*
+Copyright 2019 Midokura
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package edge
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"k8s.io/api/core/v1"
+)
+
+func newTestGateway(client clientInterface, deviceID, localAddress, externalIP string) *gateway {
+	return &gateway{
+		connections: []wanConnection{{
+			client:       client,
+			localAddress: net.ParseIP(localAddress),
+			externalIP:   net.ParseIP(externalIP),
+			deviceID:     deviceID,
+		}},
+		externalIP: net.ParseIP(externalIP),
+	}
+}
+
+// newTestGatewayLoadBalancer returns a load balancer using the gateway given,
+// with the service of newTestService ensured on it
+func newTestGatewayLoadBalancer(t *testing.T, gw *gateway) *LoadBalancer {
+	lb := &LoadBalancer{
+		breaker:       newCircuitBreaker(),
+		loadBalancers: make(map[string]loadBalancer),
+	}
+	lb.setGateway(gw)
+	nodes := []*v1.Node{newTestNode("node", gw.connections[0].localAddress.String())}
+	_, err := lb.EnsureLoadBalancer(context.TODO(), "kubernetes", newTestService(""), nodes)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	return lb
+}
+
+func TestCheckGatewayNoReason(t *testing.T) {
+	lb := newTestGatewayLoadBalancer(t, newTestGateway(newMockClient(t), "uuid:old", "192.0.2.1", "198.51.100.1"))
+	lb.discover = func() (*gateway, error) {
+		t.Errorf("unexpected discovery")
+		return nil, fmt.Errorf("unexpected discovery")
+	}
+	lb.checkGateway()
+}
+
+func TestCheckGatewayReplacedRouter(t *testing.T) {
+	lb := newTestGatewayLoadBalancer(t, newTestGateway(newMockClient(t), "uuid:old", "192.0.2.1", "198.51.100.1"))
+	newClient := newMockClient(t)
+	lb.discover = func() (*gateway, error) {
+		return newTestGateway(newClient, "uuid:new", "192.0.2.1", "198.51.100.1"), nil
+	}
+	lb.lastDiscovery = time.Now().Add(-gatewayRediscoveryPeriod)
+	lb.checkGateway()
+
+	expected := []mapping{{proto: "TCP", externalPort: 8080, internalIP: "192.0.2.1", internalPort: 30080}}
+	if !reflect.DeepEqual(newClient.added, expected) {
+		t.Errorf("got %v\nwant %v", newClient.added, expected)
+	}
+	if lb.client.(*resilientClient).client != newClient {
+		t.Errorf("the client was not swapped")
+	}
+}
+
+func TestCheckGatewayUnchanged(t *testing.T) {
+	oldClient := newMockClient(t)
+	lb := newTestGatewayLoadBalancer(t, newTestGateway(oldClient, "uuid:old", "192.0.2.1", "198.51.100.1"))
+	newClient := newMockClient(t)
+	lb.discover = func() (*gateway, error) {
+		return newTestGateway(newClient, "uuid:old", "192.0.2.1", "198.51.100.1"), nil
+	}
+	lb.lastDiscovery = time.Now().Add(-gatewayRediscoveryPeriod)
+	lb.checkGateway()
+
+	if newClient.added != nil {
+		t.Errorf("got %v\nwant no mappings replayed", newClient.added)
+	}
+	if lb.client.(*resilientClient).client != oldClient {
+		t.Errorf("unexpected swap of the client")
+	}
+	if time.Since(lb.lastDiscovery) >= gatewayRediscoveryPeriod {
+		t.Errorf("the time of the last discovery was not updated")
+	}
+}
+
+func TestCheckGatewayAddressesChanged(t *testing.T) {
+	oldClient := newMockClient(t)
+	lb := newTestGatewayLoadBalancer(t, newTestGateway(oldClient, "uuid:old", "192.0.2.1", "198.51.100.1"))
+	newClient := newMockClient(t)
+	lb.discover = func() (*gateway, error) {
+		return newTestGateway(newClient, "uuid:old", "192.0.2.2", "203.0.113.1"), nil
+	}
+	// the gateway stops answering
+	for i := 0; i < circuitBreakerFailureThreshold; i++ {
+		lb.breaker.record(fmt.Errorf("timeout"))
+	}
+	lb.checkGateway()
+
+	expected := []mapping{{proto: "TCP", externalPort: 8080, internalIP: "192.0.2.2", internalPort: 30080}}
+	if !reflect.DeepEqual(newClient.added, expected) {
+		t.Errorf("got %v\nwant %v", newClient.added, expected)
+	}
+	if err := lb.breaker.check(); err != nil {
+		t.Errorf("unexpected open circuit: %v", err)
+	}
+	status, _, _ := lb.GetLoadBalancer(context.TODO(), "kubernetes", newTestService(""))
+	if status.Ingress[0].IP != "203.0.113.1" {
+		t.Errorf("got ingress IP %s\nwant 203.0.113.1", status.Ingress[0].IP)
+	}
+}
+
+func TestLoadBalancerGatewayNotAvailableYet(t *testing.T) {
+	lb := NewLoadBalancer()
+	lb.discover = func() (*gateway, error) {
+		return nil, fmt.Errorf("no clients available")
+	}
+	nodes := []*v1.Node{newTestNode("node", "192.0.2.1")}
+	_, err := lb.EnsureLoadBalancer(context.TODO(), "kubernetes", newTestService(""), nodes)
+	if err != errGatewayNotAvailable {
+		t.Errorf("got error %v\nwant %v", err, errGatewayNotAvailable)
+	}
+	_, _, err = lb.GetLoadBalancer(context.TODO(), "kubernetes", newTestService(""))
+	if err != errGatewayNotAvailable {
+		t.Errorf("got error %v\nwant %v", err, errGatewayNotAvailable)
+	}
+
+	// discovery keeps failing
+	lb.checkGateway()
+	if lb.hasGateway() {
+		t.Fatalf("unexpected gateway")
+	}
+
+	// a gateway appears
+	client := newMockClient(t)
+	lb.discover = func() (*gateway, error) {
+		return newTestGateway(client, "uuid:new", "192.0.2.1", "198.51.100.1"), nil
+	}
+	lb.checkGateway()
+	status, err := lb.EnsureLoadBalancer(context.TODO(), "kubernetes", newTestService(""), nodes)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if status.Ingress[0].IP != "198.51.100.1" {
+		t.Errorf("got ingress IP %s\nwant 198.51.100.1", status.Ingress[0].IP)
+	}
+	if len(client.added) != 1 {
+		t.Errorf("got %v\nwant 1 mapping added", client.added)
+	}
+}
+
+func TestCheckGatewayHealth(t *testing.T) {
+	testCases := []struct {
+		name     string
+		client   clientInterface
+		expected string
+	}{
+		{
+			name:   "healthy",
+			client: newMockClient(t),
+		},
+		{
+			name:     "no gateway",
+			expected: errGatewayNotAvailable.Error(),
+		},
+		{
+			name:     "disconnected",
+			client:   &mockClient{t: t, connectionStatus: "Disconnected"},
+			expected: "gateway WAN connection Disconnected: ERROR_NO_CARRIER",
+		},
+		{
+			name:     "timeout",
+			client:   &blockingClient{},
+			expected: "gateway external IP: context deadline exceeded",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			lb := &LoadBalancer{client: tc.client}
+			ctx, cancel := context.WithTimeout(context.TODO(), 10*time.Millisecond)
+			defer cancel()
+			err := lb.checkGatewayHealth(ctx)
+			if tc.expected == "" && err != nil {
+				t.Errorf("unexpected error %v", err)
+			}
+			if tc.expected != "" && (err == nil || err.Error() != tc.expected) {
+				t.Errorf("got error %v\nwant %s", err, tc.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,257 @@
+/*
+Copyright 2019 Midokura
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package edge
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/midokura/cloud-provider-edge/pkg/cloudprovider/providers/edge/igdtest"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// These tests run the load balancer against a simulated gateway, through
+// SSDP, the description of the device and the SOAP actions.
+
+const testIGDExternalIP = "198.51.100.1"
+
+// newTestIGD starts a simulated gateway, and points the SSDP searches and the
+// external IP lookups of the load balancer at it
+func newTestIGD(t *testing.T, config igdtest.Config) (*igdtest.Server, func()) {
+	config.ExternalIP = testIGDExternalIP
+	server, err := igdtest.NewServer(config)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	oldSSDPAddress, oldSSDPSearchWait, oldGetExternalIP, oldBackoff := ssdpAddress, ssdpSearchWait, getExternalIP, gatewayCallBackoff
+	ssdpAddress = server.SSDPAddress
+	ssdpSearchWait = 200 * time.Millisecond
+	getExternalIP = func() (net.IP, error) {
+		return net.ParseIP(testIGDExternalIP), nil
+	}
+	gatewayCallBackoff = wait.Backoff{Duration: time.Millisecond, Factor: 1, Steps: 3}
+	return server, func() {
+		ssdpAddress, ssdpSearchWait, getExternalIP, gatewayCallBackoff = oldSSDPAddress, oldSSDPSearchWait, oldGetExternalIP, oldBackoff
+		server.Close()
+	}
+}
+
+// newTestIGDLoadBalancer returns a new load balancer, after the discovery of
+// the gateway
+func newTestIGDLoadBalancer(t *testing.T, leaseDuration portMappingLeaseDuration) *LoadBalancer {
+	lb := NewLoadBalancer()
+	lb.leaseDuration = leaseDuration
+	lb.checkGateway()
+	if !lb.hasGateway() {
+		t.Fatalf("got no gateway\nwant the simulated one discovered")
+	}
+	return lb
+}
+
+func TestDiscoverSimulatedGateway(t *testing.T) {
+	_, close := newTestIGD(t, igdtest.Config{
+		ServiceTypes: []string{igdtest.WANIPConnection1, igdtest.WANIPConnection2},
+	})
+	defer close()
+
+	connections, err := discoverWANConnections()
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	// both services report the same external IP: the preferred one is kept
+	if len(connections) != 1 {
+		t.Fatalf("got %d WAN connections\nwant 1", len(connections))
+	}
+	connection := connections[0]
+	if connection.service.ServiceType != igdtest.WANIPConnection2 ||
+		connection.deviceID != "uuid:igdtest" ||
+		connection.externalIP.String() != testIGDExternalIP ||
+		connection.localAddress.String() != "127.0.0.1" {
+		t.Errorf("got %s connection of %s: %s from %s\nwant %s connection of uuid:igdtest: %s from 127.0.0.1",
+			connection.service.ServiceType, connection.deviceID, connection.externalIP, connection.localAddress,
+			igdtest.WANIPConnection2, testIGDExternalIP)
+	}
+}
+
+func TestSimulatedGatewayLoadBalancer(t *testing.T) {
+	testCases := []struct {
+		name          string
+		quirks        igdtest.Quirks
+		faults        []igdtest.Fault
+		leaseDuration portMappingLeaseDuration
+		externalPort  uint16
+		lease         uint32
+		adds          int
+	}{
+		{name: "permanent lease", externalPort: 8080, adds: 1},
+		{name: "lease", leaseDuration: 3600, externalPort: 8080, lease: 3600, adds: 1},
+		{
+			name:          "permanent leases only",
+			quirks:        igdtest.Quirks{PermanentLeasesOnly: true},
+			leaseDuration: 3600,
+			externalPort:  8080,
+			adds:          2,
+		},
+		{
+			name:         "same port values only",
+			quirks:       igdtest.Quirks{SamePortValuesOnly: true},
+			externalPort: 30080,
+			adds:         2,
+		},
+		{
+			name:         "action failed",
+			faults:       []igdtest.Fault{{Code: igdtest.ErrorActionFailed}},
+			externalPort: 8080,
+			adds:         2,
+		},
+		{
+			name:         "HTTP error",
+			faults:       []igdtest.Fault{{HTTPStatus: 503}, {HTTPStatus: 503}},
+			externalPort: 8080,
+			adds:         3,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			server, close := newTestIGD(t, igdtest.Config{Quirks: tc.quirks})
+			defer close()
+			server.InjectFaults("AddPortMapping", tc.faults...)
+			lb := newTestIGDLoadBalancer(t, tc.leaseDuration)
+
+			nodes := []*v1.Node{newTestNode("node", "127.0.0.1")}
+			status, err := lb.EnsureLoadBalancer(context.TODO(), "kubernetes", newTestService(""), nodes)
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if len(status.Ingress) != 1 || status.Ingress[0].IP != testIGDExternalIP {
+				t.Errorf("got %+v\nwant the ingress %s", status.Ingress, testIGDExternalIP)
+			}
+			expected := []igdtest.Mapping{{
+				ExternalPort:   tc.externalPort,
+				Protocol:       "TCP",
+				InternalPort:   30080,
+				InternalClient: "127.0.0.1",
+				Enabled:        true,
+				Description:    "kubernetes/default/svc/http",
+				LeaseDuration:  tc.lease,
+			}}
+			if mappings := server.Mappings(); !reflect.DeepEqual(mappings, expected) {
+				t.Errorf("got %+v\nwant %+v", mappings, expected)
+			}
+			if adds := server.CallCount("AddPortMapping"); adds != tc.adds {
+				t.Errorf("got %d AddPortMapping calls\nwant %d", adds, tc.adds)
+			}
+
+			if err := lb.EnsureLoadBalancerDeleted(context.TODO(), "kubernetes", newTestService("")); err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if mappings := server.Mappings(); len(mappings) != 0 {
+				t.Errorf("got %+v\nwant no port mappings", mappings)
+			}
+		})
+	}
+}
+
+func TestSimulatedGatewayConflict(t *testing.T) {
+	server, close := newTestIGD(t, igdtest.Config{})
+	defer close()
+	other := igdtest.Mapping{
+		ExternalPort:   8080,
+		Protocol:       "TCP",
+		InternalPort:   8080,
+		InternalClient: "192.0.2.9",
+		Enabled:        true,
+		Description:    "other host",
+	}
+	server.AddMapping(other)
+	lb := newTestIGDLoadBalancer(t, infinitePortMappingLeaseDuration)
+
+	nodes := []*v1.Node{newTestNode("node", "127.0.0.1")}
+	_, err := lb.EnsureLoadBalancer(context.TODO(), "kubernetes", newTestService(""), nodes)
+	if !isUPnPError(err, upnpConflictInMappingEntry) {
+		t.Errorf("got %v\nwant UPnP error %d", err, upnpConflictInMappingEntry)
+	}
+	if mappings := server.Mappings(); !reflect.DeepEqual(mappings, []igdtest.Mapping{other}) {
+		t.Errorf("got %+v\nwant only %+v", mappings, other)
+	}
+}
+
+func TestSimulatedGatewayHealth(t *testing.T) {
+	server, close := newTestIGD(t, igdtest.Config{})
+	defer close()
+	lb := newTestIGDLoadBalancer(t, infinitePortMappingLeaseDuration)
+
+	if err := lb.checkGatewayHealth(context.TODO()); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	server.SetStatus(igdtest.StatusDisconnected)
+	err := lb.checkGatewayHealth(context.TODO())
+	if err == nil || !strings.Contains(err.Error(), "ERROR_NO_CARRIER") {
+		t.Errorf("got %v\nwant the last connection error", err)
+	}
+}
+
+func TestSimulatedGatewayInspection(t *testing.T) {
+	server, close := newTestIGD(t, igdtest.Config{
+		ServiceTypes: []string{igdtest.WANIPConnection2},
+		Quirks:       igdtest.Quirks{RejectOtherHosts: true},
+	})
+	defer close()
+
+	gateways, err := GatewaysByLocation(server.Location)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if len(gateways) != 1 || gateways[0].ControlURL() != server.ControlURL(igdtest.WANIPConnection2) {
+		t.Fatalf("got %+v\nwant the WANIPConnection2 service", gateways)
+	}
+	gw := gateways[0]
+	entry := PortMappingEntry{
+		ExternalPort:  8080,
+		Protocol:      "UDP",
+		InternalPort:  30080,
+		InternalIP:    "192.0.2.9",
+		Enabled:       true,
+		Description:   "kubernetes/default/svc/dns",
+		LeaseDuration: 600,
+	}
+	if err := gw.AddPortMapping(context.TODO(), entry); !isUPnPError(err, upnpActionNotAuthorized) {
+		t.Errorf("got %v\nwant UPnP error %d", err, upnpActionNotAuthorized)
+	}
+	entry.InternalIP = "127.0.0.1"
+	if err := gw.AddPortMapping(context.TODO(), entry); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	entries, err := gw.PortMappings(context.TODO())
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if !reflect.DeepEqual(entries, []PortMappingEntry{entry}) {
+		t.Errorf("got %+v\nwant %+v", entries, []PortMappingEntry{entry})
+	}
+	if err := gw.DeletePortMapping(context.TODO(), "UDP", 8080); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if err := gw.DeletePortMapping(context.TODO(), "UDP", 8080); !isUPnPError(err, upnpNoSuchEntryInArray) {
+		t.Errorf("got %v\nwant UPnP error %d", err, upnpNoSuchEntryInArray)
+	}
+}
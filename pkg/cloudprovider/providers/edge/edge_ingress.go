@@ -0,0 +1,263 @@
+/*
+Copyright 2019 Midokura
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package edge
+
+import (
+	"fmt"
+	"reflect"
+	"time"
+
+	k8s "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/klog"
+)
+
+const (
+	// IngressClassAnnotation marks the Service of an ingress controller with
+	// the class of its Ingresses and Gateways: only its ports 80 and 443 are
+	// exposed, and its external IP is propagated to their status
+	IngressClassAnnotation string = "midokura.com/ingress-class"
+	// IngressHostnameAnnotation is the DNS name of the external IP of an
+	// ingress controller, propagated with it
+	IngressHostnameAnnotation string = "midokura.com/ingress-hostname"
+	// ingressClassAnnotation is the class of an Ingress
+	ingressClassAnnotation = "kubernetes.io/ingress.class"
+)
+
+// GatewayResource are the Gateways of the Gateway API
+var GatewayResource = schema.GroupVersionResource{
+	Group:    "gateway.networking.k8s.io",
+	Version:  "v1beta1",
+	Resource: "gateways",
+}
+
+// ingressPorts are the ports of an ingress controller exposed on the gateway
+var ingressPorts = map[int32]bool{80: true, 443: true}
+
+// ingressResync is the period of the propagation of the external IPs of the
+// ingress controllers, for the new Ingresses and Gateways
+var ingressResync = time.Minute
+
+// ingressExposure is the external IP of the ingress controller of a class
+type ingressExposure struct {
+	// service exposing the ingress controller, namespace/name
+	service  string
+	ip       string
+	hostname string
+	// deleted exposures have their addresses removed from the status of the
+	// Ingresses and Gateways, then are forgotten
+	deleted bool
+}
+
+// exposedServicePorts returns the ports of the service exposed on the
+// gateway: all of them, or only 80 and 443 for an ingress controller
+func exposedServicePorts(service *k8s.Service) []k8s.ServicePort {
+	if _, ok := service.Annotations[IngressClassAnnotation]; !ok {
+		return service.Spec.Ports
+	}
+	ports := make([]k8s.ServicePort, 0, len(ingressPorts))
+	for _, port := range service.Spec.Ports {
+		if ingressPorts[port.Port] {
+			ports = append(ports, port)
+		}
+	}
+	return ports
+}
+
+// updateIngressExposure records the external IP of the service if it is an
+// ingress controller, or forgets it after its load balancer is deleted. The
+// lb.mutex is held.
+func (lb *LoadBalancer) updateIngressExposure(service *k8s.Service, loadBalancer *loadBalancer) {
+	serviceName := fmt.Sprintf("%s/%s", service.Namespace, service.Name)
+	class, isIngress := service.Annotations[IngressClassAnnotation]
+	changed := false
+	for c, exposure := range lb.ingressClasses {
+		if exposure.service == serviceName && !exposure.deleted && (loadBalancer == nil || !isIngress || c != class) {
+			exposure.deleted = true
+			lb.ingressClasses[c] = exposure
+			changed = true
+		}
+	}
+	if loadBalancer != nil && isIngress && len(loadBalancer.status.Ingress) > 0 {
+		if lb.ingressClasses == nil {
+			lb.ingressClasses = make(map[string]ingressExposure)
+		}
+		exposure := ingressExposure{
+			service:  serviceName,
+			ip:       loadBalancer.status.Ingress[0].IP,
+			hostname: service.Annotations[IngressHostnameAnnotation],
+		}
+		if current, ok := lb.ingressClasses[class]; !ok || current != exposure {
+			if ok && !current.deleted && current.service != serviceName {
+				klog.Warningf("updateIngressExposure: ingress class %s of %s taken over by %s", class, current.service, serviceName)
+			}
+			lb.ingressClasses[class] = exposure
+			changed = true
+		}
+	}
+	if changed {
+		lb.triggerIngressSync()
+	}
+}
+
+func (lb *LoadBalancer) triggerIngressSync() {
+	select {
+	case lb.ingressTrigger <- struct{}{}:
+	default:
+	}
+}
+
+// runIngressPropagator propagates the external IPs of the ingress controllers
+// on their changes, and periodically, until stop is closed
+func (lb *LoadBalancer) runIngressPropagator(stop <-chan struct{}) {
+	ticker := time.NewTicker(ingressResync)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		case <-lb.ingressTrigger:
+		}
+		if err := lb.syncIngresses(); err != nil {
+			klog.Errorf("runIngressPropagator: %v", err)
+		}
+	}
+}
+
+// syncIngresses sets the external IPs of the ingress controllers in the status
+// of the Ingresses and Gateways of their class
+func (lb *LoadBalancer) syncIngresses() error {
+	lb.mutex.Lock()
+	exposures := make(map[string]ingressExposure, len(lb.ingressClasses))
+	for class, exposure := range lb.ingressClasses {
+		exposures[class] = exposure
+	}
+	lb.mutex.Unlock()
+	if len(exposures) == 0 {
+		return nil
+	}
+
+	if err := lb.syncIngressStatuses(exposures); err != nil {
+		return err
+	}
+	if err := lb.syncGatewayStatuses(exposures); err != nil {
+		return err
+	}
+
+	// forget the deleted exposures, unless exposed again meanwhile
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+	for class, exposure := range exposures {
+		if current, ok := lb.ingressClasses[class]; ok && exposure.deleted && current == exposure {
+			delete(lb.ingressClasses, class)
+		}
+	}
+	return nil
+}
+
+func (lb *LoadBalancer) syncIngressStatuses(exposures map[string]ingressExposure) error {
+	if lb.kubeClient == nil {
+		return nil
+	}
+	ingresses, err := lb.kubeClient.NetworkingV1beta1().Ingresses(metav1.NamespaceAll).List(metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("syncIngressStatuses: listing the Ingresses: %v", err)
+	}
+	for i := range ingresses.Items {
+		ingress := &ingresses.Items[i]
+		exposure, ok := exposures[ingress.Annotations[ingressClassAnnotation]]
+		if !ok {
+			continue
+		}
+		var desired []k8s.LoadBalancerIngress
+		if !exposure.deleted {
+			desired = []k8s.LoadBalancerIngress{{IP: exposure.ip, Hostname: exposure.hostname}}
+		} else if !reflect.DeepEqual(ingress.Status.LoadBalancer.Ingress, []k8s.LoadBalancerIngress{{IP: exposure.ip, Hostname: exposure.hostname}}) {
+			// only remove the addresses set from the deleted exposure
+			continue
+		}
+		if reflect.DeepEqual(ingress.Status.LoadBalancer.Ingress, desired) {
+			continue
+		}
+		ingress.Status.LoadBalancer.Ingress = desired
+		klog.Infof("syncIngressStatuses: %s/%s: %v", ingress.Namespace, ingress.Name, desired)
+		_, err := lb.kubeClient.NetworkingV1beta1().Ingresses(ingress.Namespace).UpdateStatus(ingress)
+		if err != nil && !errors.IsNotFound(err) {
+			klog.Errorf("syncIngressStatuses: %s/%s: %v", ingress.Namespace, ingress.Name, err)
+		}
+	}
+	return nil
+}
+
+func (lb *LoadBalancer) syncGatewayStatuses(exposures map[string]ingressExposure) error {
+	if lb.dynamicClient == nil {
+		return nil
+	}
+	gateways, err := lb.dynamicClient.Resource(GatewayResource).List(metav1.ListOptions{})
+	if errors.IsNotFound(err) {
+		// the Gateway API is not installed
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("syncGatewayStatuses: listing the Gateways: %v", err)
+	}
+	for i := range gateways.Items {
+		gateway := &gateways.Items[i]
+		class, _, _ := unstructured.NestedString(gateway.Object, "spec", "gatewayClassName")
+		exposure, ok := exposures[class]
+		if !ok {
+			continue
+		}
+		current, _, _ := unstructured.NestedSlice(gateway.Object, "status", "addresses")
+		var desired []interface{}
+		if !exposure.deleted {
+			desired = gatewayAddresses(exposure)
+		} else if !reflect.DeepEqual(current, gatewayAddresses(exposure)) {
+			continue
+		}
+		if reflect.DeepEqual(current, desired) || (len(current) == 0 && len(desired) == 0) {
+			continue
+		}
+		if desired == nil {
+			unstructured.RemoveNestedField(gateway.Object, "status", "addresses")
+		} else if err := unstructured.SetNestedSlice(gateway.Object, desired, "status", "addresses"); err != nil {
+			klog.Errorf("syncGatewayStatuses: %s/%s: %v", gateway.GetNamespace(), gateway.GetName(), err)
+			continue
+		}
+		klog.Infof("syncGatewayStatuses: %s/%s: %v", gateway.GetNamespace(), gateway.GetName(), desired)
+		_, err := lb.dynamicClient.Resource(GatewayResource).Namespace(gateway.GetNamespace()).UpdateStatus(gateway, metav1.UpdateOptions{})
+		if err != nil && !errors.IsNotFound(err) {
+			klog.Errorf("syncGatewayStatuses: %s/%s: %v", gateway.GetNamespace(), gateway.GetName(), err)
+		}
+	}
+	return nil
+}
+
+// gatewayAddresses returns the status addresses of a Gateway for the exposure
+func gatewayAddresses(exposure ingressExposure) []interface{} {
+	addresses := []interface{}{
+		map[string]interface{}{"type": "IPAddress", "value": exposure.ip},
+	}
+	if exposure.hostname != "" {
+		addresses = append(addresses, map[string]interface{}{"type": "Hostname", "value": exposure.hostname})
+	}
+	return addresses
+}
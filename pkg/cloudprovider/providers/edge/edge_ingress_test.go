@@ -0,0 +1,206 @@
+/*
+Copyright 2019 Midokura
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package edge
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/midokura/cloud-provider-edge/pkg/cloudprovider/providers/edge/igdtest"
+	v1 "k8s.io/api/core/v1"
+	networking "k8s.io/api/networking/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func newTestIngressService(class string) *v1.Service {
+	service := newTestService("")
+	service.Name = "ingress"
+	service.Annotations[IngressClassAnnotation] = class
+	service.Spec.Ports = []v1.ServicePort{
+		{Name: "http", Protocol: "TCP", Port: 80, NodePort: 30080},
+		{Name: "https", Protocol: "TCP", Port: 443, NodePort: 30443},
+		{Name: "metrics", Protocol: "TCP", Port: 10254, NodePort: 31254},
+	}
+	return service
+}
+
+func newTestIngress(name, class string, status ...v1.LoadBalancerIngress) *networking.Ingress {
+	ingress := &networking.Ingress{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"}}
+	if class != "" {
+		ingress.Annotations = map[string]string{ingressClassAnnotation: class}
+	}
+	ingress.Status.LoadBalancer.Ingress = status
+	return ingress
+}
+
+func newTestGatewayResource(name, class string) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "gateway.networking.k8s.io/v1beta1",
+		"kind":       "Gateway",
+		"metadata":   map[string]interface{}{"name": name, "namespace": "default"},
+		"spec":       map[string]interface{}{"gatewayClassName": class},
+	}}
+}
+
+func TestExposedServicePorts(t *testing.T) {
+	if ports := exposedServicePorts(newTestService("")); len(ports) != 1 || ports[0].Port != 8080 {
+		t.Errorf("got %+v\nwant all the ports", ports)
+	}
+	ports := exposedServicePorts(newTestIngressService("nginx"))
+	if len(ports) != 2 || ports[0].Port != 80 || ports[1].Port != 443 {
+		t.Errorf("got %+v\nwant the ports 80 and 443", ports)
+	}
+}
+
+func TestValidateIngressService(t *testing.T) {
+	lb := NewLoadBalancer()
+	nodes := []*v1.Node{newTestNode("node", "192.0.2.1")}
+	noHTTP := newTestIngressService("nginx")
+	noHTTP.Spec.Ports = noHTTP.Spec.Ports[2:]
+	for _, service := range []*v1.Service{noHTTP, newTestIngressService("")} {
+		if err := lb.validateParametersOfLoadBalancer(nil, "kubernetes", service, nodes); err == nil {
+			t.Errorf("%+v: expected error", service.Spec.Ports)
+		}
+	}
+}
+
+func TestSyncIngresses(t *testing.T) {
+	exposed := []v1.LoadBalancerIngress{{IP: "198.51.100.1", Hostname: "www.example.com"}}
+	other := []v1.LoadBalancerIngress{{IP: "203.0.113.1"}}
+	kubeClient := fake.NewSimpleClientset(
+		newTestIngress("nginx", "nginx"),
+		newTestIngress("traefik", "traefik"),
+		newTestIngress("no-class", ""),
+		newTestIngress("set-by-another", "nginx", other...),
+	)
+	dynamicClient := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme())
+	for _, class := range []string{"nginx", "traefik"} {
+		gateway := newTestGatewayResource(class, class)
+		if _, err := dynamicClient.Resource(GatewayResource).Namespace("default").Create(gateway, metav1.CreateOptions{}); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+	}
+	lb := NewLoadBalancer()
+	lb.kubeClient = kubeClient
+	lb.dynamicClient = dynamicClient
+
+	ingressStatus := func(name string) []v1.LoadBalancerIngress {
+		ingress, err := kubeClient.NetworkingV1beta1().Ingresses("default").Get(name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		return ingress.Status.LoadBalancer.Ingress
+	}
+	gatewayAddresses := func(name string) []interface{} {
+		gateway, err := dynamicClient.Resource(GatewayResource).Namespace("default").Get(name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		addresses, _, _ := unstructured.NestedSlice(gateway.Object, "status", "addresses")
+		return addresses
+	}
+
+	service := newTestIngressService("nginx")
+	service.Annotations[IngressHostnameAnnotation] = "www.example.com"
+	loadBalancer := newLoadBalancerWithPortMappings(service, "192.0.2.1", "198.51.100.1")
+	lb.updateIngressExposure(service, &loadBalancer)
+	if err := lb.syncIngresses(); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	for name, expected := range map[string][]v1.LoadBalancerIngress{
+		"nginx":          exposed,
+		"traefik":        nil,
+		"no-class":       nil,
+		"set-by-another": exposed,
+	} {
+		if status := ingressStatus(name); !reflect.DeepEqual(status, expected) {
+			t.Errorf("Ingress %s: got %+v\nwant %+v", name, status, expected)
+		}
+	}
+	expectedAddresses := []interface{}{
+		map[string]interface{}{"type": "IPAddress", "value": "198.51.100.1"},
+		map[string]interface{}{"type": "Hostname", "value": "www.example.com"},
+	}
+	if addresses := gatewayAddresses("nginx"); !reflect.DeepEqual(addresses, expectedAddresses) {
+		t.Errorf("Gateway nginx: got %+v\nwant %+v", addresses, expectedAddresses)
+	}
+	if addresses := gatewayAddresses("traefik"); addresses != nil {
+		t.Errorf("Gateway traefik: got %+v\nwant no addresses", addresses)
+	}
+
+	// another controller takes over an Ingress, then the load balancer is
+	// deleted: only the addresses of the exposure are removed
+	ingress := newTestIngress("set-by-another", "nginx", other...)
+	if _, err := kubeClient.NetworkingV1beta1().Ingresses("default").UpdateStatus(ingress); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	lb.updateIngressExposure(service, nil)
+	if err := lb.syncIngresses(); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if status := ingressStatus("nginx"); status != nil {
+		t.Errorf("Ingress nginx: got %+v\nwant no status", status)
+	}
+	if status := ingressStatus("set-by-another"); !reflect.DeepEqual(status, other) {
+		t.Errorf("Ingress set-by-another: got %+v\nwant %+v", status, other)
+	}
+	if addresses := gatewayAddresses("nginx"); addresses != nil {
+		t.Errorf("Gateway nginx: got %+v\nwant no addresses", addresses)
+	}
+	if len(lb.ingressClasses) != 0 {
+		t.Errorf("got %+v\nwant the exposure forgotten", lb.ingressClasses)
+	}
+}
+
+func TestUpdateIngressExposureClassChange(t *testing.T) {
+	lb := NewLoadBalancer()
+	service := newTestIngressService("nginx")
+	loadBalancer := newLoadBalancerWithPortMappings(service, "192.0.2.1", "198.51.100.1")
+	lb.updateIngressExposure(service, &loadBalancer)
+
+	service.Annotations[IngressClassAnnotation] = "traefik"
+	lb.updateIngressExposure(service, &loadBalancer)
+	expected := map[string]ingressExposure{
+		"nginx":   {service: "default/ingress", ip: "198.51.100.1", deleted: true},
+		"traefik": {service: "default/ingress", ip: "198.51.100.1"},
+	}
+	if !reflect.DeepEqual(lb.ingressClasses, expected) {
+		t.Errorf("got %+v\nwant %+v", lb.ingressClasses, expected)
+	}
+}
+
+func TestControllerIngressController(t *testing.T) {
+	h := newControllerHarness(t, igdtest.Config{})
+	defer h.close()
+	h.addNode("node", "127.0.0.1")
+	if _, err := h.kubeClient.NetworkingV1beta1().Ingresses("default").Create(newTestIngress("app", "nginx")); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	h.createService(newTestIngressService("nginx"))
+	http, https := newTestMapping(80, 30080), newTestMapping(443, 30443)
+	http.Description, https.Description = "kubernetes/default/ingress/http", "kubernetes/default/ingress/https"
+	h.waitForMappings(http, https)
+	h.waitFor("the status of the Ingress", func() bool {
+		ingress, err := h.kubeClient.NetworkingV1beta1().Ingresses("default").Get("app", metav1.GetOptions{})
+		return err == nil && reflect.DeepEqual(ingress.Status.LoadBalancer.Ingress, []v1.LoadBalancerIngress{{IP: testIGDExternalIP}})
+	})
+}
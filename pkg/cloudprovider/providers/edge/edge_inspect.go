@@ -0,0 +1,292 @@
+/*
+Copyright 2019 Midokura
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package edge
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/huin/goupnp"
+	"github.com/huin/goupnp/httpu"
+	k8s "k8s.io/api/core/v1"
+	"k8s.io/klog"
+)
+
+// This file is the API used by edgectl to inspect the gateways and manage
+// port mappings by hand, with the same UPnP client as the load balancer.
+
+// maxPortMappingEntries bounds the listing of the port mappings, in case the
+// gateway never reports the end of its table
+const maxPortMappingEntries = 1024
+
+// Gateway is a WAN connection service of an UPnP IGD
+type Gateway struct {
+	// Interface is the network interface the gateway was discovered on, empty
+	// if it was given by location
+	Interface string
+	// LocalAddress is the local address towards the gateway
+	LocalAddress net.IP
+	// Location is the URL of the description of the root device
+	Location *url.URL
+	// Device is the description of the root device
+	Device *goupnp.Device
+	// ServiceType is the type of the WAN connection service
+	ServiceType string
+
+	client *upnpClient
+}
+
+// PortMappingEntry is a port mapping of the gateway
+type PortMappingEntry struct {
+	RemoteHost    string
+	ExternalPort  uint16
+	Protocol      string
+	InternalPort  uint16
+	InternalIP    string
+	Enabled       bool
+	Description   string
+	LeaseDuration uint32
+}
+
+// PortMappingOwner is the port of the load balancer owning a port mapping
+type PortMappingOwner struct {
+	ClusterName string
+	Namespace   string
+	Service     string
+	Port        string
+}
+
+// portMappingDescription returns the description of the port mappings of the
+// port of a load balancer, named <cluster>/<namespace>/<service>
+func portMappingDescription(loadBalancerName string, portName string) string {
+	return fmt.Sprintf("%s/%s", loadBalancerName, portName)
+}
+
+// ParsePortMappingOwner returns the owner of a port mapping added by the edge
+// cloud provider, parsed from its description, or false if it has another one
+func ParsePortMappingOwner(desc string) (*PortMappingOwner, bool) {
+	parts := strings.Split(desc, "/")
+	if len(parts) != 4 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+		return nil, false
+	}
+	return &PortMappingOwner{ClusterName: parts[0], Namespace: parts[1], Service: parts[2], Port: parts[3]}, true
+}
+
+// ownedByCluster returns whether the description is the one of a port mapping
+// of a load balancer of the cluster
+func ownedByCluster(desc, clusterName string) bool {
+	owner, ok := ParsePortMappingOwner(desc)
+	return ok && owner.ClusterName == clusterName
+}
+
+// ValidateService runs the checks of the load balancer on the service,
+// without any gateway, as the edge cloud controller manager configured with
+// the load balancer type given
+func ValidateService(clusterName string, loadBalancerType string, service *k8s.Service) error {
+	switch loadBalancerType {
+	case UniversalPlugAndPlayInternetGatewayDeviceLoadBalancerType, LinuxNATLoadBalancerType, RouterOSLoadBalancerType,
+		OpenWrtLoadBalancerType, OPNsenseLoadBalancerType:
+	default:
+		return fmt.Errorf("invalid load balancer type '%s'", loadBalancerType)
+	}
+	lb := &LoadBalancer{loadBalancerType: loadBalancerType}
+	return lb.validateParametersOfLoadBalancer(context.TODO(), clusterName, service, nil)
+}
+
+// DiscoverGateways discovers the WAN connection services answering SSDP on
+// each IPv4 network interface, or only on the one named if not empty
+func DiscoverGateways(interfaceName string, maxWaitSeconds int) ([]*Gateway, error) {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	gateways := make([]*Gateway, 0)
+	found := false
+	for _, iface := range interfaces {
+		if interfaceName != "" && iface.Name != interfaceName {
+			continue
+		}
+		found = true
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagMulticast == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			klog.Warningf("DiscoverGateways: %s: %v", iface.Name, err)
+			continue
+		}
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok || ipNet.IP.To4() == nil {
+				continue
+			}
+			gateways = append(gateways, discoverGatewaysFrom(iface.Name, ipNet.IP, maxWaitSeconds)...)
+		}
+	}
+	if interfaceName != "" && !found {
+		return nil, fmt.Errorf("interface %s not found", interfaceName)
+	}
+	return gateways, nil
+}
+
+// discoverGatewaysFrom sends the SSDP searches from the local address given
+func discoverGatewaysFrom(interfaceName string, localAddress net.IP, maxWaitSeconds int) []*Gateway {
+	client, err := httpu.NewHTTPUClientAddr(localAddress.String())
+	if err != nil {
+		klog.Warningf("discoverGatewaysFrom: %s (%s): %v", interfaceName, localAddress, err)
+		return nil
+	}
+	defer client.Close()
+	gateways := make([]*Gateway, 0)
+	for _, serviceType := range wanConnectionServiceTypes {
+		locations, err := ssdpSearch(client, serviceType, time.Duration(maxWaitSeconds)*time.Second, 2)
+		if err != nil {
+			klog.Warningf("discoverGatewaysFrom: %s (%s): %s: %v", interfaceName, localAddress, serviceType, err)
+			continue
+		}
+		for _, location := range locations {
+			found, err := newGateways(location, serviceType)
+			if err != nil {
+				klog.Warningf("discoverGatewaysFrom: %s (%s): %s: %v", interfaceName, localAddress, location, err)
+				continue
+			}
+			for _, gw := range found {
+				gw.Interface = interfaceName
+				gw.LocalAddress = localAddress
+			}
+			gateways = append(gateways, found...)
+		}
+	}
+	return gateways
+}
+
+// GatewaysByLocation returns the WAN connection services of the root device
+// described at the URL given, without SSDP
+func GatewaysByLocation(location string) ([]*Gateway, error) {
+	loc, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	return newGateways(loc, wanConnectionServiceTypes...)
+}
+
+// newGateways returns the WAN connection services of the types given of the
+// root device described at the location
+func newGateways(location *url.URL, serviceTypes ...string) ([]*Gateway, error) {
+	rootDevice, err := goupnp.DeviceByURL(location)
+	if err != nil {
+		return nil, err
+	}
+	gateways := make([]*Gateway, 0)
+	for _, serviceType := range serviceTypes {
+		for _, service := range rootDevice.Device.FindService(serviceType) {
+			client := newUPnPClient(&goupnp.ServiceClient{
+				SOAPClient: service.NewSOAPClient(),
+				RootDevice: rootDevice,
+				Location:   location,
+				Service:    service,
+			})
+			gateways = append(gateways, &Gateway{
+				LocalAddress: getLocalAddressToHost(location.Hostname()),
+				Location:     location,
+				Device:       &rootDevice.Device,
+				ServiceType:  serviceType,
+				client:       client,
+			})
+		}
+	}
+	return gateways, nil
+}
+
+// ControlURL returns the URL of the SOAP actions of the WAN connection
+func (gw *Gateway) ControlURL() string {
+	return gw.client.SOAPClient.EndpointURL.String()
+}
+
+// ExternalIP returns the external IP of the WAN connection
+func (gw *Gateway) ExternalIP(ctx context.Context) (string, error) {
+	return gw.client.GetExternalIPAddress(ctx)
+}
+
+// StatusInfo returns the status, last connection error and uptime of the WAN
+// connection
+func (gw *Gateway) StatusInfo(ctx context.Context) (string, string, time.Duration, error) {
+	status, lastConnectionError, uptime, err := gw.client.GetStatusInfo(ctx)
+	return status, lastConnectionError, time.Duration(uptime) * time.Second, err
+}
+
+// PortMappings returns all the port mappings of the WAN connection
+func (gw *Gateway) PortMappings(ctx context.Context) ([]PortMappingEntry, error) {
+	entries := make([]PortMappingEntry, 0)
+	for index := 0; index < maxPortMappingEntries; index++ {
+		entry, err := gw.client.getGenericPortMappingEntry(ctx, index)
+		if isUPnPError(err, upnpSpecifiedArrayIndexInvalid) || isUPnPError(err, upnpNoSuchEntryInArray) {
+			return entries, nil
+		}
+		if err != nil {
+			return entries, err
+		}
+		entries = append(entries, *entry)
+	}
+	return entries, nil
+}
+
+// AddPortMapping adds or replaces the port mapping of the WAN connection
+func (gw *Gateway) AddPortMapping(ctx context.Context, entry PortMappingEntry) error {
+	return gw.client.AddPortMapping(ctx, entry.RemoteHost, entry.ExternalPort, entry.Protocol, entry.InternalPort, entry.InternalIP, entry.Enabled, entry.Description, entry.LeaseDuration)
+}
+
+// DeletePortMapping deletes the port mapping of the WAN connection
+func (gw *Gateway) DeletePortMapping(ctx context.Context, protocol string, externalPort uint16) error {
+	return gw.client.DeletePortMapping(ctx, "", externalPort, protocol)
+}
+
+// getGenericPortMappingEntry returns the port mapping at the index given of
+// the table of the gateway
+func (client *upnpClient) getGenericPortMappingEntry(ctx context.Context, index int) (*PortMappingEntry, error) {
+	response := &struct {
+		NewRemoteHost             string
+		NewExternalPort           uint16
+		NewProtocol               string
+		NewInternalPort           uint16
+		NewInternalClient         string
+		NewEnabled                bool
+		NewPortMappingDescription string
+		NewLeaseDuration          uint32
+	}{}
+	err := client.performAction(ctx, "GetGenericPortMappingEntry", []soapArgument{
+		{"NewPortMappingIndex", strconv.Itoa(index)},
+	}, response)
+	if err != nil {
+		return nil, err
+	}
+	return &PortMappingEntry{
+		RemoteHost:    response.NewRemoteHost,
+		ExternalPort:  response.NewExternalPort,
+		Protocol:      response.NewProtocol,
+		InternalPort:  response.NewInternalPort,
+		InternalIP:    response.NewInternalClient,
+		Enabled:       response.NewEnabled,
+		Description:   response.NewPortMappingDescription,
+		LeaseDuration: response.NewLeaseDuration,
+	}, nil
+}
@@ -0,0 +1,115 @@
+/*
+Copyright 2019 Midokura
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package edge
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testPortMappingEntryResponse = `<?xml version="1.0"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">
+<s:Body>
+<u:GetGenericPortMappingEntryResponse xmlns:u="urn:schemas-upnp-org:service:WANIPConnection:1">
+<NewRemoteHost></NewRemoteHost>
+<NewExternalPort>%d</NewExternalPort>
+<NewProtocol>TCP</NewProtocol>
+<NewInternalPort>30080</NewInternalPort>
+<NewInternalClient>192.0.2.1</NewInternalClient>
+<NewEnabled>1</NewEnabled>
+<NewPortMappingDescription>kubernetes/default/svc/http</NewPortMappingDescription>
+<NewLeaseDuration>0</NewLeaseDuration>
+</u:GetGenericPortMappingEntryResponse>
+</s:Body>
+</s:Envelope>`
+
+func TestGatewayPortMappings(t *testing.T) {
+	client, close := newTestUPnPClient(t, func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		for index, port := range []int{8080, 8081} {
+			if strings.Contains(string(data), fmt.Sprintf("<NewPortMappingIndex>%d</NewPortMappingIndex>", index)) {
+				w.Write([]byte(fmt.Sprintf(testPortMappingEntryResponse, port)))
+				return
+			}
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(strings.NewReplacer("718", "713", "ConflictInMappingEntry", "SpecifiedArrayIndexInvalid").Replace(testFaultResponse)))
+	})
+	defer close()
+
+	gw := &Gateway{client: client}
+	entries, err := gw.PortMappings(context.TODO())
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("got %+v\nwant 2 port mappings", entries)
+	}
+	expected := PortMappingEntry{
+		ExternalPort: 8081,
+		Protocol:     "TCP",
+		InternalPort: 30080,
+		InternalIP:   "192.0.2.1",
+		Enabled:      true,
+		Description:  "kubernetes/default/svc/http",
+	}
+	if !reflect.DeepEqual(entries[1], expected) {
+		t.Errorf("got %+v\nwant %+v", entries[1], expected)
+	}
+}
+
+func TestParsePortMappingOwner(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		expected *PortMappingOwner
+	}{
+		{"kubernetes/default/svc/http", &PortMappingOwner{ClusterName: "kubernetes", Namespace: "default", Service: "svc", Port: "http"}},
+		{"kubernetes/default/svc/", &PortMappingOwner{ClusterName: "kubernetes", Namespace: "default", Service: "svc"}},
+		{"Skype UDP at 192.0.2.2:23902", nil},
+		{"a/b/c", nil},
+		{"kubernetes//svc/http", nil},
+	}
+	for _, tc := range testCases {
+		owner, ok := ParsePortMappingOwner(tc.desc)
+		if ok != (tc.expected != nil) || !reflect.DeepEqual(owner, tc.expected) {
+			t.Errorf("%q: got %+v, %v\nwant %+v", tc.desc, owner, ok, tc.expected)
+		}
+	}
+}
+
+func TestValidateService(t *testing.T) {
+	testCases := []struct {
+		loadBalancerType string
+		valid            bool
+	}{
+		{UniversalPlugAndPlayInternetGatewayDeviceLoadBalancerType, true},
+		// the service is annotated for an UPnP IGD gateway
+		{RouterOSLoadBalancerType, false},
+		{"foo", false},
+	}
+	for _, tc := range testCases {
+		err := ValidateService("kubernetes", tc.loadBalancerType, newTestService(""))
+		if (err == nil) != tc.valid {
+			t.Errorf("%s: got %v\nwant valid %v", tc.loadBalancerType, err, tc.valid)
+		}
+	}
+}
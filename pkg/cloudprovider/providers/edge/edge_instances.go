@@ -0,0 +1,366 @@
+/*
+Copyright 2019 Midokura
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package edge
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	k8s "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	cloudprovider "k8s.io/cloud-provider"
+	"k8s.io/klog"
+	kubeletapis "k8s.io/kubernetes/pkg/kubelet/apis"
+)
+
+const (
+	// providerIDPrefix is the prefix of the provider IDs of the nodes,
+	// edge://<cluster>/<node>
+	providerIDPrefix = ProviderName + "://"
+	// nodeNameEnv is the name of the node running the cloud controller
+	// manager, set from spec.nodeName, or the hostname if unset
+	nodeNameEnv = "NODE_NAME"
+	// defaultKubeletPort is the port of the kubelet when the node does not
+	// report it
+	defaultKubeletPort = 10250
+)
+
+// kubeletDialTimeout is the time given to the kubelet of a node not ready to
+// answer, before considering the node shut down
+var kubeletDialTimeout = 3 * time.Second
+
+// dialKubelet connects to the kubelet of a node
+var dialKubelet = func(ctx context.Context, address string) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: kubeletDialTimeout}
+	return dialer.DialContext(ctx, "tcp", address)
+}
+
+// virtualInterfacePrefixes are the prefixes of the names of the network
+// interfaces of the containers and the overlay networks, whose addresses
+// are not addresses of the node
+var virtualInterfacePrefixes = []string{"cali", "cilium", "cni", "docker", "flannel", "kube-", "lxc", "tunl", "veth", "vxlan", "weave"}
+
+// instances implements cloudprovider.Instances with a node-local view: the
+// nodes are described by the addresses their kubelet reported, or, for the
+// node running the cloud controller manager, by the addresses of its network
+// interfaces in the internal networks configured. All the nodes have the
+// external IP of the gateway.
+type instances struct {
+	cloud        *Edge
+	clusterName  string
+	instanceType string
+	// localNodeName is the name of the node running the cloud controller
+	// manager
+	localNodeName string
+	// localAddresses returns the addresses of the network interfaces of the
+	// local node
+	localAddresses func() ([]net.IP, error)
+	// internalNets are the networks of the internal IPs of the nodes, none
+	// to only report the addresses the kubelets reported
+	internalNets []*net.IPNet
+}
+
+// localNodeName returns the name of the node running the cloud controller
+// manager, from the NODE_NAME environment variable, else its hostname
+func localNodeName() string {
+	if nodeName := os.Getenv(nodeNameEnv); nodeName != "" {
+		return nodeName
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		klog.Warningf("localNodeName: error getting the hostname: %v", err)
+	}
+	return strings.ToLower(hostname)
+}
+
+func newInstances(cloud *Edge) *instances {
+	clusterName := cloud.config.Global.ClusterName
+	if clusterName == "" {
+		clusterName = defaultClusterName
+	}
+	instanceType := cloud.config.Global.InstanceType
+	if instanceType == "" {
+		instanceType = defaultInstanceType
+	}
+	internalNets := make([]*net.IPNet, 0, len(cloud.config.Global.InternalCIDR))
+	for _, cidr := range cloud.config.Global.InternalCIDR {
+		// validated by ReadConfig
+		if _, ipNet, err := net.ParseCIDR(cidr); err == nil {
+			internalNets = append(internalNets, ipNet)
+		}
+	}
+	return &instances{
+		cloud:          cloud,
+		clusterName:    clusterName,
+		instanceType:   instanceType,
+		localNodeName:  localNodeName(),
+		localAddresses: localInterfaceAddresses,
+		internalNets:   internalNets,
+	}
+}
+
+// NodeAddresses returns the addresses of the specified instance.
+func (i *instances) NodeAddresses(ctx context.Context, name types.NodeName) ([]k8s.NodeAddress, error) {
+	node, err := i.getNode(name)
+	if err != nil {
+		return nil, err
+	}
+	addresses := make([]k8s.NodeAddress, 0)
+	addAddress := func(addressType k8s.NodeAddressType, address string) {
+		for _, existing := range addresses {
+			if existing.Type == addressType && existing.Address == address {
+				return
+			}
+		}
+		addresses = append(addresses, k8s.NodeAddress{Type: addressType, Address: address})
+	}
+
+	// the IP given to the kubelet with --node-ip comes first
+	if providedIP, ok := node.Annotations[kubeletapis.AnnotationProvidedIPAddr]; ok {
+		if net.ParseIP(providedIP) == nil {
+			return nil, fmt.Errorf("node %s: invalid %s annotation '%s'", name, kubeletapis.AnnotationProvidedIPAddr, providedIP)
+		}
+		addAddress(k8s.NodeInternalIP, providedIP)
+	}
+	if string(name) == i.localNodeName && len(i.internalNets) > 0 {
+		ips, err := i.localAddresses()
+		if err != nil {
+			return nil, fmt.Errorf("node %s: local addresses: %v", name, err)
+		}
+		// the addresses on the WAN, or of the pods, are not internal IPs
+		for _, ip := range ips {
+			if i.isInternalIP(ip) {
+				addAddress(k8s.NodeInternalIP, ip.String())
+			}
+		}
+	} else {
+		for _, address := range node.Status.Addresses {
+			if address.Type == k8s.NodeInternalIP {
+				addAddress(k8s.NodeInternalIP, address.Address)
+			}
+		}
+	}
+	if externalIP := i.gatewayExternalIP(); externalIP != nil {
+		addAddress(k8s.NodeExternalIP, externalIP.String())
+	}
+	addAddress(k8s.NodeHostName, string(name))
+	return addresses, nil
+}
+
+// isInternalIP returns whether the address is in one of the internal networks
+func (i *instances) isInternalIP(ip net.IP) bool {
+	for _, internalNet := range i.internalNets {
+		if internalNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// NodeAddressesByProviderID returns the addresses of the specified instance.
+func (i *instances) NodeAddressesByProviderID(ctx context.Context, providerID string) ([]k8s.NodeAddress, error) {
+	name, err := i.parseProviderID(providerID)
+	if err != nil {
+		return nil, err
+	}
+	return i.NodeAddresses(ctx, name)
+}
+
+// InstanceID returns the cloud provider ID of the node with the specified
+// NodeName, <cluster>/<node>, for the provider ID edge://<cluster>/<node>
+func (i *instances) InstanceID(ctx context.Context, nodeName types.NodeName) (string, error) {
+	return fmt.Sprintf("%s/%s", i.clusterName, nodeName), nil
+}
+
+// InstanceType returns the type of the specified instance, as configured.
+func (i *instances) InstanceType(ctx context.Context, name types.NodeName) (string, error) {
+	if instance, ok := i.cloud.config.Instance[string(name)]; ok && instance.Type != "" {
+		return instance.Type, nil
+	}
+	return i.instanceType, nil
+}
+
+// InstanceTypeByProviderID returns the type of the specified instance.
+func (i *instances) InstanceTypeByProviderID(ctx context.Context, providerID string) (string, error) {
+	name, err := i.parseProviderID(providerID)
+	if err != nil {
+		return "", err
+	}
+	return i.InstanceType(ctx, name)
+}
+
+// AddSSHKeyToAllInstances is not implemented: the nodes are not managed by
+// the cloud provider
+func (i *instances) AddSSHKeyToAllInstances(ctx context.Context, user string, keyData []byte) error {
+	return cloudprovider.NotImplemented
+}
+
+// CurrentNodeName returns the name of the node we are currently running on,
+// the hostname.
+func (i *instances) CurrentNodeName(ctx context.Context, hostname string) (types.NodeName, error) {
+	return types.NodeName(hostname), nil
+}
+
+// InstanceExistsByProviderID returns true for the provider IDs of the nodes of
+// the cluster: the nodes are not managed by the cloud provider, which can't
+// tell whether they were removed, so they are never deleted.
+func (i *instances) InstanceExistsByProviderID(ctx context.Context, providerID string) (bool, error) {
+	if _, err := i.parseProviderID(providerID); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// InstanceShutdownByProviderID returns true if the node is not ready and
+// nothing answers on the port of its kubelet: a node still answering, even
+// refusing the connection, is running.
+func (i *instances) InstanceShutdownByProviderID(ctx context.Context, providerID string) (bool, error) {
+	name, err := i.parseProviderID(providerID)
+	if err != nil {
+		return false, err
+	}
+	if string(name) == i.localNodeName {
+		return false, nil
+	}
+	node, err := i.getNode(name)
+	if err != nil {
+		return false, err
+	}
+	for _, condition := range node.Status.Conditions {
+		if condition.Type == k8s.NodeReady && condition.Status == k8s.ConditionTrue {
+			return false, nil
+		}
+	}
+	internalIP := ""
+	for _, address := range node.Status.Addresses {
+		if address.Type == k8s.NodeInternalIP {
+			internalIP = address.Address
+			break
+		}
+	}
+	if internalIP == "" {
+		return false, fmt.Errorf("node %s: no internal IP to check", name)
+	}
+	port := int(node.Status.DaemonEndpoints.KubeletEndpoint.Port)
+	if port == 0 {
+		port = defaultKubeletPort
+	}
+	return !hostAnswers(ctx, net.JoinHostPort(internalIP, strconv.Itoa(port))), nil
+}
+
+// parseProviderID returns the name of the node of a provider ID of the
+// cluster, edge://<cluster>/<node>
+func (i *instances) parseProviderID(providerID string) (types.NodeName, error) {
+	if !strings.HasPrefix(providerID, providerIDPrefix) {
+		return "", fmt.Errorf("provider ID '%s' is not of the %s cloud provider", providerID, ProviderName)
+	}
+	parts := strings.Split(strings.TrimPrefix(providerID, providerIDPrefix), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", fmt.Errorf("invalid provider ID '%s': expected %s<cluster>/<node>", providerID, providerIDPrefix)
+	}
+	if parts[0] != i.clusterName {
+		return "", fmt.Errorf("provider ID '%s' is not of the cluster %s", providerID, i.clusterName)
+	}
+	return types.NodeName(parts[1]), nil
+}
+
+func (i *instances) getNode(name types.NodeName) (*k8s.Node, error) {
+	if i.cloud.kubeClient == nil {
+		return nil, fmt.Errorf("node %s: no Kubernetes client", name)
+	}
+	node, err := i.cloud.kubeClient.CoreV1().Nodes().Get(string(name), metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("node %s: %v", name, err)
+	}
+	return node, nil
+}
+
+// gatewayExternalIP returns the external IP of the default WAN connection of
+// the gateway, or nil if no gateway was discovered
+func (i *instances) gatewayExternalIP() net.IP {
+	loadBalancer := i.cloud.loadBalancer()
+	if loadBalancer == nil {
+		return nil
+	}
+	loadBalancer.mutex.Lock()
+	defer loadBalancer.mutex.Unlock()
+	if loadBalancer.client == nil {
+		return nil
+	}
+	return loadBalancer.externalIP
+}
+
+// localInterfaceAddresses returns the IPv4 addresses of the network
+// interfaces of the node that are up, excluding the loopback and virtual ones
+func localInterfaceAddresses() ([]net.IP, error) {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, 0)
+	for _, iface := range interfaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 || isVirtualInterface(iface.Name) {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			klog.Warningf("localInterfaceAddresses: %s: %v", iface.Name, err)
+			continue
+		}
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok || ipNet.IP.To4() == nil || !ipNet.IP.IsGlobalUnicast() {
+				continue
+			}
+			ips = append(ips, ipNet.IP)
+		}
+	}
+	return ips, nil
+}
+
+func isVirtualInterface(name string) bool {
+	for _, prefix := range virtualInterfacePrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// hostAnswers returns whether the host answers on the address given: it
+// accepts the connection, or refuses it
+func hostAnswers(ctx context.Context, address string) bool {
+	conn, err := dialKubelet(ctx, address)
+	if err == nil {
+		conn.Close()
+		return true
+	}
+	if opErr, ok := err.(*net.OpError); ok {
+		if syscallErr, ok := opErr.Err.(*os.SyscallError); ok && syscallErr.Err == syscall.ECONNREFUSED {
+			return true
+		}
+	}
+	klog.V(3).Infof("hostAnswers: %s: %v", address, err)
+	return false
+}
@@ -0,0 +1,290 @@
+/*
+Copyright 2019 Midokura
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package edge
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	cloudprovider "k8s.io/cloud-provider"
+	kubeletapis "k8s.io/kubernetes/pkg/kubelet/apis"
+)
+
+// newTestInstances returns the instances of a cluster with the nodes given,
+// running the cloud controller manager on the node "local"
+func newTestInstances(nodes ...*v1.Node) *instances {
+	kubeClient := fake.NewSimpleClientset()
+	for _, node := range nodes {
+		kubeClient.CoreV1().Nodes().Create(node)
+	}
+	cloud := &Edge{kubeClient: kubeClient}
+	i := newInstances(cloud)
+	i.localNodeName = "local"
+	i.localAddresses = func() ([]net.IP, error) {
+		return []net.IP{net.ParseIP("192.0.2.10"), net.ParseIP("192.0.2.11")}, nil
+	}
+	return i
+}
+
+func TestParseProviderID(t *testing.T) {
+	testCases := []struct {
+		providerID string
+		name       types.NodeName
+		err        bool
+	}{
+		{providerID: "edge://kubernetes/node", name: "node"},
+		{providerID: "gce://kubernetes/node", err: true},
+		{providerID: "edge://other/node", err: true},
+		{providerID: "edge://kubernetes/", err: true},
+		{providerID: "edge://kubernetes/node/extra", err: true},
+		{providerID: "edge://node", err: true},
+	}
+	i := newTestInstances()
+	for _, tc := range testCases {
+		name, err := i.parseProviderID(tc.providerID)
+		if (err != nil) != tc.err || name != tc.name {
+			t.Errorf("%s: got %q, %v\nwant %q, error %t", tc.providerID, name, err, tc.name, tc.err)
+		}
+	}
+}
+
+func TestInstanceID(t *testing.T) {
+	i := newTestInstances()
+	instanceID, err := i.InstanceID(context.TODO(), "node")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if instanceID != "kubernetes/node" {
+		t.Errorf("got %s\nwant kubernetes/node", instanceID)
+	}
+	providerID, err := cloudprovider.GetInstanceProviderID(context.TODO(), i.cloud, "node")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if _, err := i.parseProviderID(providerID); err != nil || providerID != "edge://kubernetes/node" {
+		t.Errorf("got %s, %v\nwant edge://kubernetes/node", providerID, err)
+	}
+}
+
+func TestNodeAddresses(t *testing.T) {
+	local := newTestNode("local", "192.0.2.10")
+	remote := newTestNode("remote", "192.0.2.20")
+	provided := newTestNode("provided", "192.0.2.30")
+	provided.Annotations = map[string]string{kubeletapis.AnnotationProvidedIPAddr: "192.0.2.31"}
+	invalid := newTestNode("invalid", "192.0.2.40")
+	invalid.Annotations = map[string]string{kubeletapis.AnnotationProvidedIPAddr: "not-an-ip"}
+
+	testCases := []struct {
+		name         string
+		internalCIDR string
+		externalIP   string
+		addresses    []v1.NodeAddress
+		err          bool
+	}{
+		{
+			name: "local",
+			addresses: []v1.NodeAddress{
+				{Type: v1.NodeInternalIP, Address: "192.0.2.10"},
+				{Type: v1.NodeHostName, Address: "local"},
+			},
+		},
+		{
+			name:         "local",
+			internalCIDR: "192.0.2.8/30",
+			addresses: []v1.NodeAddress{
+				{Type: v1.NodeInternalIP, Address: "192.0.2.10"},
+				{Type: v1.NodeInternalIP, Address: "192.0.2.11"},
+				{Type: v1.NodeHostName, Address: "local"},
+			},
+		},
+		{
+			// the address of the WAN interface is left out
+			name:         "local",
+			internalCIDR: "192.0.2.10/32",
+			addresses: []v1.NodeAddress{
+				{Type: v1.NodeInternalIP, Address: "192.0.2.10"},
+				{Type: v1.NodeHostName, Address: "local"},
+			},
+		},
+		{
+			name:       "remote",
+			externalIP: "198.51.100.1",
+			addresses: []v1.NodeAddress{
+				{Type: v1.NodeInternalIP, Address: "192.0.2.20"},
+				{Type: v1.NodeExternalIP, Address: "198.51.100.1"},
+				{Type: v1.NodeHostName, Address: "remote"},
+			},
+		},
+		{
+			name: "provided",
+			addresses: []v1.NodeAddress{
+				{Type: v1.NodeInternalIP, Address: "192.0.2.31"},
+				{Type: v1.NodeInternalIP, Address: "192.0.2.30"},
+				{Type: v1.NodeHostName, Address: "provided"},
+			},
+		},
+		{name: "invalid", err: true},
+		{name: "missing", err: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			i := newTestInstances(local, remote, provided, invalid)
+			if tc.internalCIDR != "" {
+				_, internalNet, _ := net.ParseCIDR(tc.internalCIDR)
+				i.internalNets = []*net.IPNet{internalNet}
+			}
+			if tc.externalIP != "" {
+				i.cloud.LoadBalancerInstance = &LoadBalancer{
+					client:     newMockClient(t),
+					externalIP: net.ParseIP(tc.externalIP),
+				}
+			}
+			addresses, err := i.NodeAddressesByProviderID(context.TODO(), "edge://kubernetes/"+tc.name)
+			if (err != nil) != tc.err {
+				t.Fatalf("got error %v\nwant error %t", err, tc.err)
+			}
+			if !tc.err && !reflect.DeepEqual(addresses, tc.addresses) {
+				t.Errorf("got %+v\nwant %+v", addresses, tc.addresses)
+			}
+		})
+	}
+}
+
+func TestInstanceType(t *testing.T) {
+	cfg, err := ReadConfig(strings.NewReader("[Global]\ninstance-type = small\n[Instance \"pi\"]\ntype = raspberry-pi\n"))
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	i := newTestInstances()
+	i.cloud.config = cfg
+	i = newInstances(i.cloud)
+
+	testCases := []struct {
+		providerID   string
+		instanceType string
+	}{
+		{providerID: "edge://kubernetes/pi", instanceType: "raspberry-pi"},
+		{providerID: "edge://kubernetes/other", instanceType: "small"},
+	}
+	for _, tc := range testCases {
+		instanceType, err := i.InstanceTypeByProviderID(context.TODO(), tc.providerID)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if instanceType != tc.instanceType {
+			t.Errorf("%s: got %s\nwant %s", tc.providerID, instanceType, tc.instanceType)
+		}
+	}
+	if _, err := i.InstanceTypeByProviderID(context.TODO(), "edge://other/pi"); err == nil {
+		t.Errorf("expected error")
+	}
+}
+
+func TestInstanceExistsByProviderID(t *testing.T) {
+	i := newTestInstances()
+	if exists, err := i.InstanceExistsByProviderID(context.TODO(), "edge://kubernetes/gone"); err != nil || !exists {
+		t.Errorf("got %t, %v\nwant the node to exist", exists, err)
+	}
+	if _, err := i.InstanceExistsByProviderID(context.TODO(), "gce://kubernetes/node"); err == nil {
+		t.Errorf("expected error")
+	}
+}
+
+// timeoutError is the error of a dial timing out
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestInstanceShutdownByProviderID(t *testing.T) {
+	// the nodes of TEST-NET-1 do not answer, the others are dialed
+	oldDialKubelet := dialKubelet
+	dialKubelet = func(ctx context.Context, address string) (net.Conn, error) {
+		if strings.HasPrefix(address, "192.0.2.") {
+			return nil, &net.OpError{Op: "dial", Net: "tcp", Err: timeoutError{}}
+		}
+		return oldDialKubelet(ctx, address)
+	}
+	defer func() {
+		dialKubelet = oldDialKubelet
+	}()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	defer listener.Close()
+	listeningPort := listener.Addr().(*net.TCPAddr).Port
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	closedPort := closed.Addr().(*net.TCPAddr).Port
+	closed.Close()
+
+	newNode := func(name, internalIP string, port int, ready bool) *v1.Node {
+		node := newTestNode(name, internalIP)
+		node.Status.DaemonEndpoints.KubeletEndpoint.Port = int32(port)
+		status := v1.ConditionFalse
+		if ready {
+			status = v1.ConditionTrue
+		}
+		node.Status.Conditions = []v1.NodeCondition{{Type: v1.NodeReady, Status: status}}
+		return node
+	}
+	testCases := []struct {
+		node     *v1.Node
+		shutdown bool
+	}{
+		{node: newNode("ready", "192.0.2.1", 0, true)},
+		{node: newNode("local", "192.0.2.1", 0, false)},
+		{node: newNode("listening", "127.0.0.1", listeningPort, false)},
+		{node: newNode("refusing", "127.0.0.1", closedPort, false)},
+		{node: newNode("unreachable", "192.0.2.1", 0, false), shutdown: true},
+	}
+	for _, tc := range testCases {
+		i := newTestInstances(tc.node)
+		shutdown, err := i.InstanceShutdownByProviderID(context.TODO(), "edge://kubernetes/"+tc.node.Name)
+		if err != nil {
+			t.Fatalf("%s: unexpected error %v", tc.node.Name, err)
+		}
+		if shutdown != tc.shutdown {
+			t.Errorf("%s: got shutdown %t\nwant %t", tc.node.Name, shutdown, tc.shutdown)
+		}
+	}
+	if _, err := newTestInstances().InstanceShutdownByProviderID(context.TODO(), "edge://kubernetes/missing"); err == nil {
+		t.Errorf("expected error")
+	}
+}
+
+func TestIsVirtualInterface(t *testing.T) {
+	for name, virtual := range map[string]bool{
+		"eth0": false, "wlan0": false, "enp3s0": false,
+		"cni0": true, "flannel.1": true, "docker0": true, "veth1234": true, "cali12ab": true,
+	} {
+		if isVirtualInterface(name) != virtual {
+			t.Errorf("%s: got virtual %t\nwant %t", name, !virtual, virtual)
+		}
+	}
+}
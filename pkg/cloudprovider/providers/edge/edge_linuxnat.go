@@ -0,0 +1,621 @@
+/*
+Copyright 2019 Midokura
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package edge
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"k8s.io/klog"
+)
+
+const (
+	// linuxNATTable is the nftables table, and the iptables chain, owning the
+	// rules of the linux-nat load balancers
+	linuxNATTable = "edge-cloud-provider"
+	linuxNATChain = "EDGE-CLOUD-PROVIDER"
+	// linuxNATNFTables and linuxNATIPTables are the backends of linux-nat
+	linuxNATNFTables = "nftables"
+	linuxNATIPTables = "iptables"
+)
+
+// runNATCommand runs an nft or iptables command, returning its output
+var runNATCommand = func(ctx context.Context, name string, args ...string) ([]byte, error) {
+	output, err := exec.CommandContext(ctx, name, args...).CombinedOutput()
+	if err != nil {
+		return output, fmt.Errorf("%s %s: %v: %s", name, strings.Join(args, " "), err, strings.TrimSpace(string(output)))
+	}
+	return output, nil
+}
+
+// lookNATCommand finds the nft and iptables commands
+var lookNATCommand = exec.LookPath
+
+// natInterfaceState returns whether the network interface is up, and its IPv4
+// addresses
+var natInterfaceState = func(name string) (bool, []net.IP, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return false, nil, err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return false, nil, err
+	}
+	ips := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.To4() != nil {
+			ips = append(ips, ipNet.IP)
+		}
+	}
+	return iface.Flags&net.FlagUp != 0, ips, nil
+}
+
+// parseLinuxNATMark returns the conntrack mark of the mark option, 0 if empty
+func parseLinuxNATMark(mark string) (uint32, error) {
+	if mark == "" {
+		return 0, nil
+	}
+	value, err := strconv.ParseUint(mark, 0, 32)
+	if err != nil || value == 0 {
+		return 0, fmt.Errorf("invalid mark '%s': expected a non-zero 32-bit value", mark)
+	}
+	return uint32(value), nil
+}
+
+// natRule is a port mapping programmed as a DNAT rule from the WAN interface,
+// with the filter rule accepting the forwarded traffic
+type natRule struct {
+	proto        string // TCP or UDP
+	externalPort uint16
+	internalIP   string
+	internalPort uint16
+	desc         string
+	// mark is the conntrack mark set by the DNAT rule, 0 if none
+	mark uint32
+	// deletions are the arguments of the commands deleting the rules
+	deletions [][]string
+}
+
+// natRuleset is the table, or chains, owning the rules of the port mappings
+type natRuleset interface {
+	// command is nft or iptables
+	command() string
+	// ensure creates the table or chains, if needed
+	ensure(ctx context.Context) error
+	list(ctx context.Context) ([]natRule, error)
+	// add returns the arguments of the commands adding the rule
+	add(rule natRule) [][]string
+}
+
+// linuxNATClient implements clientInterface programming the netfilter rules of
+// the node running the cloud controller manager, when it is the gateway
+type linuxNATClient struct {
+	wanInterface string
+	ruleset      natRuleset
+	// mark is the conntrack mark of the forwarded connections, 0 if none
+	mark uint32
+	// mutex serializes the changes of the rules
+	mutex   sync.Mutex
+	ensured bool
+}
+
+func newLinuxNATClient(wanInterface, backend string, mark uint32) (*linuxNATClient, error) {
+	if wanInterface == "" {
+		return nil, fmt.Errorf("newLinuxNATClient: no wan-interface configured")
+	}
+	if backend == "" {
+		// nftables, with iptables as fallback
+		backend = linuxNATIPTables
+		if _, err := lookNATCommand("nft"); err == nil {
+			backend = linuxNATNFTables
+		}
+	}
+	client := &linuxNATClient{wanInterface: wanInterface, mark: mark}
+	switch backend {
+	case linuxNATNFTables:
+		client.ruleset = &nftablesRuleset{wanInterface: wanInterface, mark: mark}
+	case linuxNATIPTables:
+		if mark != 0 {
+			return nil, fmt.Errorf("newLinuxNATClient: mark is only supported by %s", linuxNATNFTables)
+		}
+		client.ruleset = &iptablesRuleset{wanInterface: wanInterface}
+	default:
+		return nil, fmt.Errorf("newLinuxNATClient: unknown backend '%s': expected %s or %s", backend, linuxNATNFTables, linuxNATIPTables)
+	}
+	if _, err := lookNATCommand(client.ruleset.command()); err != nil {
+		return nil, fmt.Errorf("newLinuxNATClient: %v", err)
+	}
+	return client, nil
+}
+
+// run runs the commands of the ruleset
+func (client *linuxNATClient) run(ctx context.Context, commands [][]string) error {
+	for _, args := range commands {
+		if _, err := runNATCommand(ctx, client.ruleset.command(), args...); err != nil {
+			// the table or chains may have been flushed
+			client.ensured = false
+			return err
+		}
+	}
+	return nil
+}
+
+// natRulesetMissing returns whether the error of a listing is of the table or
+// chain missing
+func natRulesetMissing(err error) bool {
+	message := err.Error()
+	return strings.Contains(message, "No such file or directory") || strings.Contains(message, "No chain/target/match by that name")
+}
+
+// ensure creates the table or chains the first time, or again after a failure
+func (client *linuxNATClient) ensure(ctx context.Context) error {
+	if client.ensured {
+		return nil
+	}
+	if err := client.ruleset.ensure(ctx); err != nil {
+		return err
+	}
+	client.ensured = true
+	return nil
+}
+
+// list returns the rules of the port mappings, none when the table or chains
+// are missing: it changes nothing, only AddPortMapping creates them
+func (client *linuxNATClient) list(ctx context.Context) ([]natRule, error) {
+	rules, err := client.ruleset.list(ctx)
+	if err != nil {
+		client.ensured = false
+		if natRulesetMissing(err) {
+			return nil, nil
+		}
+	}
+	return rules, err
+}
+
+// find returns the rules of the external port
+func (client *linuxNATClient) find(ctx context.Context, externalPort uint16, proto string) ([]natRule, error) {
+	rules, err := client.list(ctx)
+	if err != nil {
+		return nil, err
+	}
+	found := make([]natRule, 0, 1)
+	for _, rule := range rules {
+		if rule.externalPort == externalPort && strings.EqualFold(rule.proto, proto) {
+			found = append(found, rule)
+		}
+	}
+	return found, nil
+}
+
+// AddPortMapping implements clientInterface. The rules are permanent, and the
+// port mappings of other owners are not replaced.
+func (client *linuxNATClient) AddPortMapping(ctx context.Context, host string, externalPort uint16, proto string, internalPort uint16, internalIP string, enabled bool, desc string, lease uint32) error {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	rule := natRule{proto: strings.ToUpper(proto), externalPort: externalPort, internalIP: internalIP, internalPort: internalPort, desc: desc, mark: client.mark}
+	current, err := client.find(ctx, externalPort, proto)
+	if err != nil {
+		return err
+	}
+	if !client.ensured {
+		// the table or chains created, the rules left in the others are listed
+		if err := client.ensure(ctx); err != nil {
+			return err
+		}
+		if current, err = client.find(ctx, externalPort, proto); err != nil {
+			return err
+		}
+	}
+	for _, existing := range current {
+		if existing.desc != desc {
+			return newUPnPError(upnpConflictInMappingEntry)
+		}
+	}
+	// unchanged if both the DNAT and the filter rules are there
+	if len(current) == 1 && len(current[0].deletions) == 2 && current[0].internalIP == internalIP && current[0].internalPort == internalPort &&
+		current[0].mark == client.mark {
+		return nil
+	}
+	for _, existing := range current {
+		if err := client.run(ctx, existing.deletions); err != nil {
+			return err
+		}
+	}
+	klog.V(3).Infof("AddPortMapping: %s %d to %s:%d on %s", rule.proto, externalPort, internalIP, internalPort, client.wanInterface)
+	return client.run(ctx, client.ruleset.add(rule))
+}
+
+// DeletePortMapping implements clientInterface
+func (client *linuxNATClient) DeletePortMapping(ctx context.Context, host string, externalPort uint16, proto string) error {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	current, err := client.find(ctx, externalPort, proto)
+	if err != nil {
+		return err
+	}
+	if len(current) == 0 {
+		return newUPnPError(upnpNoSuchEntryInArray)
+	}
+	for _, rule := range current {
+		if err := client.run(ctx, rule.deletions); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetExternalIPAddress implements clientInterface: the first IPv4 address of
+// the WAN interface
+func (client *linuxNATClient) GetExternalIPAddress(ctx context.Context) (string, error) {
+	_, ips, err := natInterfaceState(client.wanInterface)
+	if err != nil {
+		return "", err
+	}
+	if len(ips) == 0 {
+		return "", fmt.Errorf("no IPv4 address on %s", client.wanInterface)
+	}
+	return ips[0].String(), nil
+}
+
+// GetStatusInfo implements clientInterface: the WAN interface is connected
+// when up with an IPv4 address
+func (client *linuxNATClient) GetStatusInfo(ctx context.Context) (string, string, uint32, error) {
+	up, ips, err := natInterfaceState(client.wanInterface)
+	if err != nil {
+		return "", "", 0, err
+	}
+	switch {
+	case !up:
+		return "Disconnected", "ERROR_NO_CARRIER", 0, nil
+	case len(ips) == 0:
+		return "Disconnected", "ERROR_IP_CONFIGURATION", 0, nil
+	}
+	return upnpConnected, "ERROR_NONE", 0, nil
+}
+
+// GetSpecificPortMappingEntry implements clientInterface
+func (client *linuxNATClient) GetSpecificPortMappingEntry(ctx context.Context, host string, externalPort uint16, proto string) (*portMappingEntry, error) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	current, err := client.find(ctx, externalPort, proto)
+	if err != nil {
+		return nil, err
+	}
+	if len(current) == 0 {
+		return nil, newUPnPError(upnpNoSuchEntryInArray)
+	}
+	return &portMappingEntry{internalPort: current[0].internalPort, internalIP: current[0].internalIP, enabled: true, desc: current[0].desc}, nil
+}
+
+// ListPortMappings implements portMappingLister, from the comments of the
+// DNAT rules
+func (client *linuxNATClient) ListPortMappings(ctx context.Context, clusterName string) ([]listedPortMapping, error) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	rules, err := client.list(ctx)
+	if err != nil {
+		return nil, err
+	}
+	mappings := make([]listedPortMapping, 0, len(rules))
+	for _, rule := range rules {
+		if !ownedByCluster(rule.desc, clusterName) {
+			continue
+		}
+		mappings = append(mappings, listedPortMapping{
+			externalPort:     rule.externalPort,
+			proto:            rule.proto,
+			portMappingEntry: portMappingEntry{internalPort: rule.internalPort, internalIP: rule.internalIP, enabled: true, desc: rule.desc},
+		})
+	}
+	return mappings, nil
+}
+
+// nftablesRuleset owns the table edge-cloud-provider, with a prerouting chain
+// for the DNAT rules and a forward chain for the filter rules. The accept of
+// its forward chain only ends that chain: the forward chains of the other
+// tables (e.g. of firewalld, or the inet filter table of the distribution)
+// still drop the packets unless they accept them too, e.g. matching the
+// conntrack mark the DNAT rules set with mark:
+//
+//	ct mark 0x00004544 accept
+type nftablesRuleset struct {
+	wanInterface string
+	mark         uint32
+}
+
+var (
+	// nft -a list chain output, e.g.
+	// iifname "eth0" tcp dport 80 dnat to 192.168.1.2:30080 comment "kubernetes/default/svc/http" # handle 4
+	// iifname "eth0" tcp dport 80 ct mark set 0x00004544 dnat to 192.168.1.2:30080 comment "kubernetes/default/svc/http" # handle 4
+	nftDNATRule = regexp.MustCompile(`(tcp|udp) dport (\d+) (?:ct mark set (0x[0-9a-f]+) )?dnat (?:ip )?to ([0-9.]+):(\d+)(?: comment "([^"]*)")? # handle (\d+)`)
+	// ip daddr 192.168.1.2 tcp dport 30080 accept comment "kubernetes/default/svc/http" # handle 5
+	nftFilterRule = regexp.MustCompile(`ip daddr ([0-9.]+) (tcp|udp) dport (\d+) accept(?: comment "([^"]*)")? # handle (\d+)`)
+)
+
+func (ruleset *nftablesRuleset) command() string {
+	return "nft"
+}
+
+func (ruleset *nftablesRuleset) ensure(ctx context.Context) error {
+	for _, args := range [][]string{
+		{"add", "table", "ip", linuxNATTable},
+		{"add", "chain", "ip", linuxNATTable, "prerouting", "{ type nat hook prerouting priority -100 ; }"},
+		{"add", "chain", "ip", linuxNATTable, "forward", "{ type filter hook forward priority 0 ; }"},
+	} {
+		if _, err := runNATCommand(ctx, "nft", args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ruleset *nftablesRuleset) list(ctx context.Context) ([]natRule, error) {
+	dnat, err := runNATCommand(ctx, "nft", "-a", "list", "chain", "ip", linuxNATTable, "prerouting")
+	if err != nil {
+		return nil, err
+	}
+	filter, err := runNATCommand(ctx, "nft", "-a", "list", "chain", "ip", linuxNATTable, "forward")
+	if err != nil {
+		return nil, err
+	}
+	rules := make([]natRule, 0)
+	for _, match := range nftDNATRule.FindAllStringSubmatch(string(dnat), -1) {
+		externalPort, _ := strconv.ParseUint(match[2], 10, 16)
+		mark, _ := strconv.ParseUint(match[3], 0, 32)
+		internalPort, _ := strconv.ParseUint(match[5], 10, 16)
+		rules = append(rules, natRule{
+			proto:        strings.ToUpper(match[1]),
+			externalPort: uint16(externalPort),
+			internalIP:   match[4],
+			internalPort: uint16(internalPort),
+			desc:         match[6],
+			mark:         uint32(mark),
+			deletions:    [][]string{{"delete", "rule", "ip", linuxNATTable, "prerouting", "handle", match[7]}},
+		})
+	}
+	for _, match := range nftFilterRule.FindAllStringSubmatch(string(filter), -1) {
+		for i := range rules {
+			rule := &rules[i]
+			if rule.internalIP == match[1] && strings.EqualFold(rule.proto, match[2]) && strconv.Itoa(int(rule.internalPort)) == match[3] && rule.desc == match[4] {
+				rule.deletions = append(rule.deletions, []string{"delete", "rule", "ip", linuxNATTable, "forward", "handle", match[5]})
+				break
+			}
+		}
+	}
+	return rules, nil
+}
+
+func (ruleset *nftablesRuleset) add(rule natRule) [][]string {
+	proto := strings.ToLower(rule.proto)
+	comment := strconv.Quote(rule.desc)
+	dnat := []string{"add", "rule", "ip", linuxNATTable, "prerouting", "iifname", strconv.Quote(ruleset.wanInterface),
+		proto, "dport", strconv.Itoa(int(rule.externalPort))}
+	if rule.mark != 0 {
+		dnat = append(dnat, "ct", "mark", "set", fmt.Sprintf("0x%08x", rule.mark))
+	}
+	return [][]string{
+		append(dnat, "dnat", "to", fmt.Sprintf("%s:%d", rule.internalIP, rule.internalPort), "comment", comment),
+		{"add", "rule", "ip", linuxNATTable, "forward", "iifname", strconv.Quote(ruleset.wanInterface),
+			"ip", "daddr", rule.internalIP, proto, "dport", strconv.Itoa(int(rule.internalPort)),
+			"accept", "comment", comment},
+	}
+}
+
+// iptablesRuleset owns the chains EDGE-CLOUD-PROVIDER of the nat and filter
+// tables, jumped to from PREROUTING and FORWARD for the WAN interface. The jump
+// is inserted first in FORWARD, so the rules of iptables dropping the packets
+// after it don't apply, but the nftables tables still see them.
+type iptablesRuleset struct {
+	wanInterface string
+}
+
+func (ruleset *iptablesRuleset) command() string {
+	return "iptables"
+}
+
+func (ruleset *iptablesRuleset) ensure(ctx context.Context) error {
+	for table, hook := range map[string]string{"nat": "PREROUTING", "filter": "FORWARD"} {
+		if _, err := runNATCommand(ctx, "iptables", "-t", table, "-S", linuxNATChain); err != nil {
+			if _, err := runNATCommand(ctx, "iptables", "-t", table, "-N", linuxNATChain); err != nil {
+				return err
+			}
+		}
+		jump := []string{hook, "-i", ruleset.wanInterface, "-j", linuxNATChain}
+		if _, err := runNATCommand(ctx, "iptables", append([]string{"-t", table, "-C"}, jump...)...); err != nil {
+			if _, err := runNATCommand(ctx, "iptables", append([]string{"-t", table, "-I"}, jump...)...); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (ruleset *iptablesRuleset) list(ctx context.Context) ([]natRule, error) {
+	dnat, err := runNATCommand(ctx, "iptables", "-t", "nat", "-S", linuxNATChain)
+	if err != nil {
+		return nil, err
+	}
+	filter, err := runNATCommand(ctx, "iptables", "-t", "filter", "-S", linuxNATChain)
+	if err != nil {
+		return nil, err
+	}
+	rules := make([]natRule, 0)
+	for _, spec := range iptablesRuleSpecs(string(dnat)) {
+		flags := iptablesFlags(spec)
+		host, port, err := net.SplitHostPort(flags["--to-destination"])
+		if flags["-j"] != "DNAT" || err != nil {
+			continue
+		}
+		externalPort, _ := strconv.ParseUint(flags["--dport"], 10, 16)
+		internalPort, _ := strconv.ParseUint(port, 10, 16)
+		rules = append(rules, natRule{
+			proto:        strings.ToUpper(flags["-p"]),
+			externalPort: uint16(externalPort),
+			internalIP:   host,
+			internalPort: uint16(internalPort),
+			desc:         flags["--comment"],
+			deletions:    [][]string{append([]string{"-t", "nat", "-D", linuxNATChain}, spec...)},
+		})
+	}
+	for _, spec := range iptablesRuleSpecs(string(filter)) {
+		flags := iptablesFlags(spec)
+		for i := range rules {
+			rule := &rules[i]
+			if rule.internalIP+"/32" == flags["-d"] && strings.EqualFold(rule.proto, flags["-p"]) && strconv.Itoa(int(rule.internalPort)) == flags["--dport"] && rule.desc == flags["--comment"] {
+				rule.deletions = append(rule.deletions, append([]string{"-t", "filter", "-D", linuxNATChain}, spec...))
+				break
+			}
+		}
+	}
+	return rules, nil
+}
+
+func (ruleset *iptablesRuleset) add(rule natRule) [][]string {
+	proto := strings.ToLower(rule.proto)
+	return [][]string{
+		{"-t", "nat", "-A", linuxNATChain, "-p", proto, "-m", proto, "--dport", strconv.Itoa(int(rule.externalPort)),
+			"-m", "comment", "--comment", rule.desc,
+			"-j", "DNAT", "--to-destination", fmt.Sprintf("%s:%d", rule.internalIP, rule.internalPort)},
+		{"-t", "filter", "-A", linuxNATChain, "-d", rule.internalIP + "/32", "-p", proto, "-m", proto, "--dport", strconv.Itoa(int(rule.internalPort)),
+			"-m", "comment", "--comment", rule.desc,
+			"-j", "ACCEPT"},
+	}
+}
+
+// iptablesRuleSpecs returns the arguments of the rules of the chain in the
+// output of iptables -S, without the "-A chain" prefix
+func iptablesRuleSpecs(output string) [][]string {
+	specs := make([][]string, 0)
+	for _, line := range strings.Split(output, "\n") {
+		args := splitQuoted(line)
+		if len(args) > 2 && args[0] == "-A" && args[1] == linuxNATChain {
+			specs = append(specs, args[2:])
+		}
+	}
+	return specs
+}
+
+// iptablesFlags returns the values of the options of a rule
+func iptablesFlags(spec []string) map[string]string {
+	flags := make(map[string]string)
+	for i := 0; i+1 < len(spec); i++ {
+		if strings.HasPrefix(spec[i], "-") {
+			flags[spec[i]] = spec[i+1]
+		}
+	}
+	return flags
+}
+
+// splitQuoted splits the line in words, keeping the double-quoted ones whole
+func splitQuoted(line string) []string {
+	words := make([]string, 0)
+	var word strings.Builder
+	inWord, quoted, escaped := false, false, false
+	for _, r := range line {
+		switch {
+		case escaped:
+			word.WriteRune(r)
+			escaped = false
+		case r == '\\' && quoted:
+			escaped = true
+		case r == '"':
+			quoted = !quoted
+			inWord = true
+		case (r == ' ' || r == '\t') && !quoted:
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words
+}
+
+// discoverLinuxNAT returns the discovery of the node as gateway: its WAN
+// interface, and its address towards the nodes. Only the node named nodeName
+// is the gateway: on the others, the discovery fails.
+func discoverLinuxNAT(nodeName, wanInterface, backend, internalIP string, mark uint32) func() (*gateway, error) {
+	return func() (*gateway, error) {
+		if local := localNodeName(); local != nodeName {
+			return nil, fmt.Errorf("discoverLinuxNAT: running on node %s, not on the gateway node %s", local, nodeName)
+		}
+		client, err := newLinuxNATClient(wanInterface, backend, mark)
+		if err != nil {
+			return nil, err
+		}
+		externalIPAddress, err := client.GetExternalIPAddress(context.Background())
+		if err != nil {
+			return nil, fmt.Errorf("discoverLinuxNAT: external IP: %v", err)
+		}
+		localAddress := net.ParseIP(internalIP)
+		if localAddress == nil {
+			if localAddress, err = linuxNATLocalAddress(wanInterface); err != nil {
+				return nil, err
+			}
+		}
+		hostname, _ := os.Hostname()
+		externalIP := net.ParseIP(externalIPAddress)
+		klog.Infof("discoverLinuxNAT: %s (%s): external IP %s, local address %s", wanInterface, client.ruleset.command(), externalIP, localAddress)
+		return &gateway{
+			connections: []wanConnection{{
+				client:       client,
+				localAddress: localAddress,
+				externalIP:   externalIP,
+				deviceID:     fmt.Sprintf("%s:%s/%s", LinuxNATLoadBalancerType, hostname, wanInterface),
+			}},
+			externalIP: externalIP,
+		}, nil
+	}
+}
+
+// linuxNATLocalAddress returns the first IPv4 address of the node not on the
+// WAN interface
+func linuxNATLocalAddress(wanInterface string) (net.IP, error) {
+	_, wanIPs, err := natInterfaceState(wanInterface)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := localInterfaceAddresses()
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		onWAN := false
+		for _, wanIP := range wanIPs {
+			onWAN = onWAN || wanIP.Equal(ip)
+		}
+		if !onWAN && ip.To4() != nil {
+			return ip, nil
+		}
+	}
+	return nil, fmt.Errorf("linuxNATLocalAddress: no IPv4 address besides %s: set internal-ip", wanInterface)
+}
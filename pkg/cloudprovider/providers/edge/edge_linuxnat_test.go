@@ -0,0 +1,529 @@
+/*
+Copyright 2019 Midokura
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package edge
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// fakeNetfilter simulates the nft and iptables commands, keeping the rules of
+// the chains in memory
+type fakeNetfilter struct {
+	mutex sync.Mutex
+	// chains are the rules of the chains, by "command table chain"
+	chains   map[string][]string
+	handle   int
+	commands []string
+}
+
+func newFakeNetfilter() *fakeNetfilter {
+	return &fakeNetfilter{chains: make(map[string][]string)}
+}
+
+func (netfilter *fakeNetfilter) run(ctx context.Context, name string, args ...string) ([]byte, error) {
+	netfilter.mutex.Lock()
+	defer netfilter.mutex.Unlock()
+	command := name + " " + strings.Join(args, " ")
+	netfilter.commands = append(netfilter.commands, command)
+	notFound := fmt.Errorf("%s: No such file or directory", command)
+	switch name {
+	case "nft":
+		switch {
+		case args[0] == "add" && args[1] == "table":
+		case args[0] == "add" && args[1] == "chain":
+			key := "nft " + args[3] + " " + args[4]
+			if _, ok := netfilter.chains[key]; !ok {
+				netfilter.chains[key] = []string{}
+			}
+		case args[0] == "add" && args[1] == "rule":
+			key := "nft " + args[3] + " " + args[4]
+			if _, ok := netfilter.chains[key]; !ok {
+				return nil, notFound
+			}
+			netfilter.handle++
+			netfilter.chains[key] = append(netfilter.chains[key], fmt.Sprintf("%s # handle %d", strings.Join(args[5:], " "), netfilter.handle))
+		case args[0] == "delete" && args[1] == "rule":
+			key := "nft " + args[3] + " " + args[4]
+			rules := make([]string, 0)
+			for _, rule := range netfilter.chains[key] {
+				if !strings.HasSuffix(rule, " # handle "+args[6]) {
+					rules = append(rules, rule)
+				}
+			}
+			if len(rules) == len(netfilter.chains[key]) {
+				return nil, notFound
+			}
+			netfilter.chains[key] = rules
+		case args[0] == "-a" && args[1] == "list":
+			rules, ok := netfilter.chains["nft "+args[4]+" "+args[5]]
+			if !ok {
+				return nil, notFound
+			}
+			output := fmt.Sprintf("table ip %s {\n\tchain %s { # handle 1\n", args[4], args[5])
+			for _, rule := range rules {
+				output += "\t\t" + rule + "\n"
+			}
+			return []byte(output + "\t}\n}\n"), nil
+		default:
+			return nil, fmt.Errorf("unexpected %s", command)
+		}
+	case "iptables":
+		key := "iptables " + args[1] + " " + args[3]
+		rules, ok := netfilter.chains[key]
+		spec := strings.Join(args[4:], " ")
+		switch args[2] {
+		case "-S":
+			if !ok {
+				return nil, fmt.Errorf("%s: iptables: No chain/target/match by that name.", command)
+			}
+			output := "-N " + args[3] + "\n"
+			for _, rule := range rules {
+				output += "-A " + args[3] + " " + rule + "\n"
+			}
+			return []byte(output), nil
+		case "-N":
+			netfilter.chains[key] = []string{}
+		case "-C":
+			for _, rule := range rules {
+				if rule == spec {
+					return nil, nil
+				}
+			}
+			return nil, notFound
+		case "-A", "-I":
+			if !ok && args[2] == "-A" {
+				return nil, notFound
+			}
+			netfilter.chains[key] = append(rules, spec)
+		case "-D":
+			for i, rule := range rules {
+				if rule == spec {
+					netfilter.chains[key] = append(rules[:i:i], rules[i+1:]...)
+					return nil, nil
+				}
+			}
+			return nil, notFound
+		default:
+			return nil, fmt.Errorf("unexpected %s", command)
+		}
+	}
+	return nil, nil
+}
+
+// flush removes all the tables and chains
+func (netfilter *fakeNetfilter) flush() {
+	netfilter.mutex.Lock()
+	defer netfilter.mutex.Unlock()
+	netfilter.chains = make(map[string][]string)
+}
+
+// stubNATCommands runs the nft and iptables commands in the fake netfilter,
+// and restores them when the test ends
+func stubNATCommands(t *testing.T, netfilter *fakeNetfilter) func() {
+	oldRun, oldLook, oldState := runNATCommand, lookNATCommand, natInterfaceState
+	runNATCommand = netfilter.run
+	lookNATCommand = func(name string) (string, error) {
+		return "/usr/sbin/" + name, nil
+	}
+	natInterfaceState = func(name string) (bool, []net.IP, error) {
+		if name != "wan0" {
+			return false, nil, fmt.Errorf("no such network interface")
+		}
+		return true, []net.IP{net.ParseIP("198.51.100.1")}, nil
+	}
+	return func() {
+		runNATCommand, lookNATCommand, natInterfaceState = oldRun, oldLook, oldState
+	}
+}
+
+// setNodeName sets the name of the node running the cloud controller manager,
+// and restores it when the test ends
+func setNodeName(t *testing.T, nodeName string) func() {
+	oldNodeName, set := os.LookupEnv(nodeNameEnv)
+	if err := os.Setenv(nodeNameEnv, nodeName); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	return func() {
+		if set {
+			os.Setenv(nodeNameEnv, oldNodeName)
+		} else {
+			os.Unsetenv(nodeNameEnv)
+		}
+	}
+}
+
+func TestLinuxNATClient(t *testing.T) {
+	for _, backend := range []string{linuxNATNFTables, linuxNATIPTables} {
+		t.Run(backend, func(t *testing.T) {
+			netfilter := newFakeNetfilter()
+			defer stubNATCommands(t, netfilter)()
+			client, err := newLinuxNATClient("wan0", backend, 0)
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			ctx := context.TODO()
+			desc := "kubernetes/default/svc/http"
+
+			if err := client.AddPortMapping(ctx, "", 80, "TCP", 30080, "192.0.2.1", true, desc, 0); err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			entry, err := client.GetSpecificPortMappingEntry(ctx, "", 80, "TCP")
+			expected := &portMappingEntry{internalPort: 30080, internalIP: "192.0.2.1", enabled: true, desc: desc}
+			if err != nil || !reflect.DeepEqual(entry, expected) {
+				t.Errorf("got %+v, %v\nwant %+v", entry, err, expected)
+			}
+			if _, err := client.GetSpecificPortMappingEntry(ctx, "", 80, "UDP"); !isUPnPError(err, upnpNoSuchEntryInArray) {
+				t.Errorf("got %v\nwant NoSuchEntryInArray", err)
+			}
+
+			// the same mapping again changes nothing
+			commands := len(netfilter.commands)
+			if err := client.AddPortMapping(ctx, "", 80, "TCP", 30080, "192.0.2.1", true, desc, 0); err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			for _, command := range netfilter.commands[commands:] {
+				if strings.Contains(command, " add rule ") || strings.Contains(command, " -A ") {
+					t.Errorf("got %s\nwant no changes", command)
+				}
+			}
+			// the filter rule deleted by another tool is added again
+			for key, rules := range netfilter.chains {
+				if key == "nft "+linuxNATTable+" forward" || key == "iptables filter "+linuxNATChain {
+					netfilter.chains[key] = rules[:0]
+				}
+			}
+			if err := client.AddPortMapping(ctx, "", 80, "TCP", 30080, "192.0.2.1", true, desc, 0); err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if rule, _ := client.find(ctx, 80, "TCP"); len(rule) != 1 || len(rule[0].deletions) != 2 {
+				t.Errorf("got %+v\nwant the DNAT and filter rules", rule)
+			}
+			// the mappings of other owners are not replaced
+			if err := client.AddPortMapping(ctx, "", 80, "TCP", 30081, "192.0.2.1", true, "other", 0); !isUPnPError(err, upnpConflictInMappingEntry) {
+				t.Errorf("got %v\nwant ConflictInMappingEntry", err)
+			}
+			// a new target replaces both the DNAT and the filter rules
+			if err := client.AddPortMapping(ctx, "", 80, "TCP", 30090, "192.0.2.2", true, desc, 0); err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if err := client.AddPortMapping(ctx, "", 53, "UDP", 30053, "192.0.2.2", true, "kubernetes/default/dns/dns", 0); err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			listed, err := client.ListPortMappings(ctx, "kubernetes")
+			expectedListed := []listedPortMapping{
+				{externalPort: 80, proto: "TCP", portMappingEntry: portMappingEntry{internalPort: 30090, internalIP: "192.0.2.2", enabled: true, desc: desc}},
+				{externalPort: 53, proto: "UDP", portMappingEntry: portMappingEntry{internalPort: 30053, internalIP: "192.0.2.2", enabled: true, desc: "kubernetes/default/dns/dns"}},
+			}
+			if err != nil || !reflect.DeepEqual(listed, expectedListed) {
+				t.Errorf("got %+v, %v\nwant %+v", listed, err, expectedListed)
+			}
+			filterRules := 0
+			for key, rules := range netfilter.chains {
+				if strings.HasSuffix(key, " forward") || strings.HasPrefix(key, "iptables filter") {
+					for _, rule := range rules {
+						filterRules += strings.Count(rule, "accept") + strings.Count(rule, "ACCEPT")
+					}
+				}
+			}
+			if filterRules != 2 {
+				t.Errorf("got %d filter rules in %v\nwant 2", filterRules, netfilter.chains)
+			}
+
+			if err := client.DeletePortMapping(ctx, "", 80, "TCP"); err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if err := client.DeletePortMapping(ctx, "", 80, "TCP"); !isUPnPError(err, upnpNoSuchEntryInArray) {
+				t.Errorf("got %v\nwant NoSuchEntryInArray", err)
+			}
+
+			// the rules flushed by another tool: the table or chains are created again
+			netfilter.flush()
+			if err := client.AddPortMapping(ctx, "", 80, "TCP", 30080, "192.0.2.1", true, desc, 0); err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if entry, err := client.GetSpecificPortMappingEntry(ctx, "", 80, "TCP"); err != nil || entry.internalPort != 30080 {
+				t.Errorf("got %+v, %v\nwant the port mapping added again", entry, err)
+			}
+		})
+	}
+}
+
+func TestLinuxNATClientReadOnly(t *testing.T) {
+	for _, backend := range []string{linuxNATNFTables, linuxNATIPTables} {
+		t.Run(backend, func(t *testing.T) {
+			netfilter := newFakeNetfilter()
+			defer stubNATCommands(t, netfilter)()
+			client, err := newLinuxNATClient("wan0", backend, 0)
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			ctx := context.TODO()
+
+			// without the table or chains, the reads find nothing and create nothing
+			if _, err := client.GetSpecificPortMappingEntry(ctx, "", 80, "TCP"); !isUPnPError(err, upnpNoSuchEntryInArray) {
+				t.Errorf("got %v\nwant NoSuchEntryInArray", err)
+			}
+			if listed, err := client.ListPortMappings(ctx, "kubernetes"); err != nil || len(listed) != 0 {
+				t.Errorf("got %+v, %v\nwant no port mappings", listed, err)
+			}
+			if err := client.DeletePortMapping(ctx, "", 80, "TCP"); !isUPnPError(err, upnpNoSuchEntryInArray) {
+				t.Errorf("got %v\nwant NoSuchEntryInArray", err)
+			}
+			if len(netfilter.chains) != 0 {
+				t.Errorf("got %v after %q\nwant no table nor chains", netfilter.chains, netfilter.commands)
+			}
+
+			// the chain of the filter rules deleted: the DNAT rule is replaced
+			desc := "kubernetes/default/svc/http"
+			if err := client.AddPortMapping(ctx, "", 80, "TCP", 30080, "192.0.2.1", true, desc, 0); err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			for key := range netfilter.chains {
+				if key == "nft "+linuxNATTable+" forward" || key == "iptables filter "+linuxNATChain {
+					delete(netfilter.chains, key)
+				}
+			}
+			if err := client.AddPortMapping(ctx, "", 80, "TCP", 30090, "192.0.2.1", true, desc, 0); err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if rules, err := client.find(ctx, 80, "TCP"); err != nil || len(rules) != 1 || rules[0].internalPort != 30090 || len(rules[0].deletions) != 2 {
+				t.Errorf("got %+v, %v\nwant only the DNAT and filter rules to 30090", rules, err)
+			}
+		})
+	}
+}
+
+func TestLinuxNATMark(t *testing.T) {
+	netfilter := newFakeNetfilter()
+	defer stubNATCommands(t, netfilter)()
+	ctx := context.TODO()
+	desc := "kubernetes/default/svc/http"
+	client, err := newLinuxNATClient("wan0", linuxNATNFTables, 0)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if err := client.AddPortMapping(ctx, "", 80, "TCP", 30080, "192.0.2.1", true, desc, 0); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	// the rules without the mark configured are replaced
+	client, err = newLinuxNATClient("wan0", linuxNATNFTables, 0x4544)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if err := client.AddPortMapping(ctx, "", 80, "TCP", 30080, "192.0.2.1", true, desc, 0); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	rules := netfilter.chains["nft "+linuxNATTable+" prerouting"]
+	if len(rules) != 1 || !strings.Contains(rules[0], " ct mark set 0x00004544 dnat to 192.0.2.1:30080 ") {
+		t.Errorf("got %q\nwant the DNAT rule setting the mark", rules)
+	}
+	commands := len(netfilter.commands)
+	if err := client.AddPortMapping(ctx, "", 80, "TCP", 30080, "192.0.2.1", true, desc, 0); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	for _, command := range netfilter.commands[commands:] {
+		if strings.Contains(command, " add rule ") {
+			t.Errorf("got %s\nwant no changes", command)
+		}
+	}
+
+	if _, err := newLinuxNATClient("wan0", linuxNATIPTables, 0x4544); err == nil {
+		t.Errorf("expected error")
+	}
+	for _, mark := range []string{"0", "red", "0x100000000"} {
+		if _, err := parseLinuxNATMark(mark); err == nil {
+			t.Errorf("%s: expected error", mark)
+		}
+	}
+	if mark, err := parseLinuxNATMark("0x4544"); err != nil || mark != 0x4544 {
+		t.Errorf("got %x, %v\nwant 4544", mark, err)
+	}
+}
+
+func TestLinuxNATStatus(t *testing.T) {
+	defer stubNATCommands(t, newFakeNetfilter())()
+	client, err := newLinuxNATClient("wan0", "", 0)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if client.ruleset.command() != "nft" {
+		t.Errorf("got %s\nwant nftables by default", client.ruleset.command())
+	}
+	if status, _, _, err := client.GetStatusInfo(context.TODO()); err != nil || status != upnpConnected {
+		t.Errorf("got %s, %v\nwant %s", status, err, upnpConnected)
+	}
+	if ip, err := client.GetExternalIPAddress(context.TODO()); err != nil || ip != "198.51.100.1" {
+		t.Errorf("got %s, %v\nwant the address of the WAN interface", ip, err)
+	}
+
+	natInterfaceState = func(name string) (bool, []net.IP, error) {
+		return false, nil, nil
+	}
+	if status, lastError, _, err := client.GetStatusInfo(context.TODO()); err != nil || status == upnpConnected {
+		t.Errorf("got %s (%s), %v\nwant disconnected", status, lastError, err)
+	}
+	if _, err := client.GetExternalIPAddress(context.TODO()); err == nil {
+		t.Errorf("expected error")
+	}
+	if _, err := newLinuxNATClient("", "", 0); err == nil {
+		t.Errorf("expected error")
+	}
+	if _, err := newLinuxNATClient("wan0", "pf", 0); err == nil {
+		t.Errorf("expected error")
+	}
+}
+
+func TestDiscoverLinuxNAT(t *testing.T) {
+	defer stubNATCommands(t, newFakeNetfilter())()
+	defer setNodeName(t, "gateway")()
+	gw, err := discoverLinuxNAT("gateway", "wan0", linuxNATIPTables, "192.0.2.1", 0)()
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	connection := gw.connections[0]
+	if !gw.externalIP.Equal(net.ParseIP("198.51.100.1")) || !connection.localAddress.Equal(net.ParseIP("192.0.2.1")) || !strings.HasPrefix(connection.deviceID, "linux-nat:") {
+		t.Errorf("got %+v\nwant the gateway of wan0", gw)
+	}
+	if _, err := discoverLinuxNAT("gateway", "eth9", linuxNATIPTables, "192.0.2.1", 0)(); err == nil {
+		t.Errorf("expected error")
+	}
+	// the leader runs on another node than the gateway
+	if _, err := discoverLinuxNAT("router", "wan0", linuxNATIPTables, "192.0.2.1", 0)(); err == nil {
+		t.Errorf("expected error")
+	}
+}
+
+func TestSplitQuoted(t *testing.T) {
+	testCases := []struct {
+		line     string
+		expected []string
+	}{
+		{line: `-A EDGE -p tcp --dport 80`, expected: []string{"-A", "EDGE", "-p", "tcp", "--dport", "80"}},
+		{line: `--comment "a b" -j  ACCEPT`, expected: []string{"--comment", "a b", "-j", "ACCEPT"}},
+		{line: `--comment "say \"hi\"" ""`, expected: []string{"--comment", `say "hi"`, ""}},
+		{line: ``, expected: []string{}},
+	}
+	for _, tc := range testCases {
+		if words := splitQuoted(tc.line); !reflect.DeepEqual(words, tc.expected) {
+			t.Errorf("%s: got %q\nwant %q", tc.line, words, tc.expected)
+		}
+	}
+}
+
+func TestCleanStalePortMappings(t *testing.T) {
+	netfilter := newFakeNetfilter()
+	defer stubNATCommands(t, netfilter)()
+	client, err := newLinuxNATClient("wan0", linuxNATNFTables, 0)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	ctx := context.TODO()
+	client.AddPortMapping(ctx, "", 8080, "TCP", 30080, "192.0.2.1", true, "kubernetes/default/svc/http", 0)
+	client.AddPortMapping(ctx, "", 9090, "TCP", 30090, "192.0.2.1", true, "kubernetes/default/deleted/http", 0)
+
+	lb := NewLoadBalancer()
+	lb.loadBalancerType = LinuxNATLoadBalancerType
+	lb.setGateway(&gateway{connections: []wanConnection{{client: client, externalIP: net.ParseIP("198.51.100.1")}}, externalIP: net.ParseIP("198.51.100.1")})
+	lb.loadBalancers["kubernetes/default/svc"] = newLoadBalancerWithPortMappings(newTestService(""), "192.0.2.1", "198.51.100.1")
+
+	// until the state is loaded, and the cluster given by an API call, no port
+	// mapping is known to be stale
+	lb.cleanStalePortMappings(ctx)
+	if listed, _ := client.ListPortMappings(ctx, "kubernetes"); len(listed) != 2 {
+		t.Errorf("got %+v\nwant the port mappings kept", listed)
+	}
+	lb.stateLoaded = true
+	lb.cleanStalePortMappings(ctx)
+	if listed, _ := client.ListPortMappings(ctx, "kubernetes"); len(listed) != 2 {
+		t.Errorf("got %+v\nwant the port mappings kept", listed)
+	}
+	gone := newTestService("")
+	gone.Name = "gone"
+	gone.Spec.Ports[0].Port = 7070
+	gone.Annotations[LoadBalancerTypeAnnotation] = LinuxNATLoadBalancerType
+	if err := lb.EnsureLoadBalancerDeleted(ctx, "kubernetes", gone); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	lb.cleanStalePortMappings(ctx)
+	listed, _ := client.ListPortMappings(ctx, "kubernetes")
+	if len(listed) != 1 || listed[0].externalPort != 8080 {
+		t.Errorf("got %+v\nwant only the port mapping of svc", listed)
+	}
+}
+
+func TestCleanStalePortMappingsOtherCluster(t *testing.T) {
+	netfilter := newFakeNetfilter()
+	defer stubNATCommands(t, netfilter)()
+	client, err := newLinuxNATClient("wan0", linuxNATNFTables, 0)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	ctx := context.TODO()
+	client.AddPortMapping(ctx, "", 8080, "TCP", 30080, "192.0.2.1", true, "kubernetes/default/svc/http", 0)
+	client.AddPortMapping(ctx, "", 9090, "TCP", 30090, "192.0.2.2", true, "other/default/svc/http", 0)
+
+	// the two clusters share the gateway, each one only knowing its services
+	lb := NewLoadBalancer()
+	lb.loadBalancerType = LinuxNATLoadBalancerType
+	lb.setGateway(&gateway{connections: []wanConnection{{client: client, externalIP: net.ParseIP("198.51.100.1")}}, externalIP: net.ParseIP("198.51.100.1")})
+	lb.loadBalancers["kubernetes/default/svc"] = newLoadBalancerWithPortMappings(newTestService(""), "192.0.2.1", "198.51.100.1")
+	lb.stateLoaded = true
+	lb.clusterName = "kubernetes"
+	other := NewLoadBalancer()
+	other.clusterName = "other"
+	other.loadBalancerType = LinuxNATLoadBalancerType
+	other.setGateway(&gateway{connections: []wanConnection{{client: client, externalIP: net.ParseIP("198.51.100.1")}}, externalIP: net.ParseIP("198.51.100.1")})
+	other.stateLoaded = true
+
+	lb.cleanStalePortMappings(ctx)
+	if listed, _ := client.ListPortMappings(ctx, "other"); len(listed) != 1 {
+		t.Errorf("got %+v\nwant the port mapping of the other cluster kept", listed)
+	}
+	// the service of the other cluster was deleted while it was down
+	other.cleanStalePortMappings(ctx)
+	if listed, _ := client.ListPortMappings(ctx, "other"); len(listed) != 0 {
+		t.Errorf("got %+v\nwant the port mapping of the other cluster deleted", listed)
+	}
+	listed, _ := client.ListPortMappings(ctx, "kubernetes")
+	if len(listed) != 1 || listed[0].desc != "kubernetes/default/svc/http" {
+		t.Errorf("got %+v\nwant only the port mapping of the first cluster", listed)
+	}
+}
+
+func TestValidateLinuxNATType(t *testing.T) {
+	lb := NewLoadBalancer()
+	lb.loadBalancerType = LinuxNATLoadBalancerType
+	service := newTestService("")
+	if err := lb.validateTypeOfLoadBalancer(context.TODO(), "kubernetes", service); err == nil {
+		t.Errorf("expected error")
+	}
+	service.Annotations[LoadBalancerTypeAnnotation] = LinuxNATLoadBalancerType
+	nodes := []*v1.Node{newTestNode("node", "192.0.2.1")}
+	if err := lb.validateParametersOfLoadBalancer(context.TODO(), "kubernetes", service, nodes); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+}
@@ -21,14 +21,20 @@ import (
 	"fmt"
 	"net"
 	"runtime"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	k8s "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/klog"
 
 	"github.com/glendc/go-external-ip"
-	"github.com/huin/goupnp/dcps/internetgateway2"
 )
 
 const (
@@ -40,6 +46,18 @@ const (
 const (
 	// UniversalPlugAndPlayInternetGatewayDeviceLoadBalancerType UPnP IGD load balancer type
 	UniversalPlugAndPlayInternetGatewayDeviceLoadBalancerType = "upnp-igd"
+	// LinuxNATLoadBalancerType netfilter rules of the node when it is the
+	// gateway
+	LinuxNATLoadBalancerType = "linux-nat"
+	// RouterOSLoadBalancerType dstnat entries of a MikroTik router, through
+	// the RouterOS API
+	RouterOSLoadBalancerType = "routeros"
+	// OpenWrtLoadBalancerType redirects of the firewall of an OpenWrt router,
+	// through ubus
+	OpenWrtLoadBalancerType = "openwrt"
+	// OPNsenseLoadBalancerType port forward rules of an OPNsense firewall,
+	// through its REST API
+	OPNsenseLoadBalancerType = "opnsense"
 )
 
 type ensureOrUpdate bool
@@ -56,27 +74,126 @@ const (
 	isNotDelete isDeleteOrIsNotDelete = false
 )
 
-type portMappingLeaseDuration uint16
+type portMappingLeaseDuration uint32
 
 const (
 	infinitePortMappingLeaseDuration portMappingLeaseDuration = 0
+	// minPortMappingLeaseDuration leaves time to renew the leases before
+	// they expire, see leaseRenewalMargin
+	minPortMappingLeaseDuration = 2 * uint32(leaseRenewalMargin/time.Second)
+	// maxPortMappingLeaseDuration is the longest lease of the WANIPConnection:2
+	// service, a week
+	maxPortMappingLeaseDuration = 604800
 )
 
 // portMapping store the data for a port mapping
 type portMapping struct {
 	servicePort k8s.ServicePort
 	nodeIP      string
+	externalIP  string    // identifies the WAN connection, "" for the default one
+	samePort    bool      // the gateway requires the node port as external port
+	leaseExpiry time.Time // expiration of the lease, zero if permanent
+}
+
+// externalPort returns the external port of the port mapping
+func (pm portMapping) externalPort() int32 {
+	if pm.samePort {
+		return pm.servicePort.NodePort
+	}
+	return pm.servicePort.Port
+}
+
+// key returns the port mapping without the fields that are irrelevant to the
+// gateway: the target port is resolved by kube-proxy behind the node port, so
+// it never affects the WAN to node port mapping.
+// The adaptations to the gateway (samePort) and the lease are not part of the
+// desired state.
+func (pm portMapping) key() portMapping {
+	pm.servicePort.TargetPort = intstr.IntOrString{}
+	pm.samePort = false
+	pm.leaseExpiry = time.Time{}
+	return pm
 }
 
 // loadBalancer store the data for a Kubernetes load balancer
 type loadBalancer struct {
 	portMappings []portMapping
+	nodeIP       string                  // target node of all the port mappings
 	status       *k8s.LoadBalancerStatus // basically to store ingress IP address
+	lastError    string                  // error of the last failed update, if it failed
+	hostname     string                  // public DNS name, see HostnameAnnotation
+	// whether the node accepts the connections to the service ports itself,
+	// see nodeServesPorts
+	nodeServesPorts bool
 }
 
 type clientInterface interface {
-	AddPortMapping(host string, externalPort uint16, proto string, internalPort uint16, internalIP string, enabled bool, desc string, lease uint32) error
-	DeletePortMapping(host string, externalPort uint16, proto string) error
+	AddPortMapping(ctx context.Context, host string, externalPort uint16, proto string, internalPort uint16, internalIP string, enabled bool, desc string, lease uint32) error
+	DeletePortMapping(ctx context.Context, host string, externalPort uint16, proto string) error
+	GetExternalIPAddress(ctx context.Context) (string, error)
+	GetStatusInfo(ctx context.Context) (status string, lastConnectionError string, uptime uint32, err error)
+	GetSpecificPortMappingEntry(ctx context.Context, host string, externalPort uint16, proto string) (*portMappingEntry, error)
+}
+
+// portMappingLister is a gateway listing the port mappings it owns, for the
+// stale ones to be cleaned
+type portMappingLister interface {
+	// ListPortMappings lists the port mappings of the cluster, the ones whose
+	// description is of one of its load balancers
+	ListPortMappings(ctx context.Context, clusterName string) ([]listedPortMapping, error)
+}
+
+// transactionalClient is a gateway staging the changes of its port mappings
+// until applied, for a load balancer to move to its new port mappings at once,
+// or not at all
+type transactionalClient interface {
+	// Begin starts staging the changes
+	Begin(ctx context.Context) error
+	// Commit applies the changes staged since Begin
+	Commit(ctx context.Context) error
+	// Rollback drops the changes staged since Begin
+	Rollback(ctx context.Context) error
+}
+
+// unwrapClient returns the client of the gateway under the dry run and
+// resilient clients
+func unwrapClient(client clientInterface) clientInterface {
+	if dryRun, ok := client.(*dryRunClient); ok {
+		client = dryRun.client
+	}
+	if resilient, ok := client.(*resilientClient); ok {
+		client = resilient.client
+	}
+	return client
+}
+
+// clientTransaction returns the transaction of the gateway client if it is a
+// transactionalClient, through the resilient client. The dry run client has
+// none.
+func clientTransaction(client clientInterface) (transactionalClient, bool) {
+	switch c := client.(type) {
+	case *resilientClient:
+		return c.transaction()
+	case transactionalClient:
+		return c, true
+	}
+	return nil, false
+}
+
+// listedPortMapping is a port mapping listed by a portMappingLister
+type listedPortMapping struct {
+	externalPort uint16
+	proto        string
+	portMappingEntry
+}
+
+// portMappingEntry is a port mapping as reported by the gateway
+type portMappingEntry struct {
+	internalPort  uint16
+	internalIP    string
+	enabled       bool
+	desc          string
+	leaseDuration uint32
 }
 
 // LoadBalancer store the data for Load Balancer API Edge cloud provider
@@ -88,47 +205,59 @@ type LoadBalancer struct {
 	localAddress net.IP
 	// External IP is the IP of the public side of the NATP mappings
 	externalIP net.IP
+	// All the WAN connections discovered, selectable using LoadBalancerIP
+	wanConnections []wanConnection
+	// Circuit breaker shared by the clients of the WAN connections of the gateway
+	breaker *circuitBreaker
+	// Only record the changes of the port mappings, see dryRunClient
+	dryRun bool
+	// Type of the load balancers implemented by the gateway, the type of
+	// UPnP IGD if empty
+	loadBalancerType string
+	// Whether the state of the load balancers was loaded: until then, the
+	// port mappings of the gateway are not known to be stale
+	stateLoaded bool
+	// Discovers the gateway again when it disappears or changes
+	discover func() (*gateway, error)
+	// Time of the last discovery of the gateway
+	lastDiscovery time.Time
+	// Serializes the API calls and the changes of gateway
+	mutex sync.Mutex
+	// Lease duration of the port mappings
+	leaseDuration portMappingLeaseDuration
+	// Name of the cluster given to the API calls, whose port mappings only are
+	// cleaned when stale: none until the first call
+	clusterName string
 	// List of known active load balancers
 	loadBalancers map[string]loadBalancer
+	// Addresses of the hostnames of the load balancers, a map[string]dnsRecord
+	// published by publishDNSRecords for the DNS responder
+	dnsRecords atomic.Value
+	// Kubernetes client, to annotate the services with their status
+	kubeClient kubernetes.Interface
+	// Kubernetes dynamic client, to persist the state in EdgeLoadBalancers
+	dynamicClient dynamic.Interface
+	// Recorder of the events of the services
+	eventRecorder record.EventRecorder
+	// External IPs of the ingress controllers, by class
+	ingressClasses map[string]ingressExposure
+	// Triggers the propagation of the external IPs of the ingress controllers
+	ingressTrigger chan struct{}
 }
 
-// NewLoadBalancer setup internal fields of LoadBalancer
-func NewLoadBalancer() (*LoadBalancer, error) {
-	lb := &LoadBalancer{}
-	// get UPnP client
-	clients, suberrors, err := internetgateway2.NewWANIPConnection2Clients()
-	if err != nil {
-		klog.Errorf("NewLoadBalancer: client error (with %d suberrors): %v", len(suberrors), err)
-		for i, suberror := range suberrors {
-			klog.Errorf("NewLoadBalancer: client suberror #%d of %d: %v", i, len(suberrors), suberror)
-		}
-		return nil, err
-	}
-	if len(clients) < 1 {
-		klog.Errorf("NewLoadBalancer: no clients available")
-		return nil, fmt.Errorf("no clients available")
-	}
-	if len(clients) > 1 {
-		klog.Warningf("NewLoadBalancer: client warning: more than one client: using client #0 of %d (maybe wrongly!)", len(clients))
-		for i, client := range clients {
-			klog.Warningf("NewLoadBalancer: client #%d of %d: %v", i, len(clients), client)
-		}
-	}
-	client := clients[0]
-	lb.client = client
-	// get local address
-	lb.localAddress = getLocalAddressToHost(client.ServiceClient.Location.Hostname())
-	// get external address
-	externalIP, err := getExternalIP()
-	if err != nil {
-		klog.Errorf("NewLoadBalancer: error: external IP: %v", err)
-		return nil, err
+// NewLoadBalancer setup internal fields of LoadBalancer. The gateway is
+// discovered in the background by runGatewayManager: until then, the API calls
+// fail with a retriable error.
+func NewLoadBalancer() *LoadBalancer {
+	registerMetrics()
+	setGatewayReachable(false)
+	return &LoadBalancer{
+		breaker:        newCircuitBreaker(),
+		discover:       discoverGateway,
+		loadBalancers:  make(map[string]loadBalancer),
+		ingressClasses: make(map[string]ingressExposure),
+		ingressTrigger: make(chan struct{}, 1),
 	}
-	lb.externalIP = externalIP
-	// init map
-	lb.loadBalancers = make(map[string]loadBalancer)
-	klog.Infof("NewLoadBalancer: addresses: {local: %s, external: %s}", lb.localAddress.String(), lb.externalIP.String())
-	return lb, nil
 }
 
 ///////////////////////////////////////////////////////////////////////////////
@@ -140,6 +269,11 @@ func NewLoadBalancer() (*LoadBalancer, error) {
 // Implementations must treat the *v1.Service parameter as read-only and not modify it.
 // Parameter 'clusterName' is the name of the cluster as presented to kube-controller-manager
 func (lb *LoadBalancer) GetLoadBalancer(ctx context.Context, clusterName string, service *k8s.Service) (status *k8s.LoadBalancerStatus, exists bool, err error) {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+	if lb.client == nil {
+		return nil, false, errGatewayNotAvailable
+	}
 	name := lb.GetLoadBalancerName(ctx, clusterName, service)
 	if loadBalancer, exists := lb.loadBalancers[name]; exists {
 		return loadBalancer.status, true, nil
@@ -203,43 +337,96 @@ func (lb *LoadBalancer) EnsureLoadBalancerDeleted(ctx context.Context, clusterNa
 
 func (lb *LoadBalancer) ensureOrUpdateLoadBalancer(ctx context.Context, clusterName string, service *k8s.Service, nodes []*k8s.Node,
 	ensure ensureOrUpdate, isDelete isDeleteOrIsNotDelete) (*loadBalancer, error) {
-	err := lb.validateParametersOfLoadBalancer(ctx, clusterName, service, nodes)
+	// the status annotation is computed with the mutex held, and sent after
+	var statusPatch []byte
+	defer func() { lb.patchStatusAnnotation(service, statusPatch) }()
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+	defer lb.publishDNSRecords()
+	lb.clusterName = clusterName
+	var err error
+	if isDelete {
+		err = lb.validateTypeOfLoadBalancer(ctx, clusterName, service)
+	} else {
+		err = lb.validateParametersOfLoadBalancer(ctx, clusterName, service, nodes)
+	}
 	if err != nil {
 		return nil, err
 	}
-	nodeIP := ""
-	if !isDelete {
-		nodeIP, err = getFirstNodeInternalIP(nodes)
-		if err != nil {
-			return nil, err
-		}
+	if lb.client == nil {
+		return nil, errGatewayNotAvailable
 	}
 	name := lb.GetLoadBalancerName(ctx, clusterName, service)
 	// getting current load balancer
 	oldLoadBalancer, oldExisted := lb.loadBalancers[name]
-	if !oldExisted {
-		if !ensure {
-			return nil, fmt.Errorf("cannot update load balancer '%s': not found", name)
+	if !oldExisted && !bool(ensure) {
+		return nil, fmt.Errorf("cannot update load balancer '%s': not found", name)
+	}
+	// getting the WAN connection (not needed to delete a known load balancer)
+	externalIP := ""
+	nodeIP := ""
+	unknownWAN := false
+	if !(bool(isDelete) && oldExisted) {
+		wan, err := lb.getWANConnection(service.Spec.LoadBalancerIP)
+		if err != nil && !isDelete {
+			return nil, fmt.Errorf("load balancer '%s': LoadBalancerIP: %v", name, err)
+		}
+		if err != nil {
+			// never ensured, as no WAN connection owns its IP: nothing to delete
+			klog.V(3).Infof("ensureOrUpdateLoadBalancer: %s: LoadBalancerIP: %v: no port mappings to delete", name, err)
+			unknownWAN = true
+			wan = lb.defaultWANConnection()
 		}
-		if isDelete {
-			oldLoadBalancer = newLoadBalancerWithPortMappings(service, nodeIP /* is "" */, lb.externalIP.String()) // for delete, assume unknown state is all installed (on a potentially unknown nodeIP, it shouldn't matter)
+		externalIP = wan.externalIP.String()
+		if !isDelete {
+			// keep the node already in use, so clients stay pinned to it
+			nodeIP, err = selectNodeInternalIP(name, nodes, oldLoadBalancer.nodeIP, wan.localAddress.String(), lb.localNodeOnly())
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if !oldExisted {
+		if bool(isDelete) && !unknownWAN {
+			oldLoadBalancer = newLoadBalancerWithPortMappings(service, nodeIP /* is "" */, externalIP) // for delete, assume unknown state is all installed (on a potentially unknown nodeIP, it shouldn't matter)
 		} else {
-			oldLoadBalancer = newLoadBalancerWithoutPortMappings(lb.externalIP.String()) // for not delete (create), assume unknown state is nothing installed
+			oldLoadBalancer = newLoadBalancerWithoutPortMappings(externalIP) // for not delete (create), or on an unknown WAN, assume unknown state is nothing installed
 		}
 	}
 	// getting target load balancer
 	var newLoadBalancer loadBalancer
 	if isDelete {
-		newLoadBalancer = newLoadBalancerWithoutPortMappings(lb.externalIP.String()) // for delete, target state is nothing installed
+		newLoadBalancer = newLoadBalancerWithoutPortMappings(externalIP) // for delete, target state is nothing installed
 	} else {
-		newLoadBalancer = newLoadBalancerWithPortMappings(service, nodeIP, lb.externalIP.String()) // for not delete (create), target state is all installed
+		newLoadBalancer = newLoadBalancerWithPortMappings(service, nodeIP, externalIP) // for not delete (create), target state is all installed
 	}
 	// move from old to new
-	err = lb.patchLoadBalancer(name, oldLoadBalancer.portMappings, newLoadBalancer.portMappings)
+	results, err := lb.patchLoadBalancer(ctx, name, oldLoadBalancer.portMappings, newLoadBalancer.portMappings)
+	recordMappingMetrics(results, lb.dryRun)
+	lb.recordMappingEvents(service, results)
+	statusPatch = lb.statusAnnotationPatch(service, getPortMappingStatuses(oldLoadBalancer.portMappings, newLoadBalancer.portMappings, results))
 	if err != nil {
+		lb.saveStateError(service, err)
+		if oldExisted {
+			oldLoadBalancer.lastError = err.Error()
+			lb.loadBalancers[name] = oldLoadBalancer
+		}
 		return nil, err
 	}
-	// update load balancer map
+	// update load balancer map and state
+	serviceName := fmt.Sprintf("%s/%s", service.Namespace, service.Name)
+	if isDelete {
+		lb.deleteState(service)
+		setActivePortMappings(serviceName, nil)
+		lb.updateIngressExposure(service, nil)
+	} else {
+		if newLoadBalancer.hostname != "" {
+			newLoadBalancer.nodeServesPorts = nodeServesPorts(ctx, nodeIP, newLoadBalancer.portMappings)
+		}
+		lb.saveState(clusterName, service, &newLoadBalancer)
+		setActivePortMappings(serviceName, &newLoadBalancer)
+		lb.updateIngressExposure(service, &newLoadBalancer)
+	}
 	if bool(isDelete) && oldExisted {
 		delete(lb.loadBalancers, name)
 		return nil, nil
@@ -259,61 +446,94 @@ func newLoadBalancerWithoutPortMappings(externalIP string) loadBalancer {
 }
 
 func newLoadBalancerWithPortMappings(service *k8s.Service, nodeIP string, externalIP string) loadBalancer {
+	servicePorts := exposedServicePorts(service)
 	lb := loadBalancer{
-		portMappings: make([]portMapping, len(service.Spec.Ports)),
+		portMappings: make([]portMapping, len(servicePorts)),
+		nodeIP:       nodeIP,
 		status: &k8s.LoadBalancerStatus{
 			Ingress: []k8s.LoadBalancerIngress{{IP: externalIP}},
 		},
+		hostname: serviceHostname(service),
 	}
-	for i, servicePort := range service.Spec.Ports {
+	for i, servicePort := range servicePorts {
 		lb.portMappings[i].servicePort = servicePort
 		lb.portMappings[i].nodeIP = nodeIP
+		lb.portMappings[i].externalIP = externalIP
 	}
 	return lb
 }
 
-func (lb *LoadBalancer) patchLoadBalancer(prefix string, old, new []portMapping) error {
+// patchLoadBalancer moves the gateway from the 'old' to the 'new' port
+// mappings, returning the results of the operations performed on the gateway
+// (stopping on the first error). The operations are rolled back on error when
+// the gateway is a transactionalClient.
+func (lb *LoadBalancer) patchLoadBalancer(ctx context.Context, prefix string, old, new []portMapping) ([]mappingResult, error) {
+	transaction, ok := clientTransaction(lb.client)
+	if !ok || lb.dryRun {
+		return lb.patchPortMappings(ctx, prefix, old, new)
+	}
+	if err := transaction.Begin(ctx); err != nil {
+		return nil, err
+	}
+	results, err := lb.patchPortMappings(ctx, prefix, old, new)
+	if err == nil {
+		if err = transaction.Commit(ctx); err == nil {
+			return results, nil
+		}
+	}
+	if rollbackErr := transaction.Rollback(ctx); rollbackErr != nil {
+		klog.Errorf("patchLoadBalancer: %s: rollback: %v", prefix, rollbackErr)
+		return results, err
+	}
+	for i := range results {
+		if results[i].err == nil {
+			results[i].err = fmt.Errorf("rolled back: %v", err)
+		}
+	}
+	return results, err
+}
+
+// patchPortMappings performs the operations of patchLoadBalancer
+func (lb *LoadBalancer) patchPortMappings(ctx context.Context, prefix string, old, new []portMapping) ([]mappingResult, error) {
+	results := make([]mappingResult, 0)
 	// create 'portMappingsToAdd' map from 'new.PortMappings'
-	toBeAddedPortMappings := make(map[portMapping]bool)
-	for _, portMapping := range new {
-		toBeAddedPortMappings[portMapping] = true
+	toBeAddedPortMappings := make(map[portMapping]int) // index in 'new'
+	for i, portMapping := range new {
+		toBeAddedPortMappings[portMapping.key()] = i
 	}
 
 	// iterate old port mappings ...
 	for _, portMapping := range old {
-		if _, exists := toBeAddedPortMappings[portMapping]; exists { // ... if one already in new ...
-			delete(toBeAddedPortMappings, portMapping) // ... remove it from 'to be added' set
+		if i, exists := toBeAddedPortMappings[portMapping.key()]; exists { // ... if one already in new ...
+			new[i].samePort = portMapping.samePort           // ... keep the adaptations to the gateway ...
+			new[i].leaseExpiry = portMapping.leaseExpiry     // ... and the lease ...
+			delete(toBeAddedPortMappings, portMapping.key()) // ... remove it from 'to be added' set
 		} else {
-			err := lb.deletePortMapping(&portMapping)
+			err := lb.deletePortMapping(ctx, &portMapping)
+			results = append(results, mappingResult{portMapping: portMapping, operation: mappingDelete, err: err})
 			if err != nil {
-				return err
+				return results, err
 			}
 		}
 	}
 
 	// iterate to be added list and add them
-	for portMapping := range toBeAddedPortMappings {
-		err := lb.addPortMapping(prefix, &portMapping)
+	for _, i := range toBeAddedPortMappings {
+		err := lb.addPortMapping(ctx, prefix, &new[i])
+		results = append(results, mappingResult{portMapping: new[i], operation: mappingAdd, err: err})
 		if err != nil {
-			return err
+			return results, err
 		}
 	}
-	return nil
+	return results, nil
 }
 
 func (lb *LoadBalancer) validateParametersOfLoadBalancer(ctx context.Context, clusterName string, service *k8s.Service, nodes []*k8s.Node) error {
+	if err := lb.validateTypeOfLoadBalancer(ctx, clusterName, service); err != nil {
+		return err
+	}
 	loadBalancerName := lb.GetLoadBalancerName(ctx, clusterName, service)
 	errCtx := fmt.Sprintf("%s: %s", fname(), loadBalancerName)
-	lbType, ok := service.Annotations[LoadBalancerTypeAnnotation]
-	if !ok {
-		// TODO: don't return error, just log
-		klog.Infof("%s: missing '%s' annotation", errCtx, LoadBalancerTypeAnnotation)
-		return fmt.Errorf("%s: missing '%s' annotation", errCtx, LoadBalancerTypeAnnotation)
-	}
-	if lbType != UniversalPlugAndPlayInternetGatewayDeviceLoadBalancerType {
-		// TODO: don't return error, just log
-		return fmt.Errorf("%s: unssuported load balancer type (annotation '%s=%s')", errCtx, LoadBalancerTypeAnnotation, lbType)
-	}
 	if service.Spec.Type != k8s.ServiceTypeLoadBalancer {
 		return fmt.Errorf("%s: ServiceType must be '%s'", errCtx, k8s.ServiceTypeLoadBalancer)
 	}
@@ -326,11 +546,11 @@ func (lb *LoadBalancer) validateParametersOfLoadBalancer(ctx context.Context, cl
 	if service.Spec.IPFamily != nil && *service.Spec.IPFamily != k8s.IPv4Protocol {
 		return fmt.Errorf("%s: IPFamily must be %v: IPFamily '%v' not supported", errCtx, k8s.IPv4Protocol, service.Spec.IPFamily)
 	}
-	if service.Spec.SessionAffinity != k8s.ServiceAffinityNone {
-		return fmt.Errorf("%s: SessionAffinity must be %s: SessionAffinity '%s' not supported", errCtx, k8s.ServiceAffinityNone, service.Spec.SessionAffinity)
+	if service.Spec.SessionAffinity != k8s.ServiceAffinityNone && service.Spec.SessionAffinity != k8s.ServiceAffinityClientIP {
+		return fmt.Errorf("%s: SessionAffinity must be %s or %s: SessionAffinity '%s' not supported", errCtx, k8s.ServiceAffinityNone, k8s.ServiceAffinityClientIP, service.Spec.SessionAffinity)
 	}
-	if service.Spec.LoadBalancerIP != "" {
-		klog.Warningf("%s: ignoring LoadBalancerIP: '%s'", errCtx, service.Spec.LoadBalancerIP)
+	if service.Spec.LoadBalancerIP != "" && net.ParseIP(service.Spec.LoadBalancerIP) == nil {
+		return fmt.Errorf("%s: LoadBalancerIP must be a valid IP address: '%s'", errCtx, service.Spec.LoadBalancerIP)
 	}
 	if len(service.Spec.LoadBalancerSourceRanges) > 0 {
 		// TODO: implement basic source range restriction functionality
@@ -341,51 +561,176 @@ func (lb *LoadBalancer) validateParametersOfLoadBalancer(ctx context.Context, cl
 		if port.Protocol != k8s.ProtocolTCP && port.Protocol != k8s.ProtocolUDP {
 			return fmt.Errorf("%s: port mapping for port %s: unsupported protocol %s", errCtx, port.Name, port.Protocol)
 		}
-		if port.TargetPort.Type == intstr.String {
-			return fmt.Errorf("%s: port mapping for port %s: unsupported TargetPort type String", errCtx, port.Name)
-		}
 		if port.NodePort == 0 {
 			return fmt.Errorf("%s: port mapping for port %s: a valid NodePort must be declared", errCtx, port.Name)
 		}
 	}
+	if class, ok := service.Annotations[IngressClassAnnotation]; ok {
+		if class == "" {
+			return fmt.Errorf("%s: annotation '%s' must not be empty", errCtx, IngressClassAnnotation)
+		}
+		if len(exposedServicePorts(service)) == 0 {
+			return fmt.Errorf("%s: ingress controller: no port 80 nor 443", errCtx)
+		}
+	}
+	return nil
+}
+
+// validateTypeOfLoadBalancer checks that the load balancer of the service is
+// of the type implemented. It is the only check before deleting a load
+// balancer, as the service may not want one anymore.
+func (lb *LoadBalancer) validateTypeOfLoadBalancer(ctx context.Context, clusterName string, service *k8s.Service) error {
+	loadBalancerName := lb.GetLoadBalancerName(ctx, clusterName, service)
+	errCtx := fmt.Sprintf("%s: %s", fname(), loadBalancerName)
+	lbType, ok := service.Annotations[LoadBalancerTypeAnnotation]
+	if !ok {
+		// TODO: don't return error, just log
+		klog.Infof("%s: missing '%s' annotation", errCtx, LoadBalancerTypeAnnotation)
+		return fmt.Errorf("%s: missing '%s' annotation", errCtx, LoadBalancerTypeAnnotation)
+	}
+	if lbType != lb.getLoadBalancerType() {
+		// TODO: don't return error, just log
+		return fmt.Errorf("%s: unssuported load balancer type (annotation '%s=%s')", errCtx, LoadBalancerTypeAnnotation, lbType)
+	}
 	return nil
 }
 
-func (lb *LoadBalancer) addPortMapping(descPrefix string, pm *portMapping) error {
+// localNodeOnly returns whether the gateway only accepts port mappings to the
+// node requesting them, like the UPnP IGD gateways do. The other gateways
+// forward to any node.
+func (lb *LoadBalancer) localNodeOnly() bool {
+	return lb.getLoadBalancerType() == UniversalPlugAndPlayInternetGatewayDeviceLoadBalancerType
+}
+
+// getLoadBalancerType returns the type of the load balancers implemented by
+// the gateway
+func (lb *LoadBalancer) getLoadBalancerType() string {
+	if lb.loadBalancerType == "" {
+		return UniversalPlugAndPlayInternetGatewayDeviceLoadBalancerType
+	}
+	return lb.loadBalancerType
+}
+
+func (lb *LoadBalancer) addPortMapping(ctx context.Context, descPrefix string, pm *portMapping) error {
+	wan, err := lb.getWANConnection(pm.externalIP)
+	if err != nil {
+		return err
+	}
 	// Check that the client is running in the target node (otherwise UPnP usually reject the request)
-	clientIP := lb.localAddress.String()
-	if pm.nodeIP != "" && pm.nodeIP != clientIP {
+	clientIP := wan.localAddress.String()
+	if lb.localNodeOnly() && pm.nodeIP != "" && pm.nodeIP != clientIP {
 		return fmt.Errorf("The local client (%s) cant be used to setup mappings to %s", clientIP, pm.nodeIP)
 	}
 
-	externalPort := uint16(pm.servicePort.Port)
 	proto := string(pm.servicePort.Protocol)
 	internalPort := uint16(pm.servicePort.NodePort)
 	internalIP := pm.nodeIP
-	desc := fmt.Sprintf("%s/%s", descPrefix, pm.servicePort.Name)
-	lease := uint32(infinitePortMappingLeaseDuration)
-
-	return lb.client.AddPortMapping("", externalPort, proto, internalPort, internalIP, true, desc, lease)
+	desc := portMappingDescription(descPrefix, pm.servicePort.Name)
+
+	for attempt := 1; ; attempt++ {
+		externalPort := uint16(pm.externalPort())
+		lease := uint32(lb.leaseDuration)
+		err = wan.client.AddPortMapping(ctx, "", externalPort, proto, internalPort, internalIP, true, desc, lease)
+		if err == nil {
+			pm.leaseExpiry = time.Time{}
+			if lease > 0 {
+				pm.leaseExpiry = time.Now().Add(time.Duration(lease) * time.Second)
+			}
+			return nil
+		}
+		class := classifyMappingError(mappingAdd, err)
+		klog.V(3).Infof("addPortMapping: %s: attempt %d of %d: %v: %s", pm, attempt, maxMappingAttempts, err, class)
+		switch class {
+		case errorAdaptSamePort:
+			if pm.samePort {
+				return err
+			}
+			klog.Warningf("addPortMapping: %s: the gateway requires the same external and internal ports: using external port %d", pm, pm.servicePort.NodePort)
+			pm.samePort = true
+		case errorAdaptPermanentLease:
+			if lb.leaseDuration == infinitePortMappingLeaseDuration {
+				return err
+			}
+			klog.Warningf("addPortMapping: %s: the gateway only supports permanent leases: using them from now on", pm)
+			lb.leaseDuration = infinitePortMappingLeaseDuration
+		case errorIgnore:
+			return nil
+		default:
+			// transient errors were already retried by the client
+			return err
+		}
+		if attempt >= maxMappingAttempts {
+			return err
+		}
+	}
 }
 
-func (lb *LoadBalancer) deletePortMapping(pm *portMapping) error {
-	externalPort := uint16(pm.servicePort.Port)
+func (lb *LoadBalancer) deletePortMapping(ctx context.Context, pm *portMapping) error {
+	wan, err := lb.getWANConnection(pm.externalIP)
+	if err != nil {
+		return err
+	}
+	externalPort := uint16(pm.externalPort())
 	proto := string(pm.servicePort.Protocol)
-	return lb.client.DeletePortMapping("", externalPort, proto)
+	err = wan.client.DeletePortMapping(ctx, "", externalPort, proto)
+	if err == nil {
+		return nil
+	}
+	class := classifyMappingError(mappingDelete, err)
+	klog.V(3).Infof("deletePortMapping: %s: %v: %s", pm, err, class)
+	if class == errorIgnore {
+		return nil
+	}
+	return err
 }
 
-func getFirstNodeInternalIP(nodes []*k8s.Node) (string, error) {
-	errCtx := "" // TODO: add ctx
-	if len(nodes) != 1 {
-		return "", fmt.Errorf("%s: unsupported number of nodes: must be exactly 1 (%d given)", errCtx, len(nodes))
+// selectNodeInternalIP returns the internal IP of the node targeted by the
+// port mappings of a load balancer. All the mappings of a load balancer target
+// a single node, so all the clients of a service reach the same node and
+// kube-proxy applies the ClientIP session affinity from there.
+// To keep the clients pinned, the selection is stable: the current node is kept
+// while it is still available, otherwise the local node, running the client of
+// the gateway, is preferred, and finally the first node by name. When the
+// gateway only accepts mappings to the local node (localOnly), it is the only
+// one selected.
+func selectNodeInternalIP(errCtx string, nodes []*k8s.Node, currentIP string, localIP string, localOnly bool) (string, error) {
+	if len(nodes) < 1 {
+		return "", fmt.Errorf("%s: unsupported number of nodes: must be at least 1 (%d given)", errCtx, len(nodes))
+	}
+
+	nodeIPs := make(map[string]string) // by node name
+	for _, node := range nodes {
+		for _, address := range node.Status.Addresses {
+			if address.Type == k8s.NodeInternalIP {
+				nodeIPs[node.Name] = address.Address
+				break
+			}
+		}
+	}
+	if len(nodeIPs) < 1 {
+		return "", fmt.Errorf("%s: error getting internal IP of any of the %d nodes given", errCtx, len(nodes))
 	}
 
-	for _, address := range nodes[0].Status.Addresses {
-		if address.Type == k8s.NodeInternalIP {
-			return address.Address, nil
+	names := make([]string, 0, len(nodeIPs))
+	for name := range nodeIPs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	preferredIPs := []string{currentIP, localIP}
+	if localOnly {
+		preferredIPs = []string{localIP}
+	}
+	for _, preferredIP := range preferredIPs {
+		for _, name := range names {
+			if preferredIP != "" && nodeIPs[name] == preferredIP {
+				return preferredIP, nil
+			}
 		}
 	}
-	return "", fmt.Errorf("%s: error getting node '%s' internal IP", errCtx, nodes[0].Name)
+	if localOnly {
+		return "", fmt.Errorf("%s: the local node (%s) is not one of the %d nodes given: the gateway only accepts port mappings to it", errCtx, localIP, len(nodes))
+	}
+	return nodeIPs[names[0]], nil
 }
 
 func getLocalAddressToHost(host string) net.IP {
@@ -404,7 +749,9 @@ func getLocalAddressToHost(host string) net.IP {
 	return net.ParseIP(strings.Split(conn.LocalAddr().String(), ":")[0])
 }
 
-func getExternalIP() (net.IP, error) {
+// getExternalIP returns the public IP, as seen by external services. The
+// tests replace it, to run offline.
+var getExternalIP = func() (net.IP, error) {
 	return externalip.DefaultConsensus(nil, nil).ExternalIP()
 }
 
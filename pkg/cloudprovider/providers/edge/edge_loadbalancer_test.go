@@ -17,11 +17,17 @@ limitations under the License.
 package edge
 
 import (
+	"context"
+	"fmt"
 	"net"
 	"reflect"
+	"sort"
+	"strings"
 	"testing"
 
 	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
 )
 
 type mapping struct {
@@ -29,25 +35,44 @@ type mapping struct {
 	externalPort uint16
 	internalIP   string
 	internalPort uint16
+	lease        uint32
 }
 
 type mockClient struct {
-	t              *testing.T
-	removed, added []mapping
+	t                       *testing.T
+	externalIP              string
+	addErrors, deleteErrors map[uint16][]error // by external port, returned once each
+	addCalls, deleteCalls   int
+	connectionStatus        string // Connected if unset
+	removed, added          []mapping
 }
 
-func (client *mockClient) AddPortMapping(host string, externalPort uint16, proto string, internalPort uint16, internalIP string, enabled bool, desc string, lease uint32) (err error) {
+func popError(errors map[uint16][]error, externalPort uint16) error {
+	if len(errors[externalPort]) == 0 {
+		return nil
+	}
+	err := errors[externalPort][0]
+	errors[externalPort] = errors[externalPort][1:]
+	return err
+}
+
+func (client *mockClient) AddPortMapping(ctx context.Context, host string, externalPort uint16, proto string, internalPort uint16, internalIP string, enabled bool, desc string, lease uint32) (err error) {
 	mapping := mapping{
 		proto:        proto,
 		externalPort: externalPort,
 		internalIP:   internalIP,
 		internalPort: internalPort,
+		lease:        lease,
+	}
+	client.addCalls++
+	if err := popError(client.addErrors, externalPort); err != nil {
+		return err
 	}
 	client.added = append(client.added, mapping)
 	return nil
 }
 
-func (client *mockClient) DeletePortMapping(host string, externalPort uint16, proto string) (err error) {
+func (client *mockClient) DeletePortMapping(ctx context.Context, host string, externalPort uint16, proto string) (err error) {
 	if client.added != nil {
 		client.t.Errorf("unexpected AddPortMapping before DeletePortMapping")
 	}
@@ -55,10 +80,40 @@ func (client *mockClient) DeletePortMapping(host string, externalPort uint16, pr
 		proto:        proto,
 		externalPort: externalPort,
 	}
+	client.deleteCalls++
+	if err := popError(client.deleteErrors, externalPort); err != nil {
+		return err
+	}
 	client.removed = append(client.removed, mapping)
 	return nil
 }
 
+func (client *mockClient) GetExternalIPAddress(ctx context.Context) (string, error) {
+	return client.externalIP, nil
+}
+
+func (client *mockClient) GetStatusInfo(ctx context.Context) (string, string, uint32, error) {
+	if client.connectionStatus == "" {
+		return "Connected", "ERROR_NONE", 3600, nil
+	}
+	return client.connectionStatus, "ERROR_NO_CARRIER", 0, nil
+}
+
+func (client *mockClient) GetSpecificPortMappingEntry(ctx context.Context, host string, externalPort uint16, proto string) (*portMappingEntry, error) {
+	for i := len(client.added) - 1; i >= 0; i-- {
+		mapping := client.added[i]
+		if mapping.externalPort == externalPort && mapping.proto == proto {
+			return &portMappingEntry{
+				internalPort:  mapping.internalPort,
+				internalIP:    mapping.internalIP,
+				enabled:       true,
+				leaseDuration: mapping.lease,
+			}, nil
+		}
+	}
+	return nil, newUPnPError(upnpNoSuchEntryInArray)
+}
+
 func newMockClient(t *testing.T) *mockClient {
 	return &mockClient{t: t}
 }
@@ -110,7 +165,7 @@ func TestPatchLoadBalancer(t *testing.T) {
 			nodeIP: nodeIP,
 		},
 	}
-	err := lb.patchLoadBalancer("foo", oldMapping, newMapping)
+	_, err := lb.patchLoadBalancer(context.TODO(), "foo", oldMapping, newMapping)
 	if err != nil {
 		t.Errorf("unexpected error %v", err)
 	}
@@ -137,3 +192,608 @@ func TestPatchLoadBalancer(t *testing.T) {
 		t.Errorf("got %v\nwant %v", actualAdded, expectedAdded)
 	}
 }
+
+func sortMappings(mappings []mapping) []mapping {
+	sort.Slice(mappings, func(i, j int) bool {
+		if mappings[i].externalPort != mappings[j].externalPort {
+			return mappings[i].externalPort < mappings[j].externalPort
+		}
+		return mappings[i].proto < mappings[j].proto
+	})
+	return mappings
+}
+
+func TestValidateParametersOfLoadBalancerNamedTargetPort(t *testing.T) {
+	lb := LoadBalancer{}
+	service := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "svc",
+			Namespace:   "default",
+			Annotations: map[string]string{LoadBalancerTypeAnnotation: UniversalPlugAndPlayInternetGatewayDeviceLoadBalancerType},
+		},
+		Spec: v1.ServiceSpec{
+			Type:            v1.ServiceTypeLoadBalancer,
+			SessionAffinity: v1.ServiceAffinityNone,
+			Ports: []v1.ServicePort{
+				{
+					Name:       "http",
+					Protocol:   "TCP",
+					Port:       8080,
+					NodePort:   30080,
+					TargetPort: intstr.FromString("http"),
+				},
+			},
+		},
+	}
+	err := lb.validateParametersOfLoadBalancer(context.TODO(), "kubernetes", service, nil)
+	if err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestPatchLoadBalancerNamedTargetPort(t *testing.T) {
+	nodeIP := "192.0.2.1"
+	mockClient := newMockClient(t)
+	lb := LoadBalancer{
+		client:       mockClient,
+		localAddress: net.ParseIP(nodeIP),
+	}
+	oldMapping := []portMapping{
+		{ // Target port changes from number to name: unchanged mapping
+			servicePort: v1.ServicePort{
+				Name:       "http",
+				Protocol:   "TCP",
+				Port:       8080,
+				NodePort:   30080,
+				TargetPort: intstr.FromInt(80),
+			},
+			nodeIP: nodeIP,
+		},
+	}
+	newMapping := []portMapping{
+		{
+			servicePort: v1.ServicePort{
+				Name:       "http",
+				Protocol:   "TCP",
+				Port:       8080,
+				NodePort:   30080,
+				TargetPort: intstr.FromString("http"),
+			},
+			nodeIP: nodeIP,
+		},
+		{ // This will be added
+			servicePort: v1.ServicePort{
+				Name:       "https",
+				Protocol:   "TCP",
+				Port:       8443,
+				NodePort:   30443,
+				TargetPort: intstr.FromString("https"),
+			},
+			nodeIP: nodeIP,
+		},
+	}
+	_, err := lb.patchLoadBalancer(context.TODO(), "foo", oldMapping, newMapping)
+	if err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	if mockClient.removed != nil {
+		t.Errorf("got %v\nwant no removed mappings", mockClient.removed)
+	}
+	actualAdded := mockClient.added
+	expectedAdded := []mapping{
+		{
+			proto:        "TCP",
+			externalPort: 8443,
+			internalIP:   nodeIP,
+			internalPort: 30443,
+		},
+	}
+	if !reflect.DeepEqual(actualAdded, expectedAdded) {
+		t.Errorf("got %v\nwant %v", actualAdded, expectedAdded)
+	}
+}
+
+func TestPatchLoadBalancerSameTargetPortNameAcrossProtocols(t *testing.T) {
+	nodeIP := "192.0.2.1"
+	mockClient := newMockClient(t)
+	lb := LoadBalancer{
+		client:       mockClient,
+		localAddress: net.ParseIP(nodeIP),
+	}
+	newMapping := []portMapping{
+		{
+			servicePort: v1.ServicePort{
+				Name:       "dns-tcp",
+				Protocol:   "TCP",
+				Port:       53,
+				NodePort:   30053,
+				TargetPort: intstr.FromString("dns"),
+			},
+			nodeIP: nodeIP,
+		},
+		{
+			servicePort: v1.ServicePort{
+				Name:       "dns-udp",
+				Protocol:   "UDP",
+				Port:       53,
+				NodePort:   30053,
+				TargetPort: intstr.FromString("dns"),
+			},
+			nodeIP: nodeIP,
+		},
+	}
+	_, err := lb.patchLoadBalancer(context.TODO(), "foo", nil, newMapping)
+	if err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	actualAdded := sortMappings(mockClient.added)
+	expectedAdded := []mapping{
+		{
+			proto:        "TCP",
+			externalPort: 53,
+			internalIP:   nodeIP,
+			internalPort: 30053,
+		},
+		{
+			proto:        "UDP",
+			externalPort: 53,
+			internalIP:   nodeIP,
+			internalPort: 30053,
+		},
+	}
+	if !reflect.DeepEqual(actualAdded, expectedAdded) {
+		t.Errorf("got %v\nwant %v", actualAdded, expectedAdded)
+	}
+
+	// Removing only the UDP port must keep the TCP one.
+	mockClient = newMockClient(t)
+	lb.client = mockClient
+	_, err = lb.patchLoadBalancer(context.TODO(), "foo", newMapping, newMapping[:1])
+	if err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	expectedRemoved := []mapping{
+		{
+			proto:        "UDP",
+			externalPort: 53,
+		},
+	}
+	if !reflect.DeepEqual(mockClient.removed, expectedRemoved) {
+		t.Errorf("got %v\nwant %v", mockClient.removed, expectedRemoved)
+	}
+	if mockClient.added != nil {
+		t.Errorf("got %v\nwant no added mappings", mockClient.added)
+	}
+}
+
+func TestPatchLoadBalancerReorderedPorts(t *testing.T) {
+	nodeIP := "192.0.2.1"
+	mockClient := newMockClient(t)
+	lb := LoadBalancer{
+		client:       mockClient,
+		localAddress: net.ParseIP(nodeIP),
+	}
+	http := portMapping{
+		servicePort: v1.ServicePort{
+			Name:       "http",
+			Protocol:   "TCP",
+			Port:       80,
+			NodePort:   30080,
+			TargetPort: intstr.FromString("http"),
+		},
+		nodeIP: nodeIP,
+	}
+	https := portMapping{
+		servicePort: v1.ServicePort{
+			Name:       "https",
+			Protocol:   "TCP",
+			Port:       443,
+			NodePort:   30443,
+			TargetPort: intstr.FromInt(8443),
+		},
+		nodeIP: nodeIP,
+	}
+	_, err := lb.patchLoadBalancer(context.TODO(), "foo", []portMapping{http, https}, []portMapping{https, http})
+	if err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	if mockClient.removed != nil || mockClient.added != nil {
+		t.Errorf("got removed %v and added %v\nwant no changes", mockClient.removed, mockClient.added)
+	}
+}
+
+func newTestService(loadBalancerIP string) *v1.Service {
+	return &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "svc",
+			Namespace:   "default",
+			Annotations: map[string]string{LoadBalancerTypeAnnotation: UniversalPlugAndPlayInternetGatewayDeviceLoadBalancerType},
+		},
+		Spec: v1.ServiceSpec{
+			Type:            v1.ServiceTypeLoadBalancer,
+			SessionAffinity: v1.ServiceAffinityNone,
+			LoadBalancerIP:  loadBalancerIP,
+			Ports: []v1.ServicePort{
+				{
+					Name:       "http",
+					Protocol:   "TCP",
+					Port:       8080,
+					NodePort:   30080,
+					TargetPort: intstr.FromInt(80),
+				},
+			},
+		},
+	}
+}
+
+func newTestNode(name, internalIP string) *v1.Node {
+	return &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Status: v1.NodeStatus{
+			Addresses: []v1.NodeAddress{{Type: v1.NodeInternalIP, Address: internalIP}},
+		},
+	}
+}
+
+func TestEnsureLoadBalancerSelectsWANConnectionByLoadBalancerIP(t *testing.T) {
+	nodeIP := "192.0.2.1"
+	wan1 := newMockClient(t)
+	wan1.externalIP = "198.51.100.1"
+	wan2 := newMockClient(t)
+	wan2.externalIP = "203.0.113.1"
+	lb := LoadBalancer{
+		client:       wan1,
+		localAddress: net.ParseIP(nodeIP),
+		externalIP:   net.ParseIP(wan1.externalIP),
+		wanConnections: []wanConnection{
+			{client: wan1, localAddress: net.ParseIP(nodeIP), externalIP: net.ParseIP(wan1.externalIP)},
+			{client: wan2, localAddress: net.ParseIP(nodeIP), externalIP: net.ParseIP(wan2.externalIP)},
+		},
+		loadBalancers: make(map[string]loadBalancer),
+	}
+	nodes := []*v1.Node{newTestNode("node", nodeIP)}
+	expected := []mapping{
+		{
+			proto:        "TCP",
+			externalPort: 8080,
+			internalIP:   nodeIP,
+			internalPort: 30080,
+		},
+	}
+
+	// Requesting the second WAN external IP creates the mapping there
+	status, err := lb.EnsureLoadBalancer(context.TODO(), "kubernetes", newTestService(wan2.externalIP), nodes)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if status.Ingress[0].IP != wan2.externalIP {
+		t.Errorf("got ingress IP %s\nwant %s", status.Ingress[0].IP, wan2.externalIP)
+	}
+	if wan1.added != nil {
+		t.Errorf("got %v added on the first WAN\nwant none", wan1.added)
+	}
+	if !reflect.DeepEqual(wan2.added, expected) {
+		t.Errorf("got %v\nwant %v", wan2.added, expected)
+	}
+
+	// Removing LoadBalancerIP moves the mapping to the default WAN
+	wan2.added = nil
+	status, err = lb.EnsureLoadBalancer(context.TODO(), "kubernetes", newTestService(""), nodes)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if status.Ingress[0].IP != wan1.externalIP {
+		t.Errorf("got ingress IP %s\nwant %s", status.Ingress[0].IP, wan1.externalIP)
+	}
+	if !reflect.DeepEqual(wan2.removed, []mapping{{proto: "TCP", externalPort: 8080}}) {
+		t.Errorf("got %v removed on the second WAN\nwant the previous mapping", wan2.removed)
+	}
+	if !reflect.DeepEqual(wan1.added, expected) {
+		t.Errorf("got %v\nwant %v", wan1.added, expected)
+	}
+}
+
+func TestGetWANConnectionConsensusIPOfSecondWAN(t *testing.T) {
+	nodeIP := "192.0.2.1"
+	wan1 := newMockClient(t)
+	wan1.externalIP = "198.51.100.1"
+	wan2 := newMockClient(t)
+	wan2.externalIP = "203.0.113.1"
+	// the public IP services see the external IP of the second WAN
+	lb := LoadBalancer{
+		client:       wan1,
+		localAddress: net.ParseIP(nodeIP),
+		externalIP:   net.ParseIP(wan2.externalIP),
+		wanConnections: []wanConnection{
+			{client: wan1, localAddress: net.ParseIP(nodeIP), externalIP: net.ParseIP(wan1.externalIP)},
+			{client: wan2, localAddress: net.ParseIP(nodeIP), externalIP: net.ParseIP(wan2.externalIP)},
+		},
+		loadBalancers: make(map[string]loadBalancer),
+	}
+	for externalIP, expected := range map[string]*mockClient{"": wan1, wan1.externalIP: wan1, wan2.externalIP: wan2} {
+		wan, err := lb.getWANConnection(externalIP)
+		if err != nil || wan.client != expected || wan.externalIP.String() != expected.externalIP {
+			t.Errorf("%q: got %+v, %v\nwant the WAN connection of %s", externalIP, wan, err, expected.externalIP)
+		}
+	}
+	_, err := lb.getWANConnection("203.0.113.99")
+	if err == nil || !strings.Contains(err.Error(), "available: 198.51.100.1, 203.0.113.1)") {
+		t.Errorf("got %v\nwant the external IPs of the WAN connections available", err)
+	}
+}
+
+func TestEnsureLoadBalancerUnknownLoadBalancerIP(t *testing.T) {
+	nodeIP := "192.0.2.1"
+	wan1 := newMockClient(t)
+	wan1.externalIP = "198.51.100.1"
+	lb := LoadBalancer{
+		client:         wan1,
+		localAddress:   net.ParseIP(nodeIP),
+		externalIP:     net.ParseIP(wan1.externalIP),
+		wanConnections: []wanConnection{{client: wan1, localAddress: net.ParseIP(nodeIP), externalIP: net.ParseIP(wan1.externalIP)}},
+		loadBalancers:  make(map[string]loadBalancer),
+	}
+	nodes := []*v1.Node{newTestNode("node", nodeIP)}
+	_, err := lb.EnsureLoadBalancer(context.TODO(), "kubernetes", newTestService("203.0.113.99"), nodes)
+	if err == nil {
+		t.Errorf("expected error for a LoadBalancerIP not owned by any WAN connection")
+	}
+	if wan1.added != nil {
+		t.Errorf("got %v\nwant no added mappings", wan1.added)
+	}
+	if _, exists := lb.loadBalancers["kubernetes/default/svc"]; exists {
+		t.Errorf("unexpected load balancer stored after error")
+	}
+
+	// Never ensured, it is deleted without deleting any mapping
+	err = lb.EnsureLoadBalancerDeleted(context.TODO(), "kubernetes", newTestService("203.0.113.99"))
+	if err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	if wan1.removed != nil {
+		t.Errorf("got %v\nwant no removed mappings", wan1.removed)
+	}
+}
+
+func TestSelectNodeInternalIP(t *testing.T) {
+	nodeA := newTestNode("node-a", "192.0.2.1")
+	nodeB := newTestNode("node-b", "192.0.2.2")
+	nodeC := newTestNode("node-c", "192.0.2.3")
+	noIP := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-0"}}
+	tests := []struct {
+		name      string
+		nodes     []*v1.Node
+		currentIP string
+		localIP   string
+		localOnly bool
+		expected  string
+	}{
+		{"current node kept", []*v1.Node{nodeA, nodeB, nodeC}, "192.0.2.3", "192.0.2.2", false, "192.0.2.3"},
+		{"local node preferred", []*v1.Node{nodeC, nodeA, nodeB}, "", "192.0.2.2", false, "192.0.2.2"},
+		{"current node gone", []*v1.Node{nodeA, nodeB}, "192.0.2.3", "192.0.2.2", false, "192.0.2.2"},
+		{"first by name", []*v1.Node{nodeC, nodeB, noIP}, "", "198.51.100.1", false, "192.0.2.2"},
+		{"local node only", []*v1.Node{nodeA, nodeB, nodeC}, "192.0.2.3", "192.0.2.2", true, "192.0.2.2"},
+	}
+	for _, test := range tests {
+		actual, err := selectNodeInternalIP("test", test.nodes, test.currentIP, test.localIP, test.localOnly)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+		}
+		if actual != test.expected {
+			t.Errorf("%s: got %s\nwant %s", test.name, actual, test.expected)
+		}
+	}
+	if _, err := selectNodeInternalIP("test", nil, "", "", false); err == nil {
+		t.Errorf("expected error for no nodes")
+	}
+	if _, err := selectNodeInternalIP("test", []*v1.Node{noIP}, "", "", false); err == nil {
+		t.Errorf("expected error for nodes without internal IP")
+	}
+	if _, err := selectNodeInternalIP("test", []*v1.Node{nodeA, nodeB}, "", "192.0.2.3", true); err == nil {
+		t.Errorf("expected error for the local node not given")
+	}
+}
+
+func TestEnsureLoadBalancerAfterLeaderFailover(t *testing.T) {
+	oldLeaderIP := "192.0.2.1"
+	newLeaderIP := "192.0.2.2"
+	nodes := []*v1.Node{newTestNode("node-a", oldLeaderIP), newTestNode("node-b", newLeaderIP)}
+	tests := []struct {
+		loadBalancerType string
+		expectedNodeIP   string
+	}{
+		// UPnP gateways only accept mappings to the new leader
+		{UniversalPlugAndPlayInternetGatewayDeviceLoadBalancerType, newLeaderIP},
+		// the other gateways keep the clients pinned to the node
+		{RouterOSLoadBalancerType, oldLeaderIP},
+	}
+	for _, test := range tests {
+		client := newMockClient(t)
+		lb := LoadBalancer{
+			client:           client,
+			localAddress:     net.ParseIP(newLeaderIP),
+			externalIP:       net.ParseIP("198.51.100.1"),
+			loadBalancerType: test.loadBalancerType,
+			loadBalancers:    make(map[string]loadBalancer),
+		}
+		service := newTestService("")
+		service.Annotations[LoadBalancerTypeAnnotation] = test.loadBalancerType
+		// as loaded from the state saved by the previous leader
+		lb.loadBalancers["kubernetes/default/svc"] = newLoadBalancerWithPortMappings(service, oldLeaderIP, "198.51.100.1")
+
+		err := lb.UpdateLoadBalancer(context.TODO(), "kubernetes", service, nodes)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", test.loadBalancerType, err)
+			continue
+		}
+		if nodeIP := lb.loadBalancers["kubernetes/default/svc"].nodeIP; nodeIP != test.expectedNodeIP {
+			t.Errorf("%s: got node %s\nwant %s", test.loadBalancerType, nodeIP, test.expectedNodeIP)
+		}
+	}
+}
+
+func TestEnsureLoadBalancerClientIPSessionAffinity(t *testing.T) {
+	localIP := "192.0.2.2"
+	client := newMockClient(t)
+	client.externalIP = "198.51.100.1"
+	lb := LoadBalancer{
+		client:        client,
+		localAddress:  net.ParseIP(localIP),
+		externalIP:    net.ParseIP(client.externalIP),
+		loadBalancers: make(map[string]loadBalancer),
+	}
+	service := newTestService("")
+	service.Spec.SessionAffinity = v1.ServiceAffinityClientIP
+	nodeA := newTestNode("node-a", "192.0.2.1")
+	nodeB := newTestNode("node-b", localIP)
+	nodeC := newTestNode("node-c", "192.0.2.3")
+
+	_, err := lb.EnsureLoadBalancer(context.TODO(), "kubernetes", service, []*v1.Node{nodeA, nodeB})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	expected := []mapping{
+		{
+			proto:        "TCP",
+			externalPort: 8080,
+			internalIP:   localIP,
+			internalPort: 30080,
+		},
+	}
+	if !reflect.DeepEqual(client.added, expected) {
+		t.Errorf("got %v\nwant %v", client.added, expected)
+	}
+
+	// Node changes must not move the clients to another node
+	client.added = nil
+	err = lb.UpdateLoadBalancer(context.TODO(), "kubernetes", service, []*v1.Node{nodeC, nodeA, nodeB})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if client.added != nil || client.removed != nil {
+		t.Errorf("got removed %v and added %v\nwant no changes", client.removed, client.added)
+	}
+}
+
+func TestPatchLoadBalancerErrorHandling(t *testing.T) {
+	nodeIP := "192.0.2.1"
+	http := portMapping{
+		servicePort: v1.ServicePort{
+			Name:     "http",
+			Protocol: "TCP",
+			Port:     80,
+			NodePort: 30080,
+		},
+		nodeIP: nodeIP,
+	}
+	tests := []struct {
+		name          string
+		old, new      []portMapping
+		leaseDuration portMappingLeaseDuration
+		addErrors     []error
+		deleteErrors  []error
+		expectErr     bool
+		expectedCalls int
+		expectedAdded []mapping
+	}{
+		{
+			name:          "transient errors are retried",
+			new:           []portMapping{http},
+			addErrors:     []error{fmt.Errorf("timeout"), newUPnPError(upnpActionFailed)},
+			expectedCalls: 3,
+			expectedAdded: []mapping{{proto: "TCP", externalPort: 80, internalIP: nodeIP, internalPort: 30080}},
+		},
+		{
+			name:          "transient errors are retried a limited number of times",
+			new:           []portMapping{http},
+			addErrors:     []error{fmt.Errorf("timeout"), fmt.Errorf("timeout"), fmt.Errorf("timeout"), fmt.Errorf("timeout")},
+			expectErr:     true,
+			expectedCalls: gatewayCallBackoff.Steps + 1,
+		},
+		{
+			name:          "permanent errors are not retried",
+			new:           []portMapping{http},
+			addErrors:     []error{newUPnPError(upnpActionNotAuthorized)},
+			expectErr:     true,
+			expectedCalls: 1,
+		},
+		{
+			name:          "same port values required",
+			new:           []portMapping{http},
+			addErrors:     []error{newUPnPError(upnpSamePortValuesRequired)},
+			expectedCalls: 2,
+			expectedAdded: []mapping{{proto: "TCP", externalPort: 30080, internalIP: nodeIP, internalPort: 30080}},
+		},
+		{
+			name:          "only permanent leases supported",
+			new:           []portMapping{http},
+			leaseDuration: 3600,
+			addErrors:     []error{newUPnPError(upnpOnlyPermanentLeasesSupported)},
+			expectedCalls: 2,
+			expectedAdded: []mapping{{proto: "TCP", externalPort: 80, internalIP: nodeIP, internalPort: 30080, lease: 0}},
+		},
+		{
+			name:          "no such entry on delete",
+			old:           []portMapping{http},
+			deleteErrors:  []error{newUPnPError(upnpNoSuchEntryInArray)},
+			expectedCalls: 1,
+		},
+	}
+	for _, test := range tests {
+		client := newMockClient(t)
+		client.addErrors = map[uint16][]error{80: test.addErrors}
+		client.deleteErrors = map[uint16][]error{80: test.deleteErrors}
+		lb := LoadBalancer{
+			client:        newTestResilientClient(client),
+			localAddress:  net.ParseIP(nodeIP),
+			leaseDuration: test.leaseDuration,
+		}
+		_, err := lb.patchLoadBalancer(context.TODO(), "foo", test.old, test.new)
+		if test.expectErr != (err != nil) {
+			t.Errorf("%s: got error %v\nwant error: %v", test.name, err, test.expectErr)
+		}
+		if calls := client.addCalls + client.deleteCalls; calls != test.expectedCalls {
+			t.Errorf("%s: got %d calls\nwant %d", test.name, calls, test.expectedCalls)
+		}
+		if !reflect.DeepEqual(client.added, test.expectedAdded) {
+			t.Errorf("%s: got %v\nwant %v", test.name, client.added, test.expectedAdded)
+		}
+	}
+}
+
+func TestEnsureLoadBalancerSamePortAdaptationIsKept(t *testing.T) {
+	nodeIP := "192.0.2.1"
+	client := newMockClient(t)
+	client.addErrors = map[uint16][]error{8080: {newUPnPError(upnpSamePortValuesRequired)}}
+	lb := LoadBalancer{
+		client:        client,
+		localAddress:  net.ParseIP(nodeIP),
+		externalIP:    net.ParseIP("198.51.100.1"),
+		loadBalancers: make(map[string]loadBalancer),
+	}
+	nodes := []*v1.Node{newTestNode("node", nodeIP)}
+	_, err := lb.EnsureLoadBalancer(context.TODO(), "kubernetes", newTestService(""), nodes)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	// Next syncs don't undo the adaptation
+	client.added = nil
+	err = lb.UpdateLoadBalancer(context.TODO(), "kubernetes", newTestService(""), nodes)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if client.added != nil || client.removed != nil {
+		t.Errorf("got removed %v and added %v\nwant no changes", client.removed, client.added)
+	}
+
+	// The mapping actually installed is deleted
+	err = lb.EnsureLoadBalancerDeleted(context.TODO(), "kubernetes", newTestService(""))
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	expected := []mapping{{proto: "TCP", externalPort: 30080}}
+	if !reflect.DeepEqual(client.removed, expected) {
+		t.Errorf("got %v\nwant %v", client.removed, expected)
+	}
+}
@@ -0,0 +1,159 @@
+/*
+Copyright 2019 Midokura
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package edge
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/legacyregistry"
+)
+
+const metricsSubsystem = "cloudprovider_edge"
+
+// Reasons of the drift repairs
+const (
+	driftGatewayChanged = "gateway_changed"
+	driftLeaseExpired   = "lease_expired"
+	driftStaleMapping   = "stale_mapping"
+)
+
+var (
+	portMappingOperations = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Subsystem:      metricsSubsystem,
+			Name:           "port_mapping_operations_total",
+			Help:           "Number of port mapping operations on the gateway, by operation, result and UPnP error code.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"operation", "result", "upnp_error_code"},
+	)
+	soapRequestDuration = metrics.NewHistogramVec(
+		&metrics.HistogramOpts{
+			Subsystem:      metricsSubsystem,
+			Name:           "soap_request_duration_seconds",
+			Help:           "Latency of the SOAP requests to the gateway, by action.",
+			Buckets:        []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"action"},
+	)
+	activePortMappings = metrics.NewGaugeVec(
+		&metrics.GaugeOpts{
+			Subsystem:      metricsSubsystem,
+			Name:           "active_port_mappings",
+			Help:           "Number of port mappings installed on the gateway, by service.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"service"},
+	)
+	gatewayReachable = metrics.NewGauge(
+		&metrics.GaugeOpts{
+			Subsystem:      metricsSubsystem,
+			Name:           "gateway_reachable",
+			Help:           "Whether the gateway is reachable (1) or not (0).",
+			StabilityLevel: metrics.ALPHA,
+		},
+	)
+	externalIPChanges = metrics.NewCounter(
+		&metrics.CounterOpts{
+			Subsystem:      metricsSubsystem,
+			Name:           "external_ip_changes_total",
+			Help:           "Number of changes of the external IP of the gateway.",
+			StabilityLevel: metrics.ALPHA,
+		},
+	)
+	leaseRenewalLag = metrics.NewHistogram(
+		&metrics.HistogramOpts{
+			Subsystem:      metricsSubsystem,
+			Name:           "lease_renewal_lag_seconds",
+			Help:           "Delay of the renewals of the port mapping leases, since they were due.",
+			Buckets:        []float64{1, 5, 15, 30, 60, 120, 300, 600},
+			StabilityLevel: metrics.ALPHA,
+		},
+	)
+	driftRepairs = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Subsystem:      metricsSubsystem,
+			Name:           "drift_repairs_total",
+			Help:           "Number of port mappings added again because the gateway lost them, by reason.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"reason"},
+	)
+)
+
+var registerMetricsOnce sync.Once
+
+// registerMetrics registers the metrics of the edge cloud provider with the
+// legacy registry, served by the cloud controller manager
+func registerMetrics() {
+	registerMetricsOnce.Do(func() {
+		legacyregistry.MustRegister(
+			portMappingOperations,
+			soapRequestDuration,
+			activePortMappings,
+			gatewayReachable,
+			externalIPChanges,
+			leaseRenewalLag,
+			driftRepairs,
+		)
+	})
+}
+
+// recordMappingMetrics counts the port mapping operations done on the gateway,
+// or only recorded in dry run
+func recordMappingMetrics(results []mappingResult, dryRun bool) {
+	for _, result := range results {
+		status, code := "success", ""
+		if dryRun {
+			status = "dry_run"
+		}
+		if result.err != nil {
+			status = strings.ToLower(mappingErrorState(result.err))
+			if upnpErr, ok := result.err.(*upnpError); ok {
+				code = strconv.Itoa(upnpErr.Code)
+			}
+		}
+		portMappingOperations.WithLabelValues(string(result.operation), status, code).Inc()
+	}
+}
+
+// setActivePortMappings sets the number of port mappings of the service, or
+// removes it if the service has no load balancer
+func setActivePortMappings(service string, loadBalancer *loadBalancer) {
+	if loadBalancer == nil {
+		activePortMappings.Delete(map[string]string{"service": service})
+		return
+	}
+	activePortMappings.WithLabelValues(service).Set(float64(len(loadBalancer.portMappings)))
+}
+
+func observeSOAPRequest(action string, start time.Time) {
+	soapRequestDuration.WithLabelValues(action).Observe(time.Since(start).Seconds())
+}
+
+func setGatewayReachable(reachable bool) {
+	if reachable {
+		gatewayReachable.Set(1)
+	} else {
+		gatewayReachable.Set(0)
+	}
+}
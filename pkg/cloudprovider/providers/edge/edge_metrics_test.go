@@ -0,0 +1,145 @@
+/*
+Copyright 2019 Midokura
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package edge
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/component-base/metrics/legacyregistry"
+)
+
+// getMetricValue returns the value of the counter or gauge with the given name
+// and labels, or of the number of observations if it is a histogram
+func getMetricValue(t *testing.T, name string, labels map[string]string) float64 {
+	families, err := legacyregistry.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+	metrics:
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if labels[label.GetName()] != label.GetValue() {
+					continue metrics
+				}
+			}
+			switch {
+			case metric.GetCounter() != nil:
+				return metric.GetCounter().GetValue()
+			case metric.GetGauge() != nil:
+				return metric.GetGauge().GetValue()
+			case metric.GetHistogram() != nil:
+				return float64(metric.GetHistogram().GetSampleCount())
+			}
+		}
+	}
+	return 0
+}
+
+func TestMappingMetrics(t *testing.T) {
+	registerMetrics()
+	nodeIP := "192.0.2.1"
+	client := newMockClient(t)
+	client.addErrors = map[uint16][]error{8443: {newUPnPError(upnpConflictInMappingEntry)}}
+	lb := LoadBalancer{
+		client:        client,
+		localAddress:  net.ParseIP(nodeIP),
+		externalIP:    net.ParseIP("198.51.100.1"),
+		loadBalancers: make(map[string]loadBalancer),
+	}
+	added := map[string]string{"operation": "add", "result": "success", "upnp_error_code": ""}
+	conflicts := map[string]string{"operation": "add", "result": "conflict", "upnp_error_code": "718"}
+	active := map[string]string{"service": "default/svc"}
+	addedBefore := getMetricValue(t, "cloudprovider_edge_port_mapping_operations_total", added)
+	conflictsBefore := getMetricValue(t, "cloudprovider_edge_port_mapping_operations_total", conflicts)
+
+	nodes := []*v1.Node{newTestNode("node", nodeIP)}
+	service := newTestService("")
+	_, err := lb.EnsureLoadBalancer(context.TODO(), "kubernetes", service, nodes)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	service.Spec.Ports = append(service.Spec.Ports, v1.ServicePort{Name: "https", Protocol: "TCP", Port: 8443, NodePort: 30443})
+	_ = lb.UpdateLoadBalancer(context.TODO(), "kubernetes", service, nodes)
+
+	if value := getMetricValue(t, "cloudprovider_edge_port_mapping_operations_total", added); value != addedBefore+1 {
+		t.Errorf("got %v added port mappings\nwant %v", value, addedBefore+1)
+	}
+	if value := getMetricValue(t, "cloudprovider_edge_port_mapping_operations_total", conflicts); value != conflictsBefore+1 {
+		t.Errorf("got %v conflicts\nwant %v", value, conflictsBefore+1)
+	}
+	if value := getMetricValue(t, "cloudprovider_edge_active_port_mappings", active); value != 1 {
+		t.Errorf("got %v active port mappings\nwant 1", value)
+	}
+}
+
+func TestRenewLeases(t *testing.T) {
+	registerMetrics()
+	now := time.Now()
+	nodeIP := "192.0.2.1"
+	client := newMockClient(t)
+	lb := LoadBalancer{
+		client:        client,
+		localAddress:  net.ParseIP(nodeIP),
+		externalIP:    net.ParseIP("198.51.100.1"),
+		leaseDuration: 3600,
+		loadBalancers: make(map[string]loadBalancer),
+	}
+	newPortMapping := func(port int32, leaseExpiry time.Time) portMapping {
+		return portMapping{
+			servicePort: v1.ServicePort{Name: fmt.Sprintf("port%d", port), Protocol: "TCP", Port: port, NodePort: port + 30000},
+			nodeIP:      nodeIP,
+			externalIP:  "198.51.100.1",
+			leaseExpiry: leaseExpiry,
+		}
+	}
+	lb.loadBalancers["kubernetes/default/svc"] = loadBalancer{
+		portMappings: []portMapping{
+			newPortMapping(80, time.Time{}),                 // permanent
+			newPortMapping(81, now.Add(time.Hour)),          // not due yet
+			newPortMapping(82, now.Add(leaseRenewalMargin)), // due
+			newPortMapping(83, now.Add(-time.Minute)),       // expired
+		},
+	}
+	renewalsBefore := getMetricValue(t, "cloudprovider_edge_lease_renewal_lag_seconds", nil)
+	repairsBefore := getMetricValue(t, "cloudprovider_edge_drift_repairs_total", map[string]string{"reason": driftLeaseExpired})
+
+	lb.renewLeases(now)
+
+	if len(client.added) != 2 || client.added[0].externalPort != 82 || client.added[1].externalPort != 83 {
+		t.Errorf("got %v\nwant ports 82 and 83 renewed", client.added)
+	}
+	for _, pm := range lb.loadBalancers["kubernetes/default/svc"].portMappings[2:] {
+		if !pm.leaseExpiry.After(now.Add(59 * time.Minute)) {
+			t.Errorf("%s: lease expiry %s not renewed", pm, pm.leaseExpiry)
+		}
+	}
+	if value := getMetricValue(t, "cloudprovider_edge_lease_renewal_lag_seconds", nil); value != renewalsBefore+2 {
+		t.Errorf("got %v renewals\nwant %v", value, renewalsBefore+2)
+	}
+	if value := getMetricValue(t, "cloudprovider_edge_drift_repairs_total", map[string]string{"reason": driftLeaseExpired}); value != repairsBefore+1 {
+		t.Errorf("got %v drift repairs\nwant %v", value, repairsBefore+1)
+	}
+}
@@ -0,0 +1,594 @@
+/*
+Copyright 2019 Midokura
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package edge
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+)
+
+const (
+	// openWrtSectionPrefix prefixes the names of the redirect sections of the
+	// firewall config owned by the edge cloud provider, followed by the hash
+	// of the cluster, the protocol and the external port
+	openWrtSectionPrefix = "edge_cloud_provider_"
+	// openWrtDefaultWAN is the logical network interface, and the firewall
+	// zone, of the WAN in the default configuration of OpenWrt
+	openWrtDefaultWAN = "wan"
+	// openWrtDefaultLAN is the logical network interface of the LAN in the
+	// default configuration of OpenWrt
+	openWrtDefaultLAN = "lan"
+	// openWrtNullSession is the session of the login calls
+	openWrtNullSession = "00000000000000000000000000000000"
+	// openWrtApplyTimeout is the time, in seconds, the router waits for the
+	// confirmation of the applied changes before rolling them back
+	openWrtApplyTimeout = 30
+	// openWrtAccessDenied is the JSON-RPC error of the calls of an expired
+	// session
+	openWrtAccessDenied = -32002
+)
+
+// ubusStatuses are the messages of the ubus statuses, by status
+var ubusStatuses = []string{
+	"success", "invalid command", "invalid argument", "method not found", "not found", "no response",
+	"permission denied", "request timed out", "operation not supported", "unknown error", "connection failed",
+}
+
+// openWrtError is a JSON-RPC error, or an ubus status other than success, of
+// a call
+type openWrtError struct {
+	call    string
+	code    int
+	message string
+}
+
+func (err *openWrtError) Error() string {
+	return fmt.Sprintf("ubus %s: %s (%d)", err.call, err.message, err.code)
+}
+
+// openWrtClient implements clientInterface managing the redirect sections of
+// the firewall config of an OpenWrt router through the ubus JSON-RPC
+// endpoint of rpcd, and routeBackend managing route sections of its network
+// config
+type openWrtClient struct {
+	url          string
+	httpClient   *http.Client
+	wanInterface string
+	wanZone      string
+	lanInterface string
+	// credentials returns the username and password, on every login
+	credentials func() (string, string, error)
+
+	// mutex serializes the changes of the configs, staged in the session
+	// until applied
+	mutex   sync.Mutex
+	session string
+	id      int
+}
+
+func newOpenWrtClient(address string, tlsConfig *tls.Config, credentials func() (string, string, error), wanInterface, wanZone, lanInterface string) (*openWrtClient, error) {
+	if !strings.Contains(address, "://") {
+		address = "http://" + address
+	}
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, err
+	}
+	if u.Path == "" {
+		u.Path = "/ubus"
+	}
+	if wanInterface == "" {
+		wanInterface = openWrtDefaultWAN
+	}
+	if wanZone == "" {
+		wanZone = openWrtDefaultWAN
+	}
+	if lanInterface == "" {
+		lanInterface = openWrtDefaultLAN
+	}
+	return &openWrtClient{
+		url:          u.String(),
+		httpClient:   &http.Client{Timeout: gatewayCallTimeout, Transport: &http.Transport{TLSClientConfig: tlsConfig}},
+		credentials:  credentials,
+		wanInterface: wanInterface,
+		wanZone:      wanZone,
+		lanInterface: lanInterface,
+	}, nil
+}
+
+// run runs the calls in a session, logged in when needed. They run again in
+// a new session when the session expired, as the changes staged in it are
+// lost.
+func (client *openWrtClient) run(ctx context.Context, calls func() error) error {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	for attempt := 0; ; attempt++ {
+		if client.session == "" {
+			if err := client.login(ctx); err != nil {
+				return err
+			}
+		}
+		err := calls()
+		if rpcErr, ok := err.(*openWrtError); ok && rpcErr.code == openWrtAccessDenied && attempt == 0 {
+			klog.V(4).Infof("run: %s: session expired", client.url)
+			client.session = ""
+			continue
+		}
+		return err
+	}
+}
+
+// login opens a session
+func (client *openWrtClient) login(ctx context.Context) error {
+	username, password, err := client.credentials()
+	if err != nil {
+		return fmt.Errorf("credentials: %v", err)
+	}
+	var result struct {
+		Session string `json:"ubus_rpc_session"`
+	}
+	args := map[string]string{"username": username, "password": password}
+	if err := client.rpc(ctx, openWrtNullSession, "session", "login", args, &result); err != nil {
+		return fmt.Errorf("login to %s: %v", client.url, err)
+	}
+	client.session = result.Session
+	return nil
+}
+
+// call calls the method of the object in the session, decoding its data into
+// the result if not nil
+func (client *openWrtClient) call(ctx context.Context, object, method string, args, result interface{}) error {
+	return client.rpc(ctx, client.session, object, method, args, result)
+}
+
+func (client *openWrtClient) rpc(ctx context.Context, session, object, method string, args, result interface{}) error {
+	if args == nil {
+		args = struct{}{}
+	}
+	client.id++
+	body, err := json.Marshal(map[string]interface{}{
+		"jsonrpc": "2.0",
+		"id":      client.id,
+		"method":  "call",
+		"params":  []interface{}{session, object, method, args},
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, client.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s: HTTP status %s", object, method, resp.Status)
+	}
+	var response struct {
+		Result []json.RawMessage `json:"result"`
+		Error  *struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return fmt.Errorf("%s %s: %v", object, method, err)
+	}
+	call := object + " " + method
+	if response.Error != nil {
+		return &openWrtError{call: call, code: response.Error.Code, message: response.Error.Message}
+	}
+	var status int
+	if len(response.Result) == 0 || json.Unmarshal(response.Result[0], &status) != nil {
+		return fmt.Errorf("%s: unexpected result", call)
+	}
+	if status != 0 {
+		message := "unknown status"
+		if status < len(ubusStatuses) {
+			message = ubusStatuses[status]
+		}
+		return &openWrtError{call: call, code: status, message: message}
+	}
+	if result != nil && len(response.Result) > 1 {
+		if err := json.Unmarshal(response.Result[1], result); err != nil {
+			return fmt.Errorf("%s: %v", call, err)
+		}
+	}
+	return nil
+}
+
+// commit applies the changes of the config staged by the calls, reloading
+// the firewall or the network, or reverts them when a call fails. The router
+// rolls the changes back unless they are confirmed in time, so it stays
+// reachable.
+func (client *openWrtClient) commit(ctx context.Context, config string, calls func() error) error {
+	err := calls()
+	if err == nil {
+		err = client.call(ctx, "uci", "apply", map[string]interface{}{"rollback": true, "timeout": openWrtApplyTimeout}, nil)
+	}
+	if err != nil {
+		if revertErr := client.call(ctx, "uci", "revert", map[string]string{"config": config}, nil); revertErr != nil {
+			klog.Warningf("commit: %s: %v", client.url, revertErr)
+		}
+		return err
+	}
+	return client.call(ctx, "uci", "confirm", nil, nil)
+}
+
+// openWrtSectionName returns the name of the redirect section of the port
+// mapping of the description, unique to its cluster for the routers shared by
+// several clusters
+func openWrtSectionName(desc string, externalPort uint16, proto string) string {
+	clusterName := ""
+	if owner, ok := ParsePortMappingOwner(desc); ok {
+		clusterName = owner.ClusterName
+	}
+	hash := fnv.New32a()
+	hash.Write([]byte(clusterName))
+	return fmt.Sprintf("%s%08x_%s_%d", openWrtSectionPrefix, hash.Sum32(), strings.ToLower(proto), externalPort)
+}
+
+// openWrtOption returns the value of the option of a section, lists joined
+// with spaces
+func openWrtOption(values map[string]interface{}, option string) string {
+	switch value := values[option].(type) {
+	case string:
+		return value
+	case []interface{}:
+		items := make([]string, 0, len(value))
+		for _, item := range value {
+			items = append(items, fmt.Sprint(item))
+		}
+		return strings.Join(items, " ")
+	}
+	return ""
+}
+
+// list returns the DNAT redirect sections from the WAN zone, owned by the edge
+// cloud provider or not. The sections owned are named by openWrtSectionName,
+// and have the description of their port mapping as name.
+func (client *openWrtClient) list(ctx context.Context) (routerPortMappings, error) {
+	var result struct {
+		Values map[string]map[string]interface{} `json:"values"`
+	}
+	args := map[string]string{"config": "firewall", "type": "redirect"}
+	if err := client.call(ctx, "uci", "get", args, &result); err != nil {
+		return nil, err
+	}
+	mappings := make(routerPortMappings, 0, len(result.Values))
+	for section, values := range result.Values {
+		owned := strings.HasPrefix(section, openWrtSectionPrefix)
+		if target := openWrtOption(values, "target"); target != "" && target != "DNAT" {
+			continue
+		}
+		// the redirects of the other zones don't forward the external ports
+		if !owned && openWrtOption(values, "src") != client.wanZone {
+			continue
+		}
+		firstPort, lastPort, err := parsePortRange(openWrtOption(values, "src_dport"))
+		if err != nil {
+			if owned {
+				klog.Warningf("list: %s: %v", section, err)
+			}
+			continue
+		}
+		internalPort, _, err := parsePortRange(openWrtOption(values, "dest_port"))
+		if err != nil {
+			internalPort = firstPort
+		}
+		protos := make([]string, 0, 2)
+		for _, proto := range strings.Fields(openWrtOption(values, "proto")) {
+			protos = append(protos, routerProtocols(proto)...)
+		}
+		if len(protos) == 0 {
+			protos = routerProtocols("")
+		}
+		mappings = append(mappings, routerPortMapping{
+			id:           section,
+			owned:        owned,
+			enabled:      openWrtOption(values, "enabled") != "0",
+			protos:       protos,
+			firstPort:    firstPort,
+			lastPort:     lastPort,
+			internalIP:   openWrtOption(values, "dest_ip"),
+			internalPort: internalPort,
+			desc:         openWrtOption(values, "name"),
+		})
+	}
+	return mappings, nil
+}
+
+// AddPortMapping implements clientInterface. The redirect section is
+// permanent, from the WAN zone, and replaces the sections of the port mapping.
+// The enabled redirects of other owners, or configured by hand, conflict. The
+// change is applied, and confirmed, before returning.
+func (client *openWrtClient) AddPortMapping(ctx context.Context, host string, externalPort uint16, proto string, internalPort uint16, internalIP string, enabled bool, desc string, lease uint32) error {
+	return client.run(ctx, func() error {
+		mappings, err := client.list(ctx)
+		if err != nil {
+			return err
+		}
+		current, err := mappings.claim(externalPort, proto, desc)
+		if err != nil {
+			return err
+		}
+		if current.mapped(internalIP, internalPort) {
+			return nil
+		}
+		name := openWrtSectionName(desc, externalPort, proto)
+		values := map[string]string{
+			"name":      desc,
+			"target":    "DNAT",
+			"src":       client.wanZone,
+			"src_dport": strconv.Itoa(int(externalPort)),
+			"dest_ip":   internalIP,
+			"dest_port": strconv.Itoa(int(internalPort)),
+			"proto":     strings.ToLower(proto),
+			"enabled":   "1",
+		}
+		return client.commit(ctx, "firewall", func() error {
+			exists := false
+			for _, existing := range current {
+				if existing.id == name {
+					exists = true
+				} else if err := client.call(ctx, "uci", "delete", map[string]string{"config": "firewall", "section": existing.id}, nil); err != nil {
+					return err
+				}
+			}
+			if exists {
+				return client.call(ctx, "uci", "set", map[string]interface{}{"config": "firewall", "section": name, "values": values}, nil)
+			}
+			return client.call(ctx, "uci", "add", map[string]interface{}{"config": "firewall", "type": "redirect", "name": name, "values": values}, nil)
+		})
+	})
+}
+
+// DeletePortMapping implements clientInterface, deleting the redirect
+// sections of the edge cloud provider forwarding the external port at once
+func (client *openWrtClient) DeletePortMapping(ctx context.Context, host string, externalPort uint16, proto string) error {
+	return client.run(ctx, func() error {
+		mappings, err := client.list(ctx)
+		if err != nil {
+			return err
+		}
+		current, _ := mappings.find(externalPort, proto)
+		if len(current) == 0 {
+			return newUPnPError(upnpNoSuchEntryInArray)
+		}
+		return client.commit(ctx, "firewall", func() error {
+			for _, redirect := range current {
+				if err := client.call(ctx, "uci", "delete", map[string]string{"config": "firewall", "section": redirect.id}, nil); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+}
+
+// openWrtInterfaceStatus is the status of a logical network interface
+type openWrtInterfaceStatus struct {
+	Up          bool `json:"up"`
+	IPv4Address []struct {
+		Address string `json:"address"`
+	} `json:"ipv4-address"`
+}
+
+func (client *openWrtClient) interfaceStatus(ctx context.Context) (*openWrtInterfaceStatus, error) {
+	var status openWrtInterfaceStatus
+	err := client.run(ctx, func() error {
+		return client.call(ctx, "network.interface", "status", map[string]string{"interface": client.wanInterface}, &status)
+	})
+	return &status, err
+}
+
+// GetExternalIPAddress implements clientInterface: the address of the WAN
+// interface
+func (client *openWrtClient) GetExternalIPAddress(ctx context.Context) (string, error) {
+	status, err := client.interfaceStatus(ctx)
+	if err != nil {
+		return "", err
+	}
+	if len(status.IPv4Address) == 0 {
+		return "", fmt.Errorf("no IPv4 address on %s", client.wanInterface)
+	}
+	return status.IPv4Address[0].Address, nil
+}
+
+// GetStatusInfo implements clientInterface: the WAN interface is connected
+// when up
+func (client *openWrtClient) GetStatusInfo(ctx context.Context) (string, string, uint32, error) {
+	status, err := client.interfaceStatus(ctx)
+	if err != nil {
+		return "", "", 0, err
+	}
+	if !status.Up {
+		return "Disconnected", "ERROR_NO_CARRIER", 0, nil
+	}
+	return upnpConnected, "ERROR_NONE", 0, nil
+}
+
+// GetSpecificPortMappingEntry implements clientInterface, from the redirect
+// section of the edge cloud provider forwarding the external port
+func (client *openWrtClient) GetSpecificPortMappingEntry(ctx context.Context, host string, externalPort uint16, proto string) (*portMappingEntry, error) {
+	var mappings routerPortMappings
+	err := client.run(ctx, func() (err error) {
+		mappings, err = client.list(ctx)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return mappings.entry(externalPort, proto)
+}
+
+// ListPortMappings implements portMappingLister, from the names of the
+// redirect sections
+func (client *openWrtClient) ListPortMappings(ctx context.Context, clusterName string) ([]listedPortMapping, error) {
+	var mappings routerPortMappings
+	err := client.run(ctx, func() (err error) {
+		mappings, err = client.list(ctx)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return mappings.listed(clusterName), nil
+}
+
+// openWrtRouteSectionName returns the name of the route section to the
+// destination
+func openWrtRouteSectionName(destination *net.IPNet) string {
+	return openWrtSectionPrefix + strings.NewReplacer(".", "_", "/", "_").Replace(destination.String())
+}
+
+// listRoutes returns the route sections of the network config owned by the
+// edge cloud provider, by name
+func (client *openWrtClient) listRoutes(ctx context.Context) (map[string]backendRoute, error) {
+	var result struct {
+		Values map[string]map[string]interface{} `json:"values"`
+	}
+	args := map[string]string{"config": "network", "type": "route"}
+	if err := client.call(ctx, "uci", "get", args, &result); err != nil {
+		return nil, err
+	}
+	routes := make(map[string]backendRoute)
+	for section, values := range result.Values {
+		if !strings.HasPrefix(section, openWrtSectionPrefix) {
+			continue
+		}
+		target := net.ParseIP(openWrtOption(values, "target")).To4()
+		netmask := net.ParseIP(openWrtOption(values, "netmask")).To4()
+		gateway := net.ParseIP(openWrtOption(values, "gateway"))
+		if target == nil || netmask == nil || gateway == nil {
+			klog.Warningf("listRoutes: %s: unexpected target '%s', netmask '%s' or gateway '%s'", section,
+				openWrtOption(values, "target"), openWrtOption(values, "netmask"), openWrtOption(values, "gateway"))
+			continue
+		}
+		routes[section] = backendRoute{
+			Destination: &net.IPNet{IP: target, Mask: net.IPMask(netmask)},
+			Gateway:     gateway,
+			Description: openWrtOption(values, "name"),
+		}
+	}
+	return routes, nil
+}
+
+// ListRoutes implements routeBackend
+func (client *openWrtClient) ListRoutes(ctx context.Context) ([]backendRoute, error) {
+	var routes map[string]backendRoute
+	err := client.run(ctx, func() (err error) {
+		routes, err = client.listRoutes(ctx)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	list := make([]backendRoute, 0, len(routes))
+	for _, route := range routes {
+		list = append(list, route)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Destination.String() < list[j].Destination.String()
+	})
+	return list, nil
+}
+
+// ReplaceRoute implements routeBackend, for the IPv4 routes: the route
+// sections of OpenWrt are on the LAN interface configured
+func (client *openWrtClient) ReplaceRoute(ctx context.Context, route backendRoute) error {
+	if route.Destination.IP.To4() == nil {
+		return fmt.Errorf("route %s: only IPv4 routes are supported", route)
+	}
+	return client.run(ctx, func() error {
+		routes, err := client.listRoutes(ctx)
+		if err != nil {
+			return err
+		}
+		name := openWrtRouteSectionName(route.Destination)
+		current, exists := routes[name]
+		if exists && current.Gateway.Equal(route.Gateway) && current.Description == route.Description {
+			return nil
+		}
+		values := map[string]string{
+			"name":      route.Description,
+			"interface": client.lanInterface,
+			"target":    route.Destination.IP.String(),
+			"netmask":   net.IP(route.Destination.Mask).String(),
+			"gateway":   route.Gateway.String(),
+		}
+		return client.commit(ctx, "network", func() error {
+			if exists {
+				return client.call(ctx, "uci", "set", map[string]interface{}{"config": "network", "section": name, "values": values}, nil)
+			}
+			return client.call(ctx, "uci", "add", map[string]interface{}{"config": "network", "type": "route", "name": name, "values": values}, nil)
+		})
+	})
+}
+
+// DeleteRoute implements routeBackend
+func (client *openWrtClient) DeleteRoute(ctx context.Context, route backendRoute) error {
+	return client.run(ctx, func() error {
+		routes, err := client.listRoutes(ctx)
+		if err != nil {
+			return err
+		}
+		name := openWrtRouteSectionName(route.Destination)
+		if _, exists := routes[name]; !exists {
+			return nil
+		}
+		return client.commit(ctx, "network", func() error {
+			return client.call(ctx, "uci", "delete", map[string]string{"config": "network", "section": name}, nil)
+		})
+	})
+}
+
+// discoverOpenWrt returns the discovery of the router, from the URL of its
+// ubus endpoint. The credentials are read from the Secret on every login.
+func discoverOpenWrt(kubeClient kubernetes.Interface, address string, tlsConfig *tls.Config, secretName, wanInterface, wanZone, lanInterface string) func() (*gateway, error) {
+	credentials := routerCredentials(kubeClient, secretName)
+	return func() (*gateway, error) {
+		client, err := newOpenWrtClient(address, tlsConfig, credentials, wanInterface, wanZone, lanInterface)
+		if err != nil {
+			return nil, fmt.Errorf("discoverOpenWrt: %v", err)
+		}
+		location, _ := url.Parse(client.url)
+		gw, err := routerGateway(OpenWrtLoadBalancerType, location.Host, client)
+		if err != nil {
+			return nil, fmt.Errorf("discoverOpenWrt: %v", err)
+		}
+		return gw, nil
+	}
+}
@@ -0,0 +1,288 @@
+/*
+Copyright 2019 Midokura
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package edge
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/midokura/cloud-provider-edge/pkg/cloudprovider/providers/edge/openwrttest"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func newTestOpenWrt(t *testing.T) (*openwrttest.Server, *openWrtClient) {
+	server := openwrttest.NewServer(openwrttest.Config{Password: "secret"})
+	credentials := func() (string, string, error) {
+		return "root", "secret", nil
+	}
+	client, err := newOpenWrtClient(server.URL, nil, credentials, "", "", "")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	return server, client
+}
+
+func TestOpenWrtClient(t *testing.T) {
+	server, client := newTestOpenWrt(t)
+	defer server.Close()
+	ctx := context.TODO()
+	desc := "kubernetes/default/svc/http"
+
+	if err := client.AddPortMapping(ctx, "", 80, "TCP", 30080, "192.0.2.1", true, desc, 0); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	expected := []openwrttest.Section{{Name: "edge_cloud_provider_74afb95d_tcp_80", Values: map[string]string{
+		"name": desc, "target": "DNAT", "src": "wan", "src_dport": "80", "dest_ip": "192.0.2.1", "dest_port": "30080", "proto": "tcp", "enabled": "1",
+	}}}
+	if redirects := server.Redirects(); !reflect.DeepEqual(redirects, expected) {
+		t.Errorf("got %+v\nwant %+v", redirects, expected)
+	}
+	entry, err := client.GetSpecificPortMappingEntry(ctx, "", 80, "TCP")
+	expectedEntry := &portMappingEntry{internalPort: 30080, internalIP: "192.0.2.1", enabled: true, desc: desc}
+	if err != nil || !reflect.DeepEqual(entry, expectedEntry) {
+		t.Errorf("got %+v, %v\nwant %+v", entry, err, expectedEntry)
+	}
+
+	// the same port mapping again changes nothing, a new target replaces it
+	if err := client.AddPortMapping(ctx, "", 80, "TCP", 30080, "192.0.2.1", true, desc, 0); err != nil || server.Reloads() != 1 {
+		t.Errorf("got %d reloads, %v\nwant the firewall unchanged", server.Reloads(), err)
+	}
+	if err := client.AddPortMapping(ctx, "", 80, "TCP", 30090, "192.0.2.2", true, desc, 0); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if redirects := server.Redirects(); len(redirects) != 1 || redirects[0].Values["dest_port"] != "30090" || redirects[0].Values["dest_ip"] != "192.0.2.2" {
+		t.Errorf("got %+v\nwant the redirect replaced", redirects)
+	}
+
+	// the port mappings of other owners, and the redirects by hand, are kept
+	if err := client.AddPortMapping(ctx, "", 80, "TCP", 30080, "192.0.2.1", true, "other", 0); !isUPnPError(err, upnpConflictInMappingEntry) {
+		t.Errorf("got %v\nwant ConflictInMappingEntry", err)
+	}
+	server.AddRedirect("", map[string]string{"name": "ssh", "target": "DNAT", "src": "wan", "src_dport": "22", "dest_ip": "192.168.1.2"})
+	server.AddRedirect("games", map[string]string{"name": "games", "src": "wan", "src_dport": "27000-27100", "dest_ip": "192.168.1.3", "proto": "udp"})
+	server.AddRedirect("disabled", map[string]string{"name": "disabled", "src": "wan", "src_dport": "8443", "dest_ip": "192.168.1.4", "enabled": "0"})
+	for _, port := range []struct {
+		externalPort uint16
+		proto        string
+	}{{22, "UDP"}, {27015, "UDP"}} {
+		if err := client.AddPortMapping(ctx, "", port.externalPort, port.proto, 30022, "192.0.2.1", true, desc, 0); !isUPnPError(err, upnpConflictWithOtherMechanisms) {
+			t.Errorf("%d/%s: got %v\nwant ConflictWithOtherMechanisms", port.externalPort, port.proto, err)
+		}
+	}
+	if err := client.AddPortMapping(ctx, "", 8443, "TCP", 30443, "192.0.2.1", true, "kubernetes/default/svc/https", 0); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	listed, err := client.ListPortMappings(ctx, "kubernetes")
+	if err != nil || len(listed) != 2 {
+		t.Errorf("got %+v, %v\nwant only the owned port mappings", listed, err)
+	}
+
+	if err := client.DeletePortMapping(ctx, "", 80, "TCP"); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if err := client.DeletePortMapping(ctx, "", 80, "TCP"); !isUPnPError(err, upnpNoSuchEntryInArray) {
+		t.Errorf("got %v\nwant NoSuchEntryInArray", err)
+	}
+	if err := client.DeletePortMapping(ctx, "", 22, "TCP"); !isUPnPError(err, upnpNoSuchEntryInArray) {
+		t.Errorf("got %v\nwant the redirect by hand kept", err)
+	}
+	if redirects := server.Redirects(); len(redirects) != 4 {
+		t.Errorf("got %+v\nwant the redirects by hand and of 8443", redirects)
+	}
+	if pending := server.Pending(); pending != 0 {
+		t.Errorf("got %d sessions with pending changes\nwant none", pending)
+	}
+}
+
+func TestOpenWrtClientOwnership(t *testing.T) {
+	server, client := newTestOpenWrt(t)
+	defer server.Close()
+	ctx := context.TODO()
+	desc := "kubernetes/default/svc/http"
+
+	// the redirects from the other zones don't forward the external ports
+	server.AddRedirect("guest", map[string]string{"name": "guest", "target": "DNAT", "src": "guest", "src_dport": "80", "dest_ip": "192.168.2.2"})
+	if err := client.AddPortMapping(ctx, "", 80, "TCP", 30080, "192.0.2.1", true, desc, 0); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	// the sections named without the cluster hash are replaced
+	server.AddRedirect("edge_cloud_provider_tcp_8080", map[string]string{
+		"name": desc, "target": "DNAT", "src": "wan", "src_dport": "8080", "dest_ip": "192.0.2.1", "dest_port": "30080", "proto": "tcp",
+	})
+	if err := client.AddPortMapping(ctx, "", 8080, "TCP", 30080, "192.0.2.2", true, desc, 0); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	names := make([]string, 0, 3)
+	for _, redirect := range server.Redirects() {
+		names = append(names, redirect.Name)
+	}
+	expected := []string{"edge_cloud_provider_74afb95d_tcp_80", "edge_cloud_provider_74afb95d_tcp_8080", "guest"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("got %v\nwant %v", names, expected)
+	}
+
+	// the port mappings of the other clusters are not listed
+	if err := client.AddPortMapping(ctx, "", 81, "TCP", 30081, "192.0.2.1", true, "other/default/svc/http", 0); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	listed, err := client.ListPortMappings(ctx, "kubernetes")
+	if err != nil || len(listed) != 2 {
+		t.Errorf("got %+v, %v\nwant the port mappings of 80 and 8080", listed, err)
+	}
+	if listed, err := client.ListPortMappings(ctx, "other"); err != nil || len(listed) != 1 || listed[0].externalPort != 81 {
+		t.Errorf("got %+v, %v\nwant the port mapping of 81", listed, err)
+	}
+}
+
+func TestOpenWrtClientErrors(t *testing.T) {
+	server, client := newTestOpenWrt(t)
+	defer server.Close()
+	ctx := context.TODO()
+	desc := "kubernetes/default/svc/http"
+
+	// a failed apply reverts the staged changes, the next one succeeds
+	server.FailCall("uci", "apply", 9)
+	if err := client.AddPortMapping(ctx, "", 80, "TCP", 30080, "192.0.2.1", true, desc, 0); err == nil || !strings.Contains(err.Error(), "unknown error") {
+		t.Errorf("got %v\nwant the apply error", err)
+	}
+	if redirects, pending := server.Redirects(), server.Pending(); len(redirects) != 0 || pending != 0 {
+		t.Errorf("got %+v and %d sessions with pending changes\nwant the changes reverted", redirects, pending)
+	}
+	if err := client.AddPortMapping(ctx, "", 80, "TCP", 30080, "192.0.2.1", true, desc, 0); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	// an expired session is opened again
+	server.ExpireSessions()
+	if err := client.DeletePortMapping(ctx, "", 80, "TCP"); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	if calls := server.Calls(); calls[len(calls)-1] != "uci.confirm" || server.Reloads() != 2 {
+		t.Errorf("got %v\nwant the redirect deleted in a new session", calls)
+	}
+
+	if status, _, _, err := client.GetStatusInfo(ctx); err != nil || status != upnpConnected {
+		t.Errorf("got %s, %v\nwant %s", status, err, upnpConnected)
+	}
+	server.SetUp(false)
+	if status, _, _, err := client.GetStatusInfo(ctx); err != nil || status == upnpConnected {
+		t.Errorf("got %s, %v\nwant disconnected", status, err)
+	}
+	if _, err := client.GetExternalIPAddress(ctx); err == nil {
+		t.Errorf("expected error")
+	}
+
+	wrongPassword, _ := newOpenWrtClient(server.URL, nil, func() (string, string, error) {
+		return "root", "wrong", nil
+	}, "", "", "")
+	if _, err := wrongPassword.GetExternalIPAddress(ctx); err == nil || !strings.Contains(err.Error(), "permission denied") {
+		t.Errorf("got %v\nwant a login error", err)
+	}
+}
+
+func TestOpenWrtRoutes(t *testing.T) {
+	server, client := newTestOpenWrt(t)
+	defer server.Close()
+	ctx := context.TODO()
+	server.AddRoute("", map[string]string{"interface": "lan", "target": "10.0.0.0", "netmask": "255.0.0.0", "gateway": "192.168.1.254"})
+
+	route := newTestRoute("10.42.1.0/24", "192.0.2.1", "kubernetes/node")
+	if err := client.ReplaceRoute(ctx, route); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	route.Gateway = net.ParseIP("192.0.2.2")
+	if err := client.ReplaceRoute(ctx, route); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	expected := []openwrttest.Section{
+		{Name: "cfg000001", Values: map[string]string{"interface": "lan", "target": "10.0.0.0", "netmask": "255.0.0.0", "gateway": "192.168.1.254"}},
+		{Name: "edge_cloud_provider_10_42_1_0_24", Values: map[string]string{
+			"name":      "kubernetes/node",
+			"interface": "lan",
+			"target":    "10.42.1.0",
+			"netmask":   "255.255.255.0",
+			"gateway":   "192.0.2.2",
+		}},
+	}
+	if routes := server.Routes(); !reflect.DeepEqual(routes, expected) {
+		t.Errorf("got %+v\nwant %+v", routes, expected)
+	}
+	// the routes configured by hand are not listed
+	routes, err := client.ListRoutes(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if !reflect.DeepEqual(routes, []backendRoute{route}) {
+		t.Errorf("got %v\nwant %v", routes, []backendRoute{route})
+	}
+	if err := client.ReplaceRoute(ctx, newTestRoute("fd00:42:1::/64", "2001:db8::1", "kubernetes/node")); err == nil {
+		t.Errorf("expected error")
+	}
+
+	if err := client.DeleteRoute(ctx, route); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if routes := server.Routes(); !reflect.DeepEqual(routes, expected[:1]) {
+		t.Errorf("got %+v\nwant %+v", routes, expected[:1])
+	}
+	if server.Pending() != 0 {
+		t.Errorf("got %d sessions with pending changes\nwant none", server.Pending())
+	}
+}
+
+func TestOpenWrtLoadBalancer(t *testing.T) {
+	server := openwrttest.NewServer(openwrttest.Config{})
+	defer server.Close()
+	secret := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "openwrt", Namespace: "kube-system"},
+		Data:       map[string][]byte{"username": []byte("root"), "password": []byte("")},
+	}
+	lb := NewLoadBalancer()
+	lb.loadBalancerType = OpenWrtLoadBalancerType
+	lb.discover = discoverOpenWrt(fake.NewSimpleClientset(secret), server.URL, nil, "kube-system/openwrt", "", "", "")
+	lb.checkGateway()
+	if !lb.hasGateway() {
+		t.Fatalf("got no gateway\nwant the router")
+	}
+
+	service := newTestService("")
+	service.Annotations[LoadBalancerTypeAnnotation] = OpenWrtLoadBalancerType
+	nodes := []*v1.Node{newTestNode("node", lb.localAddress.String())}
+	status, err := lb.EnsureLoadBalancer(context.TODO(), "kubernetes", service, nodes)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if status.Ingress[0].IP != "198.51.100.1" {
+		t.Errorf("got %+v\nwant the external IP of the router", status)
+	}
+	redirects := server.Redirects()
+	if len(redirects) != 1 || redirects[0].Name != "edge_cloud_provider_74afb95d_tcp_8080" || redirects[0].Values["name"] != "kubernetes/default/svc/http" {
+		t.Errorf("got %+v\nwant the redirect of the service", redirects)
+	}
+	if err := lb.EnsureLoadBalancerDeleted(context.TODO(), "kubernetes", service); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if redirects := server.Redirects(); len(redirects) != 0 {
+		t.Errorf("got %+v\nwant no redirects", redirects)
+	}
+}
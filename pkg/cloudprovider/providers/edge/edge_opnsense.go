@@ -0,0 +1,661 @@
+/*
+Copyright 2019 Midokura
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package edge
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+)
+
+const (
+	// opnsenseOwnerTag prefixes the descriptions of the port forward rules
+	// owned by the edge cloud provider, followed by the description of the
+	// port mapping
+	opnsenseOwnerTag = "edge-cloud-provider:"
+	// opnsenseAliasPrefix prefixes the names of the host aliases of the
+	// services, the targets of their port forward rules
+	opnsenseAliasPrefix = "edge_"
+	// opnsenseDefaultWANInterface is the identifier of the WAN interface in
+	// the default configuration of OPNsense
+	opnsenseDefaultWANInterface = "wan"
+)
+
+// opnsenseError is an error reported by the firewall
+type opnsenseError struct {
+	endpoint string
+	message  string
+}
+
+func (err *opnsenseError) Error() string {
+	return fmt.Sprintf("OPNsense %s: %s", err.endpoint, err.message)
+}
+
+// opnsenseDestination is the destination of a port forward rule
+type opnsenseDestination struct {
+	Network string `json:"network"`
+	Port    string `json:"port"`
+}
+
+// opnsenseRule is a port forward rule of the destination NAT
+type opnsenseRule struct {
+	UUID        string              `json:"uuid,omitempty"`
+	Disabled    string              `json:"disabled"`
+	Interface   string              `json:"interface"`
+	IPProtocol  string              `json:"ipprotocol"`
+	Protocol    string              `json:"protocol"`
+	Destination opnsenseDestination `json:"destination"`
+	Target      string              `json:"target"`
+	LocalPort   string              `json:"local-port"`
+	Descr       string              `json:"descr"`
+}
+
+// opnsenseAlias is a firewall alias
+type opnsenseAlias struct {
+	UUID        string `json:"uuid,omitempty"`
+	Enabled     string `json:"enabled"`
+	Name        string `json:"name"`
+	Type        string `json:"type"`
+	Content     string `json:"content"`
+	Description string `json:"description"`
+}
+
+// opnsenseClient implements clientInterface managing the port forward rules
+// of the destination NAT of an OPNsense firewall through its REST API, each
+// to the host alias of its service. It implements transactionalClient: the
+// changes are made to the configuration from a savepoint, and applied at the
+// end of the call, or of the transaction, else reverted to the savepoint.
+type opnsenseClient struct {
+	url          string
+	httpClient   *http.Client
+	wanInterface string
+	// credentials returns the API key and secret, read again when rejected
+	credentials func() (string, string, error)
+
+	mutex          sync.Mutex
+	key, secret    string
+	inTransaction  bool
+	revision       string            // savepoint of the changes not applied
+	changedAliases map[string]string // contents before the changes, by UUID
+	aliasesStaged  bool              // aliases changed, to reconfigure on apply
+}
+
+func newOPNsenseClient(address string, tlsConfig *tls.Config, credentials func() (string, string, error), wanInterface string) (*opnsenseClient, error) {
+	if !strings.Contains(address, "://") {
+		address = "https://" + address
+	}
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, err
+	}
+	if u.Path == "" {
+		u.Path = "/api"
+	}
+	if wanInterface == "" {
+		wanInterface = opnsenseDefaultWANInterface
+	}
+	return &opnsenseClient{
+		url:          strings.TrimSuffix(u.String(), "/"),
+		httpClient:   &http.Client{Timeout: gatewayCallTimeout, Transport: &http.Transport{TLSClientConfig: tlsConfig}},
+		credentials:  credentials,
+		wanInterface: wanInterface,
+	}, nil
+}
+
+// call calls the endpoint of the API, with the argument if not empty,
+// decoding the response into the result if not nil. The request is a POST
+// with the body, or a GET if nil.
+func (client *opnsenseClient) call(ctx context.Context, endpoint, argument string, body, result interface{}) error {
+	for attempt := 0; ; attempt++ {
+		if client.key == "" {
+			key, secret, err := client.credentials()
+			if err != nil {
+				return fmt.Errorf("credentials: %v", err)
+			}
+			client.key, client.secret = key, secret
+		}
+		resp, err := client.request(ctx, endpoint, argument, body)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode == http.StatusUnauthorized && attempt == 0 {
+			// the credentials may have been rotated
+			resp.Body.Close()
+			client.key = ""
+			continue
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return &opnsenseError{endpoint: endpoint, message: fmt.Sprintf("HTTP status %s", resp.Status)}
+		}
+		if result == nil {
+			return nil
+		}
+		if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+			return &opnsenseError{endpoint: endpoint, message: err.Error()}
+		}
+		return nil
+	}
+}
+
+func (client *opnsenseClient) request(ctx context.Context, endpoint, argument string, body interface{}) (*http.Response, error) {
+	u := client.url + "/" + endpoint
+	if argument != "" {
+		u += "/" + url.PathEscape(argument)
+	}
+	method := http.MethodGet
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		method = http.MethodPost
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, u, reader)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.SetBasicAuth(client.key, client.secret)
+	return client.httpClient.Do(req.WithContext(ctx))
+}
+
+// opnsenseResult is the result of the calls changing the configuration
+type opnsenseResult struct {
+	Result      string            `json:"result"`
+	Status      string            `json:"status"`
+	Message     string            `json:"message"`
+	UUID        string            `json:"uuid"`
+	Revision    string            `json:"revision"`
+	Validations map[string]string `json:"validations"`
+}
+
+// change calls an endpoint changing the configuration, checking its result
+func (client *opnsenseClient) change(ctx context.Context, endpoint, argument string, body interface{}) (*opnsenseResult, error) {
+	if body == nil {
+		body = struct{}{}
+	}
+	var result opnsenseResult
+	if err := client.call(ctx, endpoint, argument, body, &result); err != nil {
+		return nil, err
+	}
+	switch {
+	case result.Result == "saved" || result.Result == "deleted" || result.Revision != "":
+	case strings.EqualFold(result.Status, "ok"):
+	case len(result.Validations) > 0:
+		// rejected by the firewall, not to be retried
+		validations := make([]string, 0, len(result.Validations))
+		for field, validation := range result.Validations {
+			validations = append(validations, fmt.Sprintf("%s: %s", field, validation))
+		}
+		sort.Strings(validations)
+		return nil, &upnpError{Code: upnpArgumentValueInvalid, Description: fmt.Sprintf("OPNsense %s: %s", endpoint, strings.Join(validations, ", "))}
+	default:
+		message := result.Result
+		if result.Message != "" {
+			message = result.Message
+		}
+		return nil, &opnsenseError{endpoint: endpoint, message: message}
+	}
+	return &result, nil
+}
+
+// stage makes the changes, from a savepoint taken before the first ones. They
+// are applied at once unless in a transaction.
+func (client *opnsenseClient) stage(ctx context.Context, changes func() error) error {
+	if client.revision == "" {
+		result, err := client.change(ctx, "firewall/d_nat/savepoint", "", nil)
+		if err != nil {
+			return err
+		}
+		client.revision = result.Revision
+	}
+	err := changes()
+	if client.inTransaction {
+		return err
+	}
+	if err == nil {
+		err = client.apply(ctx)
+	}
+	if err != nil {
+		if rollbackErr := client.rollback(ctx); rollbackErr != nil {
+			klog.Errorf("stage: %s: %v", client.url, rollbackErr)
+		}
+	}
+	return err
+}
+
+// apply applies the changes, the aliases first for the rules to find them,
+// confirming them for the firewall not to revert to the savepoint by itself
+func (client *opnsenseClient) apply(ctx context.Context) error {
+	if client.revision == "" {
+		return nil
+	}
+	if client.aliasesStaged {
+		if _, err := client.change(ctx, "firewall/alias/reconfigure", "", nil); err != nil {
+			return err
+		}
+	}
+	if _, err := client.change(ctx, "firewall/d_nat/apply", client.revision, nil); err != nil {
+		return err
+	}
+	if _, err := client.change(ctx, "firewall/d_nat/cancel_rollback", client.revision, nil); err != nil {
+		return err
+	}
+	client.revision, client.changedAliases, client.aliasesStaged = "", nil, false
+	client.cleanAliases(ctx)
+	return nil
+}
+
+// rollback reverts the rules to the savepoint, and the aliases to their
+// contents before the changes
+func (client *opnsenseClient) rollback(ctx context.Context) error {
+	if client.revision == "" {
+		return nil
+	}
+	if _, err := client.change(ctx, "firewall/d_nat/revert", client.revision, nil); err != nil {
+		return err
+	}
+	client.revision, client.aliasesStaged = "", false
+	if len(client.changedAliases) > 0 {
+		aliases, err := client.listAliases(ctx)
+		if err != nil {
+			return err
+		}
+		for _, alias := range aliases {
+			if content, ok := client.changedAliases[alias.UUID]; ok {
+				alias.Content = content
+				if err := client.setAlias(ctx, alias); err != nil {
+					return err
+				}
+			}
+		}
+		if _, err := client.change(ctx, "firewall/alias/reconfigure", "", nil); err != nil {
+			return err
+		}
+	}
+	client.changedAliases = nil
+	client.cleanAliases(ctx)
+	return nil
+}
+
+// Begin implements transactionalClient
+func (client *opnsenseClient) Begin(ctx context.Context) error {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	client.inTransaction = true
+	return nil
+}
+
+// Commit implements transactionalClient
+func (client *opnsenseClient) Commit(ctx context.Context) error {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	client.inTransaction = false
+	return client.apply(ctx)
+}
+
+// Rollback implements transactionalClient
+func (client *opnsenseClient) Rollback(ctx context.Context) error {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	client.inTransaction = false
+	return client.rollback(ctx)
+}
+
+// opnsenseAliasName returns the name of the host alias of the service of the
+// port mapping, cluster/namespace/name
+func opnsenseAliasName(service string) string {
+	hash := fnv.New32a()
+	hash.Write([]byte(service))
+	return fmt.Sprintf("%s%08x", opnsenseAliasPrefix, hash.Sum32())
+}
+
+// opnsenseService returns the service of the description of a port mapping
+func opnsenseService(desc string) string {
+	if i := strings.LastIndex(desc, "/"); i >= 0 {
+		return desc[:i]
+	}
+	return desc
+}
+
+func (client *opnsenseClient) listRules(ctx context.Context) ([]opnsenseRule, error) {
+	var result struct {
+		Rows []opnsenseRule `json:"rows"`
+	}
+	search := map[string]interface{}{"current": 1, "rowCount": -1, "searchPhrase": ""}
+	if err := client.call(ctx, "firewall/d_nat/search_rule", "", search, &result); err != nil {
+		return nil, err
+	}
+	return result.Rows, nil
+}
+
+func (client *opnsenseClient) listAliases(ctx context.Context) ([]opnsenseAlias, error) {
+	var result struct {
+		Rows []opnsenseAlias `json:"rows"`
+	}
+	search := map[string]interface{}{"current": 1, "rowCount": -1, "searchPhrase": opnsenseAliasPrefix}
+	if err := client.call(ctx, "firewall/alias/search_item", "", search, &result); err != nil {
+		return nil, err
+	}
+	return result.Rows, nil
+}
+
+func (client *opnsenseClient) setAlias(ctx context.Context, alias opnsenseAlias) error {
+	uuid := alias.UUID
+	alias.UUID = ""
+	_, err := client.change(ctx, "firewall/alias/set_item", uuid, map[string]interface{}{"alias": alias})
+	return err
+}
+
+// cleanAliases deletes the host aliases of the services which are not the
+// target of any port forward rule anymore
+func (client *opnsenseClient) cleanAliases(ctx context.Context) {
+	rules, err := client.listRules(ctx)
+	if err != nil {
+		klog.Warningf("cleanAliases: %v", err)
+		return
+	}
+	aliases, err := client.listAliases(ctx)
+	if err != nil {
+		klog.Warningf("cleanAliases: %v", err)
+		return
+	}
+	targets := make(map[string]bool)
+	for _, rule := range rules {
+		targets[rule.Target] = true
+	}
+	deleted := false
+	for _, alias := range aliases {
+		if !strings.HasPrefix(alias.Name, opnsenseAliasPrefix) || targets[alias.Name] {
+			continue
+		}
+		if _, err := client.change(ctx, "firewall/alias/del_item", alias.UUID, nil); err != nil {
+			klog.Warningf("cleanAliases: %s: %v", alias.Name, err)
+			continue
+		}
+		deleted = true
+	}
+	if deleted {
+		if _, err := client.change(ctx, "firewall/alias/reconfigure", "", nil); err != nil {
+			klog.Warningf("cleanAliases: %v", err)
+		}
+	}
+}
+
+// list returns the port forward rules of the WAN interface, owned by the edge
+// cloud provider or not, to the content of their target alias, along with the
+// host aliases of the services. The rules owned have the description of their
+// port mapping in their description, after opnsenseOwnerTag.
+func (client *opnsenseClient) list(ctx context.Context) (routerPortMappings, []opnsenseAlias, error) {
+	rules, err := client.listRules(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	aliases, err := client.listAliases(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	mappings := make(routerPortMappings, 0, len(rules))
+	for _, rule := range rules {
+		if rule.Interface != client.wanInterface {
+			continue
+		}
+		owned := strings.HasPrefix(rule.Descr, opnsenseOwnerTag)
+		firstPort, lastPort, err := parsePortRange(rule.Destination.Port)
+		if err != nil {
+			if owned {
+				klog.Warningf("list: %s: %v", rule.UUID, err)
+			}
+			continue
+		}
+		internalPort, _, err := parsePortRange(rule.LocalPort)
+		if err != nil {
+			internalPort = firstPort
+		}
+		protos := make([]string, 0, 2)
+		for _, proto := range strings.Split(rule.Protocol, "/") {
+			protos = append(protos, routerProtocols(proto)...)
+		}
+		mappings = append(mappings, routerPortMapping{
+			id:           rule.UUID,
+			owned:        owned,
+			enabled:      rule.Disabled != "1",
+			protos:       protos,
+			firstPort:    firstPort,
+			lastPort:     lastPort,
+			internalIP:   aliasContent(aliases, rule.Target),
+			internalPort: internalPort,
+			desc:         strings.TrimPrefix(rule.Descr, opnsenseOwnerTag),
+		})
+	}
+	return mappings, aliases, nil
+}
+
+// aliasContent returns the content of the alias, or the target itself if it
+// is not an alias
+func aliasContent(aliases []opnsenseAlias, target string) string {
+	for _, alias := range aliases {
+		if alias.Name == target {
+			return alias.Content
+		}
+	}
+	return target
+}
+
+// ensureAlias adds the host alias of the service, or sets its content to the
+// internal IP, in the configuration: the firewall loads it on apply, along
+// with the rules
+func (client *opnsenseClient) ensureAlias(ctx context.Context, aliases []opnsenseAlias, service, internalIP string) error {
+	name := opnsenseAliasName(service)
+	for _, alias := range aliases {
+		if alias.Name != name {
+			continue
+		}
+		if alias.Content == internalIP {
+			return nil
+		}
+		if client.changedAliases == nil {
+			client.changedAliases = make(map[string]string)
+		}
+		if _, ok := client.changedAliases[alias.UUID]; !ok {
+			client.changedAliases[alias.UUID] = alias.Content
+		}
+		alias.Content = internalIP
+		client.aliasesStaged = true
+		return client.setAlias(ctx, alias)
+	}
+	alias := opnsenseAlias{Enabled: "1", Name: name, Type: "host", Content: internalIP, Description: opnsenseOwnerTag + service}
+	client.aliasesStaged = true
+	_, err := client.change(ctx, "firewall/alias/add_item", "", map[string]interface{}{"alias": alias})
+	return err
+}
+
+// AddPortMapping implements clientInterface. The port forward rule is
+// permanent, from the WAN interface to the host alias of the service, and
+// replaces the rules of the port mapping. The enabled rules of other owners,
+// or configured by hand, conflict. The change is staged, see stage.
+func (client *opnsenseClient) AddPortMapping(ctx context.Context, host string, externalPort uint16, proto string, internalPort uint16, internalIP string, enabled bool, desc string, lease uint32) error {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	mappings, aliases, err := client.list(ctx)
+	if err != nil {
+		return err
+	}
+	current, err := mappings.claim(externalPort, proto, desc)
+	if err != nil {
+		return err
+	}
+	if current.mapped(internalIP, internalPort) {
+		return nil
+	}
+	service := opnsenseService(desc)
+	rule := opnsenseRule{
+		Disabled:    "0",
+		Interface:   client.wanInterface,
+		IPProtocol:  "inet",
+		Protocol:    strings.ToLower(proto),
+		Destination: opnsenseDestination{Network: client.wanInterface + "ip", Port: strconv.Itoa(int(externalPort))},
+		Target:      opnsenseAliasName(service),
+		LocalPort:   strconv.Itoa(int(internalPort)),
+		Descr:       opnsenseOwnerTag + desc,
+	}
+	return client.stage(ctx, func() error {
+		if err := client.ensureAlias(ctx, aliases, service, internalIP); err != nil {
+			return err
+		}
+		if len(current) == 1 {
+			_, err := client.change(ctx, "firewall/d_nat/set_rule", current[0].id, map[string]interface{}{"rule": rule})
+			return err
+		}
+		for _, existing := range current {
+			if _, err := client.change(ctx, "firewall/d_nat/del_rule", existing.id, nil); err != nil {
+				return err
+			}
+		}
+		_, err := client.change(ctx, "firewall/d_nat/add_rule", "", map[string]interface{}{"rule": rule})
+		return err
+	})
+}
+
+// DeletePortMapping implements clientInterface, deleting the port forward
+// rules of the edge cloud provider forwarding the external port. The alias of
+// the service is deleted with its last rule, once the change is applied.
+func (client *opnsenseClient) DeletePortMapping(ctx context.Context, host string, externalPort uint16, proto string) error {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	mappings, _, err := client.list(ctx)
+	if err != nil {
+		return err
+	}
+	current, _ := mappings.find(externalPort, proto)
+	if len(current) == 0 {
+		return newUPnPError(upnpNoSuchEntryInArray)
+	}
+	return client.stage(ctx, func() error {
+		for _, existing := range current {
+			if _, err := client.change(ctx, "firewall/d_nat/del_rule", existing.id, nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// opnsenseInterface is the overview of an interface
+type opnsenseInterface struct {
+	Details struct {
+		Status string `json:"status"`
+		IPv4   []struct {
+			IPAddr string `json:"ipaddr"`
+		} `json:"ipv4"`
+	} `json:"details"`
+}
+
+func (client *opnsenseClient) getInterface(ctx context.Context) (*opnsenseInterface, error) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	var overview opnsenseInterface
+	if err := client.call(ctx, "interfaces/overview/get_interface", client.wanInterface, nil, &overview); err != nil {
+		return nil, err
+	}
+	return &overview, nil
+}
+
+// GetExternalIPAddress implements clientInterface: the address of the WAN
+// interface
+func (client *opnsenseClient) GetExternalIPAddress(ctx context.Context) (string, error) {
+	overview, err := client.getInterface(ctx)
+	if err != nil {
+		return "", err
+	}
+	if len(overview.Details.IPv4) == 0 {
+		return "", fmt.Errorf("no IPv4 address on %s", client.wanInterface)
+	}
+	return overview.Details.IPv4[0].IPAddr, nil
+}
+
+// GetStatusInfo implements clientInterface: the WAN interface is connected
+// when up
+func (client *opnsenseClient) GetStatusInfo(ctx context.Context) (string, string, uint32, error) {
+	overview, err := client.getInterface(ctx)
+	if err != nil {
+		return "", "", 0, err
+	}
+	if overview.Details.Status != "up" {
+		return "Disconnected", "ERROR_NO_CARRIER", 0, nil
+	}
+	return upnpConnected, "ERROR_NONE", 0, nil
+}
+
+// GetSpecificPortMappingEntry implements clientInterface, from the port
+// forward rule of the edge cloud provider forwarding the external port, to
+// the content of its alias
+func (client *opnsenseClient) GetSpecificPortMappingEntry(ctx context.Context, host string, externalPort uint16, proto string) (*portMappingEntry, error) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	mappings, _, err := client.list(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return mappings.entry(externalPort, proto)
+}
+
+// ListPortMappings implements portMappingLister, from the descriptions of the
+// port forward rules
+func (client *opnsenseClient) ListPortMappings(ctx context.Context, clusterName string) ([]listedPortMapping, error) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	mappings, _, err := client.list(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return mappings.listed(clusterName), nil
+}
+
+// discoverOPNsense returns the discovery of the firewall, from the URL of its
+// API. The credentials are read from the Secret again when rejected.
+func discoverOPNsense(kubeClient kubernetes.Interface, address string, tlsConfig *tls.Config, secretName, wanInterface string) func() (*gateway, error) {
+	credentials := routerCredentials(kubeClient, secretName)
+	return func() (*gateway, error) {
+		client, err := newOPNsenseClient(address, tlsConfig, credentials, wanInterface)
+		if err != nil {
+			return nil, fmt.Errorf("discoverOPNsense: %v", err)
+		}
+		location, _ := url.Parse(client.url)
+		gw, err := routerGateway(OPNsenseLoadBalancerType, location.Host, client)
+		if err != nil {
+			return nil, fmt.Errorf("discoverOPNsense: %v", err)
+		}
+		return gw, nil
+	}
+}
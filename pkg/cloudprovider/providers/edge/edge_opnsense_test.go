@@ -0,0 +1,252 @@
+/*
+Copyright 2019 Midokura
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package edge
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/midokura/cloud-provider-edge/pkg/cloudprovider/providers/edge/opnsensetest"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func newTestOPNsenseSecret(secret string) *v1.Secret {
+	return &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "opnsense", Namespace: "kube-system"},
+		Data:       map[string][]byte{"username": []byte("key"), "password": []byte(secret)},
+	}
+}
+
+func newTestOPNsenseLoadBalancer(t *testing.T, server *opnsensetest.Server, kubeClient *fake.Clientset) *LoadBalancer {
+	lb := NewLoadBalancer()
+	lb.loadBalancerType = OPNsenseLoadBalancerType
+	lb.discover = discoverOPNsense(kubeClient, server.URL, nil, "kube-system/opnsense", "")
+	lb.checkGateway()
+	if !lb.hasGateway() {
+		t.Fatalf("got no gateway\nwant the firewall")
+	}
+	return lb
+}
+
+func TestOPNsenseClient(t *testing.T) {
+	server := opnsensetest.NewServer(opnsensetest.Config{})
+	defer server.Close()
+	client, err := newOPNsenseClient(server.URL, nil, func() (string, string, error) {
+		return "key", "secret", nil
+	}, "")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	ctx := context.TODO()
+	desc := "kubernetes/default/svc/http"
+	alias := opnsenseAliasName("kubernetes/default/svc")
+
+	if err := client.AddPortMapping(ctx, "", 80, "TCP", 30080, "192.0.2.1", true, desc, 0); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	expected := []opnsensetest.Rule{{
+		UUID: server.Applied()[0].UUID, Disabled: "0", Interface: "wan", IPProtocol: "inet", Protocol: "tcp",
+		Destination: opnsensetest.Destination{Network: "wanip", Port: "80"}, Target: alias, LocalPort: "30080", Descr: "edge-cloud-provider:" + desc,
+	}}
+	if rules := server.Applied(); !reflect.DeepEqual(rules, expected) {
+		t.Errorf("got %+v\nwant %+v", rules, expected)
+	}
+	if aliases := server.Aliases(); !reflect.DeepEqual(aliases, map[string]string{alias: "192.0.2.1"}) {
+		t.Errorf("got %v\nwant the alias of the service", aliases)
+	}
+	entry, err := client.GetSpecificPortMappingEntry(ctx, "", 80, "TCP")
+	expectedEntry := &portMappingEntry{internalPort: 30080, internalIP: "192.0.2.1", enabled: true, desc: desc}
+	if err != nil || !reflect.DeepEqual(entry, expectedEntry) {
+		t.Errorf("got %+v, %v\nwant %+v", entry, err, expectedEntry)
+	}
+
+	// the same port mapping again changes nothing, a new node changes the
+	// alias of the service
+	if err := client.AddPortMapping(ctx, "", 80, "TCP", 30080, "192.0.2.1", true, desc, 0); err != nil || server.Applies() != 1 {
+		t.Errorf("got %d applies, %v\nwant the firewall unchanged", server.Applies(), err)
+	}
+	if err := client.AddPortMapping(ctx, "", 80, "TCP", 30080, "192.0.2.2", true, desc, 0); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if aliases, rules := server.Aliases(), server.Applied(); aliases[alias] != "192.0.2.2" || len(rules) != 1 || rules[0].UUID != expected[0].UUID {
+		t.Errorf("got %v, %+v\nwant the alias changed", aliases, rules)
+	}
+
+	// the port mappings of other owners, and the rules by hand, are kept
+	if err := client.AddPortMapping(ctx, "", 80, "TCP", 30080, "192.0.2.1", true, "other", 0); !isUPnPError(err, upnpConflictInMappingEntry) {
+		t.Errorf("got %v\nwant ConflictInMappingEntry", err)
+	}
+	server.AddRule(opnsensetest.Rule{Disabled: "0", Interface: "wan", Protocol: "tcp/udp", Destination: opnsensetest.Destination{Port: "27000-27100"}, Target: "192.168.1.3", Descr: "games"})
+	server.AddRule(opnsensetest.Rule{Disabled: "1", Interface: "wan", Protocol: "tcp", Destination: opnsensetest.Destination{Port: "8443"}, Target: "192.168.1.4"})
+	if err := client.AddPortMapping(ctx, "", 27015, "UDP", 30015, "192.0.2.1", true, desc, 0); !isUPnPError(err, upnpConflictWithOtherMechanisms) {
+		t.Errorf("got %v\nwant ConflictWithOtherMechanisms", err)
+	}
+	if err := client.AddPortMapping(ctx, "", 8443, "TCP", 30443, "192.0.2.2", true, "kubernetes/default/svc/https", 0); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	listed, err := client.ListPortMappings(ctx, "kubernetes")
+	if err != nil || len(listed) != 2 || listed[0].internalIP != "192.0.2.2" {
+		t.Errorf("got %+v, %v\nwant only the owned port mappings", listed, err)
+	}
+	if err := client.AddPortMapping(ctx, "", 81, "TCP", 30081, "192.0.2.2", true, "other/default/svc/http", 0); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	if listed, err := client.ListPortMappings(ctx, "kubernetes"); err != nil || len(listed) != 2 {
+		t.Errorf("got %+v, %v\nwant the port mappings of the cluster", listed, err)
+	}
+	if listed, err := client.ListPortMappings(ctx, "other"); err != nil || len(listed) != 1 || listed[0].externalPort != 81 {
+		t.Errorf("got %+v, %v\nwant the port mapping of 81", listed, err)
+	}
+
+	// the alias is deleted with the last rule of the service
+	for _, port := range []uint16{80, 81, 8443} {
+		if err := client.DeletePortMapping(ctx, "", port, "TCP"); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+	}
+	if err := client.DeletePortMapping(ctx, "", 80, "TCP"); !isUPnPError(err, upnpNoSuchEntryInArray) {
+		t.Errorf("got %v\nwant NoSuchEntryInArray", err)
+	}
+	if rules, aliases := server.Applied(), server.Aliases(); len(rules) != 2 || len(aliases) != 0 {
+		t.Errorf("got %+v, %v\nwant only the rules by hand", rules, aliases)
+	}
+
+	// a failed apply is reverted
+	server.FailCall("firewall/d_nat/apply", 0)
+	if err := client.AddPortMapping(ctx, "", 80, "TCP", 30080, "192.0.2.1", true, desc, 0); err == nil {
+		t.Errorf("expected error")
+	}
+	if rules, aliases := server.Rules(), server.Aliases(); len(rules) != 2 || len(aliases) != 0 {
+		t.Errorf("got %+v, %v\nwant the configuration reverted", rules, aliases)
+	}
+
+	if status, _, _, err := client.GetStatusInfo(ctx); err != nil || status != upnpConnected {
+		t.Errorf("got %s, %v\nwant %s", status, err, upnpConnected)
+	}
+	server.SetUp(false)
+	if status, _, _, err := client.GetStatusInfo(ctx); err != nil || status == upnpConnected {
+		t.Errorf("got %s, %v\nwant disconnected", status, err)
+	}
+}
+
+func TestOPNsenseTransaction(t *testing.T) {
+	server := opnsensetest.NewServer(opnsensetest.Config{})
+	defer server.Close()
+	lb := newTestOPNsenseLoadBalancer(t, server, fake.NewSimpleClientset(newTestOPNsenseSecret("secret")))
+	ctx := context.TODO()
+	service := newTestService("")
+	service.Annotations[LoadBalancerTypeAnnotation] = OPNsenseLoadBalancerType
+	service.Spec.Ports = append(service.Spec.Ports, v1.ServicePort{Name: "https", Protocol: "TCP", Port: 8443, NodePort: 30443})
+	nodes := []*v1.Node{newTestNode("node", lb.localAddress.String())}
+
+	// the port mapping added before the one failing is rolled back
+	server.FailCall("firewall/d_nat/add_rule", 1)
+	new := newLoadBalancerWithPortMappings(service, lb.localAddress.String(), "198.51.100.1").portMappings
+	results, err := lb.patchLoadBalancer(ctx, "kubernetes/default/svc", nil, new)
+	if err == nil || len(results) != 2 {
+		t.Fatalf("got %+v, %v\nwant the 2 port mappings failed", results, err)
+	}
+	for _, result := range results {
+		if result.err == nil {
+			t.Errorf("%s: got no error\nwant rolled back", result.portMapping)
+		}
+	}
+	if rules, applied, aliases := server.Rules(), server.Applied(), server.Aliases(); len(rules) != 0 || len(applied) != 0 || len(aliases) != 0 {
+		t.Errorf("got %+v, %+v, %v\nwant the firewall unchanged", rules, applied, aliases)
+	}
+
+	// the port mappings of a load balancer are applied at once
+	if _, err := lb.EnsureLoadBalancer(ctx, "kubernetes", service, nodes); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if applied := server.Applied(); len(applied) != 2 || server.Applies() != 1 || server.PendingRollback() != "" {
+		t.Errorf("got %+v in %d applies\nwant the 2 port mappings applied at once", applied, server.Applies())
+	}
+
+	// the alias of a new node is loaded with the rules, on Commit
+	alias := opnsenseAliasName("kubernetes/default/svc")
+	transaction, ok := clientTransaction(lb.client)
+	if !ok {
+		t.Fatalf("got no transaction\nwant the one of the firewall")
+	}
+	if err := transaction.Begin(ctx); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if err := lb.client.AddPortMapping(ctx, "", 8080, "TCP", 30080, "192.0.2.9", true, "kubernetes/default/svc/http", 0); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if loaded := server.LoadedAliases(); loaded[alias] != lb.localAddress.String() {
+		t.Errorf("got %v\nwant the alias loaded unchanged until Commit", loaded)
+	}
+	if err := transaction.Commit(ctx); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if loaded := server.LoadedAliases(); loaded[alias] != "192.0.2.9" {
+		t.Errorf("got %v\nwant the alias of the new node loaded", loaded)
+	}
+
+	// a failed update keeps the port mappings applied
+	service.Spec.Ports = append(service.Spec.Ports, v1.ServicePort{Name: "metrics", Protocol: "TCP", Port: 9090, NodePort: 30090})
+	service.Spec.Ports = service.Spec.Ports[1:]
+	server.FailCall("firewall/d_nat/apply", 0)
+	if err := lb.UpdateLoadBalancer(ctx, "kubernetes", service, nodes); err == nil || !strings.Contains(err.Error(), "apply") {
+		t.Errorf("got %v\nwant the apply error", err)
+	}
+	if rules, applied := server.Rules(), server.Applied(); len(rules) != 2 || !reflect.DeepEqual(rules, applied) || rules[0].Destination.Port != "8080" {
+		t.Errorf("got %+v, %+v\nwant the configuration reverted", rules, applied)
+	}
+	if err := lb.UpdateLoadBalancer(ctx, "kubernetes", service, nodes); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	if applied := server.Applied(); len(applied) != 2 || applied[0].Destination.Port != "8443" || applied[1].Destination.Port != "9090" {
+		t.Errorf("got %+v\nwant the ports 8443 and 9090", applied)
+	}
+
+	if err := lb.EnsureLoadBalancerDeleted(ctx, "kubernetes", service); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if applied, aliases := server.Applied(), server.Aliases(); len(applied) != 0 || len(aliases) != 0 {
+		t.Errorf("got %+v, %v\nwant no rules nor aliases", applied, aliases)
+	}
+}
+
+func TestDiscoverOPNsense(t *testing.T) {
+	server := opnsensetest.NewServer(opnsensetest.Config{})
+	defer server.Close()
+	kubeClient := fake.NewSimpleClientset(newTestOPNsenseSecret("secret"))
+	lb := newTestOPNsenseLoadBalancer(t, server, kubeClient)
+	if lb.externalIP.String() != "198.51.100.1" {
+		t.Errorf("got %s\nwant the external IP of the firewall", lb.externalIP)
+	}
+
+	// the rotated credentials are read when rejected
+	server.SetSecret("rotated")
+	if _, err := kubeClient.CoreV1().Secrets("kube-system").Update(newTestOPNsenseSecret("rotated")); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if _, err := unwrapClient(lb.client).GetExternalIPAddress(context.TODO()); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	server.SetSecret("revoked")
+	if _, err := unwrapClient(lb.client).GetExternalIPAddress(context.TODO()); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("got %v\nwant the credentials rejected", err)
+	}
+}
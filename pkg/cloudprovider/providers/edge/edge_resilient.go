@@ -0,0 +1,286 @@
+/*
+Copyright 2019 Midokura
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package edge
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog"
+)
+
+const (
+	// gatewayCallTimeout is the timeout of each call to the gateway
+	gatewayCallTimeout = 10 * time.Second
+	// circuitBreakerFailureThreshold is the number of consecutive failed calls
+	// to the gateway that opens the circuit
+	circuitBreakerFailureThreshold = 5
+	// circuitBreakerOpenDuration is the time the circuit stays open before
+	// allowing a call to check whether the gateway is back
+	circuitBreakerOpenDuration = 30 * time.Second
+)
+
+// gatewayCallBackoff is the backoff between retries of failed calls to the
+// gateway: up to 4 attempts in about 7 seconds
+var gatewayCallBackoff = wait.Backoff{
+	Duration: 1 * time.Second,
+	Factor:   2.0,
+	Jitter:   0.1,
+	Steps:    3,
+}
+
+// errCircuitOpen is returned without calling the gateway while the circuit is open
+type errCircuitOpen struct {
+	lastErr error
+	until   time.Time
+}
+
+func (err *errCircuitOpen) Error() string {
+	return fmt.Sprintf("gateway not available (circuit open until %s): %v", err.until.Format(time.RFC3339), err.lastErr)
+}
+
+// circuitBreaker short-circuits the calls to a gateway that is down
+type circuitBreaker struct {
+	failureThreshold int
+	openDuration     time.Duration
+	now              func() time.Time
+
+	mutex    sync.Mutex
+	failures int
+	lastErr  error
+	openedAt time.Time
+	probing  bool // a call is checking whether the gateway is back (half-open)
+}
+
+func newCircuitBreaker() *circuitBreaker {
+	return &circuitBreaker{
+		failureThreshold: circuitBreakerFailureThreshold,
+		openDuration:     circuitBreakerOpenDuration,
+		now:              time.Now,
+	}
+}
+
+// allow returns an error if the call must not be done, because the circuit is
+// open. Once the open duration expires, a single call is allowed to check
+// whether the gateway is back (half-open state).
+func (cb *circuitBreaker) allow() error {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	if cb.failures < cb.failureThreshold {
+		return nil
+	}
+	until := cb.openedAt.Add(cb.openDuration)
+	if cb.probing || cb.now().Before(until) {
+		return &errCircuitOpen{lastErr: cb.lastErr, until: until}
+	}
+	cb.probing = true
+	return nil
+}
+
+// record records the result of a call allowed by the circuit breaker
+func (cb *circuitBreaker) record(err error) {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	cb.probing = false
+	if err == nil {
+		if cb.failures >= cb.failureThreshold {
+			klog.Infof("circuitBreaker: gateway is back: closing circuit")
+		}
+		setGatewayReachable(true)
+		cb.failures = 0
+		cb.lastErr = nil
+		return
+	}
+	cb.failures++
+	cb.lastErr = err
+	if cb.failures >= cb.failureThreshold {
+		if cb.failures == cb.failureThreshold {
+			klog.Warningf("circuitBreaker: %d consecutive failures: opening circuit: %v", cb.failures, err)
+		}
+		setGatewayReachable(false)
+		cb.openedAt = cb.now()
+	}
+}
+
+// release ends a call allowed by the circuit breaker without a result, when
+// cancelled by the caller: a half-open circuit allows another probe
+func (cb *circuitBreaker) release() {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	cb.probing = false
+}
+
+// check returns an error while the circuit is open
+func (cb *circuitBreaker) check() error {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	if cb.failures < cb.failureThreshold {
+		return nil
+	}
+	return &errCircuitOpen{lastErr: cb.lastErr, until: cb.openedAt.Add(cb.openDuration)}
+}
+
+// reset closes the circuit, when the gateway is replaced
+func (cb *circuitBreaker) reset() {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	cb.failures = 0
+	cb.lastErr = nil
+	cb.probing = false
+	setGatewayReachable(true)
+}
+
+// resilientClient wraps a gateway client with timeouts, retries with
+// exponential backoff of the transient errors, and a circuit breaker
+type resilientClient struct {
+	client  clientInterface
+	breaker *circuitBreaker
+	timeout time.Duration
+	backoff wait.Backoff
+}
+
+func newResilientClient(client clientInterface, breaker *circuitBreaker) *resilientClient {
+	return &resilientClient{
+		client:  client,
+		breaker: breaker,
+		timeout: gatewayCallTimeout,
+		backoff: gatewayCallBackoff,
+	}
+}
+
+// AddPortMapping implements clientInterface
+func (client *resilientClient) AddPortMapping(ctx context.Context, host string, externalPort uint16, proto string, internalPort uint16, internalIP string, enabled bool, desc string, lease uint32) error {
+	return client.call(ctx, mappingAdd, func(ctx context.Context) error {
+		return client.client.AddPortMapping(ctx, host, externalPort, proto, internalPort, internalIP, enabled, desc, lease)
+	})
+}
+
+// DeletePortMapping implements clientInterface
+func (client *resilientClient) DeletePortMapping(ctx context.Context, host string, externalPort uint16, proto string) error {
+	return client.call(ctx, mappingDelete, func(ctx context.Context) error {
+		return client.client.DeletePortMapping(ctx, host, externalPort, proto)
+	})
+}
+
+// GetExternalIPAddress implements clientInterface
+func (client *resilientClient) GetExternalIPAddress(ctx context.Context) (string, error) {
+	var externalIP string
+	err := client.call(ctx, "", func(ctx context.Context) error {
+		var err error
+		externalIP, err = client.client.GetExternalIPAddress(ctx)
+		return err
+	})
+	return externalIP, err
+}
+
+// GetStatusInfo implements clientInterface
+func (client *resilientClient) GetStatusInfo(ctx context.Context) (string, string, uint32, error) {
+	var status, lastConnectionError string
+	var uptime uint32
+	err := client.call(ctx, "", func(ctx context.Context) error {
+		var err error
+		status, lastConnectionError, uptime, err = client.client.GetStatusInfo(ctx)
+		return err
+	})
+	return status, lastConnectionError, uptime, err
+}
+
+// GetSpecificPortMappingEntry implements clientInterface
+func (client *resilientClient) GetSpecificPortMappingEntry(ctx context.Context, host string, externalPort uint16, proto string) (*portMappingEntry, error) {
+	var entry *portMappingEntry
+	err := client.call(ctx, "", func(ctx context.Context) error {
+		var err error
+		entry, err = client.client.GetSpecificPortMappingEntry(ctx, host, externalPort, proto)
+		return err
+	})
+	return entry, err
+}
+
+// transaction returns the transaction of the client wrapped, if it is a
+// transactionalClient, with the timeouts and circuit breaker of the calls
+func (client *resilientClient) transaction() (transactionalClient, bool) {
+	transaction, ok := client.client.(transactionalClient)
+	if !ok {
+		return nil, false
+	}
+	return &resilientTransaction{client: client, transaction: transaction}, true
+}
+
+// resilientTransaction is the transaction of the client of a resilientClient.
+// Commit is not retried: the changes of a failed one are rolled back.
+type resilientTransaction struct {
+	client      *resilientClient
+	transaction transactionalClient
+}
+
+// Begin implements transactionalClient
+func (t *resilientTransaction) Begin(ctx context.Context) error {
+	return t.client.call(ctx, "", t.transaction.Begin)
+}
+
+// Commit implements transactionalClient
+func (t *resilientTransaction) Commit(ctx context.Context) error {
+	once := *t.client
+	once.backoff.Steps = 0
+	return once.call(ctx, "", t.transaction.Commit)
+}
+
+// Rollback implements transactionalClient
+func (t *resilientTransaction) Rollback(ctx context.Context) error {
+	return t.client.call(ctx, "", t.transaction.Rollback)
+}
+
+func (client *resilientClient) call(ctx context.Context, operation mappingOperation, f func(ctx context.Context) error) error {
+	backoff := client.backoff
+	for {
+		if err := client.breaker.allow(); err != nil {
+			return err
+		}
+		callCtx, cancel := context.WithTimeout(ctx, client.timeout)
+		err := f(callCtx)
+		cancel()
+		if ctx.Err() != nil {
+			if err == nil {
+				client.breaker.record(nil) // the gateway answered
+				return nil
+			}
+			// cancelled by the caller: neither a gateway failure nor an answer
+			client.breaker.release()
+			return ctx.Err()
+		}
+		if _, isUPnPErr := err.(*upnpError); isUPnPErr || err == nil {
+			client.breaker.record(nil) // the gateway answered
+		} else {
+			client.breaker.record(err)
+		}
+		if err == nil || classifyMappingError(operation, err) != errorRetry || backoff.Steps < 1 {
+			return err
+		}
+		delay := backoff.Step()
+		klog.V(3).Infof("resilientClient: retrying in %s: %v", delay, err)
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
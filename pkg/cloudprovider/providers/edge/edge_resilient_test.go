@@ -0,0 +1,223 @@
+/*
+Copyright 2019 Midokura
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package edge
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// newTestResilientClient wraps the client in a resilientClient retrying
+// without delays
+func newTestResilientClient(client clientInterface) *resilientClient {
+	resilient := newResilientClient(client, newCircuitBreaker())
+	resilient.backoff = wait.Backoff{Steps: gatewayCallBackoff.Steps}
+	return resilient
+}
+
+func TestResilientClientDoesNotRetryUPnPErrors(t *testing.T) {
+	client := newMockClient(t)
+	client.addErrors = map[uint16][]error{80: {newUPnPError(upnpConflictInMappingEntry)}}
+	resilient := newTestResilientClient(client)
+	err := resilient.AddPortMapping(context.TODO(), "", 80, "TCP", 30080, "192.0.2.1", true, "foo", 0)
+	if !isUPnPError(err, upnpConflictInMappingEntry) {
+		t.Errorf("got error %v\nwant %v", err, newUPnPError(upnpConflictInMappingEntry))
+	}
+	if client.addCalls != 1 {
+		t.Errorf("got %d calls\nwant 1", client.addCalls)
+	}
+	if err := resilient.breaker.check(); err != nil {
+		t.Errorf("unexpected open circuit: %v", err)
+	}
+}
+
+func TestResilientClientCircuitBreaker(t *testing.T) {
+	now := time.Unix(0, 0)
+	client := newMockClient(t)
+	timeouts := make([]error, circuitBreakerFailureThreshold+1)
+	for i := range timeouts {
+		timeouts[i] = fmt.Errorf("timeout")
+	}
+	client.deleteErrors = map[uint16][]error{80: timeouts}
+	resilient := newTestResilientClient(client)
+	resilient.backoff.Steps = 0
+	resilient.breaker.now = func() time.Time { return now }
+
+	// consecutive failures open the circuit
+	for i := 0; i < circuitBreakerFailureThreshold; i++ {
+		if err := resilient.DeletePortMapping(context.TODO(), "", 80, "TCP"); err == nil {
+			t.Fatalf("call %d: expected error", i)
+		}
+	}
+	if err := resilient.breaker.check(); err == nil {
+		t.Errorf("expected open circuit")
+	}
+
+	// calls are short-circuited while the circuit is open
+	err := resilient.DeletePortMapping(context.TODO(), "", 80, "TCP")
+	if _, ok := err.(*errCircuitOpen); !ok {
+		t.Errorf("got error %v\nwant circuit open error", err)
+	}
+	if client.deleteCalls != circuitBreakerFailureThreshold {
+		t.Errorf("got %d calls\nwant %d", client.deleteCalls, circuitBreakerFailureThreshold)
+	}
+
+	// after the open duration, a failed trial call keeps the circuit open
+	now = now.Add(circuitBreakerOpenDuration)
+	if err := resilient.DeletePortMapping(context.TODO(), "", 80, "TCP"); err == nil {
+		t.Errorf("expected error")
+	}
+	if _, ok := resilient.DeletePortMapping(context.TODO(), "", 80, "TCP").(*errCircuitOpen); !ok {
+		t.Errorf("expected circuit open error after failed trial")
+	}
+
+	// a successful trial call closes the circuit
+	now = now.Add(circuitBreakerOpenDuration)
+	if err := resilient.DeletePortMapping(context.TODO(), "", 80, "TCP"); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	if err := resilient.breaker.check(); err != nil {
+		t.Errorf("unexpected open circuit: %v", err)
+	}
+}
+
+type blockingClient struct {
+	mockClient
+}
+
+func (client *blockingClient) GetExternalIPAddress(ctx context.Context) (string, error) {
+	<-ctx.Done()
+	return "", ctx.Err()
+}
+
+func TestResilientClientTimeout(t *testing.T) {
+	resilient := newTestResilientClient(&blockingClient{})
+	resilient.timeout = time.Millisecond
+	_, err := resilient.GetExternalIPAddress(context.TODO())
+	if err != context.DeadlineExceeded {
+		t.Errorf("got error %v\nwant %v", err, context.DeadlineExceeded)
+	}
+	if resilient.breaker.failures != gatewayCallBackoff.Steps+1 {
+		t.Errorf("got %d failures\nwant %d", resilient.breaker.failures, gatewayCallBackoff.Steps+1)
+	}
+}
+
+func TestResilientClientCancelled(t *testing.T) {
+	resilient := newTestResilientClient(&blockingClient{})
+	ctx, cancel := context.WithCancel(context.TODO())
+	cancel()
+	_, err := resilient.GetExternalIPAddress(ctx)
+	if err != context.Canceled {
+		t.Errorf("got error %v\nwant %v", err, context.Canceled)
+	}
+	if resilient.breaker.failures != 0 {
+		t.Errorf("got %d failures\nwant 0: cancellations are not gateway failures", resilient.breaker.failures)
+	}
+
+	// a cancelled probe keeps the circuit open, and allows another probe
+	now := time.Unix(0, 0)
+	resilient.breaker.now = func() time.Time { return now }
+	resilient.breaker.failures = circuitBreakerFailureThreshold
+	resilient.breaker.openedAt = now.Add(-circuitBreakerOpenDuration)
+	if _, err := resilient.GetExternalIPAddress(ctx); err != context.Canceled {
+		t.Errorf("got error %v\nwant %v", err, context.Canceled)
+	}
+	if err := resilient.breaker.check(); err == nil {
+		t.Errorf("got a closed circuit\nwant it still open after a cancelled probe")
+	}
+	if err := resilient.breaker.allow(); err != nil {
+		t.Errorf("got %v\nwant another probe allowed", err)
+	}
+}
+
+// transactionMockClient is a gateway with transactions, failing its calls
+// with the errors given
+type transactionMockClient struct {
+	*mockClient
+	calls  []string
+	errors []error
+}
+
+func (client *transactionMockClient) call(name string) error {
+	client.calls = append(client.calls, name)
+	if len(client.errors) == 0 {
+		return nil
+	}
+	err := client.errors[0]
+	client.errors = client.errors[1:]
+	return err
+}
+
+func (client *transactionMockClient) Begin(ctx context.Context) error {
+	return client.call("Begin")
+}
+
+func (client *transactionMockClient) Commit(ctx context.Context) error {
+	return client.call("Commit")
+}
+
+func (client *transactionMockClient) Rollback(ctx context.Context) error {
+	return client.call("Rollback")
+}
+
+func TestResilientClientTransaction(t *testing.T) {
+	if _, ok := clientTransaction(newTestResilientClient(newMockClient(t))); ok {
+		t.Errorf("got a transaction\nwant none for a gateway without transactions")
+	}
+	if _, ok := clientTransaction(newDryRunClient(newTestResilientClient(&transactionMockClient{mockClient: newMockClient(t)}))); ok {
+		t.Errorf("got a transaction\nwant none in dry run")
+	}
+
+	// the failed Begin and Rollback are retried, not the failed Commit
+	client := &transactionMockClient{mockClient: newMockClient(t), errors: []error{fmt.Errorf("timeout"), nil, fmt.Errorf("timeout"), fmt.Errorf("timeout")}}
+	resilient := newTestResilientClient(client)
+	transaction, ok := clientTransaction(resilient)
+	if !ok {
+		t.Fatalf("got no transaction\nwant the one of the gateway")
+	}
+	ctx := context.TODO()
+	if err := transaction.Begin(ctx); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	if err := transaction.Commit(ctx); err == nil {
+		t.Errorf("expected error")
+	}
+	if err := transaction.Rollback(ctx); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	expected := []string{"Begin", "Begin", "Commit", "Rollback", "Rollback"}
+	if !reflect.DeepEqual(client.calls, expected) {
+		t.Errorf("got %v\nwant %v", client.calls, expected)
+	}
+
+	// the calls are short-circuited while the circuit is open
+	resilient.breaker.failures = circuitBreakerFailureThreshold
+	resilient.breaker.openedAt = time.Now()
+	if err := transaction.Begin(ctx); err == nil {
+		t.Errorf("expected error")
+	} else if _, ok := err.(*errCircuitOpen); !ok {
+		t.Errorf("got error %v\nwant circuit open error", err)
+	}
+	if len(client.calls) != len(expected) {
+		t.Errorf("got %v\nwant no more calls", client.calls)
+	}
+}
@@ -0,0 +1,196 @@
+/*
+Copyright 2019 Midokura
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package edge
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+)
+
+// routerPortMapping is a port forward entry of a router managed through its
+// API (routeros, openwrt or opnsense), owned by the edge cloud provider or not
+type routerPortMapping struct {
+	id      string // of the entry in the router
+	owned   bool   // by the edge cloud provider
+	enabled bool
+	protos  []string // TCP and, or, UDP
+	// firstPort and lastPort are the range of the external ports
+	firstPort    uint16
+	lastPort     uint16
+	internalIP   string
+	internalPort uint16
+	desc         string
+}
+
+// forwards returns whether the entry forwards the external port
+func (mapping *routerPortMapping) forwards(externalPort uint16, proto string) bool {
+	if externalPort < mapping.firstPort || externalPort > mapping.lastPort {
+		return false
+	}
+	return containsString(mapping.protos, strings.ToUpper(proto))
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// routerPortMappings are the port forward entries of a router from its WAN
+type routerPortMappings []routerPortMapping
+
+// find returns the entries of the external port owned by the edge cloud
+// provider, and whether an enabled one is not
+func (mappings routerPortMappings) find(externalPort uint16, proto string) (routerPortMappings, bool) {
+	found := make(routerPortMappings, 0, 1)
+	foreign := false
+	for _, mapping := range mappings {
+		if !mapping.forwards(externalPort, proto) {
+			continue
+		}
+		if mapping.owned {
+			found = append(found, mapping)
+		} else if mapping.enabled {
+			foreign = true
+		}
+	}
+	return found, foreign
+}
+
+// claim returns the entries of the external port owned by the edge cloud
+// provider, to be replaced by the port mapping of the description. It fails
+// when the port is forwarded by an entry of another owner, or configured by
+// hand, or by the one of another port mapping.
+func (mappings routerPortMappings) claim(externalPort uint16, proto, desc string) (routerPortMappings, error) {
+	current, foreign := mappings.find(externalPort, proto)
+	if foreign {
+		return nil, newUPnPError(upnpConflictWithOtherMechanisms)
+	}
+	for _, existing := range current {
+		if existing.desc != desc {
+			return nil, newUPnPError(upnpConflictInMappingEntry)
+		}
+	}
+	return current, nil
+}
+
+// mapped returns whether the entries, claimed, already are the port mapping
+func (mappings routerPortMappings) mapped(internalIP string, internalPort uint16) bool {
+	return len(mappings) == 1 && mappings[0].enabled && mappings[0].internalIP == internalIP && mappings[0].internalPort == internalPort
+}
+
+// entry returns the entry of the external port owned by the edge cloud
+// provider, as GetSpecificPortMappingEntry
+func (mappings routerPortMappings) entry(externalPort uint16, proto string) (*portMappingEntry, error) {
+	current, _ := mappings.find(externalPort, proto)
+	if len(current) == 0 {
+		return nil, newUPnPError(upnpNoSuchEntryInArray)
+	}
+	return &portMappingEntry{internalPort: current[0].internalPort, internalIP: current[0].internalIP, enabled: current[0].enabled, desc: current[0].desc}, nil
+}
+
+// listed returns the port mappings of the entries owned by the edge cloud
+// provider for the cluster, as ListPortMappings
+func (mappings routerPortMappings) listed(clusterName string) []listedPortMapping {
+	listed := make([]listedPortMapping, 0, len(mappings))
+	for _, mapping := range mappings {
+		if !mapping.owned || !ownedByCluster(mapping.desc, clusterName) {
+			continue
+		}
+		for _, proto := range mapping.protos {
+			listed = append(listed, listedPortMapping{
+				externalPort:     mapping.firstPort,
+				proto:            proto,
+				portMappingEntry: portMappingEntry{internalPort: mapping.internalPort, internalIP: mapping.internalIP, enabled: mapping.enabled, desc: mapping.desc},
+			})
+		}
+	}
+	return listed
+}
+
+// parsePortRange parses a port, or a range of ports first-last or first:last
+func parsePortRange(ports string) (uint16, uint16, error) {
+	bounds := strings.FieldsFunc(ports, func(r rune) bool { return r == '-' || r == ':' })
+	if len(bounds) == 0 || len(bounds) > 2 {
+		return 0, 0, fmt.Errorf("invalid ports '%s'", ports)
+	}
+	first, err := strconv.ParseUint(bounds[0], 10, 16)
+	if err != nil {
+		return 0, 0, err
+	}
+	last := first
+	if len(bounds) == 2 {
+		if last, err = strconv.ParseUint(bounds[1], 10, 16); err != nil {
+			return 0, 0, err
+		}
+	}
+	return uint16(first), uint16(last), nil
+}
+
+// routerProtocols returns the protocols, TCP and, or, UDP, of the protocol of
+// an entry: all of them if empty or all
+func routerProtocols(protocol string) []string {
+	switch strings.ToLower(protocol) {
+	case "", "all", "any", "tcpudp", "tcp/udp":
+		return []string{"TCP", "UDP"}
+	}
+	return []string{strings.ToUpper(protocol)}
+}
+
+// routerCredentials returns the credentials of the API of a router, read from
+// the Secret on every call to follow their rotation
+func routerCredentials(kubeClient kubernetes.Interface, secretName string) func() (string, string, error) {
+	return func() (string, string, error) {
+		return secretCredentials(kubeClient, secretName)
+	}
+}
+
+// routerGateway returns the gateway of a router whose API, on host, the client
+// uses: its external IP, and the local address towards it
+func routerGateway(loadBalancerType, host string, client clientInterface) (*gateway, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), gatewayCallTimeout)
+	defer cancel()
+	externalIPAddress, err := client.GetExternalIPAddress(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("external IP: %v", err)
+	}
+	hostname := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+	}
+	externalIP := net.ParseIP(externalIPAddress)
+	localAddress := getLocalAddressToHost(hostname)
+	klog.Infof("routerGateway: %s %s: external IP %s, local address %s", loadBalancerType, host, externalIP, localAddress)
+	return &gateway{
+		connections: []wanConnection{{
+			client:       client,
+			localAddress: localAddress,
+			externalIP:   externalIP,
+			deviceID:     fmt.Sprintf("%s:%s", loadBalancerType, host),
+		}},
+		externalIP: externalIP,
+	}, nil
+}
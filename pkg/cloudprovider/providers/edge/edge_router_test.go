@@ -0,0 +1,129 @@
+/*
+Copyright 2019 Midokura
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package edge
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func testRouterPortMappings() routerPortMappings {
+	return routerPortMappings{
+		{id: "1", owned: true, enabled: true, protos: []string{"TCP"}, firstPort: 80, lastPort: 80, internalIP: "192.0.2.1", internalPort: 30080, desc: "kubernetes/default/svc/http"},
+		{id: "2", owned: true, enabled: true, protos: []string{"TCP"}, firstPort: 81, lastPort: 81, internalIP: "192.0.2.1", internalPort: 30081, desc: "other/default/svc/http"},
+		{id: "3", enabled: true, protos: []string{"TCP", "UDP"}, firstPort: 27000, lastPort: 27100, internalIP: "192.168.1.3"},
+		{id: "4", protos: []string{"TCP"}, firstPort: 443, lastPort: 443, internalIP: "192.168.1.4"},
+	}
+}
+
+func TestRouterPortMappingsClaim(t *testing.T) {
+	mappings := testRouterPortMappings()
+	desc := "kubernetes/default/svc/http"
+
+	current, err := mappings.claim(80, "tcp", desc)
+	if err != nil || len(current) != 1 || current[0].id != "1" {
+		t.Errorf("got %+v, %v\nwant the entry 1", current, err)
+	}
+	if !current.mapped("192.0.2.1", 30080) || current.mapped("192.0.2.2", 30080) || current.mapped("192.0.2.1", 30090) {
+		t.Errorf("got %+v\nwant mapped only to 192.0.2.1:30080", current)
+	}
+	if current, err := mappings.claim(80, "UDP", desc); err != nil || len(current) != 0 {
+		t.Errorf("got %+v, %v\nwant no entry", current, err)
+	}
+	if _, err := mappings.claim(80, "TCP", "kubernetes/default/other/http"); !isUPnPError(err, upnpConflictInMappingEntry) {
+		t.Errorf("got %v\nwant ConflictInMappingEntry", err)
+	}
+	if _, err := mappings.claim(27015, "UDP", desc); !isUPnPError(err, upnpConflictWithOtherMechanisms) {
+		t.Errorf("got %v\nwant ConflictWithOtherMechanisms", err)
+	}
+	// the disabled entries by hand don't conflict
+	if current, err := mappings.claim(443, "TCP", desc); err != nil || len(current) != 0 {
+		t.Errorf("got %+v, %v\nwant no entry", current, err)
+	}
+}
+
+func TestRouterPortMappingsEntry(t *testing.T) {
+	mappings := testRouterPortMappings()
+
+	entry, err := mappings.entry(80, "TCP")
+	expected := &portMappingEntry{internalPort: 30080, internalIP: "192.0.2.1", enabled: true, desc: "kubernetes/default/svc/http"}
+	if err != nil || !reflect.DeepEqual(entry, expected) {
+		t.Errorf("got %+v, %v\nwant %+v", entry, err, expected)
+	}
+	for _, port := range []uint16{27015, 443, 8080} {
+		if _, err := mappings.entry(port, "TCP"); !isUPnPError(err, upnpNoSuchEntryInArray) {
+			t.Errorf("%d: got %v\nwant NoSuchEntryInArray", port, err)
+		}
+	}
+
+	listed := mappings.listed("kubernetes")
+	expectedListed := []listedPortMapping{{externalPort: 80, proto: "TCP", portMappingEntry: *expected}}
+	if !reflect.DeepEqual(listed, expectedListed) {
+		t.Errorf("got %+v\nwant %+v", listed, expectedListed)
+	}
+	if listed := mappings.listed("other"); len(listed) != 1 || listed[0].externalPort != 81 {
+		t.Errorf("got %+v\nwant the port mapping of 81", listed)
+	}
+}
+
+func TestRouterProtocols(t *testing.T) {
+	for protocol, expected := range map[string][]string{
+		"":        {"TCP", "UDP"},
+		"all":     {"TCP", "UDP"},
+		"tcpudp":  {"TCP", "UDP"},
+		"TCP/UDP": {"TCP", "UDP"},
+		"tcp":     {"TCP"},
+		"udp":     {"UDP"},
+	} {
+		if protos := routerProtocols(protocol); !reflect.DeepEqual(protos, expected) {
+			t.Errorf("%s: got %v\nwant %v", protocol, protos, expected)
+		}
+	}
+}
+
+func TestParsePortRange(t *testing.T) {
+	for ports, expected := range map[string][2]uint16{
+		"80":          {80, 80},
+		"27000-27100": {27000, 27100},
+		"27000:27100": {27000, 27100},
+	} {
+		first, last, err := parsePortRange(ports)
+		if err != nil || first != expected[0] || last != expected[1] {
+			t.Errorf("%s: got %d-%d, %v\nwant %d-%d", ports, first, last, err, expected[0], expected[1])
+		}
+	}
+	for _, ports := range []string{"", "http", "1-2-3", "70000"} {
+		if _, _, err := parsePortRange(ports); err == nil {
+			t.Errorf("%s: expected error", ports)
+		}
+	}
+}
+
+func TestRouterGateway(t *testing.T) {
+	client := newMockClient(t)
+	client.externalIP = "203.0.113.1"
+
+	gw, err := routerGateway(RouterOSLoadBalancerType, "127.0.0.1:8728", client)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	connection := gw.connections[0]
+	if !gw.externalIP.Equal(net.ParseIP("203.0.113.1")) || connection.client != client || connection.deviceID != "routeros:127.0.0.1:8728" || !connection.localAddress.Equal(net.ParseIP("127.0.0.1")) {
+		t.Errorf("got %+v, %+v\nwant the external IP 203.0.113.1 and the local address to 127.0.0.1", gw, connection)
+	}
+}
@@ -0,0 +1,519 @@
+/*
+Copyright 2019 Midokura
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package edge
+
+import (
+	"bufio"
+	"context"
+	"crypto/md5"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+)
+
+const (
+	// routerOSOwnerTag prefixes the comments of the dstnat entries owned by
+	// the edge cloud provider, followed by the description of the port mapping
+	routerOSOwnerTag = "edge-cloud-provider:"
+	// routerOSDefaultWANInterface is the WAN interface of the default
+	// configuration of the MikroTik routers
+	routerOSDefaultWANInterface = "ether1"
+	// routerOSAPIPort and routerOSAPISSLPort are the default ports of the API
+	routerOSAPIPort    = "8728"
+	routerOSAPISSLPort = "8729"
+)
+
+// routerOSError is an error reported by the router in a !trap or !fatal reply
+type routerOSError struct {
+	message string
+}
+
+func (err *routerOSError) Error() string {
+	return fmt.Sprintf("RouterOS error: %s", err.message)
+}
+
+// routerOSClient implements clientInterface managing the dstnat entries of
+// /ip firewall nat of a MikroTik router through the RouterOS API, and
+// routeBackend managing the static routes of /ip route
+type routerOSClient struct {
+	address      string
+	tlsConfig    *tls.Config // nil for the plain API
+	wanInterface string
+	// credentials returns the username and password, on every login
+	credentials func() (string, string, error)
+
+	// mutex serializes the API calls over the connection
+	mutex  sync.Mutex
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func newRouterOSClient(address string, tlsConfig *tls.Config, credentials func() (string, string, error), wanInterface string) *routerOSClient {
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		port := routerOSAPIPort
+		if tlsConfig != nil {
+			port = routerOSAPISSLPort
+		}
+		address = net.JoinHostPort(address, port)
+	}
+	if wanInterface == "" {
+		wanInterface = routerOSDefaultWANInterface
+	}
+	return &routerOSClient{address: address, tlsConfig: tlsConfig, credentials: credentials, wanInterface: wanInterface}
+}
+
+// run runs the command with the words given, returning the attributes of its
+// !re replies. The connection is opened, and logged in, when needed.
+func (client *routerOSClient) run(ctx context.Context, words ...string) ([]map[string]string, error) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	if client.conn == nil {
+		if err := client.connect(ctx); err != nil {
+			return nil, err
+		}
+	}
+	replies, err := client.call(ctx, words)
+	if _, isTrap := err.(*routerOSError); err != nil && !isTrap {
+		client.close()
+	}
+	return replies, err
+}
+
+// connect opens the connection, and logs in
+func (client *routerOSClient) connect(ctx context.Context) error {
+	username, password, err := client.credentials()
+	if err != nil {
+		return fmt.Errorf("credentials: %v", err)
+	}
+	dialer := &net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "tcp", client.address)
+	if err != nil {
+		return err
+	}
+	if client.tlsConfig != nil {
+		conn = tls.Client(conn, client.tlsConfig)
+	}
+	client.conn = conn
+	client.reader = bufio.NewReader(conn)
+	replies, err := client.call(ctx, []string{"/login", "=name=" + username, "=password=" + password})
+	if err == nil && len(replies) == 1 && replies[0]["ret"] != "" {
+		// RouterOS before 6.43: challenge-response login
+		err = client.legacyLogin(ctx, username, password, replies[0]["ret"])
+	}
+	if err != nil {
+		client.close()
+		return fmt.Errorf("login to %s: %v", client.address, err)
+	}
+	return nil
+}
+
+func (client *routerOSClient) legacyLogin(ctx context.Context, username, password, challenge string) error {
+	challengeBytes, err := hex.DecodeString(challenge)
+	if err != nil {
+		return err
+	}
+	hash := md5.New()
+	hash.Write([]byte{0})
+	hash.Write([]byte(password))
+	hash.Write(challengeBytes)
+	response := "00" + hex.EncodeToString(hash.Sum(nil))
+	_, err = client.call(ctx, []string{"/login", "=name=" + username, "=response=" + response})
+	return err
+}
+
+// close closes the connection, opened again by the next call
+func (client *routerOSClient) close() {
+	if client.conn != nil {
+		client.conn.Close()
+	}
+	client.conn, client.reader = nil, nil
+}
+
+// call sends a sentence and reads the replies up to !done
+func (client *routerOSClient) call(ctx context.Context, words []string) ([]map[string]string, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(gatewayCallTimeout)
+	}
+	client.conn.SetDeadline(deadline)
+	if err := writeRouterOSSentence(client.conn, words); err != nil {
+		return nil, err
+	}
+	replies := make([]map[string]string, 0)
+	var trap error
+	for {
+		sentence, err := readRouterOSSentence(client.reader)
+		if err != nil {
+			return nil, err
+		}
+		if len(sentence) == 0 {
+			continue
+		}
+		attributes := routerOSAttributes(sentence[1:])
+		switch sentence[0] {
+		case "!re":
+			replies = append(replies, attributes)
+		case "!trap":
+			trap = &routerOSError{message: attributes["message"]}
+		case "!fatal":
+			message := strings.Join(sentence[1:], " ")
+			return nil, fmt.Errorf("RouterOS fatal error: %s", message)
+		case "!done":
+			if trap != nil {
+				return nil, trap
+			}
+			if len(attributes) > 0 {
+				replies = append(replies, attributes)
+			}
+			return replies, nil
+		}
+	}
+}
+
+// routerOSAttributes returns the =name=value attributes of the words
+func routerOSAttributes(words []string) map[string]string {
+	attributes := make(map[string]string)
+	for _, word := range words {
+		if !strings.HasPrefix(word, "=") {
+			continue
+		}
+		parts := strings.SplitN(word[1:], "=", 2)
+		if len(parts) == 2 {
+			attributes[parts[0]] = parts[1]
+		}
+	}
+	return attributes
+}
+
+// readRouterOSSentence reads the words of a sentence, up to the empty word
+func readRouterOSSentence(reader *bufio.Reader) ([]string, error) {
+	words := make([]string, 0)
+	for {
+		first, err := reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		// the length is encoded in 1 to 5 bytes, as many as the leading ones
+		// of the first byte plus one
+		extra, length := 0, uint32(first)
+		switch {
+		case first&0x80 == 0:
+		case first&0xC0 == 0x80:
+			extra, length = 1, uint32(first&0x3F)
+		case first&0xE0 == 0xC0:
+			extra, length = 2, uint32(first&0x1F)
+		case first&0xF0 == 0xE0:
+			extra, length = 3, uint32(first&0x0F)
+		default:
+			extra, length = 4, 0
+		}
+		for i := 0; i < extra; i++ {
+			b, err := reader.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			length = length<<8 | uint32(b)
+		}
+		if length == 0 {
+			return words, nil
+		}
+		word := make([]byte, length)
+		if _, err := io.ReadFull(reader, word); err != nil {
+			return nil, err
+		}
+		words = append(words, string(word))
+	}
+}
+
+// writeRouterOSSentence writes the words of a sentence, and the empty word
+func writeRouterOSSentence(w io.Writer, words []string) error {
+	var buffer []byte
+	for _, word := range words {
+		length := uint32(len(word))
+		encoded := make([]byte, 4)
+		switch {
+		case length < 0x80:
+			buffer = append(buffer, byte(length))
+		case length < 0x4000:
+			binary.BigEndian.PutUint32(encoded, length|0x8000)
+			buffer = append(buffer, encoded[2:]...)
+		case length < 0x200000:
+			binary.BigEndian.PutUint32(encoded, length|0xC00000)
+			buffer = append(buffer, encoded[1:]...)
+		case length < 0x10000000:
+			binary.BigEndian.PutUint32(encoded, length|0xE0000000)
+			buffer = append(buffer, encoded...)
+		default:
+			binary.BigEndian.PutUint32(encoded, length)
+			buffer = append(append(buffer, 0xF0), encoded...)
+		}
+		buffer = append(buffer, word...)
+	}
+	_, err := w.Write(append(buffer, 0))
+	return err
+}
+
+// list returns the dstnat entries, owned by the edge cloud provider or not.
+// The entries owned have the description of their port mapping in their
+// comment, after routerOSOwnerTag.
+func (client *routerOSClient) list(ctx context.Context) (routerPortMappings, error) {
+	replies, err := client.run(ctx, "/ip/firewall/nat/print", "?chain=dstnat")
+	if err != nil {
+		return nil, err
+	}
+	mappings := make(routerPortMappings, 0, len(replies))
+	for _, reply := range replies {
+		owned := strings.HasPrefix(reply["comment"], routerOSOwnerTag)
+		firstPort, lastPort, err := parsePortRange(reply["dst-port"])
+		if err != nil || reply["action"] != "dst-nat" {
+			if owned {
+				klog.Warningf("list: %s: unexpected dst-port '%s' or action '%s'", reply[".id"], reply["dst-port"], reply["action"])
+			}
+			continue
+		}
+		internalPort, _, err := parsePortRange(reply["to-ports"])
+		if err != nil {
+			internalPort = firstPort
+		}
+		mappings = append(mappings, routerPortMapping{
+			id:           reply[".id"],
+			owned:        owned,
+			enabled:      reply["disabled"] != "true",
+			protos:       routerProtocols(reply["protocol"]),
+			firstPort:    firstPort,
+			lastPort:     lastPort,
+			internalIP:   reply["to-addresses"],
+			internalPort: internalPort,
+			desc:         strings.TrimPrefix(reply["comment"], routerOSOwnerTag),
+		})
+	}
+	return mappings, nil
+}
+
+func (client *routerOSClient) remove(ctx context.Context, mappings routerPortMappings) error {
+	for _, mapping := range mappings {
+		if _, err := client.run(ctx, "/ip/firewall/nat/remove", "=.id="+mapping.id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AddPortMapping implements clientInterface. The dstnat entry is permanent,
+// from the WAN interface, and replaces the entries of the port mapping. The
+// enabled entries of other owners, or configured by hand, conflict.
+func (client *routerOSClient) AddPortMapping(ctx context.Context, host string, externalPort uint16, proto string, internalPort uint16, internalIP string, enabled bool, desc string, lease uint32) error {
+	mappings, err := client.list(ctx)
+	if err != nil {
+		return err
+	}
+	current, err := mappings.claim(externalPort, proto, desc)
+	if err != nil {
+		return err
+	}
+	if current.mapped(internalIP, internalPort) {
+		return nil
+	}
+	if err := client.remove(ctx, current); err != nil {
+		return err
+	}
+	_, err = client.run(ctx, "/ip/firewall/nat/add",
+		"=chain=dstnat",
+		"=action=dst-nat",
+		"=protocol="+strings.ToLower(proto),
+		"=dst-port="+strconv.Itoa(int(externalPort)),
+		"=in-interface="+client.wanInterface,
+		"=to-addresses="+internalIP,
+		"=to-ports="+strconv.Itoa(int(internalPort)),
+		"=comment="+routerOSOwnerTag+desc,
+	)
+	return err
+}
+
+// DeletePortMapping implements clientInterface, removing the dstnat entries
+// of the edge cloud provider forwarding the external port
+func (client *routerOSClient) DeletePortMapping(ctx context.Context, host string, externalPort uint16, proto string) error {
+	mappings, err := client.list(ctx)
+	if err != nil {
+		return err
+	}
+	current, _ := mappings.find(externalPort, proto)
+	if len(current) == 0 {
+		return newUPnPError(upnpNoSuchEntryInArray)
+	}
+	return client.remove(ctx, current)
+}
+
+// GetExternalIPAddress implements clientInterface: the address of the WAN
+// interface
+func (client *routerOSClient) GetExternalIPAddress(ctx context.Context) (string, error) {
+	replies, err := client.run(ctx, "/ip/address/print", "?interface="+client.wanInterface)
+	if err != nil {
+		return "", err
+	}
+	for _, reply := range replies {
+		if ip, _, err := net.ParseCIDR(reply["address"]); err == nil && ip.To4() != nil {
+			return ip.String(), nil
+		}
+	}
+	return "", fmt.Errorf("no IPv4 address on %s", client.wanInterface)
+}
+
+// GetStatusInfo implements clientInterface: the WAN interface is connected
+// when running
+func (client *routerOSClient) GetStatusInfo(ctx context.Context) (string, string, uint32, error) {
+	replies, err := client.run(ctx, "/interface/print", "?name="+client.wanInterface)
+	if err != nil {
+		return "", "", 0, err
+	}
+	if len(replies) == 0 {
+		return "", "", 0, fmt.Errorf("no interface %s", client.wanInterface)
+	}
+	if replies[0]["running"] != "true" || replies[0]["disabled"] == "true" {
+		return "Disconnected", "ERROR_NO_CARRIER", 0, nil
+	}
+	return upnpConnected, "ERROR_NONE", 0, nil
+}
+
+// GetSpecificPortMappingEntry implements clientInterface, from the dstnat
+// entry of the edge cloud provider forwarding the external port
+func (client *routerOSClient) GetSpecificPortMappingEntry(ctx context.Context, host string, externalPort uint16, proto string) (*portMappingEntry, error) {
+	mappings, err := client.list(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return mappings.entry(externalPort, proto)
+}
+
+// ListPortMappings implements portMappingLister, from the comments of the
+// dstnat entries
+func (client *routerOSClient) ListPortMappings(ctx context.Context, clusterName string) ([]listedPortMapping, error) {
+	mappings, err := client.list(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return mappings.listed(clusterName), nil
+}
+
+// listRoutes returns the static routes of /ip route owned by the edge cloud
+// provider, with their ID
+func (client *routerOSClient) listRoutes(ctx context.Context) (map[string]backendRoute, error) {
+	replies, err := client.run(ctx, "/ip/route/print", "?static=true")
+	if err != nil {
+		return nil, err
+	}
+	routes := make(map[string]backendRoute)
+	for _, reply := range replies {
+		if !strings.HasPrefix(reply["comment"], routerOSOwnerTag) {
+			continue
+		}
+		_, destination, err := net.ParseCIDR(reply["dst-address"])
+		gateway := net.ParseIP(reply["gateway"])
+		if err != nil || gateway == nil {
+			klog.Warningf("listRoutes: %s: unexpected dst-address '%s' or gateway '%s'", reply[".id"], reply["dst-address"], reply["gateway"])
+			continue
+		}
+		routes[reply[".id"]] = backendRoute{
+			Destination: destination,
+			Gateway:     gateway,
+			Description: strings.TrimPrefix(reply["comment"], routerOSOwnerTag),
+		}
+	}
+	return routes, nil
+}
+
+// ListRoutes implements routeBackend
+func (client *routerOSClient) ListRoutes(ctx context.Context) ([]backendRoute, error) {
+	routes, err := client.listRoutes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	list := make([]backendRoute, 0, len(routes))
+	for _, route := range routes {
+		list = append(list, route)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Destination.String() < list[j].Destination.String()
+	})
+	return list, nil
+}
+
+// ReplaceRoute implements routeBackend. The static routes to the destination
+// not owned by the edge cloud provider are left alone.
+func (client *routerOSClient) ReplaceRoute(ctx context.Context, route backendRoute) error {
+	routes, err := client.listRoutes(ctx)
+	if err != nil {
+		return err
+	}
+	for id, existing := range routes {
+		if existing.Destination.String() != route.Destination.String() {
+			continue
+		}
+		_, err := client.run(ctx, "/ip/route/set", "=.id="+id, "=gateway="+route.Gateway.String(), "=comment="+routerOSOwnerTag+route.Description)
+		return err
+	}
+	_, err = client.run(ctx, "/ip/route/add",
+		"=dst-address="+route.Destination.String(),
+		"=gateway="+route.Gateway.String(),
+		"=comment="+routerOSOwnerTag+route.Description,
+	)
+	return err
+}
+
+// DeleteRoute implements routeBackend
+func (client *routerOSClient) DeleteRoute(ctx context.Context, route backendRoute) error {
+	routes, err := client.listRoutes(ctx)
+	if err != nil {
+		return err
+	}
+	for id, existing := range routes {
+		if existing.Destination.String() != route.Destination.String() {
+			continue
+		}
+		if _, err := client.run(ctx, "/ip/route/remove", "=.id="+id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// discoverRouterOS returns the discovery of the router, from the address of
+// its API. The credentials are read from the Secret on every login.
+func discoverRouterOS(kubeClient kubernetes.Interface, address string, tlsConfig *tls.Config, secretName, wanInterface string) func() (*gateway, error) {
+	credentials := routerCredentials(kubeClient, secretName)
+	return func() (*gateway, error) {
+		client := newRouterOSClient(address, tlsConfig, credentials, wanInterface)
+		gw, err := routerGateway(RouterOSLoadBalancerType, client.address, client)
+		// the client connects again when used, if the router is new
+		client.close()
+		if err != nil {
+			return nil, fmt.Errorf("discoverRouterOS: %v", err)
+		}
+		return gw, nil
+	}
+}
@@ -0,0 +1,283 @@
+/*
+Copyright 2019 Midokura
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package edge
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/midokura/cloud-provider-edge/pkg/cloudprovider/providers/edge/routerostest"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func newTestRouterOSSecret(username, password string) *v1.Secret {
+	return &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "routeros", Namespace: "kube-system"},
+		Data:       map[string][]byte{"username": []byte(username), "password": []byte(password)},
+	}
+}
+
+func newTestRouterOS(t *testing.T) (*routerostest.Server, *routerOSClient) {
+	server, err := routerostest.NewServer(routerostest.Config{Username: "edge", Password: "secret"})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	credentials := func() (string, string, error) {
+		return "edge", "secret", nil
+	}
+	return server, newRouterOSClient(server.Address, nil, credentials, "")
+}
+
+func TestRouterOSSentences(t *testing.T) {
+	for _, length := range []int{0x7F, 0x80, 0x3FFF, 0x4000, 0x1FFFFF, 0x200000} {
+		word := strings.Repeat("x", length)
+		var buffer bytes.Buffer
+		if err := writeRouterOSSentence(&buffer, []string{"/print", word}); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		words, err := readRouterOSSentence(bufio.NewReader(&buffer))
+		if err != nil || len(words) != 2 || words[0] != "/print" || words[1] != word {
+			t.Errorf("length %d: got %d words, %v\nwant the sentence", length, len(words), err)
+		}
+	}
+}
+
+func TestRouterOSClient(t *testing.T) {
+	server, client := newTestRouterOS(t)
+	defer server.Close()
+	ctx := context.TODO()
+	desc := "kubernetes/default/svc/http"
+
+	if err := client.AddPortMapping(ctx, "", 80, "TCP", 30080, "192.0.2.1", true, desc, 0); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	expected := []routerostest.NATRule{{
+		ID: "*1", Chain: "dstnat", Action: "dst-nat", Protocol: "tcp", DstPort: "80", InInterface: "ether1",
+		ToAddresses: "192.0.2.1", ToPorts: "30080", Comment: "edge-cloud-provider:" + desc,
+	}}
+	if rules := server.Rules(); !reflect.DeepEqual(rules, expected) {
+		t.Errorf("got %+v\nwant %+v", rules, expected)
+	}
+	entry, err := client.GetSpecificPortMappingEntry(ctx, "", 80, "TCP")
+	expectedEntry := &portMappingEntry{internalPort: 30080, internalIP: "192.0.2.1", enabled: true, desc: desc}
+	if err != nil || !reflect.DeepEqual(entry, expectedEntry) {
+		t.Errorf("got %+v, %v\nwant %+v", entry, err, expectedEntry)
+	}
+
+	// the same port mapping again changes nothing, a new target replaces it
+	if err := client.AddPortMapping(ctx, "", 80, "TCP", 30080, "192.0.2.1", true, desc, 0); err != nil || len(server.Rules()) != 1 || server.Rules()[0].ID != "*1" {
+		t.Errorf("got %+v, %v\nwant the entry unchanged", server.Rules(), err)
+	}
+	if err := client.AddPortMapping(ctx, "", 80, "TCP", 30090, "192.0.2.2", true, desc, 0); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if rules := server.Rules(); len(rules) != 1 || rules[0].ToPorts != "30090" || rules[0].ToAddresses != "192.0.2.2" {
+		t.Errorf("got %+v\nwant the entry replaced", rules)
+	}
+
+	// the port mappings of other owners, and the entries by hand, are kept
+	if err := client.AddPortMapping(ctx, "", 80, "TCP", 30080, "192.0.2.1", true, "other", 0); !isUPnPError(err, upnpConflictInMappingEntry) {
+		t.Errorf("got %v\nwant ConflictInMappingEntry", err)
+	}
+	server.AddRule(routerostest.NATRule{Chain: "dstnat", Action: "dst-nat", Protocol: "tcp", DstPort: "22", ToAddresses: "192.168.88.2", Comment: "ssh"})
+	if err := client.AddPortMapping(ctx, "", 22, "TCP", 30022, "192.0.2.1", true, desc, 0); !isUPnPError(err, upnpConflictWithOtherMechanisms) {
+		t.Errorf("got %v\nwant ConflictWithOtherMechanisms", err)
+	}
+	listed, err := client.ListPortMappings(ctx, "kubernetes")
+	if err != nil || len(listed) != 1 || listed[0].externalPort != 80 || listed[0].proto != "TCP" {
+		t.Errorf("got %+v, %v\nwant only the owned port mapping", listed, err)
+	}
+
+	if err := client.DeletePortMapping(ctx, "", 80, "TCP"); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if err := client.DeletePortMapping(ctx, "", 80, "TCP"); !isUPnPError(err, upnpNoSuchEntryInArray) {
+		t.Errorf("got %v\nwant NoSuchEntryInArray", err)
+	}
+	if err := client.DeletePortMapping(ctx, "", 22, "TCP"); !isUPnPError(err, upnpNoSuchEntryInArray) {
+		t.Errorf("got %v\nwant the entry by hand kept", err)
+	}
+	if rules := server.Rules(); len(rules) != 1 || rules[0].Comment != "ssh" {
+		t.Errorf("got %+v\nwant only the entry by hand", rules)
+	}
+
+	// the disabled entries by hand don't forward the port, the ranges do
+	server.AddRule(routerostest.NATRule{Chain: "dstnat", Action: "dst-nat", Protocol: "tcp", DstPort: "443", ToAddresses: "192.168.88.2", Comment: "https", Disabled: true})
+	if err := client.AddPortMapping(ctx, "", 443, "TCP", 30443, "192.0.2.1", true, "kubernetes/default/svc/https", 0); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	server.AddRule(routerostest.NATRule{Chain: "dstnat", Action: "dst-nat", Protocol: "udp", DstPort: "5000-5100", ToAddresses: "192.168.88.3", Comment: "rtp"})
+	if err := client.AddPortMapping(ctx, "", 5060, "UDP", 30060, "192.0.2.1", true, "kubernetes/default/sip/sip", 0); !isUPnPError(err, upnpConflictWithOtherMechanisms) {
+		t.Errorf("got %v\nwant ConflictWithOtherMechanisms", err)
+	}
+	// only the port mappings of the cluster are listed
+	if err := client.AddPortMapping(ctx, "", 53, "UDP", 30053, "192.0.2.2", true, "other/default/dns/dns", 0); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	listed, err = client.ListPortMappings(ctx, "kubernetes")
+	if err != nil || len(listed) != 1 || listed[0].externalPort != 443 {
+		t.Errorf("got %+v, %v\nwant only the port mapping of the cluster", listed, err)
+	}
+}
+
+func TestRouterOSRoutes(t *testing.T) {
+	server, client := newTestRouterOS(t)
+	defer server.Close()
+	ctx := context.TODO()
+	server.AddRoute(routerostest.Route{DstAddress: "10.0.0.0/8", Gateway: "192.168.88.254"})
+
+	route := newTestRoute("10.42.1.0/24", "192.0.2.1", "kubernetes/node")
+	if err := client.ReplaceRoute(ctx, route); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	route.Gateway = net.ParseIP("192.0.2.2")
+	if err := client.ReplaceRoute(ctx, route); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	expected := []routerostest.Route{
+		{ID: "*1", DstAddress: "10.0.0.0/8", Gateway: "192.168.88.254"},
+		{ID: "*2", DstAddress: "10.42.1.0/24", Gateway: "192.0.2.2", Comment: "edge-cloud-provider:kubernetes/node"},
+	}
+	if routes := server.Routes(); !reflect.DeepEqual(routes, expected) {
+		t.Errorf("got %+v\nwant %+v", routes, expected)
+	}
+	// the routes configured by hand are not listed
+	routes, err := client.ListRoutes(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if !reflect.DeepEqual(routes, []backendRoute{route}) {
+		t.Errorf("got %v\nwant %v", routes, []backendRoute{route})
+	}
+
+	if err := client.DeleteRoute(ctx, route); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if routes := server.Routes(); !reflect.DeepEqual(routes, expected[:1]) {
+		t.Errorf("got %+v\nwant %+v", routes, expected[:1])
+	}
+}
+
+func TestRouterOSClientErrors(t *testing.T) {
+	server, client := newTestRouterOS(t)
+	defer server.Close()
+	ctx := context.TODO()
+
+	server.InjectTraps("/ip/firewall/nat/add", "failure: out of memory")
+	err := client.AddPortMapping(ctx, "", 80, "TCP", 30080, "192.0.2.1", true, "kubernetes/default/svc/http", 0)
+	if err == nil || !strings.Contains(err.Error(), "out of memory") {
+		t.Errorf("got %v\nwant the trap", err)
+	}
+	// the connection is kept after a trap, and opened again when dropped
+	server.DropConnections()
+	if err := client.AddPortMapping(ctx, "", 80, "TCP", 30080, "192.0.2.1", true, "kubernetes/default/svc/http", 0); err == nil {
+		t.Errorf("expected error")
+	}
+	if err := client.AddPortMapping(ctx, "", 80, "TCP", 30080, "192.0.2.1", true, "kubernetes/default/svc/http", 0); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	if status, _, _, err := client.GetStatusInfo(ctx); err != nil || status != upnpConnected {
+		t.Errorf("got %s, %v\nwant %s", status, err, upnpConnected)
+	}
+	server.SetRunning(false)
+	if status, _, _, err := client.GetStatusInfo(ctx); err != nil || status == upnpConnected {
+		t.Errorf("got %s, %v\nwant disconnected", status, err)
+	}
+
+	wrongPassword := newRouterOSClient(server.Address, nil, func() (string, string, error) {
+		return "edge", "wrong", nil
+	}, "")
+	if _, err := wrongPassword.GetExternalIPAddress(ctx); err == nil || !strings.Contains(err.Error(), "invalid user name or password") {
+		t.Errorf("got %v\nwant a login error", err)
+	}
+}
+
+func TestDiscoverRouterOS(t *testing.T) {
+	server, err := routerostest.NewServer(routerostest.Config{Username: "edge", Password: "secret"})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	defer server.Close()
+	kubeClient := fake.NewSimpleClientset(newTestRouterOSSecret("edge", "secret"))
+
+	gw, err := discoverRouterOS(kubeClient, server.Address, nil, "kube-system/routeros", "")()
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if gw.externalIP.String() != "198.51.100.1" || gw.connections[0].deviceID != "routeros:"+server.Address {
+		t.Errorf("got %+v\nwant the router", gw)
+	}
+	for _, secret := range []string{"kube-system/missing", "routeros"} {
+		if _, err := discoverRouterOS(kubeClient, server.Address, nil, secret, "")(); err == nil {
+			t.Errorf("%s: expected error", secret)
+		}
+	}
+
+	// the rotated credentials are used on the next login
+	client := gw.connections[0].client
+	server.DropConnections()
+	if _, err := kubeClient.CoreV1().Secrets("kube-system").Update(newTestRouterOSSecret("edge", "rotated")); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if _, err := client.GetExternalIPAddress(context.TODO()); err == nil {
+		t.Errorf("got no error\nwant the rotated password rejected by the router")
+	}
+}
+
+func TestRouterOSLoadBalancer(t *testing.T) {
+	server, err := routerostest.NewServer(routerostest.Config{})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	defer server.Close()
+	lb := NewLoadBalancer()
+	lb.loadBalancerType = RouterOSLoadBalancerType
+	lb.discover = discoverRouterOS(fake.NewSimpleClientset(newTestRouterOSSecret("admin", "")), server.Address, nil, "kube-system/routeros", "")
+	lb.checkGateway()
+	if !lb.hasGateway() {
+		t.Fatalf("got no gateway\nwant the router")
+	}
+
+	service := newTestService("")
+	service.Annotations[LoadBalancerTypeAnnotation] = RouterOSLoadBalancerType
+	nodes := []*v1.Node{newTestNode("node", lb.localAddress.String())}
+	status, err := lb.EnsureLoadBalancer(context.TODO(), "kubernetes", service, nodes)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if status.Ingress[0].IP != "198.51.100.1" {
+		t.Errorf("got %+v\nwant the external IP of the router", status)
+	}
+	rules := server.Rules()
+	if len(rules) != 1 || rules[0].DstPort != "8080" || rules[0].ToPorts != "30080" || rules[0].Comment != "edge-cloud-provider:kubernetes/default/svc/http" {
+		t.Errorf("got %+v\nwant the entry of the service", rules)
+	}
+	if err := lb.EnsureLoadBalancerDeleted(context.TODO(), "kubernetes", service); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if rules := server.Rules(); len(rules) != 0 {
+		t.Errorf("got %+v\nwant no entries", rules)
+	}
+}
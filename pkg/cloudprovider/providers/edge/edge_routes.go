@@ -0,0 +1,368 @@
+/*
+Copyright 2019 Midokura
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package edge
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	k8s "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	cloudprovider "k8s.io/cloud-provider"
+	"k8s.io/klog"
+)
+
+// nodeRoutesResync is the period of the resyncs of the routing table of the
+// node with the pod CIDRs of the other nodes
+var nodeRoutesResync = time.Minute
+
+// backendRoute is a static route to the pod CIDR of a node
+type backendRoute struct {
+	Destination *net.IPNet
+	Gateway     net.IP
+	// Description identifies the node, <cluster>/<node>, on the backends
+	// keeping one
+	Description string
+}
+
+func (route backendRoute) String() string {
+	return fmt.Sprintf("%s via %s", route.Destination, route.Gateway)
+}
+
+// routeBackend is a routing table the static routes to the pod CIDRs of the
+// nodes are programmed into. The gateway clients implementing it get the
+// routes of the route controller.
+type routeBackend interface {
+	// ListRoutes returns the routes added by the cloud provider
+	ListRoutes(ctx context.Context) ([]backendRoute, error)
+	// ReplaceRoute adds the route, or replaces the one to its destination
+	ReplaceRoute(ctx context.Context, route backendRoute) error
+	// DeleteRoute deletes the route to the destination
+	DeleteRoute(ctx context.Context, route backendRoute) error
+}
+
+// memoryRouteBackend only keeps the routes, for the route controller when the
+// routing tables of the nodes are programmed by their node agent
+type memoryRouteBackend struct {
+	mutex  sync.Mutex
+	routes map[string]backendRoute
+}
+
+func newMemoryRouteBackend() *memoryRouteBackend {
+	return &memoryRouteBackend{routes: make(map[string]backendRoute)}
+}
+
+// ListRoutes implements routeBackend
+func (backend *memoryRouteBackend) ListRoutes(ctx context.Context) ([]backendRoute, error) {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+	routes := make([]backendRoute, 0, len(backend.routes))
+	for _, route := range backend.routes {
+		routes = append(routes, route)
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		return routes[i].Destination.String() < routes[j].Destination.String()
+	})
+	return routes, nil
+}
+
+// ReplaceRoute implements routeBackend
+func (backend *memoryRouteBackend) ReplaceRoute(ctx context.Context, route backendRoute) error {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+	backend.routes[route.Destination.String()] = route
+	return nil
+}
+
+// DeleteRoute implements routeBackend
+func (backend *memoryRouteBackend) DeleteRoute(ctx context.Context, route backendRoute) error {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+	delete(backend.routes, route.Destination.String())
+	return nil
+}
+
+// syncRoutes makes the routes of the backend the ones desired, deleting the
+// others. All the routes are tried, the last error is returned.
+func syncRoutes(ctx context.Context, backend routeBackend, desired []backendRoute) error {
+	existing, err := backend.ListRoutes(ctx)
+	if err != nil {
+		return fmt.Errorf("syncRoutes: listing the routes: %v", err)
+	}
+	existingByDestination := make(map[string]backendRoute)
+	for _, route := range existing {
+		existingByDestination[route.Destination.String()] = route
+	}
+	desiredByDestination := make(map[string]backendRoute)
+	for _, route := range desired {
+		desiredByDestination[route.Destination.String()] = route
+	}
+
+	var lastErr error
+	for destination, route := range existingByDestination {
+		if _, ok := desiredByDestination[destination]; ok {
+			continue
+		}
+		klog.Infof("syncRoutes: deleting the route %s", route)
+		if err := backend.DeleteRoute(ctx, route); err != nil {
+			klog.Errorf("syncRoutes: deleting the route %s: %v", route, err)
+			lastErr = err
+		}
+	}
+	for destination, route := range desiredByDestination {
+		if current, ok := existingByDestination[destination]; ok && current.Gateway.Equal(route.Gateway) {
+			continue
+		}
+		klog.Infof("syncRoutes: adding the route %s", route)
+		if err := backend.ReplaceRoute(ctx, route); err != nil {
+			klog.Errorf("syncRoutes: adding the route %s: %v", route, err)
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// routes implements cloudprovider.Routes for the route controller. The routing
+// tables of the nodes are programmed by the node agent of each one, the route
+// controller running only on the leader: the routes are kept in memory, and
+// added to the gateway if its client supports static routes.
+type routes struct {
+	cloud     *Edge
+	instances *instances
+	memory    *memoryRouteBackend
+}
+
+func newRoutes(cloud *Edge) *routes {
+	return &routes{cloud: cloud, instances: newInstances(cloud), memory: newMemoryRouteBackend()}
+}
+
+// ListRoutes lists all managed routes that belong to the specified clusterName
+func (r *routes) ListRoutes(ctx context.Context, clusterName string) ([]*cloudprovider.Route, error) {
+	backend := r.backend()
+	existing, err := backend.ListRoutes(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("ListRoutes: %v", err)
+	}
+	prefix := clusterName + "/"
+	routes := make([]*cloudprovider.Route, 0, len(existing))
+	for _, route := range existing {
+		if !strings.HasPrefix(route.Description, prefix) {
+			continue
+		}
+		nodeName := strings.TrimPrefix(route.Description, prefix)
+		routes = append(routes, &cloudprovider.Route{
+			Name:            route.Description,
+			TargetNode:      types.NodeName(nodeName),
+			DestinationCIDR: route.Destination.String(),
+		})
+	}
+	return routes, nil
+}
+
+// CreateRoute creates the route to the pod CIDR of the target node, through
+// its internal IP
+func (r *routes) CreateRoute(ctx context.Context, clusterName string, nameHint string, route *cloudprovider.Route) error {
+	_, destination, err := net.ParseCIDR(route.DestinationCIDR)
+	if err != nil {
+		return fmt.Errorf("CreateRoute: invalid destination: %v", err)
+	}
+	node, err := r.instances.getNode(route.TargetNode)
+	if err != nil {
+		return fmt.Errorf("CreateRoute: %v", err)
+	}
+	gateway := nodeInternalIP(node, destination.IP.To4() != nil)
+	if gateway == nil {
+		return fmt.Errorf("CreateRoute: node %s has no internal IP for %s", route.TargetNode, destination)
+	}
+	backendRoute := backendRoute{
+		Destination: destination,
+		Gateway:     gateway,
+		Description: fmt.Sprintf("%s/%s", clusterName, route.TargetNode),
+	}
+	klog.Infof("CreateRoute: %s (%s)", backendRoute, backendRoute.Description)
+	return r.backend().ReplaceRoute(ctx, backendRoute)
+}
+
+// DeleteRoute deletes the route to the pod CIDR of the node
+func (r *routes) DeleteRoute(ctx context.Context, clusterName string, route *cloudprovider.Route) error {
+	_, destination, err := net.ParseCIDR(route.DestinationCIDR)
+	if err != nil {
+		return fmt.Errorf("DeleteRoute: invalid destination: %v", err)
+	}
+	klog.Infof("DeleteRoute: %s of %s", destination, route.TargetNode)
+	return r.backend().DeleteRoute(ctx, backendRoute{Destination: destination})
+}
+
+// backend returns the client of the gateway if it supports static routes, or
+// the routes in memory
+func (r *routes) backend() routeBackend {
+	if backend := r.gatewayBackend(); backend != nil {
+		return backend
+	}
+	return r.memory
+}
+
+// gatewayBackend returns the client of the gateway if it supports static
+// routes, the routeros and openwrt ones. The dry runs never change the routes
+// of the gateway.
+func (r *routes) gatewayBackend() routeBackend {
+	loadBalancer := r.cloud.loadBalancer()
+	if loadBalancer == nil || loadBalancer.dryRun {
+		return nil
+	}
+	loadBalancer.mutex.Lock()
+	client := loadBalancer.client
+	loadBalancer.mutex.Unlock()
+	backend, _ := unwrapClient(client).(routeBackend)
+	return backend
+}
+
+// nodeInternalIP returns the first internal IP of the node of the family
+// given, or nil if none
+func nodeInternalIP(node *k8s.Node, ipv4 bool) net.IP {
+	for _, address := range node.Status.Addresses {
+		if address.Type != k8s.NodeInternalIP {
+			continue
+		}
+		ip := net.ParseIP(address.Address)
+		if ip != nil && (ip.To4() != nil) == ipv4 {
+			return ip
+		}
+	}
+	return nil
+}
+
+// nodePodCIDRs returns the pod CIDRs of the node
+func nodePodCIDRs(node *k8s.Node) []string {
+	if len(node.Spec.PodCIDRs) > 0 {
+		return node.Spec.PodCIDRs
+	}
+	if node.Spec.PodCIDR != "" {
+		return []string{node.Spec.PodCIDR}
+	}
+	return nil
+}
+
+// nodeRoutes returns the routes to the pod CIDRs of the nodes other than the
+// local one, through their internal IP
+func nodeRoutes(nodes []*k8s.Node, localNodeName string) []backendRoute {
+	routes := make([]backendRoute, 0, len(nodes))
+	for _, node := range nodes {
+		if node.Name == localNodeName {
+			continue
+		}
+		for _, podCIDR := range nodePodCIDRs(node) {
+			_, destination, err := net.ParseCIDR(podCIDR)
+			if err != nil {
+				klog.Warningf("nodeRoutes: node %s: invalid pod CIDR %s: %v", node.Name, podCIDR, err)
+				continue
+			}
+			gateway := nodeInternalIP(node, destination.IP.To4() != nil)
+			if gateway == nil {
+				klog.Warningf("nodeRoutes: node %s: no internal IP for %s", node.Name, podCIDR)
+				continue
+			}
+			routes = append(routes, backendRoute{Destination: destination, Gateway: gateway, Description: node.Name})
+		}
+	}
+	return routes
+}
+
+// nodeRouteAgent keeps the routing table of the node running the cloud
+// controller manager in sync with the pod CIDRs of the other nodes, for host-gw
+// style networking on flat L2 edge clusters
+type nodeRouteAgent struct {
+	backend       routeBackend
+	nodeLister    corelisters.NodeLister
+	localNodeName string
+	trigger       chan struct{}
+}
+
+// RunNodeAgent starts the node agent of the cloud provider, run by every
+// cloud controller manager and not only the leader: it programs the routing
+// table of the node if node-routes is set. The dry runs only log the routes.
+func (cloud *Edge) RunNodeAgent(clientBuilder cloudprovider.ControllerClientBuilder, stop <-chan struct{}) {
+	if !cloud.config.Routes.NodeRoutes {
+		return
+	}
+	kubeClient := clientBuilder.ClientOrDie(clientName + "-node-agent")
+	var backend routeBackend = newNetlinkRouteBackend()
+	if cloud.config.Global.DryRun {
+		backend = newDryRunRouteBackend(backend)
+	}
+	agent := newNodeRouteAgent(kubeClient, backend, newInstances(cloud).localNodeName, stop)
+	go agent.run(stop)
+}
+
+func newNodeRouteAgent(kubeClient kubernetes.Interface, backend routeBackend, localNodeName string, stop <-chan struct{}) *nodeRouteAgent {
+	informerFactory := informers.NewSharedInformerFactory(kubeClient, nodeRoutesResync)
+	nodeInformer := informerFactory.Core().V1().Nodes()
+	agent := &nodeRouteAgent{
+		backend:       backend,
+		nodeLister:    nodeInformer.Lister(),
+		localNodeName: localNodeName,
+		trigger:       make(chan struct{}, 1),
+	}
+	nodeInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(interface{}) { agent.triggerSync() },
+		UpdateFunc: func(interface{}, interface{}) { agent.triggerSync() },
+		DeleteFunc: func(interface{}) { agent.triggerSync() },
+	})
+	informerFactory.Start(stop)
+	return agent
+}
+
+func (agent *nodeRouteAgent) triggerSync() {
+	select {
+	case agent.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// run syncs the routing table of the node on the changes of the nodes, and
+// their periodic resyncs, until stop is closed
+func (agent *nodeRouteAgent) run(stop <-chan struct{}) {
+	klog.Infof("nodeRouteAgent: programming the routes of the node %s", agent.localNodeName)
+	for {
+		select {
+		case <-stop:
+			return
+		case <-agent.trigger:
+			if err := agent.sync(context.TODO()); err != nil {
+				klog.Errorf("nodeRouteAgent: %v", err)
+			}
+		}
+	}
+}
+
+func (agent *nodeRouteAgent) sync(ctx context.Context) error {
+	nodes, err := agent.nodeLister.List(labels.Everything())
+	if err != nil {
+		return fmt.Errorf("listing the nodes: %v", err)
+	}
+	return syncRoutes(ctx, agent.backend, nodeRoutes(nodes, agent.localNodeName))
+}
@@ -0,0 +1,77 @@
+/*
+Copyright 2019 Midokura
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package edge
+
+import (
+	"context"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+)
+
+// netlinkRouteProtocol tags the routes added by the cloud provider in the
+// routing table of the node, for them to be listed and cleaned: "proto 237"
+// in ip route
+const netlinkRouteProtocol = 237
+
+// netlinkRouteBackend programs the main routing table of the node running the
+// cloud controller manager
+type netlinkRouteBackend struct {
+	table int
+}
+
+func newNetlinkRouteBackend() *netlinkRouteBackend {
+	return &netlinkRouteBackend{table: syscall.RT_TABLE_MAIN}
+}
+
+// ListRoutes implements routeBackend
+func (backend *netlinkRouteBackend) ListRoutes(ctx context.Context) ([]backendRoute, error) {
+	filter := &netlink.Route{Protocol: netlinkRouteProtocol, Table: backend.table}
+	routes := make([]backendRoute, 0)
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		list, err := netlink.RouteListFiltered(family, filter, netlink.RT_FILTER_PROTOCOL|netlink.RT_FILTER_TABLE)
+		if err != nil {
+			return nil, err
+		}
+		for _, route := range list {
+			if route.Dst == nil {
+				continue
+			}
+			routes = append(routes, backendRoute{Destination: route.Dst, Gateway: route.Gw})
+		}
+	}
+	return routes, nil
+}
+
+// ReplaceRoute implements routeBackend
+func (backend *netlinkRouteBackend) ReplaceRoute(ctx context.Context, route backendRoute) error {
+	return netlink.RouteReplace(&netlink.Route{
+		Dst:      route.Destination,
+		Gw:       route.Gateway,
+		Protocol: netlinkRouteProtocol,
+		Table:    backend.table,
+	})
+}
+
+// DeleteRoute implements routeBackend
+func (backend *netlinkRouteBackend) DeleteRoute(ctx context.Context, route backendRoute) error {
+	return netlink.RouteDel(&netlink.Route{
+		Dst:      route.Destination,
+		Protocol: netlinkRouteProtocol,
+		Table:    backend.table,
+	})
+}
@@ -0,0 +1,85 @@
+/*
+Copyright 2019 Midokura
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package edge
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+// TestNetlinkRouteBackend programs the routes in a new network namespace,
+// with an interface towards the nodes
+func TestNetlinkRouteBackend(t *testing.T) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	origin, err := netns.Get()
+	if err != nil {
+		t.Skipf("no network namespace: %v", err)
+	}
+	defer origin.Close()
+	ns, err := netns.New()
+	if err != nil {
+		t.Skipf("cannot create a network namespace: %v", err)
+	}
+	defer ns.Close()
+	defer netns.Set(origin)
+
+	var link netlink.Link = &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "edge0"}}
+	if err := netlink.LinkAdd(link); err != nil {
+		// without dummy interfaces, the loopback of the namespace will do
+		if link, err = netlink.LinkByName("lo"); err != nil {
+			t.Skipf("no interface: %v", err)
+		}
+	}
+	addr, _ := netlink.ParseAddr("192.0.2.1/24")
+	if err := netlink.AddrAdd(link, addr); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if err := netlink.LinkSetUp(link); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	backend := newNetlinkRouteBackend()
+	route := newTestRoute("10.42.2.0/24", "192.0.2.2", "")
+	if err := backend.ReplaceRoute(context.TODO(), route); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	// replaced through another node
+	route = newTestRoute("10.42.2.0/24", "192.0.2.3", "")
+	if err := backend.ReplaceRoute(context.TODO(), route); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	routes, err := backend.ListRoutes(context.TODO())
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	// the route of the subnet of the interface is not listed
+	if fmt.Sprint(routes) != fmt.Sprint([]backendRoute{route}) {
+		t.Errorf("got %v\nwant %v", routes, []backendRoute{route})
+	}
+	if err := backend.DeleteRoute(context.TODO(), route); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if routes, _ := backend.ListRoutes(context.TODO()); len(routes) != 0 {
+		t.Errorf("got %v\nwant no routes", routes)
+	}
+}
@@ -0,0 +1,261 @@
+/*
+Copyright 2019 Midokura
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package edge
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes/fake"
+	cloudprovider "k8s.io/cloud-provider"
+)
+
+// recordingRouteBackend keeps the routes in memory, and records the changes
+type recordingRouteBackend struct {
+	*memoryRouteBackend
+	changes []string
+}
+
+func newRecordingRouteBackend(routes ...backendRoute) *recordingRouteBackend {
+	backend := &recordingRouteBackend{memoryRouteBackend: newMemoryRouteBackend()}
+	for _, route := range routes {
+		backend.memoryRouteBackend.ReplaceRoute(context.TODO(), route)
+	}
+	return backend
+}
+
+func (backend *recordingRouteBackend) ReplaceRoute(ctx context.Context, route backendRoute) error {
+	backend.changes = append(backend.changes, "replace "+route.String())
+	return backend.memoryRouteBackend.ReplaceRoute(ctx, route)
+}
+
+func (backend *recordingRouteBackend) DeleteRoute(ctx context.Context, route backendRoute) error {
+	backend.changes = append(backend.changes, "delete "+route.Destination.String())
+	return backend.memoryRouteBackend.DeleteRoute(ctx, route)
+}
+
+// routingMockClient is a gateway supporting static routes
+type routingMockClient struct {
+	*mockClient
+	*memoryRouteBackend
+}
+
+func newTestRoute(destination, gateway, description string) backendRoute {
+	_, ipNet, _ := net.ParseCIDR(destination)
+	return backendRoute{Destination: ipNet, Gateway: net.ParseIP(gateway), Description: description}
+}
+
+func newTestPodNode(name, internalIP string, podCIDRs ...string) *v1.Node {
+	node := newTestNode(name, internalIP)
+	node.Spec.PodCIDRs = podCIDRs
+	if len(podCIDRs) > 0 {
+		node.Spec.PodCIDR = podCIDRs[0]
+	}
+	return node
+}
+
+func TestSyncRoutes(t *testing.T) {
+	backend := newRecordingRouteBackend(
+		newTestRoute("10.42.1.0/24", "192.0.2.1", "node1"),
+		newTestRoute("10.42.2.0/24", "192.0.2.9", "node2"),
+		newTestRoute("10.42.3.0/24", "192.0.2.3", "gone"),
+	)
+	desired := []backendRoute{
+		newTestRoute("10.42.1.0/24", "192.0.2.1", "node1"),
+		newTestRoute("10.42.2.0/24", "192.0.2.2", "node2"),
+		newTestRoute("10.42.4.0/24", "192.0.2.4", "node4"),
+	}
+	if err := syncRoutes(context.TODO(), backend, desired); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	sort.Strings(backend.changes)
+	expectedChanges := []string{
+		"delete 10.42.3.0/24",
+		"replace 10.42.2.0/24 via 192.0.2.2",
+		"replace 10.42.4.0/24 via 192.0.2.4",
+	}
+	if !reflect.DeepEqual(backend.changes, expectedChanges) {
+		t.Errorf("got %v\nwant %v", backend.changes, expectedChanges)
+	}
+	routes, _ := backend.ListRoutes(context.TODO())
+	if !reflect.DeepEqual(routes, desired) {
+		t.Errorf("got %v\nwant %v", routes, desired)
+	}
+
+	// in sync: nothing changes
+	backend.changes = nil
+	if err := syncRoutes(context.TODO(), backend, desired); err != nil || len(backend.changes) != 0 {
+		t.Errorf("got %v, %v\nwant no changes", backend.changes, err)
+	}
+}
+
+func TestNodeRoutes(t *testing.T) {
+	dualStack := newTestPodNode("dual-stack", "192.0.2.3", "10.42.3.0/24", "fd00:42:3::/64")
+	dualStack.Status.Addresses = append(dualStack.Status.Addresses, v1.NodeAddress{Type: v1.NodeInternalIP, Address: "2001:db8::3"})
+	nodes := []*v1.Node{
+		newTestPodNode("local", "192.0.2.1", "10.42.1.0/24"),
+		newTestPodNode("remote", "192.0.2.2", "10.42.2.0/24"),
+		dualStack,
+		newTestPodNode("no-cidr", "192.0.2.4"),
+		newTestPodNode("no-ipv6", "192.0.2.5", "fd00:42:5::/64"),
+		newTestPodNode("invalid", "192.0.2.6", "10.42.6.0"),
+	}
+	expected := []backendRoute{
+		newTestRoute("10.42.2.0/24", "192.0.2.2", "remote"),
+		newTestRoute("10.42.3.0/24", "192.0.2.3", "dual-stack"),
+		newTestRoute("fd00:42:3::/64", "2001:db8::3", "dual-stack"),
+	}
+	if routes := nodeRoutes(nodes, "local"); !reflect.DeepEqual(routes, expected) {
+		t.Errorf("got %v\nwant %v", routes, expected)
+	}
+}
+
+func TestRoutes(t *testing.T) {
+	testCases := []struct {
+		name    string
+		client  func(t *testing.T, backend *memoryRouteBackend) clientInterface
+		dryRun  bool
+		gateway bool
+	}{
+		{name: "no gateway"},
+		{
+			name: "gateway without routes",
+			client: func(t *testing.T, backend *memoryRouteBackend) clientInterface {
+				return newResilientClient(newMockClient(t), newCircuitBreaker())
+			},
+		},
+		{
+			name: "gateway with routes",
+			client: func(t *testing.T, backend *memoryRouteBackend) clientInterface {
+				return newResilientClient(&routingMockClient{newMockClient(t), backend}, newCircuitBreaker())
+			},
+			gateway: true,
+		},
+		{
+			name: "dry run",
+			client: func(t *testing.T, backend *memoryRouteBackend) clientInterface {
+				return newDryRunClient(newResilientClient(&routingMockClient{newMockClient(t), backend}, newCircuitBreaker()))
+			},
+			dryRun: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cloud := &Edge{kubeClient: fake.NewSimpleClientset(newTestPodNode("node", "192.0.2.1", "10.42.1.0/24"))}
+			cloud.config.Routes.NodeRoutes = true
+			gatewayRoutes := newMemoryRouteBackend()
+			if tc.client != nil {
+				cloud.LoadBalancerInstance = &LoadBalancer{client: tc.client(t, gatewayRoutes), dryRun: tc.dryRun}
+			}
+			r, ok := cloud.Routes()
+			if !ok {
+				t.Fatalf("got no routes\nwant the routes supported")
+			}
+
+			route := &cloudprovider.Route{TargetNode: "node", DestinationCIDR: "10.42.1.0/24"}
+			if err := r.CreateRoute(context.TODO(), "kubernetes", "uid", route); err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			routes, err := r.ListRoutes(context.TODO(), "kubernetes")
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			expected := []*cloudprovider.Route{{Name: "kubernetes/node", TargetNode: "node", DestinationCIDR: "10.42.1.0/24"}}
+			if !reflect.DeepEqual(routes, expected) {
+				t.Errorf("got %+v\nwant %+v", routes, expected)
+			}
+			if routes, _ := r.ListRoutes(context.TODO(), "other"); len(routes) != 0 {
+				t.Errorf("got %+v\nwant no routes of another cluster", routes)
+			}
+			onGateway, _ := gatewayRoutes.ListRoutes(context.TODO())
+			if tc.gateway != (len(onGateway) == 1) {
+				t.Errorf("got %v on the gateway\nwant the route on the gateway %t", onGateway, tc.gateway)
+			}
+
+			if err := r.DeleteRoute(context.TODO(), "kubernetes", route); err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if routes, _ := r.ListRoutes(context.TODO(), "kubernetes"); len(routes) != 0 {
+				t.Errorf("got %+v\nwant no routes", routes)
+			}
+		})
+	}
+}
+
+func TestCreateRouteErrors(t *testing.T) {
+	cloud := &Edge{kubeClient: fake.NewSimpleClientset(newTestPodNode("ipv4", "192.0.2.1", "10.42.1.0/24"))}
+	cloud.config.Routes.NodeRoutes = true
+	r, _ := cloud.Routes()
+	for _, route := range []*cloudprovider.Route{
+		{TargetNode: "ipv4", DestinationCIDR: "10.42.1.0"},
+		{TargetNode: "missing", DestinationCIDR: "10.42.1.0/24"},
+		{TargetNode: "ipv4", DestinationCIDR: "fd00:42:1::/64"},
+	} {
+		if err := r.CreateRoute(context.TODO(), "kubernetes", "uid", route); err == nil {
+			t.Errorf("%+v: expected error", route)
+		}
+	}
+	if _, ok := (&Edge{}).Routes(); ok {
+		t.Errorf("got the routes supported\nwant them only with node-routes")
+	}
+}
+
+func TestNodeRouteAgent(t *testing.T) {
+	oldResync := nodeRoutesResync
+	nodeRoutesResync = 0
+	defer func() {
+		nodeRoutesResync = oldResync
+	}()
+	kubeClient := fake.NewSimpleClientset(
+		newTestPodNode("local", "192.0.2.1", "10.42.1.0/24"),
+		newTestPodNode("remote", "192.0.2.2", "10.42.2.0/24"),
+	)
+	backend := newMemoryRouteBackend()
+	stop := make(chan struct{})
+	defer close(stop)
+	agent := newNodeRouteAgent(kubeClient, backend, "local", stop)
+	go agent.run(stop)
+
+	waitForRoutes := func(expected ...backendRoute) {
+		err := wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+			routes, _ := backend.ListRoutes(context.TODO())
+			return fmt.Sprint(routes) == fmt.Sprint(expected), nil
+		})
+		if err != nil {
+			routes, _ := backend.ListRoutes(context.TODO())
+			t.Fatalf("got %v\nwant %v", routes, expected)
+		}
+	}
+	waitForRoutes(newTestRoute("10.42.2.0/24", "192.0.2.2", "remote"))
+
+	if _, err := kubeClient.CoreV1().Nodes().Create(newTestPodNode("new", "192.0.2.3", "10.42.3.0/24")); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	waitForRoutes(newTestRoute("10.42.2.0/24", "192.0.2.2", "remote"), newTestRoute("10.42.3.0/24", "192.0.2.3", "new"))
+
+	if err := kubeClient.CoreV1().Nodes().Delete("remote", nil); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	waitForRoutes(newTestRoute("10.42.3.0/24", "192.0.2.3", "new"))
+}
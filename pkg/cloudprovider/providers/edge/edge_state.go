@@ -0,0 +1,285 @@
+/*
+Copyright 2019 Midokura
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package edge
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"time"
+
+	k8s "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog"
+)
+
+// EdgeLoadBalancer CustomResource, see install/edge-load-balancer-crd.yaml
+const (
+	// EdgeLoadBalancerGroup is the API group of the EdgeLoadBalancer resource
+	EdgeLoadBalancerGroup = "edge.midokura.com"
+	// EdgeLoadBalancerVersion is the API version of the EdgeLoadBalancer resource
+	EdgeLoadBalancerVersion = "v1alpha1"
+	// EdgeLoadBalancerKind is the kind of the EdgeLoadBalancer resource
+	EdgeLoadBalancerKind = "EdgeLoadBalancer"
+)
+
+// stateLoadBackoff is the backoff between the attempts to load the state, e.g.
+// until the CustomResourceDefinition is installed
+var stateLoadBackoff = wait.Backoff{
+	Duration: 1 * time.Second,
+	Factor:   2.0,
+	Jitter:   0.1,
+	Steps:    8,
+	Cap:      5 * time.Minute,
+}
+
+// EdgeLoadBalancerResource is the resource of the EdgeLoadBalancers
+var EdgeLoadBalancerResource = schema.GroupVersionResource{
+	Group:    EdgeLoadBalancerGroup,
+	Version:  EdgeLoadBalancerVersion,
+	Resource: "edgeloadbalancers",
+}
+
+// EdgeLoadBalancer records the state of the load balancer of a service. It has
+// the same namespace and name as the service, which owns it.
+type EdgeLoadBalancer struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Status EdgeLoadBalancerStatus `json:"status"`
+}
+
+// EdgeLoadBalancerStatus is the state of the load balancer of a service
+type EdgeLoadBalancerStatus struct {
+	// ClusterName is the name of the cluster as presented to the cloud provider
+	ClusterName string `json:"clusterName"`
+	// GatewayUDN is the Unique Device Name of the UPnP gateway
+	GatewayUDN string `json:"gatewayUDN,omitempty"`
+	// GatewayLocation is the URL of the description of the UPnP gateway
+	GatewayLocation string `json:"gatewayLocation,omitempty"`
+	// ExternalIP is the IP of the WAN connection of the port mappings
+	ExternalIP string `json:"externalIP"`
+	// NodeIP is the internal IP of the node targeted by the port mappings
+	NodeIP string `json:"nodeIP,omitempty"`
+	// PortMappings are the port mappings installed on the gateway
+	PortMappings []EdgePortMapping `json:"portMappings,omitempty"`
+	// LastError is the error of the last failed update, if it failed
+	LastError string `json:"lastError,omitempty"`
+}
+
+// EdgePortMapping is a port mapping installed on the gateway
+type EdgePortMapping struct {
+	Name         string       `json:"name,omitempty"`
+	Protocol     k8s.Protocol `json:"protocol"`
+	Port         int32        `json:"port"`
+	ExternalPort int32        `json:"externalPort"`
+	NodePort     int32        `json:"nodePort"`
+	// LeaseExpiry is the expiration of the lease, unset if it is permanent
+	LeaseExpiry *metav1.Time `json:"leaseExpiry,omitempty"`
+}
+
+// newEdgeLoadBalancer returns the EdgeLoadBalancer recording the load balancer
+// of the service
+func (lb *LoadBalancer) newEdgeLoadBalancer(clusterName string, service *k8s.Service, loadBalancer *loadBalancer) *EdgeLoadBalancer {
+	elb := &EdgeLoadBalancer{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: EdgeLoadBalancerResource.GroupVersion().String(),
+			Kind:       EdgeLoadBalancerKind,
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: service.Namespace,
+			Name:      service.Name,
+		},
+		Status: EdgeLoadBalancerStatus{
+			ClusterName:  clusterName,
+			NodeIP:       loadBalancer.nodeIP,
+			PortMappings: make([]EdgePortMapping, 0, len(loadBalancer.portMappings)),
+		},
+	}
+	if service.UID != "" {
+		elb.OwnerReferences = []metav1.OwnerReference{{
+			APIVersion: "v1",
+			Kind:       "Service",
+			Name:       service.Name,
+			UID:        service.UID,
+		}}
+	}
+	if len(loadBalancer.status.Ingress) > 0 {
+		elb.Status.ExternalIP = loadBalancer.status.Ingress[0].IP
+	}
+	if wan := findWANConnection(lb.wanConnections, net.ParseIP(elb.Status.ExternalIP)); wan != nil {
+		elb.Status.GatewayUDN = wan.deviceID
+		if wan.location != nil {
+			elb.Status.GatewayLocation = wan.location.String()
+		}
+	}
+	for _, pm := range loadBalancer.portMappings {
+		epm := EdgePortMapping{
+			Name:         pm.servicePort.Name,
+			Protocol:     pm.servicePort.Protocol,
+			Port:         pm.servicePort.Port,
+			ExternalPort: pm.externalPort(),
+			NodePort:     pm.servicePort.NodePort,
+		}
+		if !pm.leaseExpiry.IsZero() {
+			epm.LeaseExpiry = &metav1.Time{Time: pm.leaseExpiry}
+		}
+		elb.Status.PortMappings = append(elb.Status.PortMappings, epm)
+	}
+	return elb
+}
+
+// loadBalancer returns the name and the load balancer recorded
+func (elb *EdgeLoadBalancer) loadBalancer() (string, loadBalancer) {
+	name := fmt.Sprintf("%s/%s/%s", elb.Status.ClusterName, elb.Namespace, elb.Name)
+	loadBalancer := newLoadBalancerWithoutPortMappings(elb.Status.ExternalIP)
+	loadBalancer.nodeIP = elb.Status.NodeIP
+	loadBalancer.lastError = elb.Status.LastError
+	for _, epm := range elb.Status.PortMappings {
+		pm := portMapping{
+			servicePort: k8s.ServicePort{
+				Name:     epm.Name,
+				Protocol: epm.Protocol,
+				Port:     epm.Port,
+				NodePort: epm.NodePort,
+			},
+			nodeIP:     elb.Status.NodeIP,
+			externalIP: elb.Status.ExternalIP,
+			samePort:   epm.ExternalPort != epm.Port,
+		}
+		if epm.LeaseExpiry != nil {
+			pm.leaseExpiry = epm.LeaseExpiry.Time
+		}
+		loadBalancer.portMappings = append(loadBalancer.portMappings, pm)
+	}
+	return name, loadBalancer
+}
+
+// runStateLoader loads the state, retrying with backoff until it succeeds or
+// the cloud is stopped. Until then, no stale port mapping is cleaned.
+func (lb *LoadBalancer) runStateLoader(stop <-chan struct{}) {
+	backoff := stateLoadBackoff
+	for {
+		err := lb.loadState()
+		if err == nil {
+			return
+		}
+		delay := backoff.Step()
+		klog.Errorf("runStateLoader: error loading the state of the load balancers, retrying in %s: %v", delay, err)
+		select {
+		case <-stop:
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+// loadState seeds the known load balancers with the EdgeLoadBalancers. The
+// ones already known, updated since the start, are kept.
+func (lb *LoadBalancer) loadState() error {
+	if lb.dynamicClient == nil {
+		return nil
+	}
+	list, err := lb.dynamicClient.Resource(EdgeLoadBalancerResource).List(metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+	for i := range list.Items {
+		elb := &EdgeLoadBalancer{}
+		err := runtime.DefaultUnstructuredConverter.FromUnstructured(list.Items[i].Object, elb)
+		if err != nil {
+			klog.Errorf("loadState: %s/%s: %v", list.Items[i].GetNamespace(), list.Items[i].GetName(), err)
+			continue
+		}
+		name, loadBalancer := elb.loadBalancer()
+		if _, ok := lb.loadBalancers[name]; ok {
+			continue
+		}
+		lb.loadBalancers[name] = loadBalancer
+		setActivePortMappings(fmt.Sprintf("%s/%s", elb.Namespace, elb.Name), &loadBalancer)
+		klog.V(3).Infof("loadState: %s: %d port mappings", name, len(loadBalancer.portMappings))
+	}
+	lb.stateLoaded = true
+	lb.publishDNSRecords()
+	klog.Infof("loadState: %d load balancers loaded", len(list.Items))
+	return nil
+}
+
+// saveState creates or updates the EdgeLoadBalancer of the service. Errors are
+// only logged, since the state is kept in memory too.
+func (lb *LoadBalancer) saveState(clusterName string, service *k8s.Service, loadBalancer *loadBalancer) {
+	if lb.dynamicClient == nil {
+		return
+	}
+	elb := lb.newEdgeLoadBalancer(clusterName, service, loadBalancer)
+	object, err := runtime.DefaultUnstructuredConverter.ToUnstructured(elb)
+	if err != nil {
+		klog.Errorf("saveState: %s/%s: %v", service.Namespace, service.Name, err)
+		return
+	}
+	obj := &unstructured.Unstructured{Object: object}
+	client := lb.dynamicClient.Resource(EdgeLoadBalancerResource).Namespace(service.Namespace)
+	current, err := client.Get(service.Name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		_, err = client.Create(obj, metav1.CreateOptions{})
+	} else if err == nil {
+		obj.SetResourceVersion(current.GetResourceVersion())
+		_, err = client.Update(obj, metav1.UpdateOptions{})
+	}
+	if err != nil {
+		klog.Errorf("saveState: %s/%s: %v", service.Namespace, service.Name, err)
+	}
+}
+
+// saveStateError records the error of a failed update in the EdgeLoadBalancer
+// of the service, if there is one
+func (lb *LoadBalancer) saveStateError(service *k8s.Service, stateErr error) {
+	if lb.dynamicClient == nil {
+		return
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"status": map[string]string{"lastError": stateErr.Error()},
+	})
+	if err != nil {
+		klog.Errorf("saveStateError: %s/%s: %v", service.Namespace, service.Name, err)
+		return
+	}
+	_, err = lb.dynamicClient.Resource(EdgeLoadBalancerResource).Namespace(service.Namespace).
+		Patch(service.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		klog.Errorf("saveStateError: %s/%s: %v", service.Namespace, service.Name, err)
+	}
+}
+
+// deleteState deletes the EdgeLoadBalancer of the service
+func (lb *LoadBalancer) deleteState(service *k8s.Service) {
+	if lb.dynamicClient == nil {
+		return
+	}
+	err := lb.dynamicClient.Resource(EdgeLoadBalancerResource).Namespace(service.Namespace).Delete(service.Name, &metav1.DeleteOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		klog.Errorf("deleteState: %s/%s: %v", service.Namespace, service.Name, err)
+	}
+}
@@ -0,0 +1,170 @@
+/*
+Copyright 2019 Midokura
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package edge
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func getTestEdgeLoadBalancer(t *testing.T, lb *LoadBalancer, namespace, name string) *EdgeLoadBalancer {
+	obj, err := lb.dynamicClient.Resource(EdgeLoadBalancerResource).Namespace(namespace).Get(name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	elb := &EdgeLoadBalancer{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, elb); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	return elb
+}
+
+func TestEdgeLoadBalancerState(t *testing.T) {
+	nodeIP := "192.0.2.1"
+	client := newMockClient(t)
+	client.addErrors = map[uint16][]error{8080: {newUPnPError(upnpSamePortValuesRequired)}}
+	lb := &LoadBalancer{
+		client:        client,
+		localAddress:  net.ParseIP(nodeIP),
+		externalIP:    net.ParseIP("198.51.100.1"),
+		loadBalancers: make(map[string]loadBalancer),
+		dynamicClient: dynamicfake.NewSimpleDynamicClient(runtime.NewScheme()),
+	}
+	nodes := []*v1.Node{newTestNode("node", nodeIP)}
+	service := newTestService("")
+	_, err := lb.EnsureLoadBalancer(context.TODO(), "kubernetes", service, nodes)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	elb := getTestEdgeLoadBalancer(t, lb, "default", "svc")
+	expected := EdgeLoadBalancerStatus{
+		ClusterName: "kubernetes",
+		ExternalIP:  "198.51.100.1",
+		NodeIP:      nodeIP,
+		PortMappings: []EdgePortMapping{
+			{Name: "http", Protocol: "TCP", Port: 8080, ExternalPort: 30080, NodePort: 30080},
+		},
+	}
+	if !reflect.DeepEqual(elb.Status, expected) {
+		t.Errorf("got %+v\nwant %+v", elb.Status, expected)
+	}
+
+	// a new load balancer is seeded with the state
+	seeded := &LoadBalancer{
+		loadBalancers: make(map[string]loadBalancer),
+		dynamicClient: lb.dynamicClient,
+	}
+	if err := seeded.loadState(); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	expectedMappings := []portMapping{{
+		servicePort: v1.ServicePort{Name: "http", Protocol: "TCP", Port: 8080, NodePort: 30080},
+		nodeIP:      nodeIP,
+		externalIP:  "198.51.100.1",
+		samePort:    true,
+	}}
+	if seededMappings := seeded.loadBalancers["kubernetes/default/svc"].portMappings; !reflect.DeepEqual(seededMappings, expectedMappings) {
+		t.Errorf("got %+v\nwant %+v", seededMappings, expectedMappings)
+	}
+
+	// failures are recorded
+	client.addErrors = map[uint16][]error{8443: {newUPnPError(upnpActionNotAuthorized)}}
+	service.Spec.Ports = append(service.Spec.Ports, v1.ServicePort{Name: "https", Protocol: "TCP", Port: 8443, NodePort: 30443})
+	err = lb.UpdateLoadBalancer(context.TODO(), "kubernetes", service, nodes)
+	if err == nil {
+		t.Fatalf("expected error")
+	}
+	elb = getTestEdgeLoadBalancer(t, lb, "default", "svc")
+	if elb.Status.LastError != err.Error() {
+		t.Errorf("got last error %q\nwant %q", elb.Status.LastError, err.Error())
+	}
+	if len(elb.Status.PortMappings) != 1 {
+		t.Errorf("got %+v\nwant the port mappings of the last successful update", elb.Status.PortMappings)
+	}
+
+	// the state is deleted with the load balancer
+	client.added = nil
+	err = lb.EnsureLoadBalancerDeleted(context.TODO(), "kubernetes", service)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	list, err := lb.dynamicClient.Resource(EdgeLoadBalancerResource).List(metav1.ListOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if len(list.Items) != 0 {
+		t.Errorf("got %d EdgeLoadBalancers\nwant 0", len(list.Items))
+	}
+}
+
+func TestRunStateLoader(t *testing.T) {
+	nodeIP := "192.0.2.1"
+	lb := &LoadBalancer{
+		client:        newMockClient(t),
+		localAddress:  net.ParseIP(nodeIP),
+		externalIP:    net.ParseIP("198.51.100.1"),
+		loadBalancers: make(map[string]loadBalancer),
+		dynamicClient: dynamicfake.NewSimpleDynamicClient(runtime.NewScheme()),
+	}
+	for _, name := range []string{"svc", "other"} {
+		service := newTestService("")
+		service.Name = name
+		if _, err := lb.EnsureLoadBalancer(context.TODO(), "kubernetes", service, []*v1.Node{newTestNode("node", nodeIP)}); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+	}
+	oldBackoff := stateLoadBackoff
+	stateLoadBackoff = wait.Backoff{Duration: time.Millisecond, Steps: 1}
+	defer func() { stateLoadBackoff = oldBackoff }()
+
+	// the CustomResourceDefinition is not installed yet
+	failures := 2
+	lb.dynamicClient.(*dynamicfake.FakeDynamicClient).PrependReactor("list", "edgeloadbalancers", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if failures == 0 {
+			return false, nil, nil
+		}
+		failures--
+		return true, nil, fmt.Errorf("the server could not find the requested resource")
+	})
+	// the load balancer updated meanwhile is kept
+	updated := newLoadBalancerWithPortMappings(newTestService(""), "192.0.2.2", "198.51.100.1")
+	seeded := &LoadBalancer{
+		loadBalancers: map[string]loadBalancer{"kubernetes/default/svc": updated},
+		dynamicClient: lb.dynamicClient,
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	seeded.runStateLoader(stop)
+	if failures != 0 || !seeded.stateLoaded {
+		t.Fatalf("got %d failures left, loaded %t\nwant the state loaded after the failures", failures, seeded.stateLoaded)
+	}
+	if len(seeded.loadBalancers) != 2 || seeded.loadBalancers["kubernetes/default/svc"].nodeIP != "192.0.2.2" {
+		t.Errorf("got %+v\nwant the other load balancer loaded, and svc kept", seeded.loadBalancers)
+	}
+}
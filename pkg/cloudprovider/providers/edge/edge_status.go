@@ -0,0 +1,215 @@
+/*
+Copyright 2019 Midokura
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package edge
+
+import (
+	"encoding/json"
+	"fmt"
+
+	k8s "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog"
+)
+
+const (
+	// LoadBalancerStatusAnnotation annotates the per-port status of the load balancer
+	LoadBalancerStatusAnnotation string = "midokura.com/load-balancer-status"
+)
+
+// Reasons of the events recorded on the services
+const (
+	portMappingAddedReason    = "PortMappingAdded"
+	portMappingRemovedReason  = "PortMappingRemoved"
+	portMappingConflictReason = "PortMappingConflict"
+	portMappingRejectedReason = "PortMappingRejected"
+	portMappingFailedReason   = "PortMappingFailed"
+)
+
+// Port mapping states of the status annotation
+const (
+	portMappingMapped   = "Mapped"
+	portMappingPending  = "Pending"
+	portMappingConflict = "Conflict"
+	portMappingRejected = "Rejected"
+	portMappingFailed   = "Failed"
+)
+
+type mappingOperation string
+
+const (
+	mappingAdd    mappingOperation = "add"
+	mappingDelete mappingOperation = "delete"
+)
+
+// mappingResult store the outcome of a port mapping operation on the gateway
+type mappingResult struct {
+	portMapping portMapping
+	operation   mappingOperation
+	err         error
+}
+
+// PortMappingStatus is the status of a service port, as shown in the
+// LoadBalancerStatusAnnotation
+type PortMappingStatus struct {
+	Name       string       `json:"name,omitempty"`
+	Protocol   k8s.Protocol `json:"protocol"`
+	Port       int32        `json:"port"`
+	NodePort   int32        `json:"nodePort"`
+	NodeIP     string       `json:"nodeIP,omitempty"`
+	ExternalIP string       `json:"externalIP,omitempty"`
+	State      string       `json:"state"`
+	Error      string       `json:"error,omitempty"`
+}
+
+func (pm portMapping) String() string {
+	s := fmt.Sprintf("%s %s:%d", pm.servicePort.Protocol, pm.externalIP, pm.externalPort())
+	if pm.nodeIP != "" {
+		s += fmt.Sprintf(" -> %s:%d", pm.nodeIP, pm.servicePort.NodePort)
+	}
+	if pm.servicePort.Name != "" {
+		s += fmt.Sprintf(" (%s)", pm.servicePort.Name)
+	}
+	return s
+}
+
+// recordMappingEvents records an event on the service for each port mapping
+// operation done on the gateway
+func (lb *LoadBalancer) recordMappingEvents(service *k8s.Service, results []mappingResult) {
+	if lb.eventRecorder == nil {
+		return
+	}
+	dryRun := ""
+	if lb.dryRun {
+		dryRun = " (dry run)"
+	}
+	for _, result := range results {
+		if result.err == nil {
+			if result.operation == mappingAdd {
+				lb.eventRecorder.Eventf(service, k8s.EventTypeNormal, portMappingAddedReason, "Added port mapping %s%s", result.portMapping, dryRun)
+			} else {
+				lb.eventRecorder.Eventf(service, k8s.EventTypeNormal, portMappingRemovedReason, "Removed port mapping %s%s", result.portMapping, dryRun)
+			}
+			continue
+		}
+		switch mappingErrorState(result.err) {
+		case portMappingConflict:
+			lb.eventRecorder.Eventf(service, k8s.EventTypeWarning, portMappingConflictReason, "Failed to %s port mapping %s: conflict with an existing mapping: %v", result.operation, result.portMapping, result.err)
+		case portMappingRejected:
+			lb.eventRecorder.Eventf(service, k8s.EventTypeWarning, portMappingRejectedReason, "Failed to %s port mapping %s: rejected by the gateway: %v", result.operation, result.portMapping, result.err)
+		default:
+			lb.eventRecorder.Eventf(service, k8s.EventTypeWarning, portMappingFailedReason, "Failed to %s port mapping %s: %v", result.operation, result.portMapping, result.err)
+		}
+	}
+}
+
+func mappingErrorState(err error) string {
+	if isUPnPError(err, upnpConflictInMappingEntry) {
+		return portMappingConflict
+	}
+	if _, ok := err.(*upnpError); ok {
+		return portMappingRejected
+	}
+	return portMappingFailed
+}
+
+// getPortMappingStatuses returns the status of each desired port mapping,
+// after moving from the 'old' port mappings with the given results
+func getPortMappingStatuses(old, new []portMapping, results []mappingResult) []PortMappingStatus {
+	installed := make(map[portMapping]bool)
+	for _, pm := range old {
+		installed[pm.key()] = true
+	}
+	addResults := make(map[portMapping]mappingResult)
+	for _, result := range results {
+		if result.operation == mappingAdd {
+			addResults[result.portMapping.key()] = result
+		}
+	}
+	statuses := make([]PortMappingStatus, 0, len(new))
+	for _, pm := range new {
+		status := PortMappingStatus{
+			Name:       pm.servicePort.Name,
+			Protocol:   pm.servicePort.Protocol,
+			Port:       pm.externalPort(),
+			NodePort:   pm.servicePort.NodePort,
+			NodeIP:     pm.nodeIP,
+			ExternalIP: pm.externalIP,
+		}
+		if result, attempted := addResults[pm.key()]; attempted {
+			if result.err == nil {
+				status.State = portMappingMapped
+			} else {
+				status.State = mappingErrorState(result.err)
+				status.Error = result.err.Error()
+			}
+		} else if installed[pm.key()] {
+			status.State = portMappingMapped
+		} else {
+			status.State = portMappingPending
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// statusAnnotationPatch returns the merge patch setting the
+// LoadBalancerStatusAnnotation of the service, or removing it if no statuses
+// are given, nil if the annotation is unchanged. Errors are only logged,
+// since the annotation is informational.
+func (lb *LoadBalancer) statusAnnotationPatch(service *k8s.Service, statuses []PortMappingStatus) []byte {
+	if lb.kubeClient == nil {
+		return nil
+	}
+	var value *string
+	if len(statuses) > 0 {
+		data, err := json.Marshal(statuses)
+		if err != nil {
+			klog.Errorf("statusAnnotationPatch: %s/%s: %v", service.Namespace, service.Name, err)
+			return nil
+		}
+		s := string(data)
+		value = &s
+	}
+	current, exists := service.Annotations[LoadBalancerStatusAnnotation]
+	if (value == nil && !exists) || (value != nil && exists && current == *value) {
+		return nil
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]*string{LoadBalancerStatusAnnotation: value},
+		},
+	})
+	if err != nil {
+		klog.Errorf("statusAnnotationPatch: %s/%s: %v", service.Namespace, service.Name, err)
+		return nil
+	}
+	return patch
+}
+
+// patchStatusAnnotation sends the patch of statusAnnotationPatch, if any. It
+// is called without the mutex held, not to stall the gateway management on a
+// slow API server.
+func (lb *LoadBalancer) patchStatusAnnotation(service *k8s.Service, patch []byte) {
+	if patch == nil {
+		return
+	}
+	_, err := lb.kubeClient.CoreV1().Services(service.Namespace).Patch(service.Name, types.MergePatchType, patch)
+	if err != nil && !errors.IsNotFound(err) {
+		klog.Errorf("patchStatusAnnotation: %s/%s: %v", service.Namespace, service.Name, err)
+	}
+}
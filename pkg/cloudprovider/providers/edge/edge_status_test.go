@@ -0,0 +1,215 @@
+/*
+Copyright 2019 Midokura
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package edge
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/record"
+)
+
+func getEvents(recorder *record.FakeRecorder) []string {
+	events := make([]string, 0)
+	for {
+		select {
+		case event := <-recorder.Events:
+			events = append(events, event)
+		default:
+			return events
+		}
+	}
+}
+
+func getStatusAnnotation(t *testing.T, kubeClient *fake.Clientset, service *v1.Service) []PortMappingStatus {
+	current, err := kubeClient.CoreV1().Services(service.Namespace).Get(service.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	value, exists := current.Annotations[LoadBalancerStatusAnnotation]
+	if !exists {
+		return nil
+	}
+	statuses := make([]PortMappingStatus, 0)
+	if err := json.Unmarshal([]byte(value), &statuses); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	return statuses
+}
+
+func TestEnsureLoadBalancerEventsAndStatusAnnotation(t *testing.T) {
+	nodeIP := "192.0.2.1"
+	externalIP := "198.51.100.1"
+	client := newMockClient(t)
+	client.addErrors = map[uint16][]error{
+		8443: {newUPnPError(upnpConflictInMappingEntry)},
+	}
+	service := newTestService("")
+	service.Spec.Ports = append(service.Spec.Ports, v1.ServicePort{
+		Name:       "https",
+		Protocol:   "TCP",
+		Port:       8443,
+		NodePort:   30443,
+		TargetPort: intstr.FromInt(443),
+	})
+	kubeClient := fake.NewSimpleClientset(service)
+	recorder := record.NewFakeRecorder(10)
+	lb := LoadBalancer{
+		client:        client,
+		localAddress:  net.ParseIP(nodeIP),
+		externalIP:    net.ParseIP(externalIP),
+		loadBalancers: make(map[string]loadBalancer),
+		kubeClient:    kubeClient,
+		eventRecorder: recorder,
+	}
+	nodes := []*v1.Node{newTestNode("node", nodeIP)}
+
+	// The https port conflicts: only one of the ports may be added before failing
+	_, err := lb.EnsureLoadBalancer(context.TODO(), "kubernetes", service, nodes)
+	if err == nil {
+		t.Fatalf("expected error for the conflicting port mapping")
+	}
+	events := getEvents(recorder)
+	conflicts := 0
+	for _, event := range events {
+		if strings.HasPrefix(event, "Warning "+portMappingConflictReason) {
+			conflicts++
+			if !strings.Contains(event, "UPnP error 718: ConflictInMappingEntry") {
+				t.Errorf("got event %q\nwant the UPnP error code and description", event)
+			}
+		} else if !strings.HasPrefix(event, "Normal "+portMappingAddedReason) {
+			t.Errorf("unexpected event %q", event)
+		}
+	}
+	if conflicts != 1 {
+		t.Errorf("got events %v\nwant one %s event", events, portMappingConflictReason)
+	}
+	statuses := getStatusAnnotation(t, kubeClient, service)
+	if len(statuses) != 2 {
+		t.Fatalf("got statuses %v\nwant 2", statuses)
+	}
+	if statuses[1].State != portMappingConflict || statuses[1].Error == "" {
+		t.Errorf("got status %v\nwant %s with error", statuses[1], portMappingConflict)
+	}
+	if statuses[0].State != portMappingMapped && statuses[0].State != portMappingPending {
+		t.Errorf("got status %v\nwant %s or %s", statuses[0], portMappingMapped, portMappingPending)
+	}
+
+	// Once the conflict is solved, all the ports are mapped
+	client.addErrors = nil
+	service, _ = kubeClient.CoreV1().Services(service.Namespace).Get(service.Name, metav1.GetOptions{})
+	_, err = lb.EnsureLoadBalancer(context.TODO(), "kubernetes", service, nodes)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	expected := []PortMappingStatus{
+		{Name: "http", Protocol: "TCP", Port: 8080, NodePort: 30080, NodeIP: nodeIP, ExternalIP: externalIP, State: portMappingMapped},
+		{Name: "https", Protocol: "TCP", Port: 8443, NodePort: 30443, NodeIP: nodeIP, ExternalIP: externalIP, State: portMappingMapped},
+	}
+	if statuses := getStatusAnnotation(t, kubeClient, service); !reflect.DeepEqual(statuses, expected) {
+		t.Errorf("got %v\nwant %v", statuses, expected)
+	}
+
+	// Deleting removes the mappings and the annotation
+	service, _ = kubeClient.CoreV1().Services(service.Namespace).Get(service.Name, metav1.GetOptions{})
+	getEvents(recorder)
+	client.added = nil
+	err = lb.EnsureLoadBalancerDeleted(context.TODO(), "kubernetes", service)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	events = getEvents(recorder)
+	if len(events) != 2 || !strings.HasPrefix(events[0], "Normal "+portMappingRemovedReason) || !strings.HasPrefix(events[1], "Normal "+portMappingRemovedReason) {
+		t.Errorf("got events %v\nwant 2 %s events", events, portMappingRemovedReason)
+	}
+	if statuses := getStatusAnnotation(t, kubeClient, service); statuses != nil {
+		t.Errorf("got %v\nwant no status annotation", statuses)
+	}
+}
+
+func TestStatusAnnotationPatchedWithoutMutex(t *testing.T) {
+	nodeIP := "192.0.2.1"
+	service := newTestService("")
+	kubeClient := fake.NewSimpleClientset(service)
+	lb := LoadBalancer{
+		client:        newMockClient(t),
+		localAddress:  net.ParseIP(nodeIP),
+		externalIP:    net.ParseIP("198.51.100.1"),
+		loadBalancers: make(map[string]loadBalancer),
+		kubeClient:    kubeClient,
+	}
+	patches := 0
+	kubeClient.PrependReactor("patch", "services", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		patches++
+		unlocked := make(chan struct{})
+		go func() {
+			lb.mutex.Lock()
+			lb.mutex.Unlock()
+			close(unlocked)
+		}()
+		select {
+		case <-unlocked:
+		case <-time.After(time.Second):
+			t.Errorf("got the service patched with the mutex held\nwant it released")
+		}
+		return false, nil, nil
+	})
+	nodes := []*v1.Node{newTestNode("node", nodeIP)}
+	if _, err := lb.EnsureLoadBalancer(context.TODO(), "kubernetes", service, nodes); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if patches != 1 || getStatusAnnotation(t, kubeClient, service) == nil {
+		t.Errorf("got %d patches\nwant the status annotation patched once", patches)
+	}
+
+	// the annotation unchanged is not patched again
+	service, _ = kubeClient.CoreV1().Services(service.Namespace).Get(service.Name, metav1.GetOptions{})
+	if err := lb.UpdateLoadBalancer(context.TODO(), "kubernetes", service, nodes); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if patches != 1 {
+		t.Errorf("got %d patches\nwant 1", patches)
+	}
+}
+
+func TestRecordMappingEventsRejected(t *testing.T) {
+	recorder := record.NewFakeRecorder(10)
+	lb := LoadBalancer{eventRecorder: recorder}
+	pm := portMapping{
+		servicePort: v1.ServicePort{Name: "http", Protocol: "TCP", Port: 80, NodePort: 30080},
+		nodeIP:      "192.0.2.1",
+		externalIP:  "198.51.100.1",
+	}
+	lb.recordMappingEvents(newTestService(""), []mappingResult{
+		{portMapping: pm, operation: mappingAdd, err: &upnpError{Code: 606, Description: "Action not authorized"}},
+	})
+	expected := []string{"Warning PortMappingRejected Failed to add port mapping TCP 198.51.100.1:80 -> 192.0.2.1:30080 (http): rejected by the gateway: UPnP error 606 (ActionNotAuthorized): Action not authorized"}
+	if events := getEvents(recorder); !reflect.DeepEqual(events, expected) {
+		t.Errorf("got %v\nwant %v", events, expected)
+	}
+}
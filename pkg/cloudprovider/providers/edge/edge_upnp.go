@@ -0,0 +1,285 @@
+/*
+Copyright 2019 Midokura
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package edge
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/huin/goupnp"
+	"github.com/huin/goupnp/soap"
+)
+
+const (
+	soapEnvelopeNamespace = "http://schemas.xmlsoap.org/soap/envelope/"
+	soapEncodingStyle     = "http://schemas.xmlsoap.org/soap/encoding/"
+)
+
+// UPnP error codes of the WAN connection services actions, as defined by the
+// UPnP Device Architecture and the WANIPConnection:2 service specifications.
+const (
+	upnpInvalidAction                    = 401
+	upnpInvalidArgs                      = 402
+	upnpActionFailed                     = 501
+	upnpArgumentValueInvalid             = 600
+	upnpArgumentValueOutOfRange          = 601
+	upnpActionNotAuthorized              = 606
+	upnpSpecifiedArrayIndexInvalid       = 713
+	upnpNoSuchEntryInArray               = 714
+	upnpWildCardNotPermittedInSrcIP      = 715
+	upnpWildCardNotPermittedInExtPort    = 716
+	upnpConflictInMappingEntry           = 718
+	upnpSamePortValuesRequired           = 724
+	upnpOnlyPermanentLeasesSupported     = 725
+	upnpRemoteHostOnlySupportsWildcard   = 726
+	upnpExternalPortOnlySupportsWildcard = 727
+	upnpNoPortMapsAvailable              = 728
+	upnpConflictWithOtherMechanisms      = 729
+	upnpWildCardNotPermittedInIntPort    = 732
+)
+
+var upnpErrorNames = map[int]string{
+	upnpInvalidAction:                    "InvalidAction",
+	upnpInvalidArgs:                      "InvalidArgs",
+	upnpActionFailed:                     "ActionFailed",
+	upnpArgumentValueInvalid:             "ArgumentValueInvalid",
+	upnpArgumentValueOutOfRange:          "ArgumentValueOutOfRange",
+	upnpActionNotAuthorized:              "ActionNotAuthorized",
+	upnpSpecifiedArrayIndexInvalid:       "SpecifiedArrayIndexInvalid",
+	upnpNoSuchEntryInArray:               "NoSuchEntryInArray",
+	upnpWildCardNotPermittedInSrcIP:      "WildCardNotPermittedInSrcIP",
+	upnpWildCardNotPermittedInExtPort:    "WildCardNotPermittedInExtPort",
+	upnpConflictInMappingEntry:           "ConflictInMappingEntry",
+	upnpSamePortValuesRequired:           "SamePortValuesRequired",
+	upnpOnlyPermanentLeasesSupported:     "OnlyPermanentLeasesSupported",
+	upnpRemoteHostOnlySupportsWildcard:   "RemoteHostOnlySupportsWildcard",
+	upnpExternalPortOnlySupportsWildcard: "ExternalPortOnlySupportsWildcard",
+	upnpNoPortMapsAvailable:              "NoPortMapsAvailable",
+	upnpConflictWithOtherMechanisms:      "ConflictWithOtherMechanisms",
+	upnpWildCardNotPermittedInIntPort:    "WildCardNotPermittedInIntPort",
+}
+
+// upnpError is an error reported by the UPnP device in a SOAP fault
+type upnpError struct {
+	Code        int
+	Description string
+}
+
+func (err *upnpError) Error() string {
+	if name, known := upnpErrorNames[err.Code]; known && name != err.Description {
+		return fmt.Sprintf("UPnP error %d (%s): %s", err.Code, name, err.Description)
+	}
+	return fmt.Sprintf("UPnP error %d: %s", err.Code, err.Description)
+}
+
+// newUPnPError returns the error for the given code, with its standard description
+func newUPnPError(code int) *upnpError {
+	return &upnpError{Code: code, Description: upnpErrorNames[code]}
+}
+
+// isUPnPError returns whether err is an UPnP error with the given code
+func isUPnPError(err error, code int) bool {
+	upnpErr, ok := err.(*upnpError)
+	return ok && upnpErr.Code == code
+}
+
+// soapArgument is an argument of a SOAP action: UPnP requires them to be sent
+// in the order defined by the service description.
+type soapArgument struct {
+	name  string
+	value string
+}
+
+type soapFault struct {
+	FaultCode   string `xml:"faultcode"`
+	FaultString string `xml:"faultstring"`
+	Detail      struct {
+		UPnPError struct {
+			ErrorCode        string `xml:"errorCode"`
+			ErrorDescription string `xml:"errorDescription"`
+		} `xml:"UPnPError"`
+	} `xml:"detail"`
+}
+
+type soapResponseEnvelope struct {
+	XMLName xml.Name `xml:"http://schemas.xmlsoap.org/soap/envelope/ Envelope"`
+	Body    struct {
+		Fault     *soapFault `xml:"Fault"`
+		RawAction []byte     `xml:",innerxml"`
+	} `xml:"http://schemas.xmlsoap.org/soap/envelope/ Body"`
+}
+
+// upnpClient is a UPnP IGD WAN connection client (WANIPConnection or
+// WANPPPConnection). It performs the SOAP actions itself, instead of using the
+// goupnp generated clients, to decode the UPnP errors of the SOAP faults.
+type upnpClient struct {
+	*goupnp.ServiceClient
+	httpClient http.Client
+}
+
+func newUPnPClient(serviceClient *goupnp.ServiceClient) *upnpClient {
+	return &upnpClient{ServiceClient: serviceClient}
+}
+
+// AddPortMapping implements clientInterface
+func (client *upnpClient) AddPortMapping(ctx context.Context, host string, externalPort uint16, proto string, internalPort uint16, internalIP string, enabled bool, desc string, lease uint32) error {
+	return client.performAction(ctx, "AddPortMapping", []soapArgument{
+		{"NewRemoteHost", host},
+		{"NewExternalPort", strconv.FormatUint(uint64(externalPort), 10)},
+		{"NewProtocol", proto},
+		{"NewInternalPort", strconv.FormatUint(uint64(internalPort), 10)},
+		{"NewInternalClient", internalIP},
+		{"NewEnabled", soapBoolean(enabled)},
+		{"NewPortMappingDescription", desc},
+		{"NewLeaseDuration", strconv.FormatUint(uint64(lease), 10)},
+	}, nil)
+}
+
+// DeletePortMapping implements clientInterface
+func (client *upnpClient) DeletePortMapping(ctx context.Context, host string, externalPort uint16, proto string) error {
+	return client.performAction(ctx, "DeletePortMapping", []soapArgument{
+		{"NewRemoteHost", host},
+		{"NewExternalPort", strconv.FormatUint(uint64(externalPort), 10)},
+		{"NewProtocol", proto},
+	}, nil)
+}
+
+// GetExternalIPAddress implements clientInterface
+func (client *upnpClient) GetExternalIPAddress(ctx context.Context) (string, error) {
+	response := &struct {
+		NewExternalIPAddress string
+	}{}
+	err := client.performAction(ctx, "GetExternalIPAddress", nil, response)
+	return response.NewExternalIPAddress, err
+}
+
+// GetStatusInfo implements clientInterface
+func (client *upnpClient) GetStatusInfo(ctx context.Context) (string, string, uint32, error) {
+	response := &struct {
+		NewConnectionStatus    string
+		NewLastConnectionError string
+		NewUptime              uint32
+	}{}
+	err := client.performAction(ctx, "GetStatusInfo", nil, response)
+	return response.NewConnectionStatus, response.NewLastConnectionError, response.NewUptime, err
+}
+
+// GetSpecificPortMappingEntry implements clientInterface
+func (client *upnpClient) GetSpecificPortMappingEntry(ctx context.Context, host string, externalPort uint16, proto string) (*portMappingEntry, error) {
+	response := &struct {
+		NewInternalPort           uint16
+		NewInternalClient         string
+		NewEnabled                bool
+		NewPortMappingDescription string
+		NewLeaseDuration          uint32
+	}{}
+	err := client.performAction(ctx, "GetSpecificPortMappingEntry", []soapArgument{
+		{"NewRemoteHost", host},
+		{"NewExternalPort", strconv.FormatUint(uint64(externalPort), 10)},
+		{"NewProtocol", proto},
+	}, response)
+	if err != nil {
+		return nil, err
+	}
+	return &portMappingEntry{
+		internalPort:  response.NewInternalPort,
+		internalIP:    response.NewInternalClient,
+		enabled:       response.NewEnabled,
+		desc:          response.NewPortMappingDescription,
+		leaseDuration: response.NewLeaseDuration,
+	}, nil
+}
+
+func (client *upnpClient) performAction(ctx context.Context, actionName string, arguments []soapArgument, response interface{}) error {
+	defer observeSOAPRequest(actionName, time.Now())
+	serviceType := client.Service.ServiceType
+	request, err := http.NewRequest("POST", client.SOAPClient.EndpointURL.String(), bytes.NewReader(encodeSOAPAction(serviceType, actionName, arguments)))
+	if err != nil {
+		return err
+	}
+	request = request.WithContext(ctx)
+	request.Header.Set("SOAPACTION", `"`+serviceType+"#"+actionName+`"`)
+	request.Header.Set("CONTENT-TYPE", `text/xml; charset="utf-8"`)
+	httpResponse, err := client.httpClient.Do(request)
+	if err != nil {
+		return fmt.Errorf("%s: %v", actionName, err)
+	}
+	defer httpResponse.Body.Close()
+	body, err := ioutil.ReadAll(httpResponse.Body)
+	if err != nil {
+		return fmt.Errorf("%s: error reading response: %v", actionName, err)
+	}
+
+	// Faults are usually sent with HTTP status 500, so decode the body first
+	envelope := soapResponseEnvelope{}
+	decodeErr := xml.Unmarshal(body, &envelope)
+	if decodeErr == nil && envelope.Body.Fault != nil {
+		return decodeSOAPFault(envelope.Body.Fault)
+	}
+	if httpResponse.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: SOAP request got HTTP %s", actionName, httpResponse.Status)
+	}
+	if decodeErr != nil {
+		return fmt.Errorf("%s: error decoding response: %v", actionName, decodeErr)
+	}
+	if response != nil {
+		if err := xml.Unmarshal(envelope.Body.RawAction, response); err != nil {
+			return fmt.Errorf("%s: error decoding response arguments: %v", actionName, err)
+		}
+	}
+	return nil
+}
+
+func encodeSOAPAction(serviceType, actionName string, arguments []soapArgument) []byte {
+	buffer := &bytes.Buffer{}
+	buffer.WriteString(xml.Header)
+	buffer.WriteString(`<s:Envelope xmlns:s="` + soapEnvelopeNamespace + `" s:encodingStyle="` + soapEncodingStyle + `"><s:Body>`)
+	buffer.WriteString(`<u:` + actionName + ` xmlns:u="`)
+	xml.EscapeText(buffer, []byte(serviceType))
+	buffer.WriteString(`">`)
+	for _, argument := range arguments {
+		buffer.WriteString(`<` + argument.name + `>`)
+		xml.EscapeText(buffer, []byte(argument.value))
+		buffer.WriteString(`</` + argument.name + `>`)
+	}
+	buffer.WriteString(`</u:` + actionName + `>`)
+	buffer.WriteString(`</s:Body></s:Envelope>`)
+	return buffer.Bytes()
+}
+
+func decodeSOAPFault(fault *soapFault) error {
+	upnpErr := fault.Detail.UPnPError
+	code, err := strconv.Atoi(upnpErr.ErrorCode)
+	if err != nil {
+		// not an UPnP error: keep the SOAP fault information
+		return &soap.SOAPFaultError{FaultCode: fault.FaultCode, FaultString: fault.FaultString}
+	}
+	return &upnpError{Code: code, Description: upnpErr.ErrorDescription}
+}
+
+func soapBoolean(value bool) string {
+	if value {
+		return "1"
+	}
+	return "0"
+}
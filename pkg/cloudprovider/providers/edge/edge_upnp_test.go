@@ -0,0 +1,154 @@
+/*
+Copyright 2019 Midokura
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package edge
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/huin/goupnp"
+	"github.com/huin/goupnp/dcps/internetgateway2"
+	"github.com/huin/goupnp/soap"
+)
+
+const testFaultResponse = `<?xml version="1.0"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">
+<s:Body>
+<s:Fault>
+<faultcode>s:Client</faultcode>
+<faultstring>UPnPError</faultstring>
+<detail>
+<UPnPError xmlns="urn:schemas-upnp-org:control-1-0">
+<errorCode>718</errorCode>
+<errorDescription>ConflictInMappingEntry</errorDescription>
+</UPnPError>
+</detail>
+</s:Fault>
+</s:Body>
+</s:Envelope>`
+
+const testExternalIPResponse = `<?xml version="1.0"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">
+<s:Body>
+<u:GetExternalIPAddressResponse xmlns:u="urn:schemas-upnp-org:service:WANIPConnection:1">
+<NewExternalIPAddress>198.51.100.1</NewExternalIPAddress>
+</u:GetExternalIPAddressResponse>
+</s:Body>
+</s:Envelope>`
+
+const testStatusInfoResponse = `<?xml version="1.0"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">
+<s:Body>
+<u:GetStatusInfoResponse xmlns:u="urn:schemas-upnp-org:service:WANIPConnection:1">
+<NewConnectionStatus>Connected</NewConnectionStatus>
+<NewLastConnectionError>ERROR_NONE</NewLastConnectionError>
+<NewUptime>86400</NewUptime>
+</u:GetStatusInfoResponse>
+</s:Body>
+</s:Envelope>`
+
+func newTestUPnPClient(t *testing.T, handler http.HandlerFunc) (*upnpClient, func()) {
+	server := httptest.NewServer(handler)
+	endpoint, err := url.Parse(server.URL + "/ctl/IPConn")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	client := newUPnPClient(&goupnp.ServiceClient{
+		SOAPClient: soap.NewSOAPClient(*endpoint),
+		Location:   endpoint,
+		Service:    &goupnp.Service{ServiceType: internetgateway2.URN_WANIPConnection_1},
+	})
+	return client, server.Close
+}
+
+func TestUPnPClientAddPortMappingFault(t *testing.T) {
+	var action, body string
+	client, close := newTestUPnPClient(t, func(w http.ResponseWriter, r *http.Request) {
+		action = r.Header.Get("SOAPACTION")
+		data, _ := ioutil.ReadAll(r.Body)
+		body = string(data)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(testFaultResponse))
+	})
+	defer close()
+
+	err := client.AddPortMapping(context.TODO(), "", 8080, "TCP", 30080, "192.0.2.1", true, "kubernetes/default/svc/http", 0)
+	expected := &upnpError{Code: 718, Description: "ConflictInMappingEntry"}
+	if !reflect.DeepEqual(err, expected) {
+		t.Errorf("got %#v\nwant %#v", err, expected)
+	}
+	if action != `"urn:schemas-upnp-org:service:WANIPConnection:1#AddPortMapping"` {
+		t.Errorf("got SOAPACTION %s", action)
+	}
+	arguments := "<NewRemoteHost></NewRemoteHost><NewExternalPort>8080</NewExternalPort><NewProtocol>TCP</NewProtocol>" +
+		"<NewInternalPort>30080</NewInternalPort><NewInternalClient>192.0.2.1</NewInternalClient><NewEnabled>1</NewEnabled>" +
+		"<NewPortMappingDescription>kubernetes/default/svc/http</NewPortMappingDescription><NewLeaseDuration>0</NewLeaseDuration>"
+	if !strings.Contains(body, arguments) {
+		t.Errorf("got request %s\nwant arguments %s", body, arguments)
+	}
+}
+
+func TestUPnPClientGetExternalIPAddress(t *testing.T) {
+	client, close := newTestUPnPClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(testExternalIPResponse))
+	})
+	defer close()
+
+	externalIP, err := client.GetExternalIPAddress(context.TODO())
+	if err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	if externalIP != "198.51.100.1" {
+		t.Errorf("got %s\nwant 198.51.100.1", externalIP)
+	}
+}
+
+func TestUPnPClientGetStatusInfo(t *testing.T) {
+	client, close := newTestUPnPClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(testStatusInfoResponse))
+	})
+	defer close()
+
+	status, lastConnectionError, uptime, err := client.GetStatusInfo(context.TODO())
+	if err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	if status != "Connected" || lastConnectionError != "ERROR_NONE" || uptime != 86400 {
+		t.Errorf("got %s, %s, %d\nwant Connected, ERROR_NONE, 86400", status, lastConnectionError, uptime)
+	}
+}
+
+func TestUPnPClientHTTPError(t *testing.T) {
+	client, close := newTestUPnPClient(t, func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "not found", http.StatusNotFound)
+	})
+	defer close()
+
+	err := client.DeletePortMapping(context.TODO(), "", 8080, "TCP")
+	if err == nil {
+		t.Fatalf("expected error")
+	}
+	if _, ok := err.(*upnpError); ok {
+		t.Errorf("got UPnP error %v\nwant HTTP error", err)
+	}
+}
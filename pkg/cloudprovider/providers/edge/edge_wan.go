@@ -0,0 +1,253 @@
+/*
+Copyright 2019 Midokura
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package edge
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/klog"
+
+	"github.com/huin/goupnp"
+	"github.com/huin/goupnp/dcps/internetgateway2"
+	"github.com/huin/goupnp/httpu"
+)
+
+// wanConnection store the data for one WAN connection service of an IGD
+type wanConnection struct {
+	// UPnP IGD WAN connection client
+	client clientInterface
+	// Local address of the client on the interface towards the UPnP device
+	localAddress net.IP
+	// External IP of the WAN connection
+	externalIP net.IP
+	// Unique Device Name of the UPnP root device, identifying the gateway
+	deviceID string
+	// Location of the description of the UPnP root device
+	location *url.URL
+	// UPnP root device and WAN connection service, as described by the gateway
+	device  *goupnp.Device
+	service *goupnp.Service
+}
+
+// wanConnectionServiceTypes are the WAN connection services supported, in
+// order of preference
+var wanConnectionServiceTypes = []string{
+	internetgateway2.URN_WANIPConnection_2,
+	internetgateway2.URN_WANIPConnection_1,
+	internetgateway2.URN_WANPPPConnection_1,
+}
+
+// ssdpAddress is where the SSDP searches are sent: the SSDP multicast address,
+// unless the tests use a simulated gateway
+var ssdpAddress = "239.255.255.250:1900"
+
+// ssdpSearchWait is how long the discoveries wait for answers to the SSDP
+// searches
+var ssdpSearchWait = 2 * time.Second
+
+// discoverWANConnections discovers all the WAN connection services available,
+// in order of preference: WANIPConnection2, WANIPConnection1 and
+// WANPPPConnection1. Services reporting the same external IP (like an IGDv2
+// device also exposing its IGDv1 description) are returned only once.
+func discoverWANConnections() ([]wanConnection, error) {
+	clients := make([]*upnpClient, 0)
+	var lastErr error
+	for _, serviceType := range wanConnectionServiceTypes {
+		serviceClients, suberrors, err := newServiceClients(serviceType)
+		logDiscoveryErrors(serviceType, suberrors, err)
+		if err != nil {
+			lastErr = err
+		}
+		for i := range serviceClients {
+			clients = append(clients, newUPnPClient(&serviceClients[i]))
+		}
+	}
+
+	connections := make([]wanConnection, 0, len(clients))
+	for i, client := range clients {
+		ctx, cancel := context.WithTimeout(context.Background(), gatewayCallTimeout)
+		externalIPAddress, err := client.GetExternalIPAddress(ctx)
+		cancel()
+		if err != nil {
+			klog.Warningf("discoverWANConnections: client #%d of %d (%s): error getting external IP: %v", i, len(clients), client.Location, err)
+			continue
+		}
+		externalIP := net.ParseIP(externalIPAddress)
+		if externalIP == nil {
+			klog.Warningf("discoverWANConnections: client #%d of %d (%s): invalid external IP '%s'", i, len(clients), client.Location, externalIPAddress)
+			continue
+		}
+		if findWANConnection(connections, externalIP) != nil {
+			klog.V(3).Infof("discoverWANConnections: client #%d of %d (%s): skipping duplicated external IP %s", i, len(clients), client.Location, externalIP)
+			continue
+		}
+		klog.Infof("discoverWANConnections: client #%d of %d (%s, %s): external IP %s", i, len(clients), client.Location, client.Service.ServiceType, externalIP)
+		connections = append(connections, wanConnection{
+			client:       client,
+			localAddress: getLocalAddressToHost(client.Location.Hostname()),
+			externalIP:   externalIP,
+			deviceID:     client.RootDevice.Device.UDN,
+			location:     client.Location,
+			device:       &client.RootDevice.Device,
+			service:      client.Service,
+		})
+	}
+	if len(connections) < 1 {
+		if lastErr != nil {
+			return nil, lastErr
+		}
+		return nil, fmt.Errorf("no clients available")
+	}
+	return connections, nil
+}
+
+// newServiceClients discovers the services of the type given, like
+// goupnp.NewServiceClients but searching at ssdpAddress
+func newServiceClients(serviceType string) ([]goupnp.ServiceClient, []error, error) {
+	client, err := httpu.NewHTTPUClient()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer client.Close()
+	locations, err := ssdpSearch(client, serviceType, ssdpSearchWait, 3)
+	if err != nil {
+		return nil, nil, err
+	}
+	clients := make([]goupnp.ServiceClient, 0, len(locations))
+	suberrors := make([]error, 0)
+	for _, location := range locations {
+		rootDevice, err := goupnp.DeviceByURL(location)
+		if err != nil {
+			suberrors = append(suberrors, err)
+			continue
+		}
+		deviceClients, err := goupnp.NewServiceClientsFromRootDevice(rootDevice, location, serviceType)
+		if err != nil {
+			suberrors = append(suberrors, err)
+			continue
+		}
+		clients = append(clients, deviceClients...)
+	}
+	return clients, suberrors, nil
+}
+
+// ssdpSearch sends SSDP searches of the target given to ssdpAddress, and
+// returns the locations of the root devices answering, without duplicates
+func ssdpSearch(client *httpu.HTTPUClient, searchTarget string, wait time.Duration, numSends int) ([]*url.URL, error) {
+	maxWaitSeconds := int((wait + time.Second - 1) / time.Second)
+	if maxWaitSeconds < 1 {
+		maxWaitSeconds = 1
+	}
+	request := &http.Request{
+		Method: "M-SEARCH",
+		Host:   ssdpAddress,
+		URL:    &url.URL{Opaque: "*"},
+		Header: http.Header{
+			// set directly, as SSDP headers are case-sensitive
+			"HOST": []string{ssdpAddress},
+			"MX":   []string{strconv.Itoa(maxWaitSeconds)},
+			"MAN":  []string{`"ssdp:discover"`},
+			"ST":   []string{searchTarget},
+		},
+	}
+	responses, err := client.Do(request, wait+100*time.Millisecond, numSends)
+	if err != nil {
+		return nil, err
+	}
+	locations := make([]*url.URL, 0, len(responses))
+	seen := make(map[string]bool)
+	for _, response := range responses {
+		if response.StatusCode != http.StatusOK || response.Header.Get("ST") != searchTarget {
+			continue
+		}
+		location, err := response.Location()
+		if err != nil {
+			klog.V(3).Infof("ssdpSearch: %s: invalid location: %v", searchTarget, err)
+			continue
+		}
+		if seen[location.String()] {
+			continue
+		}
+		seen[location.String()] = true
+		locations = append(locations, location)
+	}
+	return locations, nil
+}
+
+func logDiscoveryErrors(urn string, suberrors []error, err error) {
+	if err != nil {
+		klog.Errorf("discoverWANConnections: %s: client error (with %d suberrors): %v", urn, len(suberrors), err)
+	}
+	for i, suberror := range suberrors {
+		klog.V(3).Infof("discoverWANConnections: %s: client suberror #%d of %d: %v", urn, i, len(suberrors), suberror)
+	}
+}
+
+func findWANConnection(connections []wanConnection, externalIP net.IP) *wanConnection {
+	for i := range connections {
+		if connections[i].externalIP.Equal(externalIP) {
+			return &connections[i]
+		}
+	}
+	return nil
+}
+
+// defaultWANConnection returns the WAN connection used when the service does
+// not request a specific LoadBalancerIP: the first one, with its own external
+// IP, not the one of the public IP services
+func (lb *LoadBalancer) defaultWANConnection() *wanConnection {
+	if len(lb.wanConnections) > 0 {
+		connection := lb.wanConnections[0]
+		return &connection
+	}
+	return &wanConnection{
+		client:       lb.client,
+		localAddress: lb.localAddress,
+		externalIP:   lb.externalIP,
+	}
+}
+
+// getWANConnection returns the WAN connection owning the external IP given,
+// or the default one if no IP is given.
+func (lb *LoadBalancer) getWANConnection(externalIP string) (*wanConnection, error) {
+	if externalIP == "" {
+		return lb.defaultWANConnection(), nil
+	}
+	ip := net.ParseIP(externalIP)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid external IP '%s'", externalIP)
+	}
+	connections := lb.wanConnections
+	if len(connections) == 0 {
+		connections = []wanConnection{*lb.defaultWANConnection()}
+	}
+	if connection := findWANConnection(connections, ip); connection != nil {
+		return connection, nil
+	}
+	available := make([]string, 0, len(connections))
+	for _, connection := range connections {
+		available = append(available, connection.externalIP.String())
+	}
+	return nil, fmt.Errorf("no WAN connection owns the external IP '%s' (available: %s)", externalIP, strings.Join(available, ", "))
+}
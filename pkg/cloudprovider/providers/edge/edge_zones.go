@@ -0,0 +1,153 @@
+/*
+Copyright 2019 Midokura
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package edge
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+	cloudprovider "k8s.io/cloud-provider"
+	"k8s.io/klog"
+)
+
+const (
+	// ZoneLabel is the label of the nodes giving their zone, the edge site
+	// they belong to, when not configured in an Instance section
+	ZoneLabel string = "midokura.com/zone"
+	// RegionLabel is the label of the nodes giving their region
+	RegionLabel string = "midokura.com/region"
+)
+
+// Sources of the zones derived from the discovered gateway
+const (
+	zoneFromGatewayUDN        = "udn"
+	zoneFromGatewayExternalIP = "external-ip"
+)
+
+// zones implements cloudprovider.Zones from the site topology: the region and
+// zone of a node are taken, in order, from its Instance section, its labels,
+// the Global section, or derived from the gateway of the site.
+type zones struct {
+	cloud     *Edge
+	instances *instances
+}
+
+func newZones(cloud *Edge) *zones {
+	return &zones{cloud: cloud, instances: newInstances(cloud)}
+}
+
+// GetZone returns the zone of the node running the cloud controller manager
+func (z *zones) GetZone(ctx context.Context) (cloudprovider.Zone, error) {
+	return z.GetZoneByNodeName(ctx, types.NodeName(z.instances.localNodeName))
+}
+
+// GetZoneByProviderID returns the zone of the node of the provider ID
+func (z *zones) GetZoneByProviderID(ctx context.Context, providerID string) (cloudprovider.Zone, error) {
+	name, err := z.instances.parseProviderID(providerID)
+	if err != nil {
+		return cloudprovider.Zone{}, err
+	}
+	return z.GetZoneByNodeName(ctx, name)
+}
+
+// GetZoneByNodeName returns the zone of the node, empty if not configured, or
+// an error while the zone is to be derived from a gateway not discovered yet
+func (z *zones) GetZoneByNodeName(ctx context.Context, nodeName types.NodeName) (cloudprovider.Zone, error) {
+	var zone cloudprovider.Zone
+	if instance, ok := z.cloud.config.Instance[string(nodeName)]; ok {
+		zone.Region, zone.FailureDomain = instance.Region, instance.Zone
+	}
+	if zone.Region == "" || zone.FailureDomain == "" {
+		if node, err := z.instances.getNode(nodeName); err != nil {
+			// the node may not be registered yet, e.g. for GetZone
+			klog.V(3).Infof("GetZoneByNodeName: ignoring the labels: %v", err)
+		} else {
+			zone = mergeZone(zone, node.Labels[RegionLabel], node.Labels[ZoneLabel])
+		}
+	}
+	zone = mergeZone(zone, z.cloud.config.Global.Region, z.cloud.config.Global.Zone)
+	if zone.FailureDomain == "" {
+		failureDomain, err := z.gatewayZone()
+		if err != nil {
+			return cloudprovider.Zone{}, err
+		}
+		zone.FailureDomain = failureDomain
+	}
+	return zone, nil
+}
+
+// mergeZone fills the region and zone not set yet
+func mergeZone(zone cloudprovider.Zone, region, failureDomain string) cloudprovider.Zone {
+	if zone.Region == "" {
+		zone.Region = region
+	}
+	if zone.FailureDomain == "" {
+		zone.FailureDomain = failureDomain
+	}
+	return zone
+}
+
+// gatewayZone returns the zone derived from the discovered gateway, as
+// configured with zone-from-gateway, "" if not configured, or an error while
+// the gateway is not discovered yet so that the caller retries
+func (z *zones) gatewayZone() (string, error) {
+	source := z.cloud.config.Global.ZoneFromGateway
+	if source == "" {
+		return "", nil
+	}
+	errNotDiscovered := fmt.Errorf("gatewayZone: no gateway discovered yet for the zone from its %s", source)
+	loadBalancer := z.cloud.loadBalancer()
+	if loadBalancer == nil {
+		return "", errNotDiscovered
+	}
+	loadBalancer.mutex.Lock()
+	defer loadBalancer.mutex.Unlock()
+	if loadBalancer.client == nil {
+		return "", errNotDiscovered
+	}
+	switch source {
+	case zoneFromGatewayUDN:
+		if len(loadBalancer.wanConnections) == 0 {
+			return "", errNotDiscovered
+		}
+		return labelValue(strings.TrimPrefix(loadBalancer.wanConnections[0].deviceID, "uuid:")), nil
+	case zoneFromGatewayExternalIP:
+		if loadBalancer.externalIP == nil {
+			return "", errNotDiscovered
+		}
+		return labelValue(loadBalancer.externalIP.String()), nil
+	}
+	return "", fmt.Errorf("gatewayZone: unknown zone-from-gateway %s", source)
+}
+
+// labelValue makes a valid label value of the string, the topology labels of
+// the nodes being set from the zones
+func labelValue(value string) string {
+	value = strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.' {
+			return r
+		}
+		return '-'
+	}, value)
+	if len(value) > validation.LabelValueMaxLength {
+		value = value[:validation.LabelValueMaxLength]
+	}
+	return strings.Trim(value, "-_.")
+}
@@ -0,0 +1,156 @@
+/*
+Copyright 2019 Midokura
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package edge
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+
+	"k8s.io/client-go/kubernetes/fake"
+	cloudprovider "k8s.io/cloud-provider"
+)
+
+func TestGetZoneByProviderID(t *testing.T) {
+	labeled := newTestNode("labeled", "192.0.2.1")
+	labeled.Labels = map[string]string{RegionLabel: "labeled-region", ZoneLabel: "labeled-zone"}
+	zoneOnly := newTestNode("zone-only", "192.0.2.2")
+	zoneOnly.Labels = map[string]string{ZoneLabel: "labeled-zone"}
+	plain := newTestNode("plain", "192.0.2.3")
+
+	testCases := []struct {
+		name   string
+		config string
+		node   string
+		zone   cloudprovider.Zone
+	}{
+		{name: "nothing configured", node: "plain"},
+		{
+			name:   "global",
+			config: "[Global]\nregion = global-region\nzone = global-zone\n",
+			node:   "plain",
+			zone:   cloudprovider.Zone{Region: "global-region", FailureDomain: "global-zone"},
+		},
+		{
+			name:   "labels",
+			config: "[Global]\nregion = global-region\nzone = global-zone\n",
+			node:   "labeled",
+			zone:   cloudprovider.Zone{Region: "labeled-region", FailureDomain: "labeled-zone"},
+		},
+		{
+			name:   "labels and global",
+			config: "[Global]\nregion = global-region\nzone = global-zone\n",
+			node:   "zone-only",
+			zone:   cloudprovider.Zone{Region: "global-region", FailureDomain: "labeled-zone"},
+		},
+		{
+			name:   "instance",
+			config: "[Global]\nzone = global-zone\n[Instance \"labeled\"]\nregion = instance-region\nzone = instance-zone\n",
+			node:   "labeled",
+			zone:   cloudprovider.Zone{Region: "instance-region", FailureDomain: "instance-zone"},
+		},
+		{
+			name:   "gateway UDN",
+			config: "[Global]\nregion = global-region\nzone-from-gateway = udn\n",
+			node:   "plain",
+			zone:   cloudprovider.Zone{Region: "global-region", FailureDomain: "igd-1234"},
+		},
+		{
+			name:   "gateway external IP",
+			config: "[Global]\nzone-from-gateway = external-ip\n",
+			node:   "plain",
+			zone:   cloudprovider.Zone{FailureDomain: "198.51.100.1"},
+		},
+		{
+			name:   "configured zone before the gateway",
+			config: "[Global]\nzone = global-zone\nzone-from-gateway = udn\n",
+			node:   "plain",
+			zone:   cloudprovider.Zone{FailureDomain: "global-zone"},
+		},
+		{
+			name:   "unregistered node",
+			config: "[Global]\nzone = global-zone\n",
+			node:   "missing",
+			zone:   cloudprovider.Zone{FailureDomain: "global-zone"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, err := ReadConfig(strings.NewReader(tc.config))
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			kubeClient := fake.NewSimpleClientset(labeled, zoneOnly, plain)
+			cloud := &Edge{kubeClient: kubeClient, config: cfg}
+			cloud.LoadBalancerInstance = &LoadBalancer{
+				client:         newMockClient(t),
+				externalIP:     net.ParseIP("198.51.100.1"),
+				wanConnections: []wanConnection{{deviceID: "uuid:igd-1234"}},
+			}
+			z, _ := cloud.Zones()
+			zone, err := z.GetZoneByProviderID(context.TODO(), "edge://kubernetes/"+tc.node)
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if zone != tc.zone {
+				t.Errorf("got %+v\nwant %+v", zone, tc.zone)
+			}
+		})
+	}
+}
+
+func TestGetZoneWithoutGateway(t *testing.T) {
+	cfg, err := ReadConfig(strings.NewReader("[Global]\nzone-from-gateway = udn\n"))
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	z := newZones(&Edge{kubeClient: fake.NewSimpleClientset(), config: cfg})
+	if _, err := z.GetZoneByNodeName(context.TODO(), "node"); err == nil {
+		t.Errorf("expected error until the gateway is discovered")
+	}
+	z.cloud.LoadBalancerInstance = &LoadBalancer{client: newMockClient(t)}
+	if _, err := z.GetZoneByNodeName(context.TODO(), "node"); err == nil {
+		t.Errorf("expected error until the WAN connections are discovered")
+	}
+	// a configured zone needs no gateway
+	z.cloud.config.Global.Zone = "global-zone"
+	zone, err := z.GetZoneByNodeName(context.TODO(), "node")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if zone != (cloudprovider.Zone{FailureDomain: "global-zone"}) {
+		t.Errorf("got %+v\nwant the configured zone", zone)
+	}
+	if _, err := z.GetZoneByProviderID(context.TODO(), "gce://kubernetes/node"); err == nil {
+		t.Errorf("expected error")
+	}
+}
+
+func TestLabelValue(t *testing.T) {
+	for value, expected := range map[string]string{
+		"site-1":                               "site-1",
+		"2001:db8::1":                          "2001-db8--1",
+		"uuid:":                                "uuid",
+		"f8b2ad3e-64f4-11e9-a923-1681be663d3e": "f8b2ad3e-64f4-11e9-a923-1681be663d3e",
+		strings.Repeat("a", 70):                strings.Repeat("a", 63),
+	} {
+		if labelValue(value) != expected {
+			t.Errorf("%s: got %s\nwant %s", value, labelValue(value), expected)
+		}
+	}
+}
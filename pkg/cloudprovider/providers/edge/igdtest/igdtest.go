@@ -0,0 +1,350 @@
+/*
+Copyright 2019 Midokura
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package igdtest simulates an UPnP Internet Gateway Device on the loopback
+// interface, for the end-to-end tests of the edge cloud provider. The gateway
+// answers the SSDP searches on an unicast UDP address, serves its description
+// and the SOAP actions of its WAN connection services over HTTP, and keeps a
+// table of port mappings. Quirks of real gateways and faults can be set to
+// test how the provider copes with them.
+package igdtest
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Service types of the WAN connection services simulated
+const (
+	WANIPConnection1 = "urn:schemas-upnp-org:service:WANIPConnection:1"
+	WANIPConnection2 = "urn:schemas-upnp-org:service:WANIPConnection:2"
+)
+
+// Connection statuses reported by GetStatusInfo
+const (
+	StatusConnected    = "Connected"
+	StatusDisconnected = "Disconnected"
+)
+
+// UPnP error codes returned by the gateway
+const (
+	ErrorInvalidAction                = 401
+	ErrorInvalidArgs                  = 402
+	ErrorActionFailed                 = 501
+	ErrorActionNotAuthorized          = 606
+	ErrorSpecifiedArrayIndexInvalid   = 713
+	ErrorNoSuchEntryInArray           = 714
+	ErrorConflictInMappingEntry       = 718
+	ErrorSamePortValuesRequired       = 724
+	ErrorOnlyPermanentLeasesSupported = 725
+)
+
+var errorDescriptions = map[int]string{
+	ErrorInvalidAction:                "Invalid Action",
+	ErrorInvalidArgs:                  "Invalid Args",
+	ErrorActionFailed:                 "Action Failed",
+	ErrorActionNotAuthorized:          "ActionNotAuthorized",
+	ErrorSpecifiedArrayIndexInvalid:   "SpecifiedArrayIndexInvalid",
+	ErrorNoSuchEntryInArray:           "NoSuchEntryInArray",
+	ErrorConflictInMappingEntry:       "ConflictInMappingEntry",
+	ErrorSamePortValuesRequired:       "SamePortValuesRequired",
+	ErrorOnlyPermanentLeasesSupported: "OnlyPermanentLeasesSupported",
+}
+
+// Config is the configuration of a simulated gateway
+type Config struct {
+	// UDN is the Unique Device Name of the root device, uuid:igdtest by default
+	UDN string
+	// ServiceTypes are the WAN connection services of the gateway,
+	// WANIPConnection1 by default. The device types are of version 2 if one
+	// of them is WANIPConnection2.
+	ServiceTypes []string
+	// ExternalIP is the external IP of the WAN connection, 198.51.100.1 by
+	// default
+	ExternalIP string
+	// Quirks of the gateway
+	Quirks Quirks
+}
+
+// Quirks are the limitations of real gateways the simulated one can have
+type Quirks struct {
+	// PermanentLeasesOnly rejects the port mappings with a lease duration,
+	// like the IGDv1 gateways not supporting them
+	PermanentLeasesOnly bool
+	// SamePortValuesOnly rejects the port mappings with different external
+	// and internal ports
+	SamePortValuesOnly bool
+	// RejectOtherHosts rejects the port mappings to another host than the
+	// caller, like miniupnpd in secure mode
+	RejectOtherHosts bool
+}
+
+// Fault is a failure injected in the answer to an action
+type Fault struct {
+	// Delay is the time waited before answering
+	Delay time.Duration
+	// Code is the UPnP error code returned in a SOAP fault, if not zero
+	Code int
+	// HTTPStatus is returned with an empty body, if not zero
+	HTTPStatus int
+}
+
+// Mapping is a port mapping of the gateway
+type Mapping struct {
+	RemoteHost     string
+	ExternalPort   uint16
+	Protocol       string
+	InternalPort   uint16
+	InternalClient string
+	Enabled        bool
+	Description    string
+	LeaseDuration  uint32
+
+	expiry time.Time
+}
+
+// Server is a simulated gateway, running until closed
+type Server struct {
+	// Location is the URL of the description of the root device
+	Location string
+	// SSDPAddress is the UDP address answering the SSDP searches
+	SSDPAddress string
+
+	config     Config
+	httpServer *httptest.Server
+	ssdpConn   net.PacketConn
+	done       chan struct{}
+
+	mutex      sync.Mutex
+	externalIP string
+	status     string
+	started    time.Time
+	mappings   []Mapping
+	faults     map[string][]Fault
+	calls      []string
+}
+
+// NewServer starts a simulated gateway on the loopback interface
+func NewServer(config Config) (*Server, error) {
+	if config.UDN == "" {
+		config.UDN = "uuid:igdtest"
+	}
+	if len(config.ServiceTypes) == 0 {
+		config.ServiceTypes = []string{WANIPConnection1}
+	}
+	if config.ExternalIP == "" {
+		config.ExternalIP = "198.51.100.1"
+	}
+	ssdpConn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		SSDPAddress: ssdpConn.LocalAddr().String(),
+		config:      config,
+		ssdpConn:    ssdpConn,
+		done:        make(chan struct{}),
+		externalIP:  config.ExternalIP,
+		status:      StatusConnected,
+		started:     time.Now(),
+		faults:      make(map[string][]Fault),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(descriptionPath, s.serveDescription)
+	for i := range config.ServiceTypes {
+		mux.HandleFunc(controlPath(i), s.serveControl(i))
+	}
+	s.httpServer = httptest.NewServer(mux)
+	s.Location = s.httpServer.URL + descriptionPath
+	go s.serveSSDP()
+	return s, nil
+}
+
+// Close stops the gateway
+func (s *Server) Close() {
+	close(s.done)
+	s.ssdpConn.Close()
+	s.httpServer.Close()
+}
+
+// ControlURL returns the URL of the SOAP actions of the service of the type
+// given, or "" if the gateway does not have it
+func (s *Server) ControlURL(serviceType string) string {
+	for i, st := range s.config.ServiceTypes {
+		if st == serviceType {
+			return s.httpServer.URL + controlPath(i)
+		}
+	}
+	return ""
+}
+
+// Mappings returns the port mappings of the gateway, sorted by protocol and
+// external port
+func (s *Server) Mappings() []Mapping {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.expireMappings(time.Now())
+	mappings := append([]Mapping(nil), s.mappings...)
+	sort.Slice(mappings, func(i, j int) bool {
+		if mappings[i].Protocol != mappings[j].Protocol {
+			return mappings[i].Protocol < mappings[j].Protocol
+		}
+		return mappings[i].ExternalPort < mappings[j].ExternalPort
+	})
+	for i := range mappings {
+		mappings[i].expiry = time.Time{}
+	}
+	return mappings
+}
+
+// AddMapping adds a port mapping directly, as another host or the owner of
+// the gateway would
+func (s *Server) AddMapping(mapping Mapping) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.setMapping(mapping)
+}
+
+// DeleteMapping deletes a port mapping directly, and returns whether it
+// existed
+func (s *Server) DeleteMapping(protocol string, externalPort uint16) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	index := s.findMapping("", externalPort, protocol)
+	if index < 0 {
+		return false
+	}
+	s.mappings = append(s.mappings[:index], s.mappings[index+1:]...)
+	return true
+}
+
+// Reset clears the port mappings, like a reboot of the gateway
+func (s *Server) Reset() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.mappings = nil
+	s.started = time.Now()
+}
+
+// SetExternalIP changes the external IP of the WAN connection
+func (s *Server) SetExternalIP(externalIP string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.externalIP = externalIP
+}
+
+// SetStatus changes the status of the WAN connection
+func (s *Server) SetStatus(status string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.status = status
+}
+
+// InjectFaults makes the next calls of the action given fail, one fault per
+// call, in order
+func (s *Server) InjectFaults(action string, faults ...Fault) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.faults[action] = append(s.faults[action], faults...)
+}
+
+// Calls returns the names of the actions called, oldest first
+func (s *Server) Calls() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]string(nil), s.calls...)
+}
+
+// CallCount returns how many times the action given was called
+func (s *Server) CallCount(action string) int {
+	count := 0
+	for _, call := range s.Calls() {
+		if call == action {
+			count++
+		}
+	}
+	return count
+}
+
+// serveSSDP answers the SSDP searches of the root device, of its device types
+// and of its services
+func (s *Server) serveSSDP() {
+	buffer := make([]byte, 2048)
+	for {
+		n, addr, err := s.ssdpConn.ReadFrom(buffer)
+		if err != nil {
+			select {
+			case <-s.done:
+				return
+			default:
+				continue
+			}
+		}
+		request, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(buffer[:n])))
+		if err != nil || request.Method != "M-SEARCH" || request.Header.Get("MAN") != `"ssdp:discover"` {
+			continue
+		}
+		for _, target := range s.searchTargets(request.Header.Get("ST")) {
+			response := fmt.Sprintf("HTTP/1.1 200 OK\r\n"+
+				"CACHE-CONTROL: max-age=120\r\n"+
+				"EXT:\r\n"+
+				"LOCATION: %s\r\n"+
+				"SERVER: igdtest UPnP/1.1\r\n"+
+				"ST: %s\r\n"+
+				"USN: %s::%s\r\n"+
+				"\r\n", s.Location, target, s.config.UDN, target)
+			s.ssdpConn.WriteTo([]byte(response), addr)
+		}
+	}
+}
+
+// searchTargets returns the targets matching the one of a search
+func (s *Server) searchTargets(searchTarget string) []string {
+	version := s.deviceVersion()
+	targets := []string{
+		"upnp:rootdevice",
+		fmt.Sprintf("urn:schemas-upnp-org:device:InternetGatewayDevice:%d", version),
+		fmt.Sprintf("urn:schemas-upnp-org:device:WANDevice:%d", version),
+		fmt.Sprintf("urn:schemas-upnp-org:device:WANConnectionDevice:%d", version),
+	}
+	targets = append(targets, s.config.ServiceTypes...)
+	if searchTarget == "ssdp:all" {
+		return targets
+	}
+	for _, target := range targets {
+		if target == searchTarget {
+			return []string{target}
+		}
+	}
+	return nil
+}
+
+func (s *Server) deviceVersion() int {
+	for _, serviceType := range s.config.ServiceTypes {
+		if strings.HasSuffix(serviceType, ":2") {
+			return 2
+		}
+	}
+	return 1
+}
@@ -0,0 +1,401 @@
+/*
+Copyright 2019 Midokura
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package igdtest
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	descriptionPath       = "/rootDesc.xml"
+	soapEnvelopeNamespace = "http://schemas.xmlsoap.org/soap/envelope/"
+	soapEncodingStyle     = "http://schemas.xmlsoap.org/soap/encoding/"
+)
+
+func controlPath(index int) string {
+	return fmt.Sprintf("/ctl/conn%d", index)
+}
+
+// argument is an argument of an action, in the order of the service
+// description
+type argument struct {
+	name  string
+	value string
+}
+
+// soapRequest is the envelope of an action called
+type soapRequest struct {
+	Body struct {
+		Action struct {
+			XMLName   xml.Name
+			Arguments []struct {
+				XMLName xml.Name
+				Value   string `xml:",chardata"`
+			} `xml:",any"`
+		} `xml:",any"`
+	} `xml:"http://schemas.xmlsoap.org/soap/envelope/ Body"`
+}
+
+// upnpError is an error of an action, returned in a SOAP fault
+type upnpError struct {
+	code int
+}
+
+func (err *upnpError) Error() string {
+	return fmt.Sprintf("UPnP error %d: %s", err.code, errorDescriptions[err.code])
+}
+
+func newError(code int) error {
+	return &upnpError{code: code}
+}
+
+// serveDescription serves the description of the root device:
+// InternetGatewayDevice > WANDevice > WANConnectionDevice > services
+func (s *Server) serveDescription(w http.ResponseWriter, r *http.Request) {
+	version := s.deviceVersion()
+	services := &bytes.Buffer{}
+	for i, serviceType := range s.config.ServiceTypes {
+		fmt.Fprintf(services, `<service>
+<serviceType>%s</serviceType>
+<serviceId>urn:upnp-org:serviceId:WANIPConn%d</serviceId>
+<SCPDURL>/WANIPCn%d.xml</SCPDURL>
+<controlURL>%s</controlURL>
+<eventSubURL>/evt/conn%d</eventSubURL>
+</service>
+`, serviceType, i+1, i+1, controlPath(i), i)
+	}
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	fmt.Fprintf(w, `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+<specVersion><major>1</major><minor>%d</minor></specVersion>
+<device>
+<deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:%d</deviceType>
+<friendlyName>igdtest router</friendlyName>
+<manufacturer>igdtest</manufacturer>
+<modelName>igdtest</modelName>
+<modelNumber>%d</modelNumber>
+<UDN>%s</UDN>
+<deviceList>
+<device>
+<deviceType>urn:schemas-upnp-org:device:WANDevice:%d</deviceType>
+<friendlyName>WAN device</friendlyName>
+<UDN>%s-wan</UDN>
+<deviceList>
+<device>
+<deviceType>urn:schemas-upnp-org:device:WANConnectionDevice:%d</deviceType>
+<friendlyName>WAN connection device</friendlyName>
+<UDN>%s-wanconn</UDN>
+<serviceList>
+%s</serviceList>
+</device>
+</deviceList>
+</device>
+</deviceList>
+</device>
+</root>
+`, version-1, version, version, s.config.UDN, version, s.config.UDN, version, s.config.UDN, services.String())
+}
+
+// serveControl serves the SOAP actions of the service at the index given
+func (s *Server) serveControl(index int) http.HandlerFunc {
+	serviceType := s.config.ServiceTypes[index]
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		soapAction := strings.Trim(r.Header.Get("SOAPACTION"), `"`)
+		actionName := soapAction[strings.LastIndex(soapAction, "#")+1:]
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		request := soapRequest{}
+		if err := xml.Unmarshal(body, &request); err != nil {
+			writeFault(w, newError(ErrorInvalidArgs))
+			return
+		}
+		action := request.Body.Action.XMLName
+		if soapAction != serviceType+"#"+actionName || action.Space != serviceType || action.Local != actionName {
+			writeFault(w, newError(ErrorInvalidAction))
+			return
+		}
+		arguments := make(map[string]string)
+		for _, argument := range request.Body.Action.Arguments {
+			arguments[argument.XMLName.Local] = argument.Value
+		}
+		caller, _, _ := net.SplitHostPort(r.RemoteAddr)
+
+		if fault, injected := s.nextFault(actionName); injected {
+			time.Sleep(fault.Delay)
+			if fault.HTTPStatus != 0 {
+				w.WriteHeader(fault.HTTPStatus)
+				return
+			}
+			if fault.Code != 0 {
+				writeFault(w, newError(fault.Code))
+				return
+			}
+		}
+		results, err := s.perform(actionName, arguments, caller)
+		if err != nil {
+			writeFault(w, err)
+			return
+		}
+		writeResponse(w, serviceType, actionName, results)
+	}
+}
+
+// nextFault returns the fault injected for the next call of the action, and
+// records the call
+func (s *Server) nextFault(actionName string) (Fault, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.calls = append(s.calls, actionName)
+	faults := s.faults[actionName]
+	if len(faults) == 0 {
+		return Fault{}, false
+	}
+	s.faults[actionName] = faults[1:]
+	return faults[0], true
+}
+
+// perform runs the action on the state of the gateway
+func (s *Server) perform(actionName string, arguments map[string]string, caller string) ([]argument, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	now := time.Now()
+	s.expireMappings(now)
+	switch actionName {
+	case "GetExternalIPAddress":
+		return []argument{{"NewExternalIPAddress", s.externalIP}}, nil
+	case "GetStatusInfo":
+		lastConnectionError := "ERROR_NONE"
+		if s.status != StatusConnected {
+			lastConnectionError = "ERROR_NO_CARRIER"
+		}
+		return []argument{
+			{"NewConnectionStatus", s.status},
+			{"NewLastConnectionError", lastConnectionError},
+			{"NewUptime", strconv.Itoa(int(now.Sub(s.started) / time.Second))},
+		}, nil
+	case "AddPortMapping":
+		mapping, err := parseMapping(arguments)
+		if err != nil {
+			return nil, err
+		}
+		return nil, s.addMapping(mapping, caller, now)
+	case "DeletePortMapping":
+		remoteHost, externalPort, protocol, err := parseMappingKey(arguments)
+		if err != nil {
+			return nil, err
+		}
+		index := s.findMapping(remoteHost, externalPort, protocol)
+		if index < 0 {
+			return nil, newError(ErrorNoSuchEntryInArray)
+		}
+		if s.config.Quirks.RejectOtherHosts && s.mappings[index].InternalClient != caller {
+			return nil, newError(ErrorActionNotAuthorized)
+		}
+		s.mappings = append(s.mappings[:index], s.mappings[index+1:]...)
+		return nil, nil
+	case "GetSpecificPortMappingEntry":
+		remoteHost, externalPort, protocol, err := parseMappingKey(arguments)
+		if err != nil {
+			return nil, err
+		}
+		index := s.findMapping(remoteHost, externalPort, protocol)
+		if index < 0 {
+			return nil, newError(ErrorNoSuchEntryInArray)
+		}
+		return mappingArguments(s.mappings[index], now)[3:], nil
+	case "GetGenericPortMappingEntry":
+		index, err := strconv.ParseUint(arguments["NewPortMappingIndex"], 10, 16)
+		if err != nil {
+			return nil, newError(ErrorInvalidArgs)
+		}
+		if int(index) >= len(s.mappings) {
+			return nil, newError(ErrorSpecifiedArrayIndexInvalid)
+		}
+		return mappingArguments(s.mappings[index], now), nil
+	}
+	return nil, newError(ErrorInvalidAction)
+}
+
+// addMapping adds or replaces a port mapping, as allowed by the quirks
+func (s *Server) addMapping(mapping Mapping, caller string, now time.Time) error {
+	quirks := s.config.Quirks
+	if quirks.RejectOtherHosts && mapping.InternalClient != caller {
+		return newError(ErrorActionNotAuthorized)
+	}
+	if quirks.SamePortValuesOnly && mapping.ExternalPort != mapping.InternalPort {
+		return newError(ErrorSamePortValuesRequired)
+	}
+	if quirks.PermanentLeasesOnly && mapping.LeaseDuration != 0 {
+		return newError(ErrorOnlyPermanentLeasesSupported)
+	}
+	if index := s.findMapping(mapping.RemoteHost, mapping.ExternalPort, mapping.Protocol); index >= 0 {
+		if s.mappings[index].InternalClient != mapping.InternalClient {
+			return newError(ErrorConflictInMappingEntry)
+		}
+	}
+	if mapping.LeaseDuration > 0 {
+		mapping.expiry = now.Add(time.Duration(mapping.LeaseDuration) * time.Second)
+	}
+	s.setMapping(mapping)
+	return nil
+}
+
+// setMapping adds a port mapping, or replaces the one with the same remote
+// host, external port and protocol. The caller must hold the mutex.
+func (s *Server) setMapping(mapping Mapping) {
+	if index := s.findMapping(mapping.RemoteHost, mapping.ExternalPort, mapping.Protocol); index >= 0 {
+		s.mappings[index] = mapping
+		return
+	}
+	s.mappings = append(s.mappings, mapping)
+}
+
+// findMapping returns the index of the port mapping, or -1 if missing. The
+// caller must hold the mutex.
+func (s *Server) findMapping(remoteHost string, externalPort uint16, protocol string) int {
+	for i, mapping := range s.mappings {
+		if mapping.RemoteHost == remoteHost && mapping.ExternalPort == externalPort && mapping.Protocol == protocol {
+			return i
+		}
+	}
+	return -1
+}
+
+// expireMappings removes the port mappings with an expired lease. The caller
+// must hold the mutex.
+func (s *Server) expireMappings(now time.Time) {
+	mappings := s.mappings[:0]
+	for _, mapping := range s.mappings {
+		if mapping.expiry.IsZero() || now.Before(mapping.expiry) {
+			mappings = append(mappings, mapping)
+		}
+	}
+	s.mappings = mappings
+}
+
+func parseMappingKey(arguments map[string]string) (string, uint16, string, error) {
+	externalPort, err := strconv.ParseUint(arguments["NewExternalPort"], 10, 16)
+	if err != nil || externalPort == 0 {
+		return "", 0, "", newError(ErrorInvalidArgs)
+	}
+	protocol := arguments["NewProtocol"]
+	if protocol != "TCP" && protocol != "UDP" {
+		return "", 0, "", newError(ErrorInvalidArgs)
+	}
+	return arguments["NewRemoteHost"], uint16(externalPort), protocol, nil
+}
+
+func parseMapping(arguments map[string]string) (Mapping, error) {
+	remoteHost, externalPort, protocol, err := parseMappingKey(arguments)
+	if err != nil {
+		return Mapping{}, err
+	}
+	internalPort, err := strconv.ParseUint(arguments["NewInternalPort"], 10, 16)
+	if err != nil || internalPort == 0 {
+		return Mapping{}, newError(ErrorInvalidArgs)
+	}
+	if net.ParseIP(arguments["NewInternalClient"]) == nil {
+		return Mapping{}, newError(ErrorInvalidArgs)
+	}
+	enabled := arguments["NewEnabled"]
+	if enabled != "0" && enabled != "1" {
+		return Mapping{}, newError(ErrorInvalidArgs)
+	}
+	leaseDuration, err := strconv.ParseUint(arguments["NewLeaseDuration"], 10, 32)
+	if err != nil {
+		return Mapping{}, newError(ErrorInvalidArgs)
+	}
+	return Mapping{
+		RemoteHost:     remoteHost,
+		ExternalPort:   externalPort,
+		Protocol:       protocol,
+		InternalPort:   uint16(internalPort),
+		InternalClient: arguments["NewInternalClient"],
+		Enabled:        enabled == "1",
+		Description:    arguments["NewPortMappingDescription"],
+		LeaseDuration:  uint32(leaseDuration),
+	}, nil
+}
+
+// mappingArguments returns the output arguments of GetGenericPortMappingEntry
+// for the port mapping, with the remaining lease duration
+func mappingArguments(mapping Mapping, now time.Time) []argument {
+	leaseDuration := uint32(0)
+	if !mapping.expiry.IsZero() {
+		leaseDuration = uint32((mapping.expiry.Sub(now) + time.Second - 1) / time.Second)
+	}
+	enabled := "0"
+	if mapping.Enabled {
+		enabled = "1"
+	}
+	return []argument{
+		{"NewRemoteHost", mapping.RemoteHost},
+		{"NewExternalPort", strconv.Itoa(int(mapping.ExternalPort))},
+		{"NewProtocol", mapping.Protocol},
+		{"NewInternalPort", strconv.Itoa(int(mapping.InternalPort))},
+		{"NewInternalClient", mapping.InternalClient},
+		{"NewEnabled", enabled},
+		{"NewPortMappingDescription", mapping.Description},
+		{"NewLeaseDuration", strconv.FormatUint(uint64(leaseDuration), 10)},
+	}
+}
+
+func writeResponse(w http.ResponseWriter, serviceType, actionName string, results []argument) {
+	buffer := &bytes.Buffer{}
+	buffer.WriteString(xml.Header)
+	buffer.WriteString(`<s:Envelope xmlns:s="` + soapEnvelopeNamespace + `" s:encodingStyle="` + soapEncodingStyle + `"><s:Body>`)
+	buffer.WriteString(`<u:` + actionName + `Response xmlns:u="` + serviceType + `">`)
+	for _, result := range results {
+		buffer.WriteString(`<` + result.name + `>`)
+		xml.EscapeText(buffer, []byte(result.value))
+		buffer.WriteString(`</` + result.name + `>`)
+	}
+	buffer.WriteString(`</u:` + actionName + `Response>`)
+	buffer.WriteString(`</s:Body></s:Envelope>`)
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	w.Write(buffer.Bytes())
+}
+
+func writeFault(w http.ResponseWriter, err error) {
+	code := ErrorActionFailed
+	if upnpErr, ok := err.(*upnpError); ok {
+		code = upnpErr.code
+	}
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	w.WriteHeader(http.StatusInternalServerError)
+	fmt.Fprintf(w, `%s<s:Envelope xmlns:s="%s" s:encodingStyle="%s"><s:Body><s:Fault>`+
+		`<faultcode>s:Client</faultcode><faultstring>UPnPError</faultstring>`+
+		`<detail><UPnPError xmlns="urn:schemas-upnp-org:control-1-0">`+
+		`<errorCode>%d</errorCode><errorDescription>%s</errorDescription>`+
+		`</UPnPError></detail></s:Fault></s:Body></s:Envelope>`,
+		xml.Header, soapEnvelopeNamespace, soapEncodingStyle, code, errorDescriptions[code])
+}
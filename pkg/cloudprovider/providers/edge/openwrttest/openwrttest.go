@@ -0,0 +1,449 @@
+/*
+Copyright 2019 Midokura
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package openwrttest simulates the ubus JSON-RPC endpoint of rpcd on an
+// OpenWrt router, for the tests of the openwrt backend of the edge cloud
+// provider. The router keeps the redirect sections of the firewall config and
+// the route sections of the network config, staged per session until applied
+// like with rpcd, and the status of its WAN interface.
+package openwrttest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ubus statuses
+const (
+	statusOK               = 0
+	statusInvalidArgument  = 2
+	statusMethodNotFound   = 3
+	statusNotFound         = 4
+	statusNoData           = 5
+	statusPermissionDenied = 6
+)
+
+// nullSession is the session of the login calls
+const nullSession = "00000000000000000000000000000000"
+
+// sectionTypes are the types of the sections kept, by config
+var sectionTypes = map[string]string{"firewall": "redirect", "network": "route"}
+
+// Config is the configuration of a simulated router
+type Config struct {
+	// Username and Password are the credentials of the rpcd login, root and
+	// an empty password by default
+	Username string
+	Password string
+	// WANInterface is the logical network interface of the WAN, wan by
+	// default
+	WANInterface string
+	// ExternalIP is the address of the WAN interface, 198.51.100.1 by
+	// default
+	ExternalIP string
+}
+
+// Section is a redirect section of the firewall config, or a route section of
+// the network config
+type Section struct {
+	Name   string
+	Values map[string]string
+}
+
+// session is a login session, with the changes of the configs staged in it
+type session struct {
+	// staged are the sections with the changes, by config
+	staged map[string][]Section
+	// rollback are the sections of the configs before the changes applied
+	// with rollback, until confirmed
+	rollback map[string][]Section
+}
+
+// Server is a simulated router, running until closed
+type Server struct {
+	// URL is the URL of the ubus endpoint
+	URL string
+
+	config Config
+	server *httptest.Server
+
+	mutex    sync.Mutex
+	up       bool
+	configs  map[string][]Section
+	sessions map[string]*session
+	nextID   int
+	failures map[string]int
+	reloads  int
+	calls    []string
+}
+
+// NewServer starts a simulated router on the loopback interface
+func NewServer(config Config) *Server {
+	if config.Username == "" {
+		config.Username = "root"
+	}
+	if config.WANInterface == "" {
+		config.WANInterface = "wan"
+	}
+	if config.ExternalIP == "" {
+		config.ExternalIP = "198.51.100.1"
+	}
+	s := &Server{
+		config:   config,
+		up:       true,
+		configs:  make(map[string][]Section),
+		sessions: make(map[string]*session),
+		nextID:   1,
+		failures: make(map[string]int),
+	}
+	s.server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	s.URL = s.server.URL + "/ubus"
+	return s
+}
+
+// Close stops the router
+func (s *Server) Close() {
+	s.server.Close()
+}
+
+// Redirects returns the redirect sections of the committed firewall config,
+// sorted by name
+func (s *Server) Redirects() []Section {
+	return s.sections("firewall")
+}
+
+// AddRedirect adds a redirect section to the committed firewall config, like
+// configured by hand. An empty name adds an anonymous section.
+func (s *Server) AddRedirect(name string, values map[string]string) {
+	s.addSection("firewall", name, values)
+}
+
+// Routes returns the route sections of the committed network config, sorted
+// by name
+func (s *Server) Routes() []Section {
+	return s.sections("network")
+}
+
+// AddRoute adds a route section to the committed network config, like
+// configured by hand. An empty name adds an anonymous section.
+func (s *Server) AddRoute(name string, values map[string]string) {
+	s.addSection("network", name, values)
+}
+
+func (s *Server) sections(config string) []Section {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	sections := copySections(s.configs[config])
+	sort.Slice(sections, func(i, j int) bool { return sections[i].Name < sections[j].Name })
+	return sections
+}
+
+func (s *Server) addSection(config, name string, values map[string]string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if name == "" {
+		name = fmt.Sprintf("cfg%06x", s.nextID)
+		s.nextID++
+	}
+	s.configs[config] = append(s.configs[config], Section{Name: name, Values: values})
+}
+
+// SetUp sets whether the WAN interface is up
+func (s *Server) SetUp(up bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.up = up
+}
+
+// ExpireSessions expires the login sessions, dropping their staged changes
+func (s *Server) ExpireSessions() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.sessions = make(map[string]*session)
+}
+
+// FailCall fails the next call of the method of the object with the ubus
+// status
+func (s *Server) FailCall(object, method string, status int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.failures[object+"."+method] = status
+}
+
+// Reloads returns the number of reloads of the firewall
+func (s *Server) Reloads() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.reloads
+}
+
+// Pending returns the number of sessions with staged changes, or changes
+// applied but not confirmed
+func (s *Server) Pending() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	pending := 0
+	for _, session := range s.sessions {
+		if len(session.staged) > 0 || session.rollback != nil {
+			pending++
+		}
+	}
+	return pending
+}
+
+// Calls returns the calls received, object.method
+func (s *Server) Calls() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]string(nil), s.calls...)
+}
+
+type request struct {
+	ID     interface{}       `json:"id"`
+	Method string            `json:"method"`
+	Params []json.RawMessage `json:"params"`
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.URL.Path != "/ubus" {
+		http.NotFound(w, r)
+		return
+	}
+	var req request
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeResponse(w, nil, nil, &rpcError{Code: -32700, Message: "Parse error"})
+		return
+	}
+	var sid, object, method string
+	args := make(map[string]interface{})
+	if req.Method != "call" || len(req.Params) != 4 ||
+		json.Unmarshal(req.Params[0], &sid) != nil ||
+		json.Unmarshal(req.Params[1], &object) != nil ||
+		json.Unmarshal(req.Params[2], &method) != nil ||
+		json.Unmarshal(req.Params[3], &args) != nil {
+		writeResponse(w, req.ID, nil, &rpcError{Code: -32602, Message: "Invalid parameters"})
+		return
+	}
+	result, rpcErr := s.call(sid, object, method, args)
+	writeResponse(w, req.ID, result, rpcErr)
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func writeResponse(w http.ResponseWriter, id interface{}, result []interface{}, rpcErr *rpcError) {
+	response := map[string]interface{}{"jsonrpc": "2.0", "id": id}
+	if rpcErr != nil {
+		response["error"] = rpcErr
+	} else {
+		response["result"] = result
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func (s *Server) call(sid, object, method string, args map[string]interface{}) ([]interface{}, *rpcError) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.calls = append(s.calls, object+"."+method)
+	if sid == nullSession && object == "session" && method == "login" {
+		if args["username"] != s.config.Username || args["password"] != s.config.Password {
+			return []interface{}{statusPermissionDenied}, nil
+		}
+		sid = fmt.Sprintf("%032x", s.nextID)
+		s.nextID++
+		s.sessions[sid] = &session{}
+		return []interface{}{statusOK, map[string]interface{}{"ubus_rpc_session": sid, "timeout": 300}}, nil
+	}
+	session, ok := s.sessions[sid]
+	if !ok {
+		return nil, &rpcError{Code: -32002, Message: "Access denied"}
+	}
+	if status, ok := s.failures[object+"."+method]; ok {
+		delete(s.failures, object+"."+method)
+		return []interface{}{status}, nil
+	}
+	switch object {
+	case "network.interface":
+		if method != "status" {
+			return []interface{}{statusMethodNotFound}, nil
+		}
+		if args["interface"] != s.config.WANInterface {
+			return []interface{}{statusNotFound}, nil
+		}
+		status := map[string]interface{}{"up": s.up, "ipv4-address": []interface{}{}}
+		if s.up {
+			status["ipv4-address"] = []interface{}{map[string]interface{}{"address": s.config.ExternalIP, "mask": 24}}
+		}
+		return []interface{}{statusOK, status}, nil
+	case "uci":
+		return s.callUCI(session, method, args), nil
+	}
+	return nil, &rpcError{Code: -32000, Message: "Object not found"}
+}
+
+// callUCI runs the method of the uci object, on the sections of the firewall
+// and network configs only
+func (s *Server) callUCI(session *session, method string, args map[string]interface{}) []interface{} {
+	switch method {
+	case "apply":
+		if session.rollback != nil {
+			return []interface{}{statusPermissionDenied}
+		}
+		if len(session.staged) > 0 {
+			if rollback, _ := args["rollback"].(bool); rollback {
+				session.rollback = make(map[string][]Section)
+				for config := range session.staged {
+					session.rollback[config] = copySections(s.configs[config])
+				}
+			}
+			for config, sections := range session.staged {
+				s.configs[config] = sections
+				if config == "firewall" {
+					s.reloads++
+				}
+			}
+			session.staged = nil
+		}
+		return []interface{}{statusOK}
+	case "confirm":
+		if session.rollback == nil {
+			return []interface{}{statusNoData}
+		}
+		session.rollback = nil
+		return []interface{}{statusOK}
+	}
+	config, _ := args["config"].(string)
+	sectionType, ok := sectionTypes[config]
+	if !ok {
+		return []interface{}{statusNotFound}
+	}
+	sections := s.configs[config]
+	if staged, ok := session.staged[config]; ok {
+		sections = staged
+	}
+	stage := func(sections []Section) {
+		if session.staged == nil {
+			session.staged = make(map[string][]Section)
+		}
+		session.staged[config] = sections
+	}
+	name, _ := args["section"].(string)
+	index := -1
+	for i, section := range sections {
+		if section.Name == name {
+			index = i
+		}
+	}
+	switch method {
+	case "get":
+		if name != "" || args["type"] != sectionType {
+			return []interface{}{statusInvalidArgument}
+		}
+		values := make(map[string]interface{})
+		for i, section := range sections {
+			options := map[string]interface{}{".name": section.Name, ".type": sectionType, ".anonymous": strings.HasPrefix(section.Name, "cfg"), ".index": i}
+			for option, value := range section.Values {
+				options[option] = value
+			}
+			values[section.Name] = options
+		}
+		return []interface{}{statusOK, map[string]interface{}{"values": values}}
+	case "add":
+		name, _ = args["name"].(string)
+		if args["type"] != sectionType || !validName(name) {
+			return []interface{}{statusInvalidArgument}
+		}
+		for _, section := range sections {
+			if section.Name == name {
+				return []interface{}{statusInvalidArgument}
+			}
+		}
+		stage(append(copySections(sections), Section{Name: name, Values: stringValues(args["values"])}))
+		return []interface{}{statusOK, map[string]interface{}{"section": name}}
+	case "set":
+		if index < 0 {
+			return []interface{}{statusNotFound}
+		}
+		staged := copySections(sections)
+		for option, value := range stringValues(args["values"]) {
+			if value == "" {
+				delete(staged[index].Values, option)
+			} else {
+				staged[index].Values[option] = value
+			}
+		}
+		stage(staged)
+		return []interface{}{statusOK}
+	case "delete":
+		if index < 0 {
+			return []interface{}{statusNotFound}
+		}
+		staged := copySections(sections)
+		stage(append(staged[:index], staged[index+1:]...))
+		return []interface{}{statusOK}
+	case "revert":
+		delete(session.staged, config)
+		return []interface{}{statusOK}
+	}
+	return []interface{}{statusMethodNotFound}
+}
+
+// validName returns whether the name is a valid name of a UCI section
+func validName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+func stringValues(values interface{}) map[string]string {
+	converted := make(map[string]string)
+	options, _ := values.(map[string]interface{})
+	for option, value := range options {
+		switch value := value.(type) {
+		case string:
+			converted[option] = value
+		case float64:
+			converted[option] = fmt.Sprint(value)
+		}
+	}
+	return converted
+}
+
+func copySections(sections []Section) []Section {
+	copies := make([]Section, 0, len(sections))
+	for _, section := range sections {
+		values := make(map[string]string, len(section.Values))
+		for option, value := range section.Values {
+			values[option] = value
+		}
+		copies = append(copies, Section{Name: section.Name, Values: values})
+	}
+	return copies
+}
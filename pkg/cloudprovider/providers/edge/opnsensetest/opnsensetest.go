@@ -0,0 +1,413 @@
+/*
+Copyright 2019 Midokura
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package opnsensetest simulates the REST API of an OPNsense firewall, for
+// the tests of the opnsense backend of the edge cloud provider. The firewall
+// keeps the port forward rules of its destination NAT, changed in its
+// configuration until applied, with the savepoints to revert to, the host
+// aliases, changed in its configuration until reconfigured, and the status of
+// its WAN interface.
+package opnsensetest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Config is the configuration of a simulated firewall
+type Config struct {
+	// Key and Secret are the credentials of the API, key and secret by
+	// default
+	Key    string
+	Secret string
+	// WANInterface is the identifier of the WAN interface, wan by default
+	WANInterface string
+	// ExternalIP is the address of the WAN interface, 198.51.100.1 by
+	// default
+	ExternalIP string
+}
+
+// Destination is the destination of a port forward rule
+type Destination struct {
+	Network string `json:"network"`
+	Port    string `json:"port"`
+}
+
+// Rule is a port forward rule of the destination NAT
+type Rule struct {
+	UUID        string      `json:"uuid,omitempty"`
+	Disabled    string      `json:"disabled"`
+	Interface   string      `json:"interface"`
+	IPProtocol  string      `json:"ipprotocol"`
+	Protocol    string      `json:"protocol"`
+	Destination Destination `json:"destination"`
+	Target      string      `json:"target"`
+	LocalPort   string      `json:"local-port"`
+	Descr       string      `json:"descr"`
+}
+
+// Alias is a firewall alias
+type Alias struct {
+	UUID        string `json:"uuid,omitempty"`
+	Enabled     string `json:"enabled"`
+	Name        string `json:"name"`
+	Type        string `json:"type"`
+	Content     string `json:"content"`
+	Description string `json:"description"`
+}
+
+// Server is a simulated firewall, running until closed
+type Server struct {
+	// URL is the URL of the API
+	URL string
+
+	config Config
+	server *httptest.Server
+
+	mutex      sync.Mutex
+	up         bool
+	rules      []Rule
+	applied    []Rule
+	savepoints map[string][]Rule
+	rollback   string
+	aliases    []Alias
+	loaded     map[string]string
+	nextID     int
+	failures   map[string]int
+	applies    int
+	calls      []string
+}
+
+// NewServer starts a simulated firewall on the loopback interface
+func NewServer(config Config) *Server {
+	if config.Key == "" {
+		config.Key = "key"
+	}
+	if config.Secret == "" {
+		config.Secret = "secret"
+	}
+	if config.WANInterface == "" {
+		config.WANInterface = "wan"
+	}
+	if config.ExternalIP == "" {
+		config.ExternalIP = "198.51.100.1"
+	}
+	s := &Server{
+		config:     config,
+		up:         true,
+		savepoints: make(map[string][]Rule),
+		loaded:     make(map[string]string),
+		nextID:     1,
+		failures:   make(map[string]int),
+	}
+	s.server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	s.URL = s.server.URL + "/api"
+	return s
+}
+
+// Close stops the firewall
+func (s *Server) Close() {
+	s.server.Close()
+}
+
+// Rules returns the port forward rules of the configuration, sorted by
+// external port
+func (s *Server) Rules() []Rule {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return sortedRules(s.rules)
+}
+
+// Applied returns the port forward rules applied to the firewall, sorted by
+// external port
+func (s *Server) Applied() []Rule {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return sortedRules(s.applied)
+}
+
+// AddRule adds a port forward rule, applied, like configured by hand
+func (s *Server) AddRule(rule Rule) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	rule.UUID = s.newUUID()
+	s.rules = append(s.rules, rule)
+	s.applied = append(s.applied, rule)
+}
+
+// Aliases returns the contents of the aliases, by name
+func (s *Server) Aliases() map[string]string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	contents := make(map[string]string)
+	for _, alias := range s.aliases {
+		contents[alias.Name] = alias.Content
+	}
+	return contents
+}
+
+// LoadedAliases returns the contents of the aliases loaded in the firewall by
+// the last reconfigure, by name
+func (s *Server) LoadedAliases() map[string]string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	contents := make(map[string]string)
+	for name, content := range s.loaded {
+		contents[name] = content
+	}
+	return contents
+}
+
+// SetUp sets whether the WAN interface is up
+func (s *Server) SetUp(up bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.up = up
+}
+
+// SetSecret changes the secret of the API key, like rotated
+func (s *Server) SetSecret(secret string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.config.Secret = secret
+}
+
+// FailCall fails a call of the endpoint, e.g. firewall/d_nat/add_rule, after
+// the given number of successful ones: the rules are rejected by validation,
+// the other calls fail
+func (s *Server) FailCall(endpoint string, after int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.failures[endpoint] = after
+}
+
+// Applies returns the number of changes applied to the firewall
+func (s *Server) Applies() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.applies
+}
+
+// PendingRollback returns the savepoint the firewall rolls back to, unless
+// cancelled, or an empty string
+func (s *Server) PendingRollback() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.rollback
+}
+
+// Calls returns the endpoints called
+func (s *Server) Calls() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]string(nil), s.calls...)
+}
+
+func (s *Server) newUUID() string {
+	uuid := fmt.Sprintf("00000000-0000-0000-0000-%012x", s.nextID)
+	s.nextID++
+	return uuid
+}
+
+func sortedRules(rules []Rule) []Rule {
+	sorted := append([]Rule{}, rules...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Destination.Port < sorted[j].Destination.Port })
+	return sorted
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	key, secret, ok := r.BasicAuth()
+	if !ok || key != s.config.Key || secret != s.config.Secret {
+		w.WriteHeader(http.StatusUnauthorized)
+		writeJSON(w, map[string]string{"status": "401", "message": "Authentication Failed"})
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/api/")
+	parts := strings.Split(path, "/")
+	if len(parts) < 3 {
+		http.NotFound(w, r)
+		return
+	}
+	endpoint, argument := strings.Join(parts[:3], "/"), strings.Join(parts[3:], "/")
+	s.calls = append(s.calls, endpoint)
+	if after, ok := s.failures[endpoint]; ok {
+		if after == 0 {
+			delete(s.failures, endpoint)
+			if strings.HasSuffix(endpoint, "/add_rule") || strings.HasSuffix(endpoint, "/set_rule") {
+				writeJSON(w, map[string]interface{}{"result": "failed", "validations": map[string]string{"rule.target": "simulated failure"}})
+			} else {
+				writeJSON(w, map[string]string{"status": "failed", "message": "simulated failure"})
+			}
+			return
+		}
+		s.failures[endpoint] = after - 1
+	}
+	if endpoint == "interfaces/overview/get_interface" {
+		if r.Method != http.MethodGet || argument != s.config.WANInterface {
+			http.NotFound(w, r)
+			return
+		}
+		status := "down"
+		ipv4 := []interface{}{}
+		if s.up {
+			status = "up"
+			ipv4 = append(ipv4, map[string]interface{}{"ipaddr": s.config.ExternalIP, "subnetbits": 24})
+		}
+		writeJSON(w, map[string]interface{}{"message": "Found interface", "details": map[string]interface{}{"status": status, "ipv4": ipv4}})
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var body struct {
+		Rule  *Rule  `json:"rule"`
+		Alias *Alias `json:"alias"`
+	}
+	json.NewDecoder(r.Body).Decode(&body)
+	response := s.handle(endpoint, argument, body.Rule, body.Alias)
+	if response == nil {
+		http.NotFound(w, r)
+		return
+	}
+	writeJSON(w, response)
+}
+
+// handle returns the response of the endpoint, or nil if not found
+func (s *Server) handle(endpoint, argument string, rule *Rule, alias *Alias) interface{} {
+	switch endpoint {
+	case "firewall/d_nat/search_rule":
+		return map[string]interface{}{"rows": s.rules, "total": len(s.rules)}
+	case "firewall/d_nat/add_rule":
+		if failed := validateRule(rule); failed != nil {
+			return failed
+		}
+		rule.UUID = s.newUUID()
+		s.rules = append(s.rules, *rule)
+		return map[string]string{"result": "saved", "uuid": rule.UUID}
+	case "firewall/d_nat/set_rule":
+		if failed := validateRule(rule); failed != nil {
+			return failed
+		}
+		for i := range s.rules {
+			if s.rules[i].UUID == argument {
+				rule.UUID = argument
+				s.rules[i] = *rule
+				return map[string]string{"result": "saved"}
+			}
+		}
+		return map[string]string{"result": "failed"}
+	case "firewall/d_nat/del_rule":
+		for i := range s.rules {
+			if s.rules[i].UUID == argument {
+				s.rules = append(s.rules[:i], s.rules[i+1:]...)
+				return map[string]string{"result": "deleted"}
+			}
+		}
+		return map[string]string{"result": "not found"}
+	case "firewall/d_nat/savepoint":
+		revision := fmt.Sprintf("1700000000.%04d", s.nextID)
+		s.nextID++
+		s.savepoints[revision] = append([]Rule{}, s.rules...)
+		return map[string]string{"revision": revision}
+	case "firewall/d_nat/apply":
+		if _, ok := s.savepoints[argument]; !ok && argument != "" {
+			return map[string]string{"status": "failed"}
+		}
+		s.applied = append([]Rule{}, s.rules...)
+		s.rollback = argument
+		s.applies++
+		return map[string]string{"status": "OK"}
+	case "firewall/d_nat/cancel_rollback":
+		if s.rollback != argument {
+			return map[string]string{"status": "failed"}
+		}
+		s.rollback = ""
+		return map[string]string{"status": "OK"}
+	case "firewall/d_nat/revert":
+		rules, ok := s.savepoints[argument]
+		if !ok {
+			return map[string]string{"status": "failed"}
+		}
+		s.rules = append([]Rule{}, rules...)
+		s.applied = append([]Rule{}, rules...)
+		s.rollback = ""
+		return map[string]string{"status": "OK"}
+	case "firewall/alias/search_item":
+		return map[string]interface{}{"rows": s.aliases, "total": len(s.aliases)}
+	case "firewall/alias/add_item":
+		if alias == nil || alias.Name == "" {
+			return map[string]interface{}{"result": "failed", "validations": map[string]string{"alias.name": "A name is required."}}
+		}
+		for _, existing := range s.aliases {
+			if existing.Name == alias.Name {
+				return map[string]interface{}{"result": "failed", "validations": map[string]string{"alias.name": "An alias with this name already exists."}}
+			}
+		}
+		alias.UUID = s.newUUID()
+		s.aliases = append(s.aliases, *alias)
+		return map[string]string{"result": "saved", "uuid": alias.UUID}
+	case "firewall/alias/set_item":
+		for i := range s.aliases {
+			if s.aliases[i].UUID == argument && alias != nil {
+				alias.UUID = argument
+				s.aliases[i] = *alias
+				return map[string]string{"result": "saved"}
+			}
+		}
+		return map[string]string{"result": "failed"}
+	case "firewall/alias/del_item":
+		for i := range s.aliases {
+			if s.aliases[i].UUID != argument {
+				continue
+			}
+			for _, rule := range s.rules {
+				if rule.Target == s.aliases[i].Name {
+					return map[string]string{"status": "failed", "message": "Alias in use"}
+				}
+			}
+			s.aliases = append(s.aliases[:i], s.aliases[i+1:]...)
+			return map[string]string{"result": "deleted"}
+		}
+		return map[string]string{"result": "not found"}
+	case "firewall/alias/reconfigure":
+		s.loaded = make(map[string]string)
+		for _, alias := range s.aliases {
+			s.loaded[alias.Name] = alias.Content
+		}
+		return map[string]string{"status": "ok"}
+	}
+	return nil
+}
+
+func validateRule(rule *Rule) interface{} {
+	if rule == nil || rule.Target == "" {
+		return map[string]interface{}{"result": "failed", "validations": map[string]string{"rule.target": "A target is required."}}
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
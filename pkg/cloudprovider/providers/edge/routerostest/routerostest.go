@@ -0,0 +1,532 @@
+/*
+Copyright 2019 Midokura
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package routerostest simulates the API of a MikroTik RouterOS router on the
+// loopback interface, for the tests of the routeros backend of the edge cloud
+// provider. The router serves the API protocol over TCP, and keeps the
+// dstnat entries of /ip firewall nat, the static routes of /ip route, the
+// address of its WAN interface and whether it is running.
+package routerostest
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Config is the configuration of a simulated router
+type Config struct {
+	// Username and Password are the credentials of the API, admin and an
+	// empty password by default
+	Username string
+	Password string
+	// WANInterface is the name of the WAN interface, ether1 by default
+	WANInterface string
+	// ExternalIP is the address of the WAN interface, 198.51.100.1/24 by
+	// default
+	ExternalIP string
+}
+
+// NATRule is an entry of /ip firewall nat
+type NATRule struct {
+	ID          string
+	Chain       string
+	Action      string
+	Protocol    string
+	DstPort     string
+	InInterface string
+	ToAddresses string
+	ToPorts     string
+	Comment     string
+	Disabled    bool
+}
+
+// Route is a static route of /ip route
+type Route struct {
+	ID         string
+	DstAddress string
+	Gateway    string
+	Comment    string
+}
+
+// Server is a simulated router, running until closed
+type Server struct {
+	// Address is the TCP address of the API
+	Address string
+
+	config   Config
+	listener net.Listener
+	wg       sync.WaitGroup
+
+	mutex   sync.Mutex
+	running bool
+	rules   []NATRule
+	routes  []Route
+	nextID  int
+	traps   map[string][]string
+	calls   []string
+	conns   map[net.Conn]bool
+}
+
+// NewServer starts a simulated router on the loopback interface
+func NewServer(config Config) (*Server, error) {
+	if config.Username == "" {
+		config.Username = "admin"
+	}
+	if config.WANInterface == "" {
+		config.WANInterface = "ether1"
+	}
+	if config.ExternalIP == "" {
+		config.ExternalIP = "198.51.100.1/24"
+	}
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		Address:  listener.Addr().String(),
+		config:   config,
+		listener: listener,
+		running:  true,
+		nextID:   1,
+		traps:    make(map[string][]string),
+		conns:    make(map[net.Conn]bool),
+	}
+	s.wg.Add(1)
+	go s.accept()
+	return s, nil
+}
+
+// Close stops the router
+func (s *Server) Close() {
+	s.listener.Close()
+	s.DropConnections()
+	s.wg.Wait()
+}
+
+// DropConnections closes the API connections, like a router rebooting
+func (s *Server) DropConnections() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+}
+
+// Rules returns the entries of /ip firewall nat, sorted by ID
+func (s *Server) Rules() []NATRule {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	rules := append([]NATRule(nil), s.rules...)
+	sort.Slice(rules, func(i, j int) bool {
+		return rules[i].ID < rules[j].ID
+	})
+	return rules
+}
+
+// AddRule adds an entry to /ip firewall nat, as by another tool
+func (s *Server) AddRule(rule NATRule) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	rule.ID = s.newID()
+	s.rules = append(s.rules, rule)
+}
+
+// Routes returns the static routes of /ip route, sorted by ID
+func (s *Server) Routes() []Route {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	routes := append([]Route(nil), s.routes...)
+	sort.Slice(routes, func(i, j int) bool {
+		return routes[i].ID < routes[j].ID
+	})
+	return routes
+}
+
+// AddRoute adds a static route to /ip route, as by another tool
+func (s *Server) AddRoute(route Route) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	route.ID = s.newID()
+	s.routes = append(s.routes, route)
+}
+
+// SetRunning sets whether the WAN interface is running
+func (s *Server) SetRunning(running bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.running = running
+}
+
+// InjectTraps makes the next calls of the command fail with the messages
+func (s *Server) InjectTraps(command string, messages ...string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.traps[command] = append(s.traps[command], messages...)
+}
+
+// Calls returns the commands called, in order
+func (s *Server) Calls() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]string(nil), s.calls...)
+}
+
+func (s *Server) newID() string {
+	id := fmt.Sprintf("*%X", s.nextID)
+	s.nextID++
+	return id
+}
+
+func (s *Server) accept() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mutex.Lock()
+		s.conns[conn] = true
+		s.mutex.Unlock()
+		s.wg.Add(1)
+		go s.serve(conn)
+	}
+}
+
+// serve answers the sentences of the connection until it is closed
+func (s *Server) serve(conn net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.mutex.Lock()
+		delete(s.conns, conn)
+		s.mutex.Unlock()
+		conn.Close()
+	}()
+	reader := bufio.NewReader(conn)
+	loggedIn := false
+	for {
+		words, err := readSentence(reader)
+		if err != nil {
+			return
+		}
+		if len(words) == 0 {
+			continue
+		}
+		command, attributes, queries := parseSentence(words)
+		var replies [][]string
+		if command == "/login" {
+			loggedIn = attributes["name"] == s.config.Username && attributes["password"] == s.config.Password
+			if loggedIn {
+				replies = [][]string{{"!done"}}
+			} else {
+				replies = [][]string{{"!trap", "=message=invalid user name or password (6)"}, {"!done"}}
+			}
+		} else if !loggedIn {
+			replies = [][]string{{"!fatal", "not logged in"}}
+		} else {
+			replies = s.perform(command, attributes, queries)
+		}
+		for _, reply := range replies {
+			if err := writeSentence(conn, reply); err != nil {
+				return
+			}
+		}
+		if replies[0][0] == "!fatal" {
+			return
+		}
+	}
+}
+
+// perform runs the command, returning the reply sentences
+func (s *Server) perform(command string, attributes, queries map[string]string) [][]string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.calls = append(s.calls, command)
+	trap := func(message string) [][]string {
+		return [][]string{{"!trap", "=message=" + message}, {"!done"}}
+	}
+	if messages := s.traps[command]; len(messages) > 0 {
+		s.traps[command] = messages[1:]
+		return trap(messages[0])
+	}
+	switch command {
+	case "/ip/firewall/nat/print":
+		replies := make([][]string, 0, len(s.rules)+1)
+		for _, rule := range s.rules {
+			attributes := ruleAttributes(rule)
+			if matches(attributes, queries) {
+				replies = append(replies, reply(attributes))
+			}
+		}
+		return append(replies, []string{"!done"})
+	case "/ip/firewall/nat/add":
+		rule := NATRule{
+			ID:          s.newID(),
+			Chain:       attributes["chain"],
+			Action:      attributes["action"],
+			Protocol:    attributes["protocol"],
+			DstPort:     attributes["dst-port"],
+			InInterface: attributes["in-interface"],
+			ToAddresses: attributes["to-addresses"],
+			ToPorts:     attributes["to-ports"],
+			Comment:     attributes["comment"],
+			Disabled:    attributes["disabled"] == "true",
+		}
+		if rule.Chain == "" {
+			return trap("failure: chain not specified")
+		}
+		if rule.Action == "dst-nat" && net.ParseIP(rule.ToAddresses) == nil {
+			return trap("invalid value for argument to-addresses")
+		}
+		s.rules = append(s.rules, rule)
+		return [][]string{{"!done", "=ret=" + rule.ID}}
+	case "/ip/firewall/nat/remove":
+		for i, rule := range s.rules {
+			if rule.ID == attributes[".id"] {
+				s.rules = append(s.rules[:i:i], s.rules[i+1:]...)
+				return [][]string{{"!done"}}
+			}
+		}
+		return trap("no such item")
+	case "/ip/route/print":
+		replies := make([][]string, 0, len(s.routes)+1)
+		for _, route := range s.routes {
+			attributes := routeAttributes(route)
+			if matches(attributes, queries) {
+				replies = append(replies, reply(attributes))
+			}
+		}
+		return append(replies, []string{"!done"})
+	case "/ip/route/add":
+		route := Route{ID: s.newID(), DstAddress: attributes["dst-address"], Gateway: attributes["gateway"], Comment: attributes["comment"]}
+		if _, _, err := net.ParseCIDR(route.DstAddress); err != nil {
+			return trap("invalid value for argument dst-address")
+		}
+		if net.ParseIP(route.Gateway) == nil {
+			return trap("invalid value for argument gateway")
+		}
+		s.routes = append(s.routes, route)
+		return [][]string{{"!done", "=ret=" + route.ID}}
+	case "/ip/route/set":
+		for i, route := range s.routes {
+			if route.ID != attributes[".id"] {
+				continue
+			}
+			if gateway, ok := attributes["gateway"]; ok {
+				if net.ParseIP(gateway) == nil {
+					return trap("invalid value for argument gateway")
+				}
+				s.routes[i].Gateway = gateway
+			}
+			if comment, ok := attributes["comment"]; ok {
+				s.routes[i].Comment = comment
+			}
+			return [][]string{{"!done"}}
+		}
+		return trap("no such item")
+	case "/ip/route/remove":
+		for i, route := range s.routes {
+			if route.ID == attributes[".id"] {
+				s.routes = append(s.routes[:i:i], s.routes[i+1:]...)
+				return [][]string{{"!done"}}
+			}
+		}
+		return trap("no such item")
+	case "/ip/address/print":
+		attributes := map[string]string{".id": "*1", "address": s.config.ExternalIP, "interface": s.config.WANInterface}
+		if !matches(attributes, queries) {
+			return [][]string{{"!done"}}
+		}
+		return [][]string{reply(attributes), {"!done"}}
+	case "/interface/print":
+		attributes := map[string]string{".id": "*1", "name": s.config.WANInterface, "running": strconv.FormatBool(s.running), "disabled": "false"}
+		if !matches(attributes, queries) {
+			return [][]string{{"!done"}}
+		}
+		return [][]string{reply(attributes), {"!done"}}
+	case "/system/identity/print":
+		return [][]string{{"!re", "=name=routerostest"}, {"!done"}}
+	}
+	return trap("no such command prefix")
+}
+
+func ruleAttributes(rule NATRule) map[string]string {
+	attributes := map[string]string{
+		".id":          rule.ID,
+		"chain":        rule.Chain,
+		"action":       rule.Action,
+		"protocol":     rule.Protocol,
+		"dst-port":     rule.DstPort,
+		"in-interface": rule.InInterface,
+		"to-addresses": rule.ToAddresses,
+		"to-ports":     rule.ToPorts,
+		"comment":      rule.Comment,
+		"disabled":     strconv.FormatBool(rule.Disabled),
+	}
+	for name, value := range attributes {
+		// like RouterOS, the unset properties are not returned
+		if value == "" {
+			delete(attributes, name)
+		}
+	}
+	return attributes
+}
+
+func routeAttributes(route Route) map[string]string {
+	attributes := map[string]string{
+		".id":         route.ID,
+		"dst-address": route.DstAddress,
+		"gateway":     route.Gateway,
+		"comment":     route.Comment,
+		"static":      "true",
+		"disabled":    "false",
+	}
+	if route.Comment == "" {
+		delete(attributes, "comment")
+	}
+	return attributes
+}
+
+// matches returns whether the attributes match the ?name=value queries
+func matches(attributes, queries map[string]string) bool {
+	for name, value := range queries {
+		if attributes[name] != value {
+			return false
+		}
+	}
+	return true
+}
+
+func reply(attributes map[string]string) []string {
+	names := make([]string, 0, len(attributes))
+	for name := range attributes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	words := []string{"!re"}
+	for _, name := range names {
+		words = append(words, "="+name+"="+attributes[name])
+	}
+	return words
+}
+
+// parseSentence returns the command, the =name=value attributes and the
+// ?name=value queries of a sentence
+func parseSentence(words []string) (string, map[string]string, map[string]string) {
+	attributes := make(map[string]string)
+	queries := make(map[string]string)
+	for _, word := range words[1:] {
+		var target map[string]string
+		switch {
+		case strings.HasPrefix(word, "="):
+			target, word = attributes, word[1:]
+		case strings.HasPrefix(word, "?"):
+			target, word = queries, word[1:]
+		default:
+			continue
+		}
+		parts := strings.SplitN(word, "=", 2)
+		if len(parts) == 2 {
+			target[parts[0]] = parts[1]
+		}
+	}
+	return words[0], attributes, queries
+}
+
+// readSentence reads the words of a sentence, up to the empty word
+func readSentence(reader *bufio.Reader) ([]string, error) {
+	words := make([]string, 0)
+	for {
+		length, err := readLength(reader)
+		if err != nil {
+			return nil, err
+		}
+		if length == 0 {
+			return words, nil
+		}
+		word := make([]byte, length)
+		if _, err := io.ReadFull(reader, word); err != nil {
+			return nil, err
+		}
+		words = append(words, string(word))
+	}
+}
+
+func readLength(reader *bufio.Reader) (int, error) {
+	first, err := reader.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	var extra int
+	var length uint32
+	switch {
+	case first&0x80 == 0:
+		return int(first), nil
+	case first&0xC0 == 0x80:
+		extra, length = 1, uint32(first&0x3F)
+	case first&0xE0 == 0xC0:
+		extra, length = 2, uint32(first&0x1F)
+	case first&0xF0 == 0xE0:
+		extra, length = 3, uint32(first&0x0F)
+	default:
+		extra, length = 4, 0
+	}
+	for i := 0; i < extra; i++ {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		length = length<<8 | uint32(b)
+	}
+	return int(length), nil
+}
+
+// writeSentence writes the words of a sentence, and the empty word
+func writeSentence(w io.Writer, words []string) error {
+	var buffer []byte
+	for _, word := range words {
+		buffer = append(buffer, encodeLength(len(word))...)
+		buffer = append(buffer, word...)
+	}
+	buffer = append(buffer, 0)
+	_, err := w.Write(buffer)
+	return err
+}
+
+func encodeLength(length int) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, uint32(length))
+	switch {
+	case length < 0x80:
+		return b[3:]
+	case length < 0x4000:
+		binary.BigEndian.PutUint32(b, uint32(length)|0x8000)
+		return b[2:]
+	case length < 0x200000:
+		binary.BigEndian.PutUint32(b, uint32(length)|0xC00000)
+		return b[1:]
+	case length < 0x10000000:
+		binary.BigEndian.PutUint32(b, uint32(length)|0xE0000000)
+		return b
+	}
+	return append([]byte{0xF0}, b...)
+}